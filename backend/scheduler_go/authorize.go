@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"shared/topics"
+)
+
+// A command is checked against its owner when it is scheduled, the way the
+// publish Lambda checks a direct publish by the same user: its topics are
+// placed in the owner's USER_NAMESPACE, TOPIC_PREFIX is applied, and with
+// DEVICE_REGISTRY_TABLE set each must belong to a registered device the owner
+// owns. Set these as on the publish Lambda. The publish Lambda checks the
+// command again when it runs, as registrations change meanwhile; topics of a
+// 'group' are only known then.
+
+// commandError is a command its owner may not schedule.
+type commandError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *commandError) Error() string { return e.msg }
+
+// authorizeCommand checks every topic the command in fields publishes to
+// against owner.
+func authorizeCommand(owner string, fields map[string]json.RawMessage) *commandError {
+	targets, err := commandTopics(fields)
+	if err != nil {
+		return &commandError{400, "INVALID_COMMAND", err.Error()}
+	}
+	for i, topic := range targets {
+		placed, cerr := ownerTopic(owner, topic)
+		if cerr != nil {
+			return cerr
+		}
+		targets[i] = placed
+	}
+
+	registry := openDeviceRegistry()
+	if registry == nil || len(targets) == 0 {
+		return nil
+	}
+	devices, err := registry.listDevices()
+	if err != nil {
+		logger.Error("device registry lookup failed", "error", err.Error())
+		return &commandError{502, "REGISTRY_UNAVAILABLE", "Device registry lookup failed"}
+	}
+	for _, topic := range targets {
+		var registered, owned *deviceRecord
+		for i := range devices {
+			d := &devices[i]
+			if !d.hasTopic(topic) {
+				continue
+			}
+			registered = d
+			if d.ownedBy(owner) {
+				owned = d
+				break
+			}
+		}
+		if registered == nil {
+			return &commandError{403, "DEVICE_NOT_REGISTERED", "topic " + topic + " does not belong to a registered device"}
+		}
+		if owned == nil {
+			return &commandError{403, "DEVICE_NOT_OWNED", "topic " + topic + " belongs to device " + registered.DeviceID + ", which you do not own"}
+		}
+	}
+	return nil
+}
+
+// commandTopics returns the topics named by 'topic', 'topics' and each
+// 'messages' entry.
+func commandTopics(fields map[string]json.RawMessage) ([]string, error) {
+	var topics []string
+	if raw := fields["topic"]; raw != nil {
+		var topic string
+		if err := json.Unmarshal(raw, &topic); err != nil {
+			return nil, fmt.Errorf("'topic' must be a string")
+		}
+		topics = append(topics, topic)
+	}
+	if raw := fields["topics"]; raw != nil {
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("'topics' must be a list of strings")
+		}
+		topics = append(topics, list...)
+	}
+	if raw := fields["messages"]; raw != nil {
+		var messages []struct {
+			Topic string `json:"topic"`
+		}
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return nil, fmt.Errorf("'messages' must be a list of objects")
+		}
+		for _, m := range messages {
+			topics = append(topics, m.Topic)
+		}
+	}
+	for i, topic := range topics {
+		if topic == "" {
+			return nil, fmt.Errorf("topic %d is empty", i)
+		}
+	}
+	return topics, nil
+}
+
+// ownerTopic places topic in owner's USER_NAMESPACE, refusing one inside
+// another user's namespace, and applies TOPIC_PREFIX.
+func ownerTopic(owner, topic string) (string, *commandError) {
+	placed, err := topics.Place(owner, topic)
+	if err != nil {
+		return "", &commandError{403, "USER_NAMESPACE", err.Error()}
+	}
+	return topics.Prefix(placed), nil
+}
+
+// deviceRecord is the part of a DEVICE_REGISTRY_TABLE item the scheduler
+// reads: the topic filters a device listens on and its owners.
+type deviceRecord struct {
+	DeviceID string   `dynamodbav:"deviceId"`
+	Topics   []string `dynamodbav:"topics"`
+	Owners   []string `dynamodbav:"owners"`
+}
+
+func (d *deviceRecord) hasTopic(topic string) bool {
+	for _, filter := range d.Topics {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *deviceRecord) ownedBy(owner string) bool {
+	for _, o := range d.Owners {
+		if o == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// topicMatches reports whether topic matches the MQTT filter.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// deviceRegistry lists the registered devices.
+type deviceRegistry interface {
+	listDevices() ([]deviceRecord, error)
+}
+
+// openDeviceRegistry returns the DEVICE_REGISTRY_TABLE registry, or nil when
+// it is unset. It is a variable so another registry can stand in.
+var openDeviceRegistry = func() deviceRegistry {
+	table := os.Getenv("DEVICE_REGISTRY_TABLE")
+	if table == "" {
+		return nil
+	}
+	return dynamoRegistry{db: dynamodb.New(session.Must(session.NewSession())), table: table}
+}
+
+type dynamoRegistry struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (r dynamoRegistry) listDevices() ([]deviceRecord, error) {
+	var devices []deviceRecord
+	var pageErr error
+	err := r.db.ScanPages(&dynamodb.ScanInput{TableName: aws.String(r.table)}, func(out *dynamodb.ScanOutput, _ bool) bool {
+		var page []deviceRecord
+		if pageErr = dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); pageErr != nil {
+			return false
+		}
+		devices = append(devices, page...)
+		return true
+	})
+	if err == nil {
+		err = pageErr
+	}
+	return devices, err
+}
@@ -0,0 +1,15 @@
+#!/bin/bash
+set -e
+
+echo "🛠️  Building Go Lambda..."
+
+# Step 1: Build inside Docker (Amazon Linux 2–compatible), with all of
+# backend/ mounted so the module's replace of ../shared resolves
+sudo docker run --rm -v "$PWD/..":/go/src/backend -w "/go/src/backend/$(basename "$PWD")" golang:1.21 \
+  /bin/sh -c 'GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o bootstrap .'
+
+# Step 2: Zip on host
+echo "📦 Zipping..."
+zip -q function.zip bootstrap
+
+echo "✅ Done: function.zip is ready for CDK deployment"
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/scheduler"
+	"github.com/aws/aws-sdk-go/service/scheduler/scheduleriface"
+)
+
+// Commands run as EventBridge Scheduler schedules whose target is the publish
+// Lambda (PUBLISH_FUNCTION_ARN). This module never talks to the broker: the
+// publish Lambda is the one MQTT path, and takes the schedule's input as a
+// queued publish, so a scheduled command goes through the same validation,
+// device schemas and connection pool (backend/shared/mqttclient)
+// as an immediate one. The input is the publish request body with
+// "scheduled_by": {"owner", "id"} added; the publish Lambda resolves the
+// owner's USER_NAMESPACE from it and applies the registry's ownership check
+// to that owner, which queued publishes otherwise skip. A publish error fails
+// the invocation, which Scheduler retries SCHEDULE_RETRIES times (default 2)
+// before sending the event to DEAD_LETTER_QUEUE_ARN, if set.
+
+// schedulerClient is a variable so another client can stand in.
+var schedulerClient = func() scheduleriface.SchedulerAPI {
+	return scheduler.New(session.Must(session.NewSession()))
+}
+
+func scheduleName(id string) string {
+	return "cmd-" + id
+}
+
+func scheduleGroup() string {
+	if g := os.Getenv("SCHEDULE_GROUP"); g != "" {
+		return g
+	}
+	return "default"
+}
+
+// scheduleInput is the schedule's input for owner's command id.
+func scheduleInput(owner, id, command string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(command), &fields); err != nil {
+		return "", err
+	}
+	by, err := json.Marshal(map[string]string{"owner": owner, "id": id})
+	if err != nil {
+		return "", err
+	}
+	fields["scheduled_by"] = by
+	input, err := json.Marshal(fields)
+	return string(input), err
+}
+
+// createSchedule registers c with EventBridge Scheduler to invoke the publish
+// Lambda with input. One-time schedules delete themselves once they have run.
+func createSchedule(c scheduledCommand, input string) error {
+	target, role := os.Getenv("PUBLISH_FUNCTION_ARN"), os.Getenv("SCHEDULER_ROLE_ARN")
+	if target == "" || role == "" {
+		return errors.New("PUBLISH_FUNCTION_ARN and SCHEDULER_ROLE_ARN must be set")
+	}
+	create := &scheduler.CreateScheduleInput{
+		Name:                       aws.String(scheduleName(c.ID)),
+		GroupName:                  aws.String(scheduleGroup()),
+		ClientToken:                aws.String(c.ID),
+		Description:                aws.String("scheduled command for " + c.Owner),
+		ScheduleExpression:         aws.String(c.Expression),
+		ScheduleExpressionTimezone: aws.String(c.Timezone),
+		FlexibleTimeWindow:         &scheduler.FlexibleTimeWindow{Mode: aws.String(scheduler.FlexibleTimeWindowModeOff)},
+		Target: &scheduler.Target{
+			Arn:         aws.String(target),
+			RoleArn:     aws.String(role),
+			Input:       aws.String(input),
+			RetryPolicy: &scheduler.RetryPolicy{MaximumRetryAttempts: aws.Int64(int64(max(envInt("SCHEDULE_RETRIES", 2), 0)))},
+		},
+	}
+	if !c.Recurring {
+		create.ActionAfterCompletion = aws.String(scheduler.ActionAfterCompletionDelete)
+	}
+	if dlq := os.Getenv("DEAD_LETTER_QUEUE_ARN"); dlq != "" {
+		create.Target.DeadLetterConfig = &scheduler.DeadLetterConfig{Arn: aws.String(dlq)}
+	}
+	_, err := schedulerClient().CreateSchedule(create)
+	return err
+}
+
+// deleteSchedule removes the schedule for command id. A schedule that is
+// already gone, such as a one-time one that has run, is not an error.
+func deleteSchedule(id string) error {
+	_, err := schedulerClient().DeleteSchedule(&scheduler.DeleteScheduleInput{
+		Name:      aws.String(scheduleName(id)),
+		GroupName: aws.String(scheduleGroup()),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == scheduler.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+module scheduler
+
+go 1.21
+
+require (
+	github.com/aws/aws-lambda-go v1.48.0
+	github.com/aws/aws-sdk-go v1.55.7
+	shared v0.0.0
+)
+
+require github.com/jmespath/go-jmespath v0.4.0 // indirect
+
+replace shared => ../shared
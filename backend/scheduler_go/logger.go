@@ -0,0 +1,9 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// logger writes structured JSON lines to CloudWatch via stdout.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"shared/apigw"
+)
+
+// Scheduled commands: POST /schedules takes a publish request with a
+// 'schedule' (see parsePlan) and an optional IANA 'timezone', checks it
+// against its owner (see authorizeCommand), stores it and hands it to
+// EventBridge Scheduler, which invokes the publish Lambda with the request at
+// the scheduled time. Commands belong to the Cognito user who created them:
+//
+//	POST   /schedules       schedule a command
+//	GET    /schedules       list pending commands (?status=all for every one)
+//	GET    /schedules/{id}  read one
+//	DELETE /schedules/{id}  cancel a pending one
+
+// maxCommandSize is EventBridge Scheduler's limit on a target's input, the
+// command with its owner added.
+const maxCommandSize = 8192
+
+// respond answers the schedules API, which a browser app may call.
+var respond = apigw.Responder{Methods: "GET,POST,DELETE,OPTIONS"}
+
+// handler serves the schedules API.
+func handler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod == "OPTIONS" {
+		return respond.JSON(204, nil)
+	}
+	path := strings.TrimSuffix(request.Path, "/")
+	if path != "/schedules" && !strings.HasPrefix(path, "/schedules/") {
+		return respond.Error(404, "NOT_FOUND", "Unknown path "+request.Path)
+	}
+	owner := apigw.Subject(request)
+	if owner == "" {
+		return respond.Error(401, "NO_CALLER", "Scheduling commands requires a signed-in user")
+	}
+	store, err := openCommandStore()
+	if err != nil {
+		return respond.Error(500, "CONFIG_ERROR", err.Error())
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(path, "/schedules"), "/")
+	if id == "" {
+		switch request.HTTPMethod {
+		case "GET":
+			return listHandler(store, owner, request.QueryStringParameters["status"] == "all")
+		case "POST":
+			body := request.Body
+			// The API's binary media types make API Gateway base64-encode
+			// request bodies too
+			if request.IsBase64Encoded {
+				decoded, err := base64.StdEncoding.DecodeString(body)
+				if err != nil {
+					return respond.Error(400, "INVALID_JSON", "Invalid base64 request body")
+				}
+				body = string(decoded)
+			}
+			return createHandler(store, owner, body, time.Now())
+		}
+		return respond.Error(405, "", "Use GET or POST")
+	}
+
+	c, err := store.getCommand(owner, id)
+	if err != nil {
+		logger.Error("schedule lookup failed", "id", id, "error", err.Error())
+		return respond.Error(502, "STORE_FAILED", "Reading the scheduled command failed")
+	}
+	// Another user's command is reported as missing, not forbidden
+	if c == nil {
+		return respond.Error(404, "SCHEDULE_NOT_FOUND", "No scheduled command "+id)
+	}
+	now := time.Now()
+	c.Status = c.effectiveStatus(now)
+	switch request.HTTPMethod {
+	case "GET":
+		return respond.JSON(200, c)
+	case "DELETE":
+		return cancelHandler(store, *c, now)
+	}
+	return respond.Error(405, "", "Use GET or DELETE")
+}
+
+// createHandler schedules the publish request in body. Everything but
+// 'schedule' and 'timezone' is passed to the publish Lambda unchanged.
+func createHandler(store commandStore, owner, body string, now time.Time) events.APIGatewayProxyResponse {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &fields); err != nil || fields == nil {
+		return respond.Error(400, "INVALID_JSON", "Body must be a JSON object")
+	}
+	var schedule, tz string
+	if err := json.Unmarshal(fields["schedule"], &schedule); fields["schedule"] != nil && err != nil {
+		return respond.Error(400, "INVALID_SCHEDULE", "'schedule' must be a string")
+	}
+	if err := json.Unmarshal(fields["timezone"], &tz); fields["timezone"] != nil && err != nil {
+		return respond.Error(400, "INVALID_SCHEDULE", "'timezone' must be a string")
+	}
+	if tz == "" {
+		tz = os.Getenv("SCHEDULE_TIMEZONE")
+	}
+	delete(fields, "schedule")
+	delete(fields, "timezone")
+	// Set from the caller when the command is handed to the scheduler
+	delete(fields, "scheduled_by")
+	if fields["topic"] == nil && fields["topics"] == nil && fields["group"] == nil {
+		return respond.Error(400, "INVALID_COMMAND", "The command needs a 'topic', 'topics' or 'group'")
+	}
+	if cerr := authorizeCommand(owner, fields); cerr != nil {
+		return respond.Error(cerr.status, cerr.code, cerr.msg)
+	}
+	command, err := json.Marshal(fields)
+	if err != nil {
+		return respond.Error(400, "INVALID_COMMAND", err.Error())
+	}
+	id := newID()
+	input, err := scheduleInput(owner, id, string(command))
+	if err != nil {
+		return respond.Error(400, "INVALID_COMMAND", err.Error())
+	}
+	if len(input) > maxCommandSize {
+		return respond.Error(413, "COMMAND_TOO_LARGE", fmt.Sprintf("A scheduled command can be at most %d bytes", maxCommandSize-(len(input)-len(command))))
+	}
+
+	p, err := parsePlan(schedule, tz, now)
+	if err != nil {
+		return respond.Error(400, "INVALID_SCHEDULE", err.Error())
+	}
+
+	existing, err := store.listCommands(owner)
+	if err != nil {
+		logger.Error("schedule list failed", "owner", owner, "error", err.Error())
+		return respond.Error(502, "STORE_FAILED", "Reading scheduled commands failed")
+	}
+	limit := envInt("MAX_PENDING_SCHEDULES", 100)
+	if pending := countPending(existing, now); pending >= limit {
+		return respond.Error(429, "TOO_MANY_SCHEDULES", fmt.Sprintf("At most %d pending scheduled commands per user", limit))
+	}
+
+	c := scheduledCommand{
+		Owner:      owner,
+		ID:         id,
+		Schedule:   schedule,
+		Expression: p.Expression,
+		Timezone:   p.Timezone,
+		Recurring:  p.Recurring,
+		Command:    string(command),
+		Status:     statusPending,
+		CreatedAt:  now.UTC().Format(time.RFC3339),
+	}
+	if !p.Recurring {
+		c.RunAt = p.RunAt.Format(time.RFC3339)
+		c.ExpiresAt = p.RunAt.Add(retention()).Unix()
+	}
+	if err := createSchedule(c, input); err != nil {
+		logger.Error("create schedule failed", "id", c.ID, "expression", c.Expression, "error", err.Error())
+		return respond.Error(502, "SCHEDULER_FAILED", "Creating the schedule failed: "+err.Error())
+	}
+	if err := store.putCommand(c); err != nil {
+		logger.Error("store scheduled command failed", "id", c.ID, "error", err.Error())
+		// Without its record the command could not be listed or cancelled
+		if err := deleteSchedule(c.ID); err != nil {
+			logger.Error("orphaned schedule", "id", c.ID, "error", err.Error())
+		}
+		return respond.Error(502, "STORE_FAILED", "Storing the scheduled command failed")
+	}
+	logger.Info("command scheduled", "id", c.ID, "owner", owner, "expression", c.Expression, "timezone", c.Timezone)
+	return respond.JSON(201, c)
+}
+
+// listHandler answers {"schedules": [...]}, soonest first with recurring
+// commands last.
+func listHandler(store commandStore, owner string, all bool) events.APIGatewayProxyResponse {
+	commands, err := store.listCommands(owner)
+	if err != nil {
+		logger.Error("schedule list failed", "owner", owner, "error", err.Error())
+		return respond.Error(502, "STORE_FAILED", "Reading scheduled commands failed")
+	}
+	now := time.Now()
+	shown := []scheduledCommand{}
+	for _, c := range commands {
+		c.Status = c.effectiveStatus(now)
+		if all || c.Status == statusPending {
+			shown = append(shown, c)
+		}
+	}
+	sort.SliceStable(shown, func(i, j int) bool {
+		a, b := shown[i], shown[j]
+		if a.Recurring != b.Recurring {
+			return !a.Recurring
+		}
+		if a.RunAt != b.RunAt {
+			return a.RunAt < b.RunAt
+		}
+		return a.CreatedAt < b.CreatedAt
+	})
+	return respond.JSON(200, map[string]interface{}{"schedules": shown})
+}
+
+// cancelHandler deletes a pending command's schedule and marks it cancelled.
+func cancelHandler(store commandStore, c scheduledCommand, now time.Time) events.APIGatewayProxyResponse {
+	if c.Status != statusPending {
+		return respond.Error(409, "NOT_PENDING", "Scheduled command "+c.ID+" is already "+c.Status)
+	}
+	if err := deleteSchedule(c.ID); err != nil {
+		logger.Error("delete schedule failed", "id", c.ID, "error", err.Error())
+		return respond.Error(502, "SCHEDULER_FAILED", "Deleting the schedule failed: "+err.Error())
+	}
+	if err := store.cancelCommand(c.Owner, c.ID, now.Add(retention()).Unix()); err != nil {
+		logger.Error("cancel scheduled command failed", "id", c.ID, "error", err.Error())
+		return respond.Error(502, "STORE_FAILED", "The schedule was deleted but its record was not updated")
+	}
+	logger.Info("scheduled command cancelled", "id", c.ID, "owner", c.Owner)
+	c.Status = statusCancelled
+	return respond.JSON(200, c)
+}
+
+func countPending(commands []scheduledCommand, now time.Time) int {
+	n := 0
+	for _, c := range commands {
+		if c.effectiveStatus(now) == statusPending {
+			n++
+		}
+	}
+	return n
+}
+
+// retention is how long a fired or cancelled command stays listable
+// (SCHEDULE_RETENTION, default 7 days).
+func retention() time.Duration {
+	return envDuration("SCHEDULE_RETENTION", 7*24*time.Hour)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/scheduler"
+	"github.com/aws/aws-sdk-go/service/scheduler/scheduleriface"
+)
+
+// memStore is an in-memory commandStore.
+type memStore struct {
+	mu       sync.Mutex
+	commands map[string]scheduledCommand // by owner + "/" + id
+	putErr   error
+}
+
+func (s *memStore) putCommand(c scheduledCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.putErr != nil {
+		return s.putErr
+	}
+	s.commands[c.Owner+"/"+c.ID] = c
+	return nil
+}
+
+func (s *memStore) getCommand(owner, id string) (*scheduledCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.commands[owner+"/"+id]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+func (s *memStore) listCommands(owner string) ([]scheduledCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []scheduledCommand
+	for _, c := range s.commands {
+		if c.Owner == owner {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) cancelCommand(owner, id string, expiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.commands[owner+"/"+id]
+	c.Status, c.ExpiresAt = statusCancelled, expiresAt
+	s.commands[owner+"/"+id] = c
+	return nil
+}
+
+// fakeScheduler records the schedules created and deleted.
+type fakeScheduler struct {
+	scheduleriface.SchedulerAPI
+
+	mu      sync.Mutex
+	created []*scheduler.CreateScheduleInput
+	deleted []string
+}
+
+func (f *fakeScheduler) CreateSchedule(in *scheduler.CreateScheduleInput) (*scheduler.CreateScheduleOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, in)
+	return &scheduler.CreateScheduleOutput{}, nil
+}
+
+func (f *fakeScheduler) DeleteSchedule(in *scheduler.DeleteScheduleInput) (*scheduler.DeleteScheduleOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, aws.StringValue(in.Name))
+	return &scheduler.DeleteScheduleOutput{}, nil
+}
+
+// fakeRegistry is a fixed device registry.
+type fakeRegistry []deviceRecord
+
+func (r fakeRegistry) listDevices() ([]deviceRecord, error) { return r, nil }
+
+// newFakes installs an empty store, a fake Scheduler and no registry for the
+// duration of t.
+func newFakes(t *testing.T) (*memStore, *fakeScheduler) {
+	t.Helper()
+	t.Setenv("PUBLISH_FUNCTION_ARN", "arn:aws:lambda:eu-central-1:123456789012:function:set-led")
+	t.Setenv("SCHEDULER_ROLE_ARN", "arn:aws:iam::123456789012:role/scheduler")
+	store := &memStore{commands: map[string]scheduledCommand{}}
+	sched := &fakeScheduler{}
+	prevStore, prevClient, prevRegistry := openCommandStore, schedulerClient, openDeviceRegistry
+	openCommandStore = func() (commandStore, error) { return store, nil }
+	schedulerClient = func() scheduleriface.SchedulerAPI { return sched }
+	openDeviceRegistry = func() deviceRegistry { return nil }
+	t.Cleanup(func() {
+		openCommandStore, schedulerClient, openDeviceRegistry = prevStore, prevClient, prevRegistry
+	})
+	return store, sched
+}
+
+// request is an API Gateway request from the Cognito user sub.
+func request(method, path, sub, body string) events.APIGatewayProxyRequest {
+	r := events.APIGatewayProxyRequest{HTTPMethod: method, Path: path, Body: body}
+	if sub != "" {
+		r.RequestContext.Authorizer = map[string]interface{}{"claims": map[string]interface{}{"sub": sub}}
+	}
+	return r
+}
+
+func decode(t *testing.T, resp events.APIGatewayProxyResponse) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("response body is not a JSON object: %s", resp.Body)
+	}
+	return body
+}
+
+func TestCreateOneTime(t *testing.T) {
+	store, sched := newFakes(t)
+	now := time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC)
+
+	resp := createHandler(store, "u1", `{"topic":"devices/lamp/led","message":"on","schedule":"30m","scheduled_by":{"owner":"u2"}}`, now)
+	if resp.StatusCode != 201 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	body := decode(t, resp)
+	id, _ := body["id"].(string)
+	if body["runAt"] != "2026-10-14T20:30:00Z" || body["status"] != statusPending || id == "" {
+		t.Errorf("response %v", body)
+	}
+	if cmd, _ := body["command"].(map[string]interface{}); cmd["topic"] != "devices/lamp/led" || cmd["scheduled_by"] != nil || cmd["schedule"] != nil {
+		t.Errorf("command %v, want the publish request alone", body["command"])
+	}
+
+	stored, _ := store.getCommand("u1", id)
+	if stored == nil || stored.ExpiresAt != now.Add(30*time.Minute+retention()).Unix() {
+		t.Fatalf("stored %+v", stored)
+	}
+	if len(sched.created) != 1 {
+		t.Fatalf("%d schedules created, want 1", len(sched.created))
+	}
+	in := sched.created[0]
+	if aws.StringValue(in.Name) != "cmd-"+id || aws.StringValue(in.ScheduleExpression) != "at(2026-10-14T20:30:00)" ||
+		aws.StringValue(in.ActionAfterCompletion) != scheduler.ActionAfterCompletionDelete {
+		t.Errorf("schedule %v", in)
+	}
+	var input struct {
+		Topic       string            `json:"topic"`
+		ScheduledBy map[string]string `json:"scheduled_by"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(in.Target.Input)), &input); err != nil || input.Topic != "devices/lamp/led" ||
+		input.ScheduledBy["owner"] != "u1" || input.ScheduledBy["id"] != id {
+		t.Errorf("schedule input %s, want the command scheduled by u1", aws.StringValue(in.Target.Input))
+	}
+}
+
+func TestCreateRecurring(t *testing.T) {
+	store, sched := newFakes(t)
+	resp := createHandler(store, "u1", `{"topic":"devices/lamp/led","message":"off","schedule":"0 23 * * 1-5","timezone":"Europe/Warsaw"}`, time.Now())
+	if resp.StatusCode != 201 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	in := sched.created[0]
+	if aws.StringValue(in.ScheduleExpression) != "cron(0 23 ? * 2-6 *)" || aws.StringValue(in.ScheduleExpressionTimezone) != "Europe/Warsaw" || in.ActionAfterCompletion != nil {
+		t.Errorf("schedule %v", in)
+	}
+	if body := decode(t, resp); body["recurring"] != true || body["runAt"] != nil {
+		t.Errorf("response %v", body)
+	}
+}
+
+func TestCreateRejects(t *testing.T) {
+	big := strings.Repeat("x", maxCommandSize)
+	tests := []struct {
+		name, body string
+		status     int
+		code       string
+	}{
+		{"not an object", `[1]`, 400, "INVALID_JSON"},
+		{"no target", `{"message":"on","schedule":"30m"}`, 400, "INVALID_COMMAND"},
+		{"bad schedule", `{"topic":"a","message":"on","schedule":"soon"}`, 400, "INVALID_SCHEDULE"},
+		{"schedule not a string", `{"topic":"a","message":"on","schedule":30}`, 400, "INVALID_SCHEDULE"},
+		{"empty topic in a broadcast", `{"topics":["a",""],"message":"on","schedule":"30m"}`, 400, "INVALID_COMMAND"},
+		{"too large", `{"topic":"a","message":"` + big + `","schedule":"30m"}`, 413, "COMMAND_TOO_LARGE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, sched := newFakes(t)
+			resp := createHandler(store, "u1", tt.body, time.Now())
+			if code := decode(t, resp)["code"]; resp.StatusCode != tt.status || code != tt.code {
+				t.Errorf("status %d code %v, want %d %s", resp.StatusCode, code, tt.status, tt.code)
+			}
+			if len(sched.created) != 0 || len(store.commands) != 0 {
+				t.Error("a rejected command was scheduled")
+			}
+		})
+	}
+}
+
+func TestCreatePendingLimit(t *testing.T) {
+	t.Setenv("MAX_PENDING_SCHEDULES", "2")
+	store, _ := newFakes(t)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if resp := createHandler(store, "u1", `{"topic":"a","message":"on","schedule":"1h"}`, now); resp.StatusCode != 201 {
+			t.Fatalf("command %d: status %d: %s", i, resp.StatusCode, resp.Body)
+		}
+	}
+	resp := createHandler(store, "u1", `{"topic":"a","message":"on","schedule":"1h"}`, now)
+	if code := decode(t, resp)["code"]; resp.StatusCode != 429 || code != "TOO_MANY_SCHEDULES" {
+		t.Errorf("status %d code %v, want 429 TOO_MANY_SCHEDULES", resp.StatusCode, code)
+	}
+	// The limit is per user
+	if resp := createHandler(store, "u2", `{"topic":"a","message":"on","schedule":"1h"}`, now); resp.StatusCode != 201 {
+		t.Errorf("another user: status %d: %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestCreateUndoesScheduleWhenStoreFails(t *testing.T) {
+	store, sched := newFakes(t)
+	store.putErr = errors.New("throttled")
+	resp := createHandler(store, "u1", `{"topic":"a","message":"on","schedule":"30m"}`, time.Now())
+	if code := decode(t, resp)["code"]; resp.StatusCode != 502 || code != "STORE_FAILED" {
+		t.Errorf("status %d code %v, want 502 STORE_FAILED", resp.StatusCode, code)
+	}
+	if len(sched.created) != 1 || len(sched.deleted) != 1 || aws.StringValue(sched.created[0].Name) != sched.deleted[0] {
+		t.Errorf("created %d, deleted %v: the orphaned schedule was not removed", len(sched.created), sched.deleted)
+	}
+}
+
+func TestCreateDecodesBase64Body(t *testing.T) {
+	store, sched := newFakes(t)
+	r := request("POST", "/schedules", "u1", base64.StdEncoding.EncodeToString([]byte(`{"topic":"devices/lamp/led","message":"on","schedule":"30m"}`)))
+	r.IsBase64Encoded = true
+	if resp := handler(r); resp.StatusCode != 201 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if len(sched.created) != 1 || len(store.commands) != 1 {
+		t.Errorf("created %d schedules, stored %d commands, want 1 of each", len(sched.created), len(store.commands))
+	}
+
+	r.Body = "not base64!"
+	if resp := handler(r); resp.StatusCode != 400 || decode(t, resp)["code"] != "INVALID_JSON" {
+		t.Errorf("undecodable body: status %d: %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestCreateChecksOwner(t *testing.T) {
+	registry := fakeRegistry{
+		{DeviceID: "lamp-1", Topics: []string{"users/u1/devices/lamp-1/#"}, Owners: []string{"u1"}},
+		{DeviceID: "lamp-2", Topics: []string{"users/u2/devices/lamp-2/#"}, Owners: []string{"u2"}},
+		{DeviceID: "shared", Topics: []string{"users/u1/devices/shared/#"}, Owners: []string{"u2"}},
+	}
+	tests := []struct {
+		name, command string
+		status        int
+		code          string
+	}{
+		{"own device, relative topic", `"topic":"devices/lamp-1/led"`, 201, ""},
+		{"own device, namespaced topic", `"topic":"users/u1/devices/lamp-1/led"`, 201, ""},
+		{"another user's namespace", `"topic":"users/u2/devices/lamp-2/led"`, 403, "USER_NAMESPACE"},
+		{"registered to another owner", `"topic":"devices/shared/led"`, 403, "DEVICE_NOT_OWNED"},
+		{"unregistered", `"topic":"devices/kettle/led"`, 403, "DEVICE_NOT_REGISTERED"},
+		{"one bad broadcast topic", `"topics":["devices/lamp-1/led","devices/kettle/led"]`, 403, "DEVICE_NOT_REGISTERED"},
+		{"one bad batch message", `"messages":[{"topic":"devices/lamp-1/led","message":"on"},{"topic":"users/u2/x","message":"on"}],"topic":"devices/lamp-1/led"`, 403, "USER_NAMESPACE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("USER_NAMESPACE", "users/{sub}/")
+			store, sched := newFakes(t)
+			openDeviceRegistry = func() deviceRegistry { return registry }
+
+			resp := createHandler(store, "u1", `{`+tt.command+`,"message":"on","schedule":"30m"}`, time.Now())
+			if code, _ := decode(t, resp)["code"].(string); resp.StatusCode != tt.status || code != tt.code {
+				t.Errorf("status %d code %q, want %d %q (%s)", resp.StatusCode, code, tt.status, tt.code, resp.Body)
+			}
+			if created := len(sched.created) == 1; created != (tt.status == 201) {
+				t.Errorf("schedule created = %v", created)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	store, _ := newFakes(t)
+	now := time.Now()
+	at := func(d time.Duration) string { return now.Add(d).UTC().Format(time.RFC3339) }
+	for _, c := range []scheduledCommand{
+		{Owner: "u1", ID: "later", RunAt: at(2 * time.Hour), Status: statusPending, Command: `{}`},
+		{Owner: "u1", ID: "nightly", Recurring: true, Status: statusPending, Command: `{}`},
+		{Owner: "u1", ID: "sooner", RunAt: at(time.Hour), Status: statusPending, Command: `{}`},
+		{Owner: "u1", ID: "fired", RunAt: at(-time.Hour), Status: statusPending, Command: `{}`},
+		{Owner: "u1", ID: "cancelled", RunAt: at(time.Hour), Status: statusCancelled, Command: `{}`},
+		{Owner: "u2", ID: "theirs", RunAt: at(time.Hour), Status: statusPending, Command: `{}`},
+	} {
+		store.putCommand(c)
+	}
+
+	ids := func(query map[string]string) string {
+		r := request("GET", "/schedules", "u1", "")
+		r.QueryStringParameters = query
+		resp := handler(r)
+		var body struct {
+			Schedules []struct{ ID, Status string }
+		}
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+		}
+		var out []string
+		for _, s := range body.Schedules {
+			out = append(out, s.ID+"="+s.Status)
+		}
+		return strings.Join(out, " ")
+	}
+	if got, want := ids(nil), "sooner=pending later=pending nightly=pending"; got != want {
+		t.Errorf("pending: %s, want %s", got, want)
+	}
+	all := ids(map[string]string{"status": "all"})
+	for _, want := range []string{"fired=fired", "cancelled=cancelled"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("all: %s, want %s listed", all, want)
+		}
+	}
+	if strings.Contains(all, "theirs") {
+		t.Errorf("all: %s lists another user's command", all)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	store, sched := newFakes(t)
+	now := time.Now()
+	store.putCommand(scheduledCommand{Owner: "u1", ID: "c1", RunAt: now.Add(time.Hour).UTC().Format(time.RFC3339), Status: statusPending, Command: `{}`})
+
+	if resp := handler(request("DELETE", "/schedules/c1", "u2", "")); resp.StatusCode != 404 {
+		t.Errorf("another user: status %d, want 404", resp.StatusCode)
+	}
+	resp := handler(request("DELETE", "/schedules/c1", "u1", ""))
+	if resp.StatusCode != 200 || decode(t, resp)["status"] != statusCancelled {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if len(sched.deleted) != 1 || sched.deleted[0] != "cmd-c1" {
+		t.Errorf("deleted schedules %v, want cmd-c1", sched.deleted)
+	}
+	if c, _ := store.getCommand("u1", "c1"); c.Status != statusCancelled || c.ExpiresAt == 0 {
+		t.Errorf("stored %+v, want cancelled with an expiry", c)
+	}
+
+	resp = handler(request("DELETE", "/schedules/c1", "u1", ""))
+	if code := decode(t, resp)["code"]; resp.StatusCode != 409 || code != "NOT_PENDING" {
+		t.Errorf("cancelling twice: status %d code %v, want 409 NOT_PENDING", resp.StatusCode, code)
+	}
+}
+
+func TestHandlerRequiresCaller(t *testing.T) {
+	newFakes(t)
+	for _, r := range []events.APIGatewayProxyRequest{
+		request("GET", "/schedules", "", ""),
+		request("POST", "/schedules", "", `{"topic":"a","message":"on","schedule":"30m"}`),
+	} {
+		if resp := handler(r); resp.StatusCode != 401 {
+			t.Errorf("%s without a caller: status %d, want 401", r.HTTPMethod, resp.StatusCode)
+		}
+	}
+	if resp := handler(request("GET", "/elsewhere", "u1", "")); resp.StatusCode != 404 {
+		t.Errorf("unknown path: status %d, want 404", resp.StatusCode)
+	}
+	if resp := handler(request("PUT", "/schedules/c1", "u1", "")); resp.StatusCode != 404 && resp.StatusCode != 405 {
+		t.Errorf("PUT: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the provided.al2 runtime ships no zoneinfo
+)
+
+// plan is a parsed 'schedule': an EventBridge Scheduler expression and, for a
+// one-time command, when it runs.
+type plan struct {
+	Expression string
+	Timezone   string
+	Recurring  bool
+	RunAt      time.Time // zero for recurring commands
+}
+
+// parsePlan reads a 'schedule' value in timezone tz (IANA, default UTC):
+//
+//	"30m", "1h30m"             a delay from now
+//	"22:00"                    the next 22:00 in tz
+//	"2026-10-14T22:00:00Z"     an RFC 3339 time
+//	"0 22 * * *"               a five-field Unix cron expression, in tz
+//	"cron(0 22 * * ? *)"       an EventBridge cron expression, in tz
+func parsePlan(schedule, tz string, now time.Time) (plan, error) {
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return plan{}, fmt.Errorf("unknown timezone %q", tz)
+	}
+	schedule = strings.TrimSpace(schedule)
+
+	var runAt time.Time
+	switch {
+	case schedule == "":
+		return plan{}, fmt.Errorf("'schedule' is required")
+	case strings.HasPrefix(schedule, "cron("):
+		if !strings.HasSuffix(schedule, ")") || len(strings.Fields(schedule[5:len(schedule)-1])) != 6 {
+			return plan{}, fmt.Errorf("%q must have six fields: minutes hours day-of-month month day-of-week year", schedule)
+		}
+		return plan{Expression: schedule, Timezone: tz, Recurring: true}, nil
+	case len(strings.Fields(schedule)) == 5:
+		expr, err := unixCron(schedule)
+		if err != nil {
+			return plan{}, err
+		}
+		return plan{Expression: expr, Timezone: tz, Recurring: true}, nil
+	case clockTime.MatchString(schedule):
+		h, _ := strconv.Atoi(schedule[:strings.Index(schedule, ":")])
+		m, _ := strconv.Atoi(schedule[strings.Index(schedule, ":")+1:])
+		local := now.In(loc)
+		runAt = time.Date(local.Year(), local.Month(), local.Day(), h, m, 0, 0, loc)
+		if !runAt.After(now) {
+			runAt = runAt.AddDate(0, 0, 1)
+		}
+	default:
+		if d, err := time.ParseDuration(schedule); err == nil {
+			if d <= 0 {
+				return plan{}, fmt.Errorf("delay %q must be positive", schedule)
+			}
+			runAt = now.Add(d)
+		} else if runAt, err = time.Parse(time.RFC3339, schedule); err != nil {
+			return plan{}, fmt.Errorf("'schedule' %q is not a delay, time of day, RFC 3339 time or cron expression", schedule)
+		}
+	}
+
+	if !runAt.After(now) {
+		return plan{}, fmt.Errorf("'schedule' %s is in the past", runAt.UTC().Format(time.RFC3339))
+	}
+	if ahead := envDuration("MAX_SCHEDULE_AHEAD", 366*24*time.Hour); runAt.Sub(now) > ahead {
+		return plan{}, fmt.Errorf("'schedule' is more than %s ahead", ahead)
+	}
+	// One-time schedules run at whole seconds
+	runAt = runAt.UTC().Truncate(time.Second)
+	return plan{Expression: "at(" + runAt.Format("2006-01-02T15:04:05") + ")", Timezone: "UTC", RunAt: runAt}, nil
+}
+
+var clockTime = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):[0-5][0-9]$`)
+
+// dayNumber is a Unix day-of-week number (0 or 7 is Sunday).
+var dayNumber = regexp.MustCompile(`[0-7]`)
+
+// unixCron converts "min hour dom month dow" to EventBridge cron: days of the
+// week count from 1 (Sunday), and one of the day fields must be "?".
+func unixCron(expr string) (string, error) {
+	f := strings.Fields(expr)
+	if f[2] != "*" && f[4] != "*" {
+		return "", fmt.Errorf("%q: EventBridge cannot combine a day of month with a day of week", expr)
+	}
+	if strings.ContainsAny(f[4], "0123456789") {
+		f[4] = dayNumber.ReplaceAllStringFunc(f[4], func(n string) string {
+			d, _ := strconv.Atoi(n)
+			return strconv.Itoa(d%7 + 1)
+		})
+	}
+	if f[4] == "*" {
+		f[4] = "?"
+	} else {
+		f[2] = "?"
+	}
+	return "cron(" + strings.Join(append(f, "*"), " ") + ")", nil
+}
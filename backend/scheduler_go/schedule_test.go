@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePlan(t *testing.T) {
+	now := time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		schedule, tz string
+		expression   string
+		recurring    bool
+	}{
+		{"30m", "", "at(2026-10-14T20:30:00)", false},
+		{"1h30m15.5s", "", "at(2026-10-14T21:30:15)", false},
+		{"21:00", "", "at(2026-10-14T21:00:00)", false},
+		// 22:00 in Warsaw (UTC+2) is now, so the next one is tomorrow's
+		{"22:00", "Europe/Warsaw", "at(2026-10-15T20:00:00)", false},
+		{"2026-10-15T08:00:00+02:00", "", "at(2026-10-15T06:00:00)", false},
+		{"0 22 * * *", "Europe/Warsaw", "cron(0 22 * * ? *)", true},
+		{"0 8 * * 1-5", "", "cron(0 8 ? * 2-6 *)", true},
+		{"0 9 * * 0,7", "", "cron(0 9 ? * 1,1 *)", true},
+		{"30 6 1 * *", "", "cron(30 6 1 * ? *)", true},
+		{"cron(0 22 ? * MON-FRI *)", "", "cron(0 22 ? * MON-FRI *)", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			p, err := parsePlan(tt.schedule, tt.tz, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Expression != tt.expression || p.Recurring != tt.recurring {
+				t.Errorf("plan %+v, want %s (recurring %v)", p, tt.expression, tt.recurring)
+			}
+			if !tt.recurring && (p.Timezone != "UTC" || p.RunAt.Format("at(2006-01-02T15:04:05)") != tt.expression) {
+				t.Errorf("one-time plan %+v does not run at its expression in UTC", p)
+			}
+			if tt.recurring && tt.tz != "" && p.Timezone != tt.tz {
+				t.Errorf("recurring plan in %s, want %s", p.Timezone, tt.tz)
+			}
+		})
+	}
+}
+
+func TestParsePlanRejects(t *testing.T) {
+	now := time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC)
+	tests := []struct{ name, schedule, tz string }{
+		{"empty", "", ""},
+		{"negative delay", "-5m", ""},
+		{"past time", "2026-10-14T19:59:59Z", ""},
+		{"too far ahead", "9000h", ""},
+		{"unknown timezone", "22:00", "Mars/Olympus"},
+		{"garbage", "tomorrow-ish", ""},
+		{"bad clock time", "24:00", ""},
+		{"short EventBridge cron", "cron(0 22 * *)", ""},
+		{"day of month and week", "0 8 1 * 1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if p, err := parsePlan(tt.schedule, tt.tz, now); err == nil {
+				t.Errorf("parsePlan(%q, %q) = %+v, want an error", tt.schedule, tt.tz, p)
+			}
+		})
+	}
+}
+
+func TestParsePlanMaxAhead(t *testing.T) {
+	t.Setenv("MAX_SCHEDULE_AHEAD", "1h")
+	now := time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC)
+	if _, err := parsePlan("59m", "", now); err != nil {
+		t.Errorf("within MAX_SCHEDULE_AHEAD: %v", err)
+	}
+	if _, err := parsePlan("61m", "", now); err == nil {
+		t.Error("beyond MAX_SCHEDULE_AHEAD was accepted")
+	}
+}
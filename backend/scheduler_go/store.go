@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	statusPending   = "pending"
+	statusCancelled = "cancelled"
+	// statusFired is never stored: a pending one-time command whose run time
+	// has passed is reported as fired
+	statusFired = "fired"
+)
+
+// scheduledCommand is one command waiting in EventBridge Scheduler. Command is
+// the publish request body, kept as JSON text so it round-trips untouched.
+type scheduledCommand struct {
+	Owner      string `json:"-" dynamodbav:"owner"`
+	ID         string `json:"id" dynamodbav:"id"`
+	Schedule   string `json:"schedule" dynamodbav:"schedule"`
+	Expression string `json:"expression" dynamodbav:"expression"`
+	Timezone   string `json:"timezone" dynamodbav:"timezone"`
+	Recurring  bool   `json:"recurring" dynamodbav:"recurring"`
+	RunAt      string `json:"runAt,omitempty" dynamodbav:"runAt,omitempty"`
+	Command    string `json:"-" dynamodbav:"command"`
+	Status     string `json:"status" dynamodbav:"status"`
+	CreatedAt  string `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt  int64  `json:"-" dynamodbav:"expiresAt,omitempty"` // DynamoDB TTL
+}
+
+// MarshalJSON adds the command as a JSON value rather than text.
+func (c scheduledCommand) MarshalJSON() ([]byte, error) {
+	type plain scheduledCommand
+	return json.Marshal(struct {
+		plain
+		Command json.RawMessage `json:"command"`
+	}{plain(c), json.RawMessage(c.Command)})
+}
+
+// effectiveStatus reports a one-time command past its run time as fired.
+func (c scheduledCommand) effectiveStatus(now time.Time) string {
+	if c.Status != statusPending || c.Recurring {
+		return c.Status
+	}
+	if runAt, err := time.Parse(time.RFC3339, c.RunAt); err == nil && !runAt.After(now) {
+		return statusFired
+	}
+	return c.Status
+}
+
+// commandStore persists scheduled commands by owner.
+type commandStore interface {
+	putCommand(c scheduledCommand) error
+	// getCommand returns nil, nil when owner has no command id
+	getCommand(owner, id string) (*scheduledCommand, error)
+	listCommands(owner string) ([]scheduledCommand, error)
+	// cancelCommand marks a command cancelled, to expire at expiresAt
+	cancelCommand(owner, id string, expiresAt int64) error
+}
+
+// openCommandStore returns the DynamoDB store for SCHEDULES_TABLE (keyed by
+// owner and id). It is a variable so another store can stand in.
+var openCommandStore = func() (commandStore, error) {
+	table := os.Getenv("SCHEDULES_TABLE")
+	if table == "" {
+		return nil, errors.New("SCHEDULES_TABLE must be set")
+	}
+	return dynamoCommandStore{db: dynamodb.New(session.Must(session.NewSession())), table: table}, nil
+}
+
+type dynamoCommandStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func commandKey(owner, id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"owner": {S: aws.String(owner)}, "id": {S: aws.String(id)}}
+}
+
+func (s dynamoCommandStore) putCommand(c scheduledCommand) error {
+	item, err := dynamodbattribute.MarshalMap(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item})
+	return err
+}
+
+func (s dynamoCommandStore) getCommand(owner, id string) (*scheduledCommand, error) {
+	out, err := s.db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            commandKey(owner, id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(out.Item) == 0 {
+		return nil, err
+	}
+	var c scheduledCommand
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s dynamoCommandStore) listCommands(owner string) ([]scheduledCommand, error) {
+	var commands []scheduledCommand
+	var pageErr error
+	err := s.db.QueryPages(&dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]*string{"#owner": aws.String("owner")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(owner)}},
+	}, func(out *dynamodb.QueryOutput, _ bool) bool {
+		var page []scheduledCommand
+		if pageErr = dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); pageErr != nil {
+			return false
+		}
+		commands = append(commands, page...)
+		return true
+	})
+	if err == nil {
+		err = pageErr
+	}
+	return commands, err
+}
+
+func (s dynamoCommandStore) cancelCommand(owner, id string, expiresAt int64) error {
+	_, err := s.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.table),
+		Key:                      commandKey(owner, id),
+		UpdateExpression:         aws.String("SET #status = :status, expiresAt = :expiresAt"),
+		ExpressionAttributeNames: map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status":    {S: aws.String(statusCancelled)},
+			":expiresAt": {N: aws.String(strconv.FormatInt(expiresAt, 10))},
+		},
+	})
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// With wait_for_ack the handler waits for the device to confirm a command
+// instead of answering as soon as the broker has it. The command carries its
+// message ID (see applyMessageID) and the device answers on the ack topic,
+// the response_topic when given or else <topic>ACK_TOPIC_SUFFIX (default
+// "/ack"), echoing the ID in the same JSON field or as MQTT 5 correlation
+// data. Acks for other commands are ignored.
+
+// ackResult is the device's confirmation, as returned in the response.
+// Message is the ack payload as sent, typically the device's reported state;
+// it stays a string so response casing never rewrites the device's keys.
+type ackResult struct {
+	Topic     string `json:"topic"`
+	Message   string `json:"message"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// ackTopic is where the device acknowledges msg.
+func ackTopic(msg outboundMessage) string {
+	if msg.Props.ResponseTopic != "" {
+		return msg.Props.ResponseTopic
+	}
+	suffix := os.Getenv("ACK_TOPIC_SUFFIX")
+	if suffix == "" {
+		suffix = "/ack"
+	}
+	return msg.Topic + suffix
+}
+
+// ackWaiter receives the acknowledgment for one command; it subscribes before
+// the command is published so a fast device is not missed.
+type ackWaiter struct {
+	client mqtt.Client
+	topic  string
+	ch     chan ackResult
+}
+
+// startAck subscribes to topic for the ack carrying messageID.
+func startAck(client mqtt.Client, topic, messageID string, qos byte) (*ackWaiter, error) {
+	if !acquireSubscription() {
+		return nil, errSubscriptionLimit
+	}
+	w := &ackWaiter{client: client, topic: topic, ch: make(chan ackResult, 1)}
+	token := client.Subscribe(topic, qos, func(_ mqtt.Client, m mqtt.Message) {
+		if !ackMatches(m, messageID) {
+			return
+		}
+		ack := ackResult{Topic: m.Topic(), Message: string(m.Payload())}
+		select {
+		case w.ch <- ack:
+		default: // already acknowledged
+		}
+	})
+	if err := mqttclient.WaitToken(token, connectTimeout()); err != nil {
+		releaseSubscription()
+		return nil, err
+	}
+	return w, nil
+}
+
+// ackMatches reports whether m acknowledges the command messageID.
+func ackMatches(m mqtt.Message, messageID string) bool {
+	if cd, ok := m.(interface{ CorrelationData() []byte }); ok && string(cd.CorrelationData()) == messageID {
+		return true
+	}
+	id, _ := payloadMessageID(string(m.Payload()))
+	return id == messageID
+}
+
+// wait returns the ack, or false if none arrived within timeout of sent.
+func (w *ackWaiter) wait(sent time.Time, timeout time.Duration) (ackResult, bool) {
+	timer := time.NewTimer(time.Until(sent.Add(timeout)))
+	defer timer.Stop()
+	select {
+	case ack := <-w.ch:
+		ack.LatencyMs = time.Since(sent).Milliseconds()
+		return ack, true
+	case <-timer.C:
+		return ackResult{}, false
+	}
+}
+
+func (w *ackWaiter) close() {
+	defer releaseSubscription()
+	mqttclient.WaitToken(w.client.Unsubscribe(w.topic), connectTimeout())
+}
+
+// payloadMessageID returns the message ID a JSON object payload already
+// carries, and whether payload is a JSON object at all.
+func payloadMessageID(payload string) (string, bool) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal([]byte(payload), &obj) != nil || obj == nil {
+		return "", false
+	}
+	var id string
+	json.Unmarshal(obj[messageIDKey()], &id)
+	return id, true
+}
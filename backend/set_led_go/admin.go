@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/mqttclient"
+)
+
+// requireAdmin checks the X-Api-Key header against the key stored in the SSM
+// parameter named by ADMIN_API_KEY_SSM. Admin endpoints are disabled when no
+// key is configured.
+func requireAdmin(request events.APIGatewayProxyRequest) *apiError {
+	name := os.Getenv("ADMIN_API_KEY_SSM")
+	if name == "" {
+		return newAPIError(403, "ADMIN_DISABLED", "admin endpoints are not configured")
+	}
+	want, err := mqttclient.GetParam(mqttclient.NewSSMClient(), name)
+	if err != nil {
+		return newAPIError(500, "", "SSM lookup failed: "+err.Error())
+	}
+	got := headerValue(request, "X-Api-Key")
+	if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return newAPIError(401, "UNAUTHORIZED", "invalid or missing API key")
+	}
+	return nil
+}
+
+// adminRefreshHandler drops every cached SSM value and pooled client, then
+// reconnects the default broker with freshly loaded credentials.
+func adminRefreshHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "POST" {
+		return errorRespStatus(405, "Use POST")
+	}
+	if apiErr := requireAdmin(request); apiErr != nil {
+		return apiErr.response()
+	}
+
+	mqttclient.ClearCache()
+	mqttclient.ResetPool()
+
+	resp := map[string]interface{}{
+		"refreshedAt": time.Now().UTC().Format(time.RFC3339),
+		"reconnected": true,
+	}
+	if _, release, apiErr := acquireClient(mqttCreds{}, "", nil); apiErr != nil {
+		resp["reconnected"] = false
+		resp["error"] = apiErr.Message
+	} else {
+		release()
+	}
+	return jsonResp(200, resp)
+}
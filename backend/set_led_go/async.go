@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// Async publishes return 202 before the broker is contacted. The validated
+// publish is handed to a second invocation of this function (an Event
+// invocation of AWS_LAMBDA_FUNCTION_NAME), which publishes it and posts the
+// callback; Lambda freezes the first invocation's environment as soon as it
+// responds, so nothing may run there after the 202. Lambda retries a second
+// invocation that crashes or times out, so async delivery is at-least-once.
+// Off Lambda the job runs in the background of the same process instead.
+// With JOBS_TABLE set, each job's status is also stored for GET /jobs/{id}.
+
+// asyncResult is what a callback_url receives once the publish finishes.
+type asyncResult struct {
+	JobID string `json:"jobId"`
+	Topic string `json:"topic"`
+	OK    bool   `json:"ok"`
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validateCallbackURL only accepts absolute https URLs.
+func validateCallbackURL(raw string) *apiError {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return newAPIError(400, "INVALID_CALLBACK_URL", "'callback_url' must be an absolute https URL")
+	}
+	return nil
+}
+
+// asyncJob is the event that hands an async publish to the invocation that
+// performs it.
+type asyncJob struct {
+	JobID       string          `json:"jobId"`
+	CallbackURL string          `json:"callbackUrl,omitempty"`
+	Message     outboundMessage `json:"message"`
+	Creds       mqttCreds       `json:"creds"`
+	// Request is the original request body, kept for dead-lettering
+	Request string `json:"request"`
+}
+
+// asyncInvoker starts the invocation that runs an async job.
+type asyncInvoker interface {
+	invokeAsync(ctx context.Context, job asyncJob) error
+}
+
+// openAsyncInvoker returns the invoker for this function, or nil when not
+// running on Lambda.
+var openAsyncInvoker = func() asyncInvoker {
+	name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	if name == "" {
+		return nil
+	}
+	return lambdaInvoker{lambda: lambda.New(session.Must(session.NewSession())), function: name}
+}
+
+type lambdaInvoker struct {
+	lambda   lambdaiface.LambdaAPI
+	function string
+}
+
+func (l lambdaInvoker) invokeAsync(ctx context.Context, job asyncJob) error {
+	payload, err := json.Marshal(map[string]asyncJob{"asyncJob": job})
+	if err != nil {
+		return err
+	}
+	_, err = l.lambda.InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(l.function),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	return err
+}
+
+// publishAsync hands job to its own invocation and records it as queued.
+func publishAsync(ctx context.Context, job asyncJob) *apiError {
+	store := openJobStore()
+	recordJob(store, job.JobID, job.Message.Topic, jobQueued, nil)
+	invoker := openAsyncInvoker()
+	if invoker == nil {
+		deadline := time.Now().Add(envDuration("ASYNC_MAX_DURATION", 30*time.Second))
+		backgroundWork.Add(1)
+		go func() {
+			defer backgroundWork.Done()
+			bgCtx, cancel := context.WithDeadline(context.Background(), deadline)
+			defer cancel()
+			runAsyncJob(bgCtx, job)
+		}()
+		return nil
+	}
+	if err := invoker.invokeAsync(ctx, job); err != nil {
+		logger.Error("async handoff failed", "jobId", job.JobID, "error", err.Error())
+		apiErr := newAPIError(502, "ASYNC_HANDOFF_FAILED", "Queueing the async publish failed: "+err.Error())
+		recordJob(store, job.JobID, job.Message.Topic, jobFailed, apiErr)
+		return apiErr
+	}
+	return nil
+}
+
+// runAsyncJob publishes job until ctx's deadline (the Lambda timeout),
+// records its status and posts the outcome to its callback URL when one is
+// given. A failed publish is not retried, so it is dead-lettered along with
+// the original request body.
+func runAsyncJob(ctx context.Context, job asyncJob) {
+	msg := job.Message
+	result := asyncResult{JobID: job.JobID, Topic: msg.Topic, OK: true}
+	status := jobPublished
+	client, release, apiErr := acquireClient(job.Creds, msg.Topic, nil)
+	if apiErr == nil {
+		_, apiErr = publishMessage(client, msg)
+		release()
+	}
+	if apiErr != nil {
+		result.OK, result.Code, result.Error = false, apiErr.Code, apiErr.Message
+		status = jobFailed
+		if apiErr.Code == "COMMAND_EXPIRED" {
+			status = jobExpired
+		}
+		if status == jobFailed {
+			deadLetterPublish(deadLetter{Request: job.Request, Source: "async", MessageID: job.JobID, Attempts: 1,
+				Status: apiErr.Status, Code: apiErr.Code, Error: apiErr.Message})
+		}
+	}
+	recordJob(openJobStore(), job.JobID, msg.Topic, status, apiErr)
+	logger.Info("async publish finished", "jobId", job.JobID, "topic", msg.Topic, "ok", result.OK, "error", result.Error)
+
+	if job.CallbackURL != "" {
+		if err := postCallback(ctx, job.CallbackURL, result); err != nil {
+			logger.Warn("async callback failed", "jobId", job.JobID, "error", err.Error())
+		}
+	}
+}
+
+func postCallback(ctx context.Context, callbackURL string, result asyncResult) error {
+	payload, _ := json.Marshal(result)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: envDuration("CALLBACK_TIMEOUT", 3*time.Second)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+)
+
+// fakeLambda records the Event invocations of the async invoker.
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+	inputs []*lambda.InvokeInput
+	err    error
+}
+
+func (f *fakeLambda) InvokeWithContext(_ aws.Context, in *lambda.InvokeInput, _ ...request.Option) (*lambda.InvokeOutput, error) {
+	f.inputs = append(f.inputs, in)
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(202)}, f.err
+}
+
+// useInvoker hands async jobs to f for the rest of t.
+func useInvoker(t *testing.T, f *fakeLambda) {
+	t.Helper()
+	prev := openAsyncInvoker
+	openAsyncInvoker = func() asyncInvoker { return lambdaInvoker{lambda: f, function: "set-led"} }
+	t.Cleanup(func() { openAsyncInvoker = prev })
+}
+
+// callbackServer collects the async results posted to it.
+func callbackServer(t *testing.T) (string, <-chan asyncResult) {
+	t.Helper()
+	results := make(chan asyncResult, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result asyncResult
+		json.NewDecoder(r.Body).Decode(&result)
+		results <- result
+	}))
+	prev := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultTransport = prev
+		srv.Close()
+	})
+	return srv.URL, results
+}
+
+func TestAsyncPublishRunsInASecondInvocation(t *testing.T) {
+	broker := newTestBroker(t)
+	invocations := &fakeLambda{}
+	useInvoker(t, invocations)
+	url, results := callbackServer(t)
+
+	resp := post(t, "/", `{"topic":"devices/lamp/led","message":"on","async":true,"callback_url":"`+url+`"}`, nil)
+	if resp.StatusCode != 202 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	jobID := decodeBody(t, resp)["job_id"]
+	if len(invocations.inputs) != 1 {
+		t.Fatalf("%d invocations, want 1", len(invocations.inputs))
+	}
+	in := invocations.inputs[0]
+	if aws.StringValue(in.FunctionName) != "set-led" || aws.StringValue(in.InvocationType) != lambda.InvocationTypeEvent {
+		t.Errorf("invoked %s as %s, want an Event invocation of set-led", aws.StringValue(in.FunctionName), aws.StringValue(in.InvocationType))
+	}
+	// Nothing may happen in the first invocation once it has answered
+	backgroundWork.Wait()
+	if n := len(broker.published()); n != 0 {
+		t.Fatalf("%d messages published before the second invocation", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := dispatch(ctx, in.Payload); err != nil {
+		t.Fatalf("second invocation: %v", err)
+	}
+	if sent := broker.sentTo("devices/lamp/led"); len(sent) != 1 || string(sent[0].payload) != "on" {
+		t.Errorf("published %v, want the command once", sent)
+	}
+	select {
+	case result := <-results:
+		if result.JobID != jobID || !result.OK {
+			t.Errorf("callback %+v, want job %v ok", result, jobID)
+		}
+	default:
+		t.Error("the second invocation posted no callback")
+	}
+}
+
+func TestAsyncHandoffFailure(t *testing.T) {
+	broker := newTestBroker(t)
+	useInvoker(t, &fakeLambda{err: errors.New("throttled")})
+
+	resp := post(t, "/", `{"topic":"devices/lamp/led","message":"on","async":true}`, nil)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 502 || code != "ASYNC_HANDOFF_FAILED" {
+		t.Errorf("status %d code %v, want 502 ASYNC_HANDOFF_FAILED", resp.StatusCode, code)
+	}
+	backgroundWork.Wait()
+	if n := len(broker.published()); n != 0 {
+		t.Errorf("%d messages published", n)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// auditEvent records one publish attempt, whatever its outcome. With
+// AUDIT_TABLE set it is stored in DynamoDB keyed by topic and timestamp;
+// ExpiresAt is the table's TTL attribute. Successful publishes are also
+// announced on AUDIT_TOPIC, so the broker does not carry a second message for
+// every rejected or failed one.
+type auditEvent struct {
+	Topic        string `json:"topic" dynamodbav:"topic"`
+	Timestamp    string `json:"timestamp" dynamodbav:"timestamp"`
+	Source       string `json:"source,omitempty" dynamodbav:"source,omitempty"`
+	Outcome      string `json:"outcome" dynamodbav:"outcome"`
+	Code         string `json:"code,omitempty" dynamodbav:"code,omitempty"`
+	QoS          int    `json:"qos" dynamodbav:"qos"`
+	Retained     bool   `json:"retained" dynamodbav:"retained"`
+	PayloadBytes int    `json:"payloadBytes" dynamodbav:"payloadBytes"`
+	LatencyMs    int64  `json:"latencyMs" dynamodbav:"latencyMs"`
+	MessageID    string `json:"messageId,omitempty" dynamodbav:"messageId,omitempty"`
+	ExpiresAt    int64  `json:"-" dynamodbav:"expiresAt,omitempty"`
+}
+
+// newAuditEvent describes msg's publish attempt. The outcome uses the job
+// statuses: published, failed, or expired for a command dropped as stale.
+func newAuditEvent(msg outboundMessage, apiErr *apiError, latency time.Duration, now time.Time) auditEvent {
+	ev := auditEvent{
+		Topic:        msg.Topic,
+		Timestamp:    now.UTC().Format(time.RFC3339Nano),
+		Source:       msg.Source,
+		Outcome:      jobPublished,
+		QoS:          msg.QoS,
+		Retained:     msg.Retained,
+		PayloadBytes: len(msg.Payload),
+		LatencyMs:    latency.Milliseconds(),
+		MessageID:    msg.MessageID,
+	}
+	if apiErr != nil {
+		ev.Outcome, ev.Code = jobFailed, apiErr.Code
+		if apiErr.Code == "COMMAND_EXPIRED" {
+			ev.Outcome = jobExpired
+		}
+	}
+	return ev
+}
+
+// recordAudit stores the audit event for one attempt and, when it succeeded,
+// publishes it. Neither sink is waited on, so the audit trail never delays or
+// fails the publish it records.
+func recordAudit(client mqtt.Client, msg outboundMessage, apiErr *apiError, latency time.Duration) {
+	ev := newAuditEvent(msg, apiErr, latency, time.Now())
+	if apiErr == nil {
+		publishAudit(client, ev)
+	}
+
+	store := openAuditStore()
+	if store == nil {
+		return
+	}
+	ev.ExpiresAt = time.Now().Add(envDuration("AUDIT_TTL", 30*24*time.Hour)).Unix()
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		if err := store.putAudit(ev); err != nil {
+			logger.Warn("audit record not stored", "topic", ev.Topic, "outcome", ev.Outcome, "error", err.Error())
+		}
+	}()
+}
+
+// publishAudit sends ev on client to AUDIT_TOPIC at QoS 0 without waiting.
+func publishAudit(client mqtt.Client, ev auditEvent) {
+	auditTopic := os.Getenv("AUDIT_TOPIC")
+	if auditTopic == "" || ev.Topic == auditTopic {
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	client.Publish(auditTopic, 0, false, payload)
+}
+
+// auditStore persists audit events.
+type auditStore interface {
+	putAudit(ev auditEvent) error
+}
+
+// openAuditStore returns the configured store, or nil when AUDIT_TABLE is
+// unset.
+var openAuditStore = func() auditStore {
+	table := os.Getenv("AUDIT_TABLE")
+	if table == "" {
+		return nil
+	}
+	return dynamoAuditStore{db: dynamodb.New(session.Must(session.NewSession())), table: table}
+}
+
+type dynamoAuditStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (s dynamoAuditStore) putAudit(ev auditEvent) error {
+	item, err := dynamodbattribute.MarshalMap(ev)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item})
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// memAuditStore records the audit events it is given.
+type memAuditStore struct {
+	mu     sync.Mutex
+	events []auditEvent
+}
+
+func (s *memAuditStore) putAudit(ev auditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+	return nil
+}
+
+// newMemAuditStore installs a memAuditStore for the duration of t.
+func newMemAuditStore(t *testing.T) *memAuditStore {
+	t.Helper()
+	s := &memAuditStore{}
+	prev := openAuditStore
+	openAuditStore = func() auditStore { return s }
+	t.Cleanup(func() { openAuditStore = prev })
+	return s
+}
+
+// stored returns the events stored so far, once background writes finish.
+func (s *memAuditStore) stored() []auditEvent {
+	backgroundWork.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]auditEvent{}, s.events...)
+}
+
+// failingClient fails every publish to topic and records the rest.
+type failingClient struct {
+	*recordingClient
+	topic string
+}
+
+func (c *failingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if topic == c.topic {
+		return failedToken(errors.New("not authorized"))
+	}
+	return c.recordingClient.Publish(topic, qos, retained, payload)
+}
+
+func TestAuditRecordsSuccess(t *testing.T) {
+	t.Setenv("AUDIT_TOPIC", "audit/publishes")
+	broker := newTestBroker(t)
+	store := newMemAuditStore(t)
+
+	resp := post(t, "/set-led", `{"topic":"devices/lamp/led","message":"on","qos":1,"retain":true,"source":"kitchen"}`, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	events := store.stored()
+	if len(events) != 1 {
+		t.Fatalf("%d audit events stored, want 1", len(events))
+	}
+	ev := events[0]
+	if ev.Topic != "devices/lamp/led" || ev.Outcome != jobPublished || ev.Code != "" || ev.QoS != 1 || !ev.Retained || ev.Source != "kitchen" {
+		t.Errorf("stored %+v", ev)
+	}
+	if ev.PayloadBytes == 0 || ev.Timestamp == "" || ev.ExpiresAt == 0 {
+		t.Errorf("stored %+v, want payload size, timestamp and expiry set", ev)
+	}
+
+	announced := broker.sentTo("audit/publishes")
+	if len(announced) != 1 {
+		t.Fatalf("%d audit messages published, want 1", len(announced))
+	}
+	var published auditEvent
+	if err := json.Unmarshal(announced[0].payload, &published); err != nil || published.Topic != ev.Topic || published.Outcome != jobPublished {
+		t.Errorf("published audit %s (%v)", announced[0].payload, err)
+	}
+}
+
+func TestAuditRecordsFailureWithoutPublishing(t *testing.T) {
+	t.Setenv("AUDIT_TOPIC", "audit/publishes")
+	broker := newTestBroker(t)
+	store := newMemAuditStore(t)
+	recorder := &recordingClient{memClient: broker.client(), broker: broker}
+	client := &failingClient{recordingClient: recorder, topic: "devices/lamp/led"}
+
+	_, apiErr := publishMessage(client, outboundMessage{Topic: "devices/lamp/led", Payload: "on", QoS: 1})
+	if apiErr == nil {
+		t.Fatal("publish succeeded")
+	}
+	events := store.stored()
+	if len(events) != 1 || events[0].Outcome != jobFailed || events[0].Code != "PUBLISH_FAILED" {
+		t.Fatalf("stored %+v, want one failed PUBLISH_FAILED event", events)
+	}
+	if n := len(broker.sentTo("audit/publishes")); n != 0 {
+		t.Errorf("%d audit messages published for a failed publish, want 0", n)
+	}
+}
+
+func TestAuditRecordsExpiredCommand(t *testing.T) {
+	t.Setenv("AUDIT_TOPIC", "audit/publishes")
+	broker := newTestBroker(t)
+	store := newMemAuditStore(t)
+
+	// A command that went stale while waiting for its connection
+	msg := outboundMessage{Topic: "devices/lamp/led", Payload: "on", ExpiresAt: time.Now().Add(-time.Second)}
+	client := &recordingClient{memClient: broker.client(), broker: broker}
+	if _, apiErr := publishMessage(client, msg); apiErr == nil || apiErr.Code != "COMMAND_EXPIRED" {
+		t.Fatalf("apiErr = %+v, want COMMAND_EXPIRED", apiErr)
+	}
+	events := store.stored()
+	if len(events) != 1 || events[0].Outcome != jobExpired || events[0].Code != "COMMAND_EXPIRED" {
+		t.Fatalf("stored %+v, want one expired event", events)
+	}
+	if n := len(broker.published()); n != 0 {
+		t.Errorf("%d messages published, want 0", n)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// backpressure backs every publish in the container off once the broker has
+// timed out BACKPRESSURE_TIMEOUTS (default 3) publishes in a row, rather than
+// letting concurrent invocations pile more work onto a struggling broker.
+// For BACKPRESSURE_BACKOFF (default 2s) publishes fail fast with a 503 and
+// Retry-After; any successful publish resets the count.
+type backpressure struct {
+	mu       sync.Mutex
+	timeouts int
+	until    time.Time
+}
+
+var publishBackpressure = &backpressure{}
+
+// active reports whether publishes are backed off at now, and for how much
+// longer.
+func (b *backpressure) active(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.until) {
+		return b.until.Sub(now), true
+	}
+	return 0, false
+}
+
+// record notes a publish outcome: timedOut for a broker acknowledgement that
+// never came, false for success. Other failures should not be recorded.
+func (b *backpressure) record(timedOut bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !timedOut {
+		b.timeouts = 0
+		return
+	}
+	b.timeouts++
+	if b.timeouts >= envInt("BACKPRESSURE_TIMEOUTS", 3) {
+		backoff := envDuration("BACKPRESSURE_BACKOFF", 2*time.Second)
+		b.until = now.Add(backoff)
+		b.timeouts = 0
+		logger.Warn("broker backpressure: backing off publishes", "backoff", backoff.String())
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// BatchMessage is one entry of a multi-message request.
+type BatchMessage struct {
+	Topic   string       `json:"topic"`
+	Message messageValue `json:"message"`
+	// MessageEncoding "base64" sends a binary message
+	MessageEncoding string `json:"message_encoding,omitempty"`
+	QoS             *int   `json:"qos,omitempty"`
+	Retain          bool   `json:"retain,omitempty"`
+}
+
+// batchResult reports the outcome of one batch entry, in request order.
+type batchResult struct {
+	Topic string `json:"topic"`
+	OK    bool   `json:"ok"`
+	// QoS is the effective QoS after QOS_POLICY
+	QoS   int    `json:"qos"`
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	latency time.Duration
+}
+
+// publishBatch publishes every entry over one connection per broker, with at most
+// BATCH_CONCURRENCY publishes in flight. Any failed entry turns the response
+// into a 207.
+func publishBatch(request events.APIGatewayProxyRequest, body RequestBody) events.APIGatewayProxyResponse {
+	if max := envInt("MAX_BATCH_SIZE", 100); len(body.Messages) > max {
+		return errorRespCode(400, "BATCH_TOO_LARGE", fmt.Sprintf("at most %d messages per request", max))
+	}
+
+	source := requestSource(request, body.Source)
+	msgs := make([]outboundMessage, len(body.Messages))
+	for i, m := range body.Messages {
+		if m.Topic == "" || m.Message == "" {
+			return errorRespStatus(400, fmt.Sprintf("messages[%d]: missing 'topic' or 'message'", i))
+		}
+		topic, apiErr := placeTopic(request, m.Topic)
+		var message string
+		if apiErr == nil {
+			message, apiErr = decodeMessage(m.Message, m.MessageEncoding)
+		}
+		var qos int
+		if apiErr == nil {
+			qos, apiErr = parseQoS(m.QoS)
+		}
+		if apiErr == nil {
+			apiErr = validateTopic(topic)
+		}
+		if apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, fmt.Sprintf("messages[%d]: %s", i, apiErr.Message))
+		}
+		msgs[i] = outboundMessage{Topic: topic, QoS: qos, Retained: m.Retain, Payload: message, Source: source, UseTopicAlias: body.UseTopicAlias}
+	}
+	return sendBatch(request, msgs, nil)
+}
+
+// publishBroadcast publishes one message to every entry of 'topics'.
+// Repeated topics are collapsed to their first occurrence unless the caller
+// sets allow_duplicate_topics.
+func publishBroadcast(request events.APIGatewayProxyRequest, body RequestBody) events.APIGatewayProxyResponse {
+	if body.Topic != "" || len(body.Messages) > 0 {
+		return errorRespStatus(400, "Use 'topics' on its own, without 'topic' or 'messages'")
+	}
+	if body.Message == "" {
+		return errorRespStatus(400, "Missing 'message' in request body")
+	}
+
+	// Tighter than MAX_BATCH_SIZE: one payload to many topics is the cheap
+	// request to abuse. Counted before collapsing duplicates, so a huge list
+	// of repeats is refused without being walked.
+	if max := envInt("MAX_BROADCAST_TOPICS", 50); len(body.Topics) > max {
+		return errorRespCode(400, "TOO_MANY_TOPICS", fmt.Sprintf("at most %d topics per broadcast", max))
+	}
+	message, apiErr := decodeMessage(body.Message, body.MessageEncoding)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	qos, apiErr := parseQoS(body.QoS)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	topics := make([]string, 0, len(body.Topics))
+	seen := make(map[string]bool, len(body.Topics))
+	for i, t := range body.Topics {
+		if t == "" {
+			return errorRespStatus(400, fmt.Sprintf("topics[%d]: empty topic", i))
+		}
+		// Topics that normalize alike are the same topic on the broker
+		t, apiErr := placeTopic(request, t)
+		if apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, fmt.Sprintf("topics[%d]: %s", i, apiErr.Message))
+		}
+		if apiErr := validateTopic(t); apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, fmt.Sprintf("topics[%d]: %s: %s", i, t, apiErr.Message))
+		}
+		if seen[t] && !body.AllowDuplicateTopics {
+			continue
+		}
+		seen[t] = true
+		topics = append(topics, t)
+	}
+
+	source := requestSource(request, body.Source)
+	msgs := make([]outboundMessage, len(topics))
+	for i, topic := range topics {
+		msgs[i] = outboundMessage{Topic: topic, QoS: qos, Retained: body.Retain, Payload: message, Source: source}
+	}
+	return sendBatch(request, msgs, map[string]interface{}{
+		"duplicatesCollapsed": len(body.Topics) - len(topics),
+	})
+}
+
+// sendBatch authorizes and publishes validated msgs, answering with
+// batchResponse.
+func sendBatch(request events.APIGatewayProxyRequest, msgs []outboundMessage, extra map[string]interface{}) events.APIGatewayProxyResponse {
+	assignMessageIDs(request, msgs)
+	topics := make([]string, len(msgs))
+	for i, m := range msgs {
+		topics[i] = m.Topic
+	}
+	if apiErr := guardRepublish(request, topics...); apiErr != nil {
+		return apiErr.response()
+	}
+	if apiErr := authorizePublishToken(request, topics...); apiErr != nil {
+		return apiErr.response()
+	}
+	if apiErr := authorizeDevices(request, msgs...); apiErr != nil {
+		return apiErr.response()
+	}
+
+	creds, apiErr := delegatedCreds(request)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	results, apiErr := publishAll(creds, msgs)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	return batchResponse(results, extra)
+}
+
+// publishAll publishes msgs with at most BATCH_CONCURRENCY in flight,
+// returning per-message results in order. One connection is acquired per
+// broker route the topics resolve to.
+func publishAll(creds mqttCreds, msgs []outboundMessage) ([]batchResult, *apiError) {
+	byRoute := map[string]mqtt.Client{}
+	clients := make([]mqtt.Client, len(msgs))
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	for i, m := range msgs {
+		msgs[i].QoS = topicQoS(m.Topic, m.QoS)
+		route, err := routeFor(m.Topic)
+		if err != nil {
+			return nil, newAPIError(500, "CONFIG_ERROR", err.Error())
+		}
+		client, ok := byRoute[route.key()]
+		if !ok {
+			var release func()
+			var apiErr *apiError
+			if client, release, apiErr = acquireClient(creds, m.Topic, nil); apiErr != nil {
+				return nil, apiErr
+			}
+			byRoute[route.key()] = client
+			releases = append(releases, release)
+		}
+		clients[i] = client
+	}
+
+	return runBounded(len(msgs), envInt("BATCH_CONCURRENCY", 10), func(i int) batchResult {
+		r := batchResult{Topic: msgs[i].Topic, OK: true, QoS: msgs[i].QoS}
+		start := time.Now()
+		if _, apiErr := publishMessage(clients[i], msgs[i]); apiErr != nil {
+			r.OK, r.Code, r.Error = false, apiErr.Code, apiErr.Message
+		}
+		r.latency = time.Since(start)
+		return r
+	}), nil
+}
+
+// batchResponse summarises results, answering 207 when any entry failed.
+// extra fields are merged into the body.
+func batchResponse(results []batchResult, extra map[string]interface{}) events.APIGatewayProxyResponse {
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			failed++
+		}
+	}
+	status := 200
+	if failed > 0 {
+		status = 207
+	}
+	body := map[string]interface{}{
+		"results":   results,
+		"published": len(results) - failed,
+		"failed":    failed,
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+	return jsonResp(status, body)
+}
+
+// runBounded calls fn for 0..n-1 with at most limit calls in flight and
+// returns the results in index order.
+func runBounded[T any](n, limit int, fn func(i int) T) []T {
+	if limit <= 0 {
+		limit = 1
+	}
+	if limit > n {
+		limit = n
+	}
+
+	results := make([]T, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < limit; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
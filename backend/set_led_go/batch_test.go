@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// peakClient is a publisher that holds each publish briefly and tracks how
+// many were in flight at once.
+type peakClient struct {
+	*memClient
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (c *peakClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	c.inFlight++
+	c.peak = max(c.peak, c.inFlight)
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return c.memClient.Publish(topic, qos, retained, payload)
+}
+
+func TestRunBoundedKeepsOrderAndLimit(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	got := runBounded(50, 4, func(i int) int {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return i
+	})
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("results[%d] = %d, want results in index order", i, v)
+		}
+	}
+	if peak > 4 {
+		t.Errorf("peak concurrency %d exceeds the limit 4", peak)
+	}
+}
+
+func TestBatchConcurrencyNeverExceedsLimit(t *testing.T) {
+	t.Setenv("BATCH_CONCURRENCY", "3")
+	newTestBroker(t)
+	client := &peakClient{memClient: newMemBroker().client()}
+	acquireClient = func(mqttCreds, string, *requestTimings) (mqtt.Client, func(), *apiError) {
+		return client, func() {}, nil
+	}
+
+	entries := make([]string, 20)
+	for i := range entries {
+		entries[i] = fmt.Sprintf(`{"topic":"esp8266/commands/led%d","message":"on"}`, i)
+	}
+	resp := post(t, "/set-led", `{"messages":[`+strings.Join(entries, ",")+`]}`, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if client.peak > 3 {
+		t.Errorf("peak concurrency %d exceeds BATCH_CONCURRENCY=3", client.peak)
+	}
+	if client.peak < 2 {
+		t.Errorf("peak concurrency %d: publishes were not run concurrently", client.peak)
+	}
+
+	results := decodeBody(t, resp)["results"].([]interface{})
+	for i, r := range results {
+		if topic := r.(map[string]interface{})["topic"]; topic != fmt.Sprintf("esp8266/commands/led%d", i) {
+			t.Errorf("results[%d] is for %v, want results in request order", i, topic)
+		}
+	}
+}
+
+func broadcastBody(topics []string, extra string) string {
+	quoted := make([]string, len(topics))
+	for i, t := range topics {
+		quoted[i] = strconv.Quote(t)
+	}
+	return `{"topics":[` + strings.Join(quoted, ",") + `],"message":"on"` + extra + `}`
+}
+
+func TestBroadcastTopicLimit(t *testing.T) {
+	t.Setenv("MAX_BROADCAST_TOPICS", "3")
+	broker := newTestBroker(t)
+
+	resp := post(t, "/set-led", broadcastBody([]string{"a/1", "a/2", "a/3"}, ""), nil)
+	if resp.StatusCode != 200 || len(broker.published()) != 3 {
+		t.Fatalf("at the limit: status %d, %d published: %s", resp.StatusCode, len(broker.published()), resp.Body)
+	}
+
+	// Repeats count towards the limit even though they would collapse
+	resp = post(t, "/set-led", broadcastBody([]string{"a/1", "a/1", "a/1", "a/1"}, ""), nil)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 400 || code != "TOO_MANY_TOPICS" {
+		t.Errorf("just over the limit: status %d code %v, want 400 TOO_MANY_TOPICS", resp.StatusCode, code)
+	}
+	if n := len(broker.published()); n != 3 {
+		t.Errorf("%d published after the refused broadcast, want 3", n)
+	}
+}
+
+func TestBroadcastValidatesEachTopic(t *testing.T) {
+	newTestBroker(t)
+	tests := []struct {
+		name   string
+		topics []string
+		want   string
+	}{
+		{"empty", []string{"a/1", "a/1", ""}, "topics[2]: empty topic"},
+		{"wildcard", []string{"a/1", "a/#"}, "topics[1]: a/#"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := post(t, "/set-led", broadcastBody(tt.topics, ""), nil)
+			msg, _ := decodeBody(t, resp)["error"].(string)
+			if resp.StatusCode != 400 || !strings.HasPrefix(msg, tt.want) {
+				t.Errorf("status %d error %q, want 400 starting %q", resp.StatusCode, msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcastDecodesMessage(t *testing.T) {
+	broker := newTestBroker(t)
+	resp := post(t, "/set-led", `{"topics":["a/1","a/2"],"message":"AAH/","message_encoding":"base64"}`, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	for _, m := range broker.published() {
+		if string(m.payload) != "\x00\x01\xff" {
+			t.Errorf("%s got payload %q, want the decoded bytes", m.topic, m.payload)
+		}
+	}
+
+	resp = post(t, "/set-led", `{"topics":["a/1"],"message":"not base64!","message_encoding":"base64"}`, nil)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 400 || code != "INVALID_BASE64" {
+		t.Errorf("status %d code %v, want 400 INVALID_BASE64", resp.StatusCode, code)
+	}
+}
+
+func TestBroadcastCollapsesTopicsThatNormalizeAlike(t *testing.T) {
+	t.Setenv("TOPIC_STRIP_TRAILING_SLASH", "true")
+	t.Setenv("TOPIC_LOWERCASE", "true")
+	broker := newTestBroker(t)
+
+	resp := post(t, "/set-led", broadcastBody([]string{"a/b/", "A/B", "a/c"}, ""), nil)
+	body := decodeBody(t, resp)
+	if resp.StatusCode != 200 || body["duplicates_collapsed"] != 1.0 {
+		t.Errorf("status %d body %v, want one duplicate collapsed", resp.StatusCode, body)
+	}
+	if n := len(broker.sentTo("a/b")); n != 1 {
+		t.Errorf("%d messages to a/b, want 1", n)
+	}
+}
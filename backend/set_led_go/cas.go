@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// casLocks serializes compare-and-set publishes per topic within this
+// instance, so two concurrent requests here cannot both pass the check.
+// Across instances the check narrows, but cannot close, the race window.
+var casLocks sync.Map // topic → *sync.Mutex
+
+func lockTopic(topic string) func() {
+	mu, _ := casLocks.LoadOrStore(topic, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// currentRetained reads topic's retained payload; ok is false when there is
+// none.
+func currentRetained(client mqtt.Client, topic string) (payload string, ok bool, err error) {
+	items, err := retainedSnapshot(client, topic)
+	if err != nil || len(items) == 0 {
+		return "", false, err
+	}
+	return items[len(items)-1].Message, true, nil
+}
+
+// compareRetained implements if_current_equals: the publish may go ahead
+// only while topic's retained payload equals want, where "" means there must
+// be no retained message yet. current is the actual value, nil when absent.
+func compareRetained(client mqtt.Client, topic, want string) (matched bool, current interface{}, apiErr *apiError) {
+	payload, ok, err := currentRetained(client, topic)
+	if errors.Is(err, errSubscriptionLimit) {
+		return false, nil, newAPIError(429, "SUBSCRIPTION_LIMIT", "Too many concurrent subscriptions; retry shortly")
+	}
+	if err != nil {
+		return false, nil, newAPIError(502, "SUBSCRIBE_FAILED", "Reading current state failed: "+err.Error())
+	}
+	if ok {
+		current = payload
+	}
+	return payload == want, current, nil
+}
+
+// conflictResp is the 409 for a failed compare-and-set, carrying the current
+// retained value so the caller can retry against it.
+func conflictResp(topic string, current interface{}) events.APIGatewayProxyResponse {
+	return jsonResp(409, map[string]interface{}{
+		"error":   "retained state of " + topic + " does not match if_current_equals",
+		"code":    "CONFLICT",
+		"current": current,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Response field names are written in camelCase in the code. RESPONSE_CASE
+// selects how they are sent: "snake" (the default) rewrites every object key
+// to snake_case, "camel" sends them unchanged.
+
+// dataMap is a response object keyed by data, such as device IDs, rather than
+// by field names; its keys are never rewritten.
+type dataMap map[string]string
+
+func snakeResponses() bool {
+	return !strings.EqualFold(os.Getenv("RESPONSE_CASE"), "camel")
+}
+
+// snakeCaseKeys rewrites the object keys of the JSON document body to
+// snake_case, leaving values (including echoed messages) untouched.
+func snakeCaseKeys(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snakeCaseValue(v))
+}
+
+func snakeCaseValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[toSnake(k)] = snakeCaseValue(val)
+		}
+		return out
+	case []interface{}:
+		for i, val := range t {
+			t[i] = snakeCaseValue(val)
+		}
+		return t
+	}
+	return v
+}
+
+// toSnake converts a camelCase name such as "payloadBytes" to "payload_bytes".
+func toSnake(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// chunkEnvelope wraps one chunk for MQTT 3.1.1 devices, which have no user
+// properties to carry the reassembly metadata. Data is base64 so a chunk
+// boundary may fall inside a multi-byte character.
+type chunkEnvelope struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+	Data  string `json:"data"`
+}
+
+// chunkSize is the request's chunk_size, else CHUNK_SIZE (default 4096 bytes).
+func chunkSize(requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	if size := envInt("CHUNK_SIZE", 4096); size > 0 {
+		return size
+	}
+	return 4096
+}
+
+// splitPayload cuts payload into size-byte chunks; an empty payload is one
+// empty chunk.
+func splitPayload(payload string, size int) []string {
+	chunks := make([]string, 0, len(payload)/size+1)
+	for len(payload) > size {
+		chunks = append(chunks, payload[:size])
+		payload = payload[size:]
+	}
+	return append(chunks, payload)
+}
+
+// publishChunks publishes msg's payload as ordered chunks on client, each
+// acknowledged before the next is sent so devices receive them in order. On
+// MQTT 5 a chunk is the raw bytes with chunk-id, chunk-index and chunk-total
+// user properties; on 3.1.1 it is a chunkEnvelope. The message is tagged and
+// audited once, as a whole, so reassembly yields what a plain publish would
+// have sent. Returns the chunk count.
+func publishChunks(client mqtt.Client, msg outboundMessage, size int) (n int, apiErr *apiError) {
+	attemptStart := time.Now()
+	defer func() { recordAudit(client, msg, apiErr, time.Since(attemptStart)) }()
+
+	if apiErr := publishGate(msg); apiErr != nil {
+		return 0, apiErr
+	}
+	msg = decorateMessage(client, msg)
+
+	_, v5 := client.(mqttclient.PropsPublisher)
+	parts := splitPayload(msg.Payload, size)
+	for i, part := range parts {
+		chunk := msg
+		if v5 {
+			chunk.Payload = part
+			chunk.Props.UserProperties = append(append([]mqttclient.UserProperty(nil), msg.Props.UserProperties...),
+				mqttclient.UserProperty{Key: "chunk-id", Value: msg.MessageID},
+				mqttclient.UserProperty{Key: "chunk-index", Value: strconv.Itoa(i)},
+				mqttclient.UserProperty{Key: "chunk-total", Value: strconv.Itoa(len(parts))},
+			)
+		} else {
+			envelope, _ := json.Marshal(chunkEnvelope{
+				ID:    msg.MessageID,
+				Index: i,
+				Total: len(parts),
+				Data:  base64.StdEncoding.EncodeToString([]byte(part)),
+			})
+			chunk.Payload = string(envelope)
+		}
+		if _, apiErr := sendMessage(client, chunk); apiErr != nil {
+			apiErr.Message = "chunk " + strconv.Itoa(i) + " of " + strconv.Itoa(len(parts)) + ": " + apiErr.Message
+			return i, apiErr
+		}
+	}
+	return len(parts), nil
+}
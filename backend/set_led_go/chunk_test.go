@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// chunkedBody is a chunked publish of a JSON payload well over size bytes.
+func chunkedBody(size int) string {
+	return `{"topic":"devices/lamp/fw","payload":{"blob":"` + strings.Repeat("x", 5*size) + `"},` +
+		`"chunked":true,"chunk_size":` + strconv.Itoa(size) + `,"source":"ci","qos":1}`
+}
+
+// checkReassembled verifies a reassembled chunked payload carries each tag
+// once, as a plain publish would.
+func checkReassembled(t *testing.T, payload string) {
+	t.Helper()
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+		t.Fatalf("reassembled payload is not JSON: %v\n%s", err, payload)
+	}
+	for _, key := range []string{"_source", "_ts", "_msgId"} {
+		if n := strings.Count(payload, `"`+key+`"`); n != 1 {
+			t.Errorf("reassembled payload has %s %d times, want once", key, n)
+		}
+	}
+}
+
+func TestChunkedPublishV3(t *testing.T) {
+	t.Setenv("INJECT_TIMESTAMP", "true")
+	broker := newTestBroker(t)
+	audits := newMemAuditStore(t)
+
+	resp := post(t, "/set-led", chunkedBody(16), nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	sent := broker.sentTo("devices/lamp/fw")
+	if got := decodeBody(t, resp)["chunks"]; got != float64(len(sent)) || len(sent) < 5 {
+		t.Fatalf("response reports %v chunks, %d sent", got, len(sent))
+	}
+
+	var data []byte
+	var id string
+	for i, m := range sent {
+		var env chunkEnvelope
+		if err := json.Unmarshal(m.payload, &env); err != nil {
+			t.Fatalf("chunk %d is not an envelope: %s", i, m.payload)
+		}
+		if env.Index != i || env.Total != len(sent) || env.ID == "" || (id != "" && env.ID != id) {
+			t.Errorf("chunk %d envelope %+v", i, env)
+		}
+		id = env.ID
+		part, _ := base64.StdEncoding.DecodeString(env.Data)
+		if len(part) > 16 {
+			t.Errorf("chunk %d holds %d bytes, want at most 16", i, len(part))
+		}
+		data = append(data, part...)
+	}
+	checkReassembled(t, string(data))
+
+	if events := audits.stored(); len(events) != 1 || events[0].MessageID != id || events[0].PayloadBytes != len(data) {
+		t.Errorf("audited %+v, want the whole message once", events)
+	}
+}
+
+func TestChunkedPublishV5(t *testing.T) {
+	t.Setenv("INJECT_TIMESTAMP", "true")
+	broker := newTestBroker(t)
+	log := speakV5(t, broker)
+	audits := newMemAuditStore(t)
+
+	resp := post(t, "/set-led", chunkedBody(16), nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	sent := log.sent()
+	if got := decodeBody(t, resp)["chunks"]; got != float64(len(sent)) || len(sent) < 5 {
+		t.Fatalf("response reports %v chunks, %d sent", got, len(sent))
+	}
+
+	var data string
+	for i, m := range sent {
+		props := map[string]string{}
+		for _, p := range m.Props.UserProperties {
+			props[p.Key] = p.Value
+		}
+		if props["chunk-index"] != strconv.Itoa(i) || props["chunk-total"] != strconv.Itoa(len(sent)) || props["chunk-id"] == "" {
+			t.Errorf("chunk %d properties %v", i, m.Props.UserProperties)
+		}
+		data += m.Payload
+	}
+	checkReassembled(t, data)
+
+	if events := audits.stored(); len(events) != 1 || events[0].PayloadBytes != len(data) {
+		t.Errorf("audited %+v, want the whole message once", events)
+	}
+}
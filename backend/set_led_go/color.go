@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const defaultColorTemplate = `{"color":"{{color}}"}`
+
+// normalizeColor validates a #RGB or #RRGGBB hex color and returns it as
+// upper-case #RRGGBB.
+func normalizeColor(color string) (string, error) {
+	hex, ok := strings.CutPrefix(color, "#")
+	if !ok {
+		return "", fmt.Errorf("color %q must start with '#'", color)
+	}
+	if len(hex) != 3 && len(hex) != 6 {
+		return "", fmt.Errorf("color %q must have 3 or 6 hex digits", color)
+	}
+	for _, c := range hex {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return "", fmt.Errorf("color %q contains non-hex digit %q", color, c)
+		}
+	}
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	return "#" + strings.ToUpper(hex), nil
+}
+
+// renderColorMessage places color into COLOR_TEMPLATE at each {{color}}.
+func renderColorMessage(color string) string {
+	tmpl := os.Getenv("COLOR_TEMPLATE")
+	if tmpl == "" {
+		tmpl = defaultColorTemplate
+	}
+	return strings.ReplaceAll(tmpl, "{{color}}", color)
+}
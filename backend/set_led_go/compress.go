@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// compressResponse gzips resp.Body when the client accepts gzip and the body
+// is at least RESPONSE_GZIP_MIN_BYTES long (0 disables compression). API
+// Gateway needs binary bodies base64-encoded, so IsBase64Encoded is set.
+func compressResponse(request events.APIGatewayProxyRequest, resp events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	threshold := envInt("RESPONSE_GZIP_MIN_BYTES", 1024)
+	if threshold <= 0 || len(resp.Body) < threshold || resp.IsBase64Encoded {
+		return resp
+	}
+	if !acceptsGzip(headerValue(request, "Accept-Encoding")) {
+		return resp
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(resp.Body)); err != nil {
+		return resp
+	}
+	if err := zw.Close(); err != nil {
+		return resp
+	}
+
+	headers := make(map[string]string, len(resp.Headers)+2)
+	for k, v := range resp.Headers {
+		headers[k] = v
+	}
+	headers["Content-Encoding"] = "gzip"
+	headers["Vary"] = "Accept-Encoding"
+
+	resp.Headers = headers
+	resp.Body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	resp.IsBase64Encoded = true
+	return resp
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, honouring
+// an explicit q=0 refusal.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		refused := false
+		for _, param := range fields[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); strings.TrimSpace(name) == "q" && err == nil && q == 0 {
+				refused = true
+			}
+		}
+		if !refused {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// CORS headers are attached in one place, applyCORS, once the response is
+// built, so every path follows the same policy. Each endpoint class has its
+// own policy, overridable per class:
+//
+//	CORS_<CLASS>_ORIGIN   allowed origin (default CORS_ALLOW_ORIGIN, else *)
+//	CORS_<CLASS>_METHODS  methods a preflight allows
+//	CORS_<CLASS>_HEADERS  request headers a preflight allows
+//
+// where CLASS is PUBLISH, READ or ADMIN. CORS_ON_ERRORS=false leaves CORS
+// headers off error (4xx/5xx) responses, so a browser cannot read them.
+
+// Endpoint classes for the CORS policy.
+const (
+	corsPublish = "publish"
+	corsRead    = "read"
+	corsAdmin   = "admin"
+)
+
+// corsDefaults are the methods and request headers each class allows.
+var corsDefaults = map[string]struct{ methods, headers string }{
+	corsPublish: {"POST,OPTIONS", "Content-Type,Authorization,X-Api-Key,X-Publish-Token,X-Mqtt-Username,X-Mqtt-Password,X-Insecure-Skip-Verify,Idempotency-Key"},
+	corsRead:    {"GET,OPTIONS", "Content-Type,Authorization,X-Api-Key,X-Publish-Token"},
+	corsAdmin:   {"GET,POST,PUT,DELETE,OPTIONS", "Content-Type,Authorization,X-Api-Key"},
+}
+
+// corsClass maps a request path to its endpoint class. /sign is a publish
+// endpoint: its tokens exist to publish.
+func corsClass(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	switch {
+	case strings.HasPrefix(path, "/admin/"), path == "/devices", strings.HasPrefix(path, "/devices/"):
+		return corsAdmin
+	case path == "/health", path == "/health/deep", path == "/state", path == "/presence", strings.HasPrefix(path, "/jobs/"):
+		return corsRead
+	}
+	return corsPublish
+}
+
+// corsSetting reads CORS_<CLASS>_<name>, falling back to def.
+func corsSetting(class, name, def string) string {
+	if v := os.Getenv("CORS_" + strings.ToUpper(class) + "_" + name); v != "" {
+		return v
+	}
+	return def
+}
+
+// applyCORS adds the CORS headers for request's endpoint to resp: the allowed
+// origin on every response (unless CORS_ON_ERRORS=false and resp is an
+// error), plus the allowed methods and headers on a preflight.
+func applyCORS(request events.APIGatewayProxyRequest, resp events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	if resp.StatusCode >= 400 && !envBool("CORS_ON_ERRORS", true) {
+		return resp
+	}
+	class := corsClass(request.Path)
+	origin := os.Getenv("CORS_ALLOW_ORIGIN")
+	if origin == "" {
+		origin = "*"
+	}
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	allowed := corsSetting(class, "ORIGIN", origin)
+	resp.Headers["Access-Control-Allow-Origin"] = allowed
+	if allowed != "*" {
+		// Caches must not serve one origin's response to another
+		if vary := resp.Headers["Vary"]; vary != "" {
+			resp.Headers["Vary"] = vary + ", Origin"
+		} else {
+			resp.Headers["Vary"] = "Origin"
+		}
+	}
+	if request.HTTPMethod == "OPTIONS" {
+		def := corsDefaults[class]
+		resp.Headers["Access-Control-Allow-Methods"] = corsSetting(class, "METHODS", def.methods)
+		resp.Headers["Access-Control-Allow-Headers"] = corsSetting(class, "HEADERS", def.headers)
+	}
+	return resp
+}
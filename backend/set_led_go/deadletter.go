@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// Publishes that will never succeed go to the SQS queue named by
+// DEAD_LETTER_QUEUE_URL, with the original request and why it failed, for
+// operators to inspect and replay: async publishes that fail, and queued
+// (SQS, SNS) ones rejected as non-retryable or, from SQS, still failing after
+// DLQ_MAX_RECEIVES (default 3) deliveries. A queued request that reaches the
+// queue is acknowledged rather than redelivered; if it cannot be written
+// there, the failure is left to the source's own retries.
+
+// deadLetter is the message written to the dead-letter queue.
+type deadLetter struct {
+	// Request is the original publish request body
+	Request string `json:"request"`
+	// Source is where the request came from: async, sqs or sns
+	Source string `json:"source"`
+	// MessageID is the source's ID: the job ID, or the SQS/SNS message ID
+	MessageID string `json:"messageId"`
+	Attempts  int    `json:"attempts"`
+	Status    int    `json:"status"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error"`
+	FailedAt  string `json:"failedAt"`
+}
+
+// deadLetterQueue accepts dead letters.
+type deadLetterQueue interface {
+	sendDeadLetter(dl deadLetter) error
+}
+
+// openDeadLetterQueue returns the configured queue, or nil when
+// DEAD_LETTER_QUEUE_URL is unset.
+var openDeadLetterQueue = func() deadLetterQueue {
+	url := os.Getenv("DEAD_LETTER_QUEUE_URL")
+	if url == "" {
+		return nil
+	}
+	return sqsDeadLetterQueue{sqs: sqs.New(session.Must(session.NewSession())), url: url}
+}
+
+type sqsDeadLetterQueue struct {
+	sqs sqsiface.SQSAPI
+	url string
+}
+
+func (q sqsDeadLetterQueue) sendDeadLetter(dl deadLetter) error {
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	// Attributes let a consumer filter by failure without parsing the body
+	attrs := map[string]*sqs.MessageAttributeValue{
+		"source": {DataType: aws.String("String"), StringValue: aws.String(dl.Source)},
+		"status": {DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(dl.Status))},
+	}
+	if dl.Code != "" {
+		attrs["code"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(dl.Code)}
+	}
+	_, err = q.sqs.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:          aws.String(q.url),
+		MessageBody:       aws.String(string(body)),
+		MessageAttributes: attrs,
+	})
+	return err
+}
+
+// retryableStatus reports whether a failed publish may succeed if repeated:
+// throttling, timeouts and server-side failures. Any other 4xx is a problem
+// with the request itself.
+func retryableStatus(status int) bool {
+	return status == 408 || status == 429 || status >= 500
+}
+
+// deadLetterPublish writes a publish that failed for good to the dead-letter
+// queue. It reports whether the failure is now accounted for: false when no
+// queue is configured or the write failed.
+func deadLetterPublish(dl deadLetter) bool {
+	queue := openDeadLetterQueue()
+	if queue == nil {
+		return false
+	}
+	dl.FailedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := queue.sendDeadLetter(dl); err != nil {
+		logger.Error("dead letter not written", "source", dl.Source, "messageId", dl.MessageID, "error", err.Error())
+		return false
+	}
+	logger.Warn("publish dead-lettered", "source", dl.Source, "messageId", dl.MessageID, "status", dl.Status, "code", dl.Code)
+	return true
+}
+
+// deadLetterQueued dead-letters a failed queued publish when it is final:
+// non-retryable, or on its last allowed delivery. It reports whether the
+// source should treat the message as handled.
+func deadLetterQueued(source, messageID, body string, attempts int, err error) bool {
+	failure, ok := err.(*queuedFailure)
+	if !ok {
+		return false
+	}
+	final := !retryableStatus(failure.status)
+	if source == "sqs" && attempts >= envInt("DLQ_MAX_RECEIVES", 3) {
+		final = true
+	}
+	if !final {
+		return false
+	}
+	return deadLetterPublish(deadLetter{
+		Request:   body,
+		Source:    source,
+		MessageID: messageID,
+		Attempts:  attempts,
+		Status:    failure.status,
+		Code:      failure.code,
+		Error:     failure.message,
+	})
+}
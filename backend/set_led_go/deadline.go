@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The configured MQTT_CONNECT_TIMEOUT + MQTT_PUBLISH_TIMEOUT may exceed the
+// Lambda timeout, in which case the function would be killed before it could
+// return a clean error. Each invocation clamps the operation timeouts so that
+// RESPONSE_BUDGET remains after both have elapsed.
+
+var (
+	clampMu          sync.Mutex
+	clampedConnect   time.Duration // zero: use the configured value
+	clampedPublish   time.Duration
+	clampDeadline    time.Time // invocation deadline; zero when unknown
+	clampWarningOnce sync.Once
+)
+
+// applyDeadline clamps the operation timeouts for the invocation in ctx.
+func applyDeadline(ctx context.Context) {
+	connect := envDuration("MQTT_CONNECT_TIMEOUT", 5*time.Second)
+	publish := envDuration("MQTT_PUBLISH_TIMEOUT", 3*time.Second)
+
+	deadline, ok := ctx.Deadline()
+	clampMu.Lock()
+	clampDeadline = deadline
+	clampMu.Unlock()
+	if !ok {
+		setClamped(0, 0)
+		return
+	}
+	remaining := time.Until(deadline)
+	c, p := clampTimeouts(connect, publish, remaining, envDuration("RESPONSE_BUDGET", 500*time.Millisecond))
+	if c != connect || p != publish {
+		clampWarningOnce.Do(func() {
+			logger.Warn("configured MQTT timeouts exceed the Lambda deadline; clamping",
+				"connectTimeout", connect.String(), "publishTimeout", publish.String(),
+				"remaining", remaining.String(), "clampedConnect", c.String(), "clampedPublish", p.String())
+		})
+	}
+	setClamped(c, p)
+}
+
+// clampTimeouts scales connect and publish down proportionally so that their
+// sum leaves budget of the remaining time. Each keeps a floor of 100ms.
+func clampTimeouts(connect, publish, remaining, budget time.Duration) (time.Duration, time.Duration) {
+	available := remaining - budget
+	total := connect + publish
+	if total <= available || total <= 0 {
+		return connect, publish
+	}
+
+	const floor = 100 * time.Millisecond
+	if available < 2*floor {
+		return floor, floor
+	}
+	c := time.Duration(float64(available) * float64(connect) / float64(total))
+	p := available - c
+	return max(c, floor), max(p, floor)
+}
+
+func setClamped(connect, publish time.Duration) {
+	clampMu.Lock()
+	defer clampMu.Unlock()
+	clampedConnect, clampedPublish = connect, publish
+}
+
+func connectTimeout() time.Duration {
+	clampMu.Lock()
+	defer clampMu.Unlock()
+	if clampedConnect > 0 {
+		return clampedConnect
+	}
+	return envDuration("MQTT_CONNECT_TIMEOUT", 5*time.Second)
+}
+
+func publishTimeout() time.Duration {
+	clampMu.Lock()
+	defer clampMu.Unlock()
+	if clampedPublish > 0 {
+		return clampedPublish
+	}
+	return envDuration("MQTT_PUBLISH_TIMEOUT", 3*time.Second)
+}
+
+// QoS 1 needs a PUBACK and QoS 2 a four-packet PUBLISH/PUBREC/PUBREL/PUBCOMP
+// handshake, so a publish timeout tuned for QoS 0/1 can spuriously fail QoS 2
+// publishes. Each level therefore has a minimum (MQTT_QOS1_MIN_TIMEOUT,
+// MQTT_QOS2_MIN_TIMEOUT) that raises the configured publish timeout. The
+// invocation deadline still takes precedence so a response can be returned.
+
+func qosMinTimeout(qos int) time.Duration {
+	switch qos {
+	case 1:
+		return envDuration("MQTT_QOS1_MIN_TIMEOUT", 0)
+	case 2:
+		return envDuration("MQTT_QOS2_MIN_TIMEOUT", 5*time.Second)
+	}
+	return 0
+}
+
+// publishTimeoutFor returns the publish timeout for a message at qos.
+func publishTimeoutFor(qos int) time.Duration {
+	t := max(publishTimeout(), qosMinTimeout(qos))
+
+	clampMu.Lock()
+	deadline := clampDeadline
+	clampMu.Unlock()
+	if !deadline.IsZero() {
+		left := time.Until(deadline) - envDuration("RESPONSE_BUDGET", 500*time.Millisecond)
+		t = min(t, max(left, 100*time.Millisecond))
+	}
+	return t
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers recent successful publishes so that an identical
+// repeat (e.g. a double-click) within DEDUP_WINDOW is answered without
+// publishing again. It is best-effort and local to the container.
+type dedupCache struct {
+	mu      sync.Mutex
+	entries map[string]dedupEntry
+}
+
+type dedupEntry struct {
+	at     time.Time
+	result map[string]interface{}
+}
+
+var recentPublishes = &dedupCache{entries: map[string]dedupEntry{}}
+
+// dedupRequest is everything that makes two publishes the same request: who
+// sent it and as which broker user, and what it asks of the broker and the
+// device. A retained repeat of a plain publish is not a duplicate, nor is one
+// from another caller, whose answer must not be replayed to them.
+type dedupRequest struct {
+	Callers       []string
+	Creds         mqttCreds
+	Topic         string
+	Message       string
+	QoS           int
+	Retain        bool
+	WaitForAck    bool
+	ProgressTopic string
+	ResponseTopic string
+}
+
+// key hashes r, so no credential is kept in the cache.
+func (r dedupRequest) key() string {
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns a copy of the stored result for key if it is younger than
+// window.
+func (c *dedupCache) lookup(key string, window time.Duration, now time.Time) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || now.Sub(e.at) > window {
+		return nil, false
+	}
+	// A copy, so the caller cannot change what is replayed next time
+	result := make(map[string]interface{}, len(e.result))
+	for k, v := range e.result {
+		result[k] = v
+	}
+	return result, true
+}
+
+// store records result for key and drops entries older than window.
+func (c *dedupCache) store(key string, result map[string]interface{}, window time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		if now.Sub(e.at) > window {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dedupEntry{at: now, result: result}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestDedupRepeatWithinWindowIsNotPublished(t *testing.T) {
+	t.Setenv("DEDUP_WINDOW", "1m")
+	broker := newTestBroker(t)
+	body := `{"topic":"esp8266/commands/led","message":"on"}`
+
+	first := post(t, "/set-led", body, nil)
+	second := post(t, "/set-led", body, nil)
+	if first.StatusCode != 200 || second.StatusCode != 200 {
+		t.Fatalf("status %d, %d; want 200, 200", first.StatusCode, second.StatusCode)
+	}
+	if got := decodeBody(t, second)["deduplicated"]; got != true {
+		t.Errorf("repeat deduplicated = %v, want true (body %s)", got, second.Body)
+	}
+	if n := len(broker.sentTo("esp8266/commands/led")); n != 1 {
+		t.Errorf("published %d times, want 1", n)
+	}
+}
+
+func TestDedupKeyIncludesQoSAndRetain(t *testing.T) {
+	t.Setenv("DEDUP_WINDOW", "1m")
+	broker := newTestBroker(t)
+
+	post(t, "/set-led", `{"topic":"esp8266/commands/led","message":"on"}`, nil)
+	retained := post(t, "/set-led", `{"topic":"esp8266/commands/led","message":"on","retain":true}`, nil)
+	qos0 := post(t, "/set-led", `{"topic":"esp8266/commands/led","message":"on","qos":0}`, nil)
+
+	for name, resp := range map[string]map[string]interface{}{"retained": decodeBody(t, retained), "qos 0": decodeBody(t, qos0)} {
+		if resp["deduplicated"] == true {
+			t.Errorf("%s repeat was deduplicated", name)
+		}
+	}
+	sent := broker.sentTo("esp8266/commands/led")
+	if len(sent) != 3 {
+		t.Fatalf("published %d times, want 3", len(sent))
+	}
+	if !sent[1].retained {
+		t.Error("second publish was not retained")
+	}
+}
+
+func TestDedupOffByDefault(t *testing.T) {
+	broker := newTestBroker(t)
+	body := `{"topic":"esp8266/commands/led","message":"on"}`
+	post(t, "/set-led", body, nil)
+	post(t, "/set-led", body, nil)
+	if n := len(broker.sentTo("esp8266/commands/led")); n != 2 {
+		t.Errorf("published %d times, want 2", n)
+	}
+}
+
+func TestDedupIsPerCaller(t *testing.T) {
+	t.Setenv("DEDUP_WINDOW", "1m")
+	t.Setenv("ALLOW_DELEGATED_CREDS", "true")
+	broker := newTestBroker(t)
+	body := `{"topic":"esp8266/commands/led","message":"on"}`
+	as := func(sub string, headers map[string]string) events.APIGatewayProxyRequest {
+		return withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/set-led", Body: body, Headers: headers}, map[string]interface{}{"sub": sub})
+	}
+	alice := map[string]string{"X-Mqtt-Username": "alice", "X-Mqtt-Password": "a-secret"}
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		dedup   bool
+	}{
+		{"u1", as("u1", nil), false},
+		{"u1 again", as("u1", nil), true},
+		{"another user", as("u2", nil), false},
+		{"u1 as a delegated broker user", as("u1", alice), false},
+		{"u1 as that user again", as("u1", alice), true},
+		{"u1 with another password", as("u1", map[string]string{"X-Mqtt-Username": "alice", "X-Mqtt-Password": "a-guess"}), false},
+	}
+	for _, tt := range tests {
+		resp := call(t, tt.request)
+		if got := decodeBody(t, resp)["deduplicated"] == true; resp.StatusCode != 200 || got != tt.dedup {
+			t.Errorf("%s: status %d, deduplicated %v, want %v", tt.name, resp.StatusCode, got, tt.dedup)
+		}
+	}
+	if n := len(broker.sentTo("esp8266/commands/led")); n != 4 {
+		t.Errorf("published %d times, want 4", n)
+	}
+}
+
+func TestDedupKeyIncludesReplies(t *testing.T) {
+	base := dedupRequest{Callers: []string{"u1"}, Topic: "devices/lamp/led", Message: "on", QoS: 1}
+	variants := map[string]dedupRequest{}
+	v := base
+	v.WaitForAck = true
+	variants["wait_for_ack"] = v
+	v = base
+	v.ProgressTopic = "devices/lamp/progress"
+	variants["progress_topic"] = v
+	v = base
+	v.ResponseTopic = "devices/lamp/reply"
+	variants["response_topic"] = v
+	for name, v := range variants {
+		if v.key() == base.key() {
+			t.Errorf("%s does not change the key", name)
+		}
+	}
+}
+
+func TestDedupLookupReturnsACopy(t *testing.T) {
+	c := &dedupCache{entries: map[string]dedupEntry{}}
+	now := time.Now()
+	c.store("k", map[string]interface{}{"published": "x"}, time.Minute, now)
+	first, _ := c.lookup("k", time.Minute, now)
+	first["deduplicated"] = true
+	if second, _ := c.lookup("k", time.Minute, now); len(second) != 1 {
+		t.Errorf("cached result changed to %v", second)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// validDeviceID is a single topic level safe to use as a key.
+var validDeviceID = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+// deviceInput is the body of POST /devices and PUT /devices/{id}. Schema is a
+// JSON Schema object (see payloadSchema).
+type deviceInput struct {
+	DeviceID string          `json:"device_id"`
+	Topics   []string        `json:"topics"`
+	Owners   []string        `json:"owners"`
+	Schema   json.RawMessage `json:"schema,omitempty"`
+}
+
+// devicesHandler manages the device registry, behind the admin API key:
+//
+//	GET    /devices       list every device
+//	POST   /devices       register a device (409 if it exists)
+//	GET    /devices/{id}  read one
+//	PUT    /devices/{id}  create or replace one
+//	DELETE /devices/{id}  remove one
+func devicesHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if apiErr := requireAdmin(request); apiErr != nil {
+		return apiErr.response()
+	}
+	store := openRegistry()
+	if store == nil {
+		return errorRespCode(503, "REGISTRY_DISABLED", "The device registry is not configured; set DEVICE_REGISTRY_TABLE")
+	}
+
+	id := strings.TrimPrefix(strings.TrimSuffix(request.Path, "/"), "/devices")
+	id = strings.TrimPrefix(id, "/")
+	if id == "" {
+		switch request.HTTPMethod {
+		case "GET":
+			devices, err := store.listDevices()
+			if err != nil {
+				return errorRespCode(502, "REGISTRY_UNAVAILABLE", "Listing devices failed: "+err.Error())
+			}
+			if devices == nil {
+				devices = []deviceRecord{}
+			}
+			return jsonResp(200, map[string]interface{}{"devices": devices})
+		case "POST":
+			return saveDevice(store, request.Body, "", true)
+		}
+		return errorRespStatus(405, "Use GET or POST")
+	}
+	if !validDeviceID.MatchString(id) {
+		return errorRespCode(400, "INVALID_DEVICE", "device ID must be 1-128 letters, digits or _.:-")
+	}
+
+	switch request.HTTPMethod {
+	case "GET":
+		d, err := store.getDevice(id)
+		if err != nil {
+			return errorRespCode(502, "REGISTRY_UNAVAILABLE", "Reading device failed: "+err.Error())
+		}
+		if d == nil {
+			return errorRespCode(404, "DEVICE_NOT_FOUND", "No device "+id)
+		}
+		return jsonResp(200, d)
+	case "PUT":
+		return saveDevice(store, request.Body, id, false)
+	case "DELETE":
+		found, err := store.deleteDevice(id)
+		if err != nil {
+			return errorRespCode(502, "REGISTRY_UNAVAILABLE", "Deleting device failed: "+err.Error())
+		}
+		invalidateRegistry()
+		if !found {
+			return errorRespCode(404, "DEVICE_NOT_FOUND", "No device "+id)
+		}
+		return jsonResp(200, map[string]interface{}{"deviceId": id, "deleted": true})
+	}
+	return errorRespStatus(405, "Use GET, PUT or DELETE")
+}
+
+// saveDevice validates a deviceInput and stores it. The path's id, when
+// given, names the device and must agree with any device_id in the body.
+func saveDevice(store registryStore, body, id string, create bool) events.APIGatewayProxyResponse {
+	var in deviceInput
+	if err := json.Unmarshal([]byte(body), &in); err != nil {
+		return errorRespStatus(400, "Invalid JSON: "+err.Error())
+	}
+	if id != "" {
+		if in.DeviceID != "" && in.DeviceID != id {
+			return errorRespStatus(400, "'device_id' does not match the path")
+		}
+		in.DeviceID = id
+	}
+	if !validDeviceID.MatchString(in.DeviceID) {
+		return errorRespCode(400, "INVALID_DEVICE", "'device_id' must be 1-128 letters, digits or _.:-")
+	}
+	if len(in.Topics) == 0 || len(in.Owners) == 0 {
+		return errorRespStatus(400, "'topics' and 'owners' must each list at least one entry")
+	}
+	for _, t := range in.Topics {
+		if !validFilter(t) {
+			return errorRespCode(400, "INVALID_FILTER", "topic "+t+" is not a valid topic filter")
+		}
+	}
+	for _, o := range in.Owners {
+		if strings.TrimSpace(o) == "" {
+			return errorRespStatus(400, "'owners' cannot contain empty entries")
+		}
+	}
+
+	d := deviceRecord{
+		DeviceID:  in.DeviceID,
+		Topics:    in.Topics,
+		Owners:    in.Owners,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(in.Schema) > 0 && !bytes.Equal(in.Schema, []byte("null")) {
+		if _, err := parseSchema(in.Schema); err != nil {
+			return errorRespCode(400, "INVALID_SCHEMA", err.Error())
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, in.Schema); err != nil {
+			return errorRespCode(400, "INVALID_SCHEMA", err.Error())
+		}
+		d.Schema = compact.String()
+	}
+
+	err := store.putDevice(d, create)
+	if errors.Is(err, errDeviceExists) {
+		return errorRespCode(409, "DEVICE_EXISTS", "Device "+d.DeviceID+" is already registered")
+	}
+	if err != nil {
+		return errorRespCode(502, "REGISTRY_UNAVAILABLE", "Storing device failed: "+err.Error())
+	}
+	invalidateRegistry()
+	status := 200
+	if create {
+		status = 201
+	}
+	return jsonResp(status, d)
+}
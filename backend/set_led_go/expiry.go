@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// parseExpiry parses the optional RFC 3339 'expires_at' field. The zero time
+// means the command never expires.
+func parseExpiry(raw string) (time.Time, *apiError) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, newAPIError(400, "INVALID_EXPIRES_AT", "'expires_at' must be an RFC 3339 timestamp")
+	}
+	return t, nil
+}
+
+// commandExpired reports whether a command with expiresAt is stale at now.
+func commandExpired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// expiredError is returned by publishMessage for a command that went stale
+// while waiting, e.g. for a connection or in the async queue.
+func expiredError(expiresAt time.Time) *apiError {
+	return newAPIError(400, "COMMAND_EXPIRED", "command expired at "+expiresAt.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"shared/mqttclient"
+)
+
+// deviceResult is one device's outcome in a group fan-out report.
+type deviceResult struct {
+	Topic     string `json:"topic"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Device statuses in a fan-out report.
+const (
+	devicePublished = "published"
+	deviceFailed    = "failed"
+	// deviceRejected devices failed validation and were never sent
+	deviceRejected = "rejected"
+)
+
+// resolveGroup returns the device topics registered for group, or nil when
+// the group is unknown. A group is a JSON array of topics stored at
+// SSM_CONFIG_PATH/groups/<name>, else an item of DEVICE_GROUPS_TABLE, else an
+// entry of the DEVICE_GROUPS JSON object of group → topics.
+var resolveGroup = func(group string) ([]string, error) {
+	var topics []string
+	if raw, ok := mqttclient.ConfigValue("groups/" + group); ok {
+		if err := json.Unmarshal([]byte(raw), &topics); err != nil {
+			return nil, fmt.Errorf("group %s: %w", group, err)
+		}
+		return topics, nil
+	}
+	if table := os.Getenv("DEVICE_GROUPS_TABLE"); table != "" {
+		return tableGroup(dynamodb.New(session.Must(session.NewSession())), table, group)
+	}
+
+	raw := os.Getenv("DEVICE_GROUPS")
+	if raw == "" {
+		return nil, nil
+	}
+	var groups map[string][]string
+	if err := json.Unmarshal([]byte(raw), &groups); err != nil {
+		return nil, fmt.Errorf("DEVICE_GROUPS: %w", err)
+	}
+	return groups[group], nil
+}
+
+// groupItem is a DEVICE_GROUPS_TABLE item, keyed by group name.
+type groupItem struct {
+	Group  string   `dynamodbav:"group"`
+	Topics []string `dynamodbav:"topics"`
+}
+
+// tableGroup reads group from table, returning nil for a missing item.
+func tableGroup(db dynamodbiface.DynamoDBAPI, table, group string) ([]string, error) {
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key:       map[string]*dynamodb.AttributeValue{"group": {S: aws.String(group)}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("group %s: %w", group, err)
+	}
+	var item groupItem
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &item); err != nil {
+		return nil, fmt.Errorf("group %s: %w", group, err)
+	}
+	return item.Topics, nil
+}
+
+// publishGroup fans one message out to every device of 'group', e.g. all the
+// lamps in a room. Devices whose topic fails validation are reported as
+// rejected instead of failing the whole request; any device that was not
+// published turns the response into a 207.
+func publishGroup(request events.APIGatewayProxyRequest, body RequestBody) events.APIGatewayProxyResponse {
+	if body.Topic != "" || len(body.Topics) > 0 || len(body.Messages) > 0 {
+		return errorRespStatus(400, "Use 'group' on its own, without 'topic', 'topics' or 'messages'")
+	}
+	if body.Message == "" {
+		return errorRespStatus(400, "Missing 'message' in request body")
+	}
+
+	devices, err := resolveGroup(body.Group)
+	if err != nil {
+		return errorRespCode(500, "CONFIG_ERROR", err.Error())
+	}
+	if len(devices) == 0 {
+		return errorRespCode(404, "GROUP_NOT_FOUND", "No devices in group "+body.Group)
+	}
+	if max := envInt("MAX_BATCH_SIZE", 100); len(devices) > max {
+		return errorRespCode(400, "BATCH_TOO_LARGE", fmt.Sprintf("group has %d devices, at most %d per request", len(devices), max))
+	}
+	message, apiErr := decodeMessage(body.Message, body.MessageEncoding)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	qos, apiErr := parseQoS(body.QoS)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	source := requestSource(request, body.Source)
+	report := make([]deviceResult, len(devices))
+	var msgs []outboundMessage
+	var sent []int // report index of each entry of msgs
+	var topics []string
+	for i, d := range devices {
+		topic, apiErr := placeTopic(request, d)
+		if apiErr != nil {
+			topic = d
+		}
+		report[i] = deviceResult{Topic: topic}
+		if apiErr == nil {
+			apiErr = validateTopic(topic)
+		}
+		if apiErr != nil {
+			report[i].Status, report[i].Code, report[i].Error = deviceRejected, apiErr.Code, apiErr.Message
+			continue
+		}
+		msgs = append(msgs, outboundMessage{Topic: topic, QoS: qos, Retained: body.Retain, Payload: message, Source: source})
+		sent = append(sent, i)
+		topics = append(topics, topic)
+	}
+
+	if len(msgs) > 0 {
+		if apiErr := guardRepublish(request, topics...); apiErr != nil {
+			return apiErr.response()
+		}
+		if apiErr := authorizePublishToken(request, topics...); apiErr != nil {
+			return apiErr.response()
+		}
+		if apiErr := authorizeDevices(request, msgs...); apiErr != nil {
+			return apiErr.response()
+		}
+		assignMessageIDs(request, msgs)
+		creds, apiErr := delegatedCreds(request)
+		if apiErr != nil {
+			return apiErr.response()
+		}
+		results, apiErr := publishAll(creds, msgs)
+		if apiErr != nil {
+			return apiErr.response()
+		}
+		for j, r := range results {
+			d := &report[sent[j]]
+			d.LatencyMs = r.latency.Milliseconds()
+			if r.OK {
+				d.Status = devicePublished
+			} else {
+				d.Status, d.Code, d.Error = deviceFailed, r.Code, r.Error
+			}
+		}
+	}
+
+	published := 0
+	for _, d := range report {
+		if d.Status == devicePublished {
+			published++
+		}
+	}
+	status := 200
+	if published < len(report) {
+		status = 207
+	}
+	return jsonResp(status, map[string]interface{}{
+		"group":     body.Group,
+		"devices":   report,
+		"total":     len(report),
+		"published": published,
+		"failed":    len(report) - published,
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// groupsTable is a DEVICE_GROUPS_TABLE answering GetItem from items.
+type groupsTable struct {
+	dynamodbiface.DynamoDBAPI
+
+	items map[string]map[string]*dynamodb.AttributeValue
+	err   error
+	gets  []*dynamodb.GetItemInput
+}
+
+func (d *groupsTable) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	d.gets = append(d.gets, in)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &dynamodb.GetItemOutput{Item: d.items[aws.StringValue(in.Key["group"].S)]}, nil
+}
+
+func topicList(topics ...string) *dynamodb.AttributeValue {
+	var l []*dynamodb.AttributeValue
+	for _, t := range topics {
+		l = append(l, &dynamodb.AttributeValue{S: aws.String(t)})
+	}
+	return &dynamodb.AttributeValue{L: l}
+}
+
+func TestTableGroup(t *testing.T) {
+	db := &groupsTable{items: map[string]map[string]*dynamodb.AttributeValue{
+		"kitchen": {"group": {S: aws.String("kitchen")}, "topics": topicList("devices/lamp-1/led", "devices/lamp-2/led")},
+		"broken":  {"group": {S: aws.String("broken")}, "topics": {S: aws.String("devices/lamp-1/led")}},
+	}}
+
+	topics, err := tableGroup(db, "groups", "kitchen")
+	if err != nil || len(topics) != 2 || topics[1] != "devices/lamp-2/led" {
+		t.Errorf("kitchen = %v, %v", topics, err)
+	}
+	if in := db.gets[0]; aws.StringValue(in.TableName) != "groups" || aws.StringValue(in.Key["group"].S) != "kitchen" {
+		t.Errorf("GetItem %v", in)
+	}
+	if topics, err := tableGroup(db, "groups", "attic"); err != nil || topics != nil {
+		t.Errorf("missing group = %v, %v, want nil, nil", topics, err)
+	}
+	// An item without a topic list has no devices, and is reported as not found
+	if topics, err := tableGroup(db, "groups", "broken"); err != nil || len(topics) != 0 {
+		t.Errorf("item without a topic list = %v, %v", topics, err)
+	}
+
+	db.err = errors.New("throttled")
+	if _, err := tableGroup(db, "groups", "kitchen"); !errors.Is(err, db.err) {
+		t.Errorf("err = %v, want the GetItem error", err)
+	}
+}
+
+func TestResolveGroupSources(t *testing.T) {
+	t.Setenv("DEVICE_GROUPS_TABLE", "")
+	t.Setenv("DEVICE_GROUPS", `{"kitchen":["devices/env/led"]}`)
+	if topics, err := resolveGroup("kitchen"); err != nil || len(topics) != 1 || topics[0] != "devices/env/led" {
+		t.Errorf("DEVICE_GROUPS: %v, %v", topics, err)
+	}
+	if topics, err := resolveGroup("attic"); err != nil || topics != nil {
+		t.Errorf("unknown group: %v, %v", topics, err)
+	}
+
+	// SSM_CONFIG_PATH/groups/<name> comes first
+	t.Cleanup(seedConfig(map[string]string{"groups/kitchen": `["devices/ssm/led"]`, "groups/bad": `"devices/ssm/led"`}))
+	if topics, err := resolveGroup("kitchen"); err != nil || len(topics) != 1 || topics[0] != "devices/ssm/led" {
+		t.Errorf("SSM: %v, %v", topics, err)
+	}
+	if _, err := resolveGroup("bad"); err == nil {
+		t.Error("a group that is not a JSON array was accepted")
+	}
+
+	t.Setenv("DEVICE_GROUPS", `{"kitchen":`)
+	if _, err := resolveGroup("attic"); err == nil {
+		t.Error("invalid DEVICE_GROUPS was accepted")
+	}
+}
+
+func TestPublishGroupFromTable(t *testing.T) {
+	broker := newTestBroker(t)
+	db := &groupsTable{items: map[string]map[string]*dynamodb.AttributeValue{
+		"kitchen": {"group": {S: aws.String("kitchen")}, "topics": topicList("devices/lamp-1/led", "devices/#")},
+	}}
+	prev := resolveGroup
+	resolveGroup = func(group string) ([]string, error) { return tableGroup(db, "groups", group) }
+	t.Cleanup(func() { resolveGroup = prev })
+
+	resp := post(t, "/", `{"group":"kitchen","message":"on"}`, nil)
+	body := decodeBody(t, resp)
+	if resp.StatusCode != 207 || body["published"] != 1.0 || body["failed"] != 1.0 {
+		t.Errorf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if n := len(broker.sentTo("devices/lamp-1/led")); n != 1 {
+		t.Errorf("%d messages to the registered lamp, want 1", n)
+	}
+	if resp := post(t, "/", `{"group":"attic","message":"on"}`, nil); resp.StatusCode != 404 {
+		t.Errorf("unknown group: status %d", resp.StatusCode)
+	}
+	db.err = errors.New("throttled")
+	if resp := post(t, "/", `{"group":"kitchen","message":"on"}`, nil); decodeBody(t, resp)["code"] != "CONFIG_ERROR" {
+		t.Errorf("table failure: %s", resp.Body)
+	}
+}
+
+func TestPublishGroupDecodesMessage(t *testing.T) {
+	t.Setenv("DEVICE_GROUPS", `{"kitchen":["devices/lamp-1/led","devices/lamp-2/led"]}`)
+	broker := newTestBroker(t)
+
+	resp := post(t, "/", `{"group":"kitchen","message":"AAH/","message_encoding":"base64"}`, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	for _, topic := range []string{"devices/lamp-1/led", "devices/lamp-2/led"} {
+		if sent := broker.sentTo(topic); len(sent) != 1 || string(sent[0].payload) != "\x00\x01\xff" {
+			t.Errorf("%s: sent %v, want the decoded bytes", topic, sent)
+		}
+	}
+
+	resp = post(t, "/", `{"group":"kitchen","message":"not base64!","message_encoding":"base64"}`, nil)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 400 || code != "INVALID_BASE64" {
+		t.Errorf("invalid base64: status %d code %v", resp.StatusCode, code)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	"shared/mqttclient"
+)
+
+// healthCheck is the result of a single deep health probe.
+type healthCheck struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// healthHandler is the cheap liveness probe: no SSM or broker calls.
+func healthHandler() events.APIGatewayProxyResponse {
+	return jsonResp(200, map[string]string{"status": "ok"})
+}
+
+// deepHealthHandler verifies SSM access, credential decryption permissions and
+// broker connectivity. It returns 200 only when every check passes.
+func deepHealthHandler() events.APIGatewayProxyResponse {
+	checks := runDeepChecks(mqttclient.NewSSMClient(), connectAndClose)
+
+	status := 200
+	failing := []string{}
+	for _, c := range checks {
+		if !c.OK {
+			status = 503
+			failing = append(failing, c.Name)
+		}
+	}
+
+	resp := map[string]interface{}{
+		"status": "pass",
+		"checks": checks,
+	}
+	if status != 200 {
+		resp["status"] = "fail"
+		resp["failing"] = failing
+	}
+	return jsonResp(status, resp)
+}
+
+// runDeepChecks runs the ssm, iam and broker checks in order. The broker check
+// depends on the credentials read by the iam check and is failed without
+// connecting when they are unavailable.
+func runDeepChecks(client ssmiface.SSMAPI, connect func(mqttclient.Config) error) []healthCheck {
+	checks := make([]healthCheck, 0, 4)
+
+	// (1) canary parameter read
+	canary := os.Getenv("HEALTH_CANARY_SSM")
+	if canary == "" {
+		canary = mqttclient.BrokerParamName()
+	}
+	checks = append(checks, timeCheck("ssm", func() error {
+		_, err := mqttclient.FetchParam(client, canary)
+		return err
+	}))
+
+	// (2) permission to read and decrypt the broker credentials, or the client
+	// certificate, which must also be usable and unexpired; the cache is
+	// bypassed so the probe reflects the current IAM/KMS state
+	cfg, err := mqttclient.Settings()
+	iam := timeCheck("iam", func() error {
+		if err != nil {
+			return err
+		}
+		if cfg.Host, err = mqttclient.FetchParam(client, mqttclient.BrokerParamName()); err != nil {
+			return err
+		}
+		if mqttclient.AuthMode() == mqttclient.AuthMTLS {
+			for _, name := range []string{mqttclient.CertParamName(), mqttclient.KeyParamName(), mqttclient.CAParamName()} {
+				if name == "" {
+					continue
+				}
+				if _, err = mqttclient.FetchParam(client, name); err != nil {
+					return err
+				}
+			}
+			return mqttclient.ApplyClientCert(client, &cfg)
+		}
+		if cfg.Username, err = mqttclient.FetchParam(client, mqttclient.UsernameParamName()); err != nil {
+			return err
+		}
+		cfg.Password, err = mqttclient.FetchParam(client, mqttclient.PasswordParamName())
+		return err
+	})
+	checks = append(checks, iam)
+
+	if !iam.OK {
+		checks = append(checks,
+			healthCheck{Name: "dns", Error: "skipped: credentials unavailable"},
+			healthCheck{Name: "broker", Error: "skipped: credentials unavailable"})
+		return checks
+	}
+
+	// (3) broker host resolution, reported apart from connect failures
+	dns := timeCheck("dns", func() error {
+		if net.ParseIP(cfg.Host) != nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout())
+		defer cancel()
+		_, err := net.DefaultResolver.LookupHost(ctx, cfg.Host)
+		return err
+	})
+	checks = append(checks, dns)
+
+	// (4) broker connect
+	if !dns.OK {
+		checks = append(checks, healthCheck{Name: "broker", Error: "skipped: broker host does not resolve"})
+		return checks
+	}
+	checks = append(checks, timeCheck("broker", func() error {
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		return connect(cfg)
+	}))
+	return checks
+}
+
+func timeCheck(name string, fn func() error) healthCheck {
+	start := time.Now()
+	err := fn()
+	c := healthCheck{Name: name, OK: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+func connectAndClose(cfg mqttclient.Config) error {
+	client, err := mqttclient.Connect(cfg)
+	if err != nil {
+		return err
+	}
+	client.Disconnect(100)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testBroker is a memBroker standing in for every broker the handler
+// acquires, recording each publish in order.
+type testBroker struct {
+	*memBroker
+
+	mu   sync.Mutex
+	sent []memMessage
+}
+
+// newTestBroker installs a fresh testBroker for the duration of t.
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	b := &testBroker{memBroker: newMemBroker()}
+	prevAcquire, prevRegistry := acquireClient, openRegistry
+	acquireClient = func(mqttCreds, string, *requestTimings) (mqtt.Client, func(), *apiError) {
+		return &recordingClient{memClient: b.client(), broker: b}, func() {}, nil
+	}
+	openRegistry = func() registryStore { return nil }
+	recentPublishes = &dedupCache{entries: map[string]dedupEntry{}}
+	publishBackpressure = &backpressure{}
+	invalidateRegistry()
+	t.Cleanup(func() {
+		backgroundWork.Wait()
+		acquireClient, openRegistry = prevAcquire, prevRegistry
+		invalidateRegistry()
+	})
+	return b
+}
+
+// published returns the messages sent so far.
+func (b *testBroker) published() []memMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]memMessage{}, b.sent...)
+}
+
+// sentTo returns the messages sent to topic, in order.
+func (b *testBroker) sentTo(topic string) []memMessage {
+	var out []memMessage
+	for _, m := range b.published() {
+		if m.topic == topic {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+type recordingClient struct {
+	*memClient
+	broker *testBroker
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	token := c.memClient.Publish(topic, qos, retained, payload)
+	if token.Error() == nil {
+		m := memMessage{topic: topic, qos: qos, retained: retained}
+		switch p := payload.(type) {
+		case string:
+			m.payload = []byte(p)
+		case []byte:
+			m.payload = append([]byte{}, p...)
+		}
+		c.broker.mu.Lock()
+		c.broker.sent = append(c.broker.sent, m)
+		c.broker.mu.Unlock()
+	}
+	return token
+}
+
+// memRegistry is an in-memory registryStore.
+type memRegistry struct {
+	mu      sync.Mutex
+	devices map[string]deviceRecord
+}
+
+// newMemRegistry installs a registry holding devices for the duration of t.
+func newMemRegistry(t *testing.T, devices ...deviceRecord) *memRegistry {
+	t.Helper()
+	r := &memRegistry{devices: map[string]deviceRecord{}}
+	for _, d := range devices {
+		r.devices[d.DeviceID] = d
+	}
+	prev := openRegistry
+	openRegistry = func() registryStore { return r }
+	invalidateRegistry()
+	t.Cleanup(func() {
+		openRegistry = prev
+		invalidateRegistry()
+	})
+	return r
+}
+
+func (r *memRegistry) listDevices() ([]deviceRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []deviceRecord
+	for _, d := range r.devices {
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func (r *memRegistry) getDevice(id string) (*deviceRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[id]
+	if !ok {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+func (r *memRegistry) putDevice(d deviceRecord, create bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.devices[d.DeviceID]; ok && create {
+		return errDeviceExists
+	}
+	r.devices[d.DeviceID] = d
+	return nil
+}
+
+func (r *memRegistry) deleteDevice(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.devices[id]
+	delete(r.devices, id)
+	return ok, nil
+}
+
+// post runs a POST to path with body through handler.
+func post(t *testing.T, path, body string, headers map[string]string) events.APIGatewayProxyResponse {
+	t.Helper()
+	return call(t, events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: path, Body: body, Headers: headers})
+}
+
+// call runs request through handler.
+func call(t *testing.T, request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := handler(ctx, request)
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	return resp
+}
+
+// withClaims sets the Cognito authorizer claims on request.
+func withClaims(request events.APIGatewayProxyRequest, claims map[string]interface{}) events.APIGatewayProxyRequest {
+	request.RequestContext.Authorizer = map[string]interface{}{"claims": claims}
+	return request
+}
+
+// decodeBody decodes a JSON response body.
+func decodeBody(t *testing.T, resp events.APIGatewayProxyResponse) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+		t.Fatalf("response body is not a JSON object: %s", resp.Body)
+	}
+	return body
+}
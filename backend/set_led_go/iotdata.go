@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iot"
+	"github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/aws/aws-sdk-go/service/iotdataplane/iotdataplaneiface"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// With MQTT_AUTH_MODE=iot-dataplane, messages go to AWS IoT Core through the
+// IoT Data Plane Publish API, signed with the function's IAM role, instead of
+// over an MQTT connection with SSM-stored credentials. Topic-level IAM
+// policies (iot:Publish on topic ARNs) then decide what the hub may publish,
+// and there is no connection to hold open. Subscriptions still need MQTT, so
+// progress collection and the read endpoints are unavailable in this mode.
+
+// dataPlaneMode reports whether MQTT_AUTH_MODE selects the IoT Data Plane.
+func dataPlaneMode() bool {
+	return mqttclient.AuthMode() == mqttclient.AuthIoTDataPlane
+}
+
+// errDataPlaneSubscribe is returned for subscriptions in data plane mode.
+var errDataPlaneSubscribe = errors.New("subscriptions need an MQTT connection; unavailable with MQTT_AUTH_MODE=iot-dataplane")
+
+// newIoTDataClient returns the data plane client. IOT_DATA_ENDPOINT names the
+// account's endpoint (xxxx-ats.iot.<region>.amazonaws.com); without it the
+// endpoint is discovered once with DescribeEndpoint.
+var newIoTDataClient = func() (iotdataplaneiface.IoTDataPlaneAPI, error) {
+	dataPlaneOnce.Do(func() {
+		sess := session.Must(session.NewSession())
+		endpoint := os.Getenv("IOT_DATA_ENDPOINT")
+		if endpoint == "" {
+			out, err := iot.New(sess).DescribeEndpoint(&iot.DescribeEndpointInput{EndpointType: aws.String("iot:Data-ATS")})
+			if err != nil {
+				dataPlaneErr = err
+				return
+			}
+			endpoint = aws.StringValue(out.EndpointAddress)
+		}
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "https://" + endpoint
+		}
+		dataPlaneAPI = iotdataplane.New(sess, aws.NewConfig().WithEndpoint(endpoint))
+	})
+	return dataPlaneAPI, dataPlaneErr
+}
+
+var (
+	dataPlaneOnce sync.Once
+	dataPlaneAPI  iotdataplaneiface.IoTDataPlaneAPI
+	dataPlaneErr  error
+)
+
+// dataPlaneClient adapts the data plane to mqtt.Client so the usual publish
+// path applies. It implements mqttclient.PropsPublisher, as IoT Core accepts
+// the MQTT 5 properties over HTTP too.
+type dataPlaneClient struct {
+	api iotdataplaneiface.IoTDataPlaneAPI
+}
+
+func (c dataPlaneClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var body string
+	switch p := payload.(type) {
+	case string:
+		body = p
+	case []byte:
+		body = string(p)
+	}
+	return c.PublishWithProps(mqttclient.Message{Topic: topic, QoS: int(qos), Retained: retained, Payload: body})
+}
+
+// PublishWithProps sends msg with one Publish call. Topic aliases have no
+// meaning without a connection and are ignored.
+func (c dataPlaneClient) PublishWithProps(msg mqttclient.Message) mqtt.Token {
+	return mqttclient.NewAsyncToken(func() error {
+		// IoT Core does not support QoS 2
+		if msg.QoS > 1 {
+			return errors.New("AWS IoT Core supports QoS 0 and 1 only")
+		}
+		input := &iotdataplane.PublishInput{
+			Topic:   aws.String(msg.Topic),
+			Qos:     aws.Int64(int64(msg.QoS)),
+			Retain:  aws.Bool(msg.Retained),
+			Payload: []byte(msg.Payload),
+		}
+		if msg.Props.ContentType != "" {
+			input.ContentType = aws.String(msg.Props.ContentType)
+		}
+		if msg.Props.ResponseTopic != "" {
+			input.ResponseTopic = aws.String(msg.Props.ResponseTopic)
+		}
+		if len(msg.Props.CorrelationData) > 0 {
+			input.CorrelationData = aws.String(base64.StdEncoding.EncodeToString(msg.Props.CorrelationData))
+		}
+		if len(msg.Props.UserProperties) > 0 {
+			props := make([]map[string]string, len(msg.Props.UserProperties))
+			for i, up := range msg.Props.UserProperties {
+				props[i] = map[string]string{up.Key: up.Value}
+			}
+			encoded, _ := json.Marshal(props)
+			input.UserProperties = aws.String(string(encoded))
+		}
+		_, err := c.api.Publish(input)
+		return err
+	})
+}
+
+func (c dataPlaneClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return failedToken(errDataPlaneSubscribe)
+}
+
+func (c dataPlaneClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return failedToken(errDataPlaneSubscribe)
+}
+
+func (c dataPlaneClient) Unsubscribe(...string) mqtt.Token        { return doneToken{} }
+func (c dataPlaneClient) IsConnected() bool                       { return true }
+func (c dataPlaneClient) IsConnectionOpen() bool                  { return true }
+func (c dataPlaneClient) Connect() mqtt.Token                     { return doneToken{} }
+func (c dataPlaneClient) Disconnect(uint)                         {}
+func (c dataPlaneClient) AddRoute(string, mqtt.MessageHandler)    {}
+func (c dataPlaneClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// dataPlaneBrokerClient is brokerClient for MQTT_AUTH_MODE=iot-dataplane.
+// Caller-supplied broker credentials have no meaning there.
+func dataPlaneBrokerClient(creds mqttCreds, t *requestTimings) (mqtt.Client, func(), *apiError) {
+	if creds.delegated() {
+		return nil, nil, newAPIError(400, "DELEGATED_CREDS_UNSUPPORTED", "MQTT credentials cannot be supplied with MQTT_AUTH_MODE=iot-dataplane")
+	}
+	start := time.Now()
+	api, err := newIoTDataClient()
+	t.since(phaseConnect, start)
+	if err != nil {
+		return nil, nil, newAPIError(503, "BROKER_UNAVAILABLE", "IoT data endpoint lookup failed: "+err.Error())
+	}
+	return dataPlaneClient{api: api}, func() {}, nil
+}
+
+// doneToken is an already-completed, successful token.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (doneToken) Error() error { return nil }
+
+// failedToken returns an already-completed token carrying err.
+func failedToken(err error) mqtt.Token {
+	return mqttclient.NewAsyncToken(func() error { return err })
+}
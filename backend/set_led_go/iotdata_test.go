@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/aws/aws-sdk-go/service/iotdataplane/iotdataplaneiface"
+
+	"shared/mqttclient"
+)
+
+// fakeIoTData records the Publish calls made to the IoT Data Plane.
+type fakeIoTData struct {
+	iotdataplaneiface.IoTDataPlaneAPI
+
+	mu     sync.Mutex
+	inputs []*iotdataplane.PublishInput
+	err    error
+}
+
+func (f *fakeIoTData) Publish(in *iotdataplane.PublishInput) (*iotdataplane.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, in)
+	return &iotdataplane.PublishOutput{}, f.err
+}
+
+func (f *fakeIoTData) published() []*iotdataplane.PublishInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*iotdataplane.PublishInput{}, f.inputs...)
+}
+
+// useDataPlane selects MQTT_AUTH_MODE=iot-dataplane for the rest of t, with
+// publishes going to the returned fake.
+func useDataPlane(t *testing.T) *fakeIoTData {
+	t.Helper()
+	t.Setenv("MQTT_AUTH_MODE", mqttclient.AuthIoTDataPlane)
+	newTestBroker(t)
+	api := &fakeIoTData{}
+	prevClient, prevAcquire := newIoTDataClient, acquireClient
+	newIoTDataClient = func() (iotdataplaneiface.IoTDataPlaneAPI, error) { return api, nil }
+	acquireClient = brokerClient
+	t.Cleanup(func() { newIoTDataClient, acquireClient = prevClient, prevAcquire })
+	return api
+}
+
+func TestDataPlanePublish(t *testing.T) {
+	api := useDataPlane(t)
+	resp := post(t, "/", `{"topic":"devices/lamp-1/led","message":"on","qos":1,"retain":true,"content_type":"text/plain"}`, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	inputs := api.published()
+	if len(inputs) != 1 {
+		t.Fatalf("%d Publish calls, want 1", len(inputs))
+	}
+	in := inputs[0]
+	if aws.StringValue(in.Topic) != "devices/lamp-1/led" || aws.Int64Value(in.Qos) != 1 || !aws.BoolValue(in.Retain) ||
+		string(in.Payload) != "on" || aws.StringValue(in.ContentType) != "text/plain" {
+		t.Errorf("Publish %v", in)
+	}
+}
+
+func TestDataPlanePublishFailure(t *testing.T) {
+	api := useDataPlane(t)
+	api.err = errors.New("AccessDenied")
+	if resp := post(t, "/", `{"topic":"devices/lamp-1/led","message":"on","qos":1}`, nil); resp.StatusCode < 500 {
+		t.Errorf("status %d, want a failed publish: %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestDataPlaneRejects(t *testing.T) {
+	api := useDataPlane(t)
+	t.Setenv("ALLOW_DELEGATED_CREDS", "true")
+	resp := post(t, "/", `{"topic":"devices/lamp-1/led","message":"on"}`, map[string]string{"X-Mqtt-Username": "u", "X-Mqtt-Password": "p"})
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 400 || code != "DELEGATED_CREDS_UNSUPPORTED" {
+		t.Errorf("delegated credentials: status %d code %v", resp.StatusCode, code)
+	}
+
+	newIoTDataClient = func() (iotdataplaneiface.IoTDataPlaneAPI, error) { return nil, errors.New("no endpoint") }
+	resp = post(t, "/", `{"topic":"devices/lamp-1/led","message":"on"}`, nil)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 503 || code != "BROKER_UNAVAILABLE" {
+		t.Errorf("endpoint lookup failure: status %d code %v", resp.StatusCode, code)
+	}
+	if n := len(api.published()); n != 0 {
+		t.Errorf("%d Publish calls, want none", n)
+	}
+}
+
+func TestDataPlaneProps(t *testing.T) {
+	api := &fakeIoTData{}
+	c := dataPlaneClient{api: api}
+	token := c.PublishWithProps(mqttclient.Message{Topic: "a", QoS: 0, Payload: "on", UseTopicAlias: true, Props: mqttclient.Props{
+		ResponseTopic:   "a/reply",
+		CorrelationData: []byte("id-1"),
+		UserProperties:  []mqttclient.UserProperty{{Key: "source", Value: "api"}, {Key: "source", Value: "retry"}},
+	}})
+	if err := mqttclient.WaitToken(token, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	in := api.published()[0]
+	if aws.StringValue(in.ResponseTopic) != "a/reply" || aws.StringValue(in.CorrelationData) != "aWQtMQ==" {
+		t.Errorf("Publish %v", in)
+	}
+	// Repeated keys survive as separate pairs
+	if got := aws.StringValue(in.UserProperties); got != `[{"source":"api"},{"source":"retry"}]` {
+		t.Errorf("userProperties %s", got)
+	}
+	if in.ContentType != nil {
+		t.Errorf("contentType %q set without one", aws.StringValue(in.ContentType))
+	}
+
+	// IoT Core has no QoS 2; nothing is sent
+	if err := mqttclient.WaitToken(c.Publish("a", 2, false, "on"), time.Second); err == nil || len(api.published()) != 1 {
+		t.Errorf("QoS 2: %v, %d calls", err, len(api.published()))
+	}
+}
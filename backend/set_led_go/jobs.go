@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Async job statuses, in lifecycle order.
+const (
+	jobQueued    = "queued"
+	jobPublished = "published"
+	jobFailed    = "failed"
+	// jobExpired commands passed their expires_at before being published and
+	// were dropped rather than sent late
+	jobExpired = "expired"
+)
+
+// jobRecord is an async publish's status as stored in JOBS_TABLE. ExpiresAt
+// is the table's TTL attribute.
+type jobRecord struct {
+	JobID     string `json:"jobId" dynamodbav:"jobId"`
+	Status    string `json:"status" dynamodbav:"status"`
+	Topic     string `json:"topic" dynamodbav:"topic"`
+	Code      string `json:"code,omitempty" dynamodbav:"code,omitempty"`
+	Error     string `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	UpdatedAt string `json:"updatedAt" dynamodbav:"updatedAt"`
+	ExpiresAt int64  `json:"-" dynamodbav:"expiresAt"`
+}
+
+// jobStore persists async job status for GET /jobs/{id}.
+type jobStore interface {
+	putJob(job jobRecord) error
+	// getJob returns nil, nil for an unknown (or expired) job
+	getJob(id string) (*jobRecord, error)
+}
+
+// openJobStore returns the configured store, or nil when JOBS_TABLE is unset
+// and job status is not persisted.
+var openJobStore = func() jobStore {
+	table := os.Getenv("JOBS_TABLE")
+	if table == "" {
+		return nil
+	}
+	return dynamoJobStore{db: dynamodb.New(session.Must(session.NewSession())), table: table}
+}
+
+type dynamoJobStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (s dynamoJobStore) putJob(job jobRecord) error {
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item})
+	return err
+}
+
+func (s dynamoJobStore) getJob(id string) (*jobRecord, error) {
+	out, err := s.db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{"jobId": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(out.Item) == 0 {
+		return nil, err
+	}
+	var job jobRecord
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &job); err != nil {
+		return nil, err
+	}
+	// DynamoDB deletes expired items lazily, so filter them here too
+	if job.ExpiresAt > 0 && time.Now().Unix() > job.ExpiresAt {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+// recordJob stores a job transition. Persistence is best effort: a failure is
+// logged but never fails the publish itself.
+func recordJob(store jobStore, jobID, topic, status string, apiErr *apiError) {
+	if store == nil {
+		return
+	}
+	now := time.Now()
+	job := jobRecord{
+		JobID:     jobID,
+		Status:    status,
+		Topic:     topic,
+		UpdatedAt: now.UTC().Format(time.RFC3339),
+		ExpiresAt: now.Add(envDuration("JOB_TTL", 24*time.Hour)).Unix(),
+	}
+	if apiErr != nil {
+		job.Code, job.Error = apiErr.Code, apiErr.Message
+	}
+	if err := store.putJob(job); err != nil {
+		logger.Warn("job status not stored", "jobId", jobID, "status", status, "error", err.Error())
+	}
+}
+
+// jobHandler serves GET /jobs/{id}.
+func jobHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "GET" {
+		return errorRespStatus(405, "Use GET")
+	}
+	store := openJobStore()
+	if store == nil {
+		return errorRespCode(503, "JOBS_DISABLED", "Job status is not stored; set JOBS_TABLE")
+	}
+
+	id := request.PathParameters["id"]
+	if id == "" {
+		id = strings.TrimPrefix(strings.TrimSuffix(request.Path, "/"), "/jobs/")
+	}
+	job, err := store.getJob(id)
+	if err != nil {
+		return errorResp("Job lookup failed: " + err.Error())
+	}
+	if job == nil {
+		return errorRespCode(404, "JOB_NOT_FOUND", "No job "+id)
+	}
+	return jsonResp(200, job)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/mqttclient"
+)
+
+// queuedPublishPath is the synthetic path message-triggered publishes (SQS,
+// EventBridge, SNS, IoT Rules) run under; see handleQueuedPublish.
+const queuedPublishPath = "/queue"
+
+// messageTriggered reports whether request came from a queued message rather
+// than API Gateway, which always sets a request ID.
+func messageTriggered(request events.APIGatewayProxyRequest) bool {
+	return request.Path == queuedPublishPath && request.RequestContext.RequestID == ""
+}
+
+// guardRepublish rejects message-triggered publishes to NO_REPUBLISH_TOPICS, a
+// comma-separated list of topic filters the hub itself consumes. Publishing
+// there in response to a message could feed the message back in a loop.
+// Direct HTTP publishes are never affected.
+func guardRepublish(request events.APIGatewayProxyRequest, topics ...string) *apiError {
+	filters := os.Getenv("NO_REPUBLISH_TOPICS")
+	if filters == "" || !messageTriggered(request) {
+		return nil
+	}
+	for _, filter := range strings.Split(filters, ",") {
+		filter = strings.TrimSpace(filter)
+		for _, topic := range topics {
+			if filter != "" && mqttclient.TopicMatches(filter, topic) {
+				return newAPIError(409, "REPUBLISH_LOOP", "topic "+topic+" cannot be published from a message-triggered request (NO_REPUBLISH_TOPICS)")
+			}
+		}
+	}
+	return nil
+}
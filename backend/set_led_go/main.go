@@ -2,116 +2,231 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
+	"runtime/debug"
+	"strings"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"go.opentelemetry.io/otel/trace"
+
+	"shared/mqttclient"
 )
 
 type RequestBody struct {
-	Topic   string `json:"topic"`
-	Message string `json:"message"`
+	Topic   string       `json:"topic"`
+	Message messageValue `json:"message"`
+	// MessageEncoding "base64" sends a binary message
+	MessageEncoding string          `json:"message_encoding,omitempty"`
+	Payload         json.RawMessage `json:"payload,omitempty"`
+	Format          string          `json:"format,omitempty"`
+	QoS             *int            `json:"qos,omitempty"`
+	Retain          bool            `json:"retain,omitempty"`
+	Color           string          `json:"color,omitempty"`
+	S3Key           string          `json:"s3_key,omitempty"`
+	Source          string          `json:"source,omitempty"`
+	// IfCurrentEquals publishes a retained message only while the topic's
+	// current retained payload equals it ("" for none), else 409
+	IfCurrentEquals *string `json:"if_current_equals,omitempty"`
+	// Variables render the payload template configured for the topic's prefix
+	Variables map[string]json.RawMessage `json:"variables,omitempty"`
+	// ExpiresAt (RFC 3339) drops the command if it cannot be published in time
+	ExpiresAt string `json:"expires_at,omitempty"`
+
+	// MQTT 5 publish properties
+	ContentType   string `json:"content_type,omitempty"`
+	ResponseTopic string `json:"response_topic,omitempty"`
+
+	// Optional progress collection after publishing
+	ProgressTopic     string `json:"progress_topic,omitempty"`
+	ProgressMax       int    `json:"progress_max,omitempty"`
+	ProgressTimeoutMs int    `json:"progress_timeout_ms,omitempty"`
+
+	// Shadow mode: publish a desired-state update for an AWS IoT thing
+	Shadow  bool            `json:"shadow,omitempty"`
+	Thing   string          `json:"thing,omitempty"`
+	Desired json.RawMessage `json:"desired,omitempty"`
+
+	// Wait for the device to acknowledge the command on its ack topic
+	WaitForAck   bool `json:"wait_for_ack,omitempty"`
+	AckTimeoutMs int  `json:"ack_timeout_ms,omitempty"`
+
+	// Async mode: respond 202 with a job ID and publish in the background
+	Async       bool   `json:"async,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// Chunked splits the message into ordered chunks of ChunkSize bytes
+	Chunked   bool `json:"chunked,omitempty"`
+	ChunkSize int  `json:"chunk_size,omitempty"`
+
+	// Multi-message batch; when set the single topic/message are ignored
+	Messages []BatchMessage `json:"messages,omitempty"`
+	// UseTopicAlias reuses MQTT 5 topic aliases across a batch's repeated topics
+	UseTopicAlias bool `json:"use_topic_alias,omitempty"`
+
+	// Broadcast of one message to many topics, deduplicated unless allowed
+	Topics               []string `json:"topics,omitempty"`
+	AllowDuplicateTopics bool     `json:"allow_duplicate_topics,omitempty"`
+	// Group fans the message out to every device registered in the group
+	Group string `json:"group,omitempty"`
 }
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Initialize SSM client
-	sess := session.Must(session.NewSession())
-	ssmClient := ssm.New(sess)
-
-	// Helper to read a parameter
-	getParam := func(name string) string {
-		param, err := ssmClient.GetParameter(&ssm.GetParameterInput{
-			Name:           &name,
-			WithDecryption: awsBool(true),
-		})
-		if err != nil {
-			panic(err)
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (resp events.APIGatewayProxyResponse, err error) {
+	// Any panic still produces a well-formed JSON response, and every
+	// response gets the endpoint's CORS headers
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("panic in handler", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			resp, err = errorRespCode(500, "INTERNAL", "unexpected error"), nil
 		}
-		return *param.Parameter.Value
-	}
+		if err == nil {
+			resp = applyCORS(request, resp)
+		}
+	}()
 
-	// Parse JSON request body
-	var body RequestBody
-	if request.Body != "" {
-		if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
-			return errorResp("Invalid JSON body"), nil
+	// Binary media types make API Gateway base64-encode request bodies too
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return errorRespStatus(400, "Invalid base64 request body"), nil
 		}
+		request.Body = string(decoded)
+		request.IsBase64Encoded = false
 	}
 
-	topic := body.Topic
-	message := body.Message
-
-	if topic == "" || message == "" {
-		return errorResp("Missing 'topic' or 'message' in request body"), nil
-	}
+	applyDeadline(ctx)
 
-	// Fetch credentials and broker
-	username := getParam(os.Getenv("MQTT_USERNAME_SSM") + ":1")
-	password := getParam(os.Getenv("MQTT_PASSWORD_SSM") + ":1")
-	broker := getParam(os.Getenv("MQTT_BROKER_SSM"))
-	port := "8883"
+	ctx, span := tracer.Start(ctx, request.HTTPMethod+" "+request.Resource, trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		endRequestSpan(span, resp.StatusCode)
+		flushTelemetry(ctx)
+	}()
 
-	// Configure MQTT
-	opts := mqtt.NewClientOptions().
-		AddBroker(fmt.Sprintf("tls://%s:%s", broker, port)).
-		SetUsername(username).
-		SetPassword(password).
-		SetTLSConfig(&tls.Config{InsecureSkipVerify: false})
+	resp, err = route(ctx, request)
+	if err != nil {
+		return resp, err
+	}
+	return compressResponse(request, resp), nil
+}
 
-	client := mqtt.NewClient(opts)
+func route(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.HTTPMethod == "OPTIONS" {
+		return preflightResp(), nil
+	}
+	if apiErr := maintenanceGuard(request); apiErr != nil {
+		return apiErr.response(), nil
+	}
+	request, apiErr := withTokenSubject(request)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return errorResp("MQTT connect failed: " + token.Error().Error()), nil
+	switch strings.TrimSuffix(request.Path, "/") {
+	case "/health":
+		return healthHandler(), nil
+	case "/health/deep":
+		return deepHealthHandler(), nil
+	case "/admin/refresh":
+		return adminRefreshHandler(request), nil
+	case "/admin/retained":
+		return adminRetainedHandler(request), nil
+	case "/presence":
+		return presenceHandler(request), nil
+	case "/state":
+		return stateHandler(request), nil
+	case "/sign":
+		return signHandler(request), nil
 	}
-	defer client.Disconnect(100)
+	if strings.HasPrefix(request.Path, "/jobs/") {
+		return jobHandler(request), nil
+	}
+	if p := strings.TrimSuffix(request.Path, "/"); p == "/devices" || strings.HasPrefix(p, "/devices/") {
+		return devicesHandler(request), nil
+	}
+	return publishHandler(ctx, request)
+}
 
-	token := client.Publish(topic, 1, false, message)
-	token.WaitTimeout(3 * time.Second)
-	if token.Error() != nil {
-		return errorResp("Publish failed: " + token.Error().Error()), nil
+// headerValue looks up a request header case-insensitively.
+func headerValue(request events.APIGatewayProxyRequest, name string) string {
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
 	}
+	return ""
+}
 
-	// Success response
-	resp := map[string]interface{}{
-		"published": map[string]string{
-			"topic":   topic,
-			"message": message,
-		},
+func jsonResp(status int, v interface{}) events.APIGatewayProxyResponse {
+	body, err := json.Marshal(v)
+	if _, data := v.(dataMap); err == nil && !data && snakeResponses() {
+		body, err = snakeCaseKeys(body)
+	}
+	if err != nil {
+		// Never answer a success status with an empty body
+		logger.Error("marshal response", "status", status, "error", err.Error())
+		status = 500
+		body = []byte(`{"error":"Failed to encode response","code":"ENCODE_FAILED"}`)
 	}
-	jsonResp, _ := json.Marshal(resp)
 
 	return events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Access-Control-Allow-Origin": "*",
-			"Content-Type":                "application/json",
-		},
-		Body: string(jsonResp),
-	}, nil
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
+
+func errorResp(msg string) events.APIGatewayProxyResponse {
+	return errorRespStatus(500, msg)
 }
 
-func awsBool(b bool) *bool {
-	return &b
+func errorRespStatus(status int, msg string) events.APIGatewayProxyResponse {
+	return errorRespCode(status, "", msg)
 }
 
-func errorResp(msg string) events.APIGatewayProxyResponse {
-	return events.APIGatewayProxyResponse{
-		StatusCode: 500,
-		Body:       fmt.Sprintf(`{"error":"%s"}`, msg),
-		Headers: map[string]string{
-			"Access-Control-Allow-Origin": "*",
-			"Content-Type":                "application/json",
-		},
+// errorRespCode adds a machine-readable code alongside the error message.
+func errorRespCode(status int, code, msg string) events.APIGatewayProxyResponse {
+	body := map[string]string{"error": msg}
+	if code != "" {
+		body["code"] = code
 	}
+	return jsonResp(status, body)
+}
+
+// preflightResp answers CORS preflight requests that reach the Lambda;
+// applyCORS adds what the endpoint allows.
+func preflightResp() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{StatusCode: 204, Headers: map[string]string{}}
 }
 
 func main() {
-	lambda.Start(handler)
+	// The broker transport logs alongside the handler and clamps its connects
+	// to the invocation deadline like every other MQTT operation
+	mqttclient.Logger = logger
+	mqttclient.ConnectTimeout = connectTimeout
+
+	// A bad pattern or pin must stop the cold start rather than allow every
+	// topic or broker
+	for _, load := range []func() error{compileTopicRegex, mqttclient.LoadCertPins} {
+		if err := load(); err != nil {
+			logger.Error("invalid configuration", "error", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := initTelemetry(context.Background()); err != nil {
+		logger.Warn("OpenTelemetry disabled", "error", err.Error())
+	}
+	// Preload dynamic configuration during the cold start
+	if err := mqttclient.LoadConfigPath(mqttclient.NewSSMClient(), time.Now()); err != nil {
+		logger.Warn("config preload failed", "path", mqttclient.ConfigPath(), "error", err.Error())
+	}
+	logStartupSummary()
+	prewarmBrokerPool()
+	// Enabling SIGTERM registers an internal extension so onShutdown can drain
+	// background publishes before the container is recycled
+	lambda.StartWithOptions(dispatch, lambda.WithEnableSIGTERM(onShutdown))
 }
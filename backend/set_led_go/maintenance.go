@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/mqttclient"
+)
+
+// maintenanceMode reports whether publishing is paused for broker
+// maintenance. The flag is read from SSM_CONFIG_PATH/maintenance_mode when
+// that parameter exists, so operators can flip it without a redeploy, and
+// from MAINTENANCE_MODE otherwise.
+func maintenanceMode() bool {
+	raw, ok := mqttclient.ConfigValue("maintenance_mode")
+	if !ok {
+		raw = os.Getenv("MAINTENANCE_MODE")
+	}
+	on, _ := strconv.ParseBool(strings.TrimSpace(raw))
+	return on
+}
+
+// maintenanceAllowed reports whether request keeps working in maintenance
+// mode: health probes, reads that only look at state or the device registry,
+// token signing and the admin refresh that picks up a changed flag.
+func maintenanceAllowed(request events.APIGatewayProxyRequest) bool {
+	path := strings.TrimSuffix(request.Path, "/")
+	switch path {
+	case "/health", "/health/deep", "/state", "/presence", "/sign", "/admin/refresh":
+		return true
+	}
+	if request.HTTPMethod == "GET" && (path == "/devices" || strings.HasPrefix(path, "/devices/")) {
+		return true
+	}
+	return strings.HasPrefix(path, "/jobs/")
+}
+
+// maintenanceGuard rejects request while maintenance mode is on, before any
+// credentials are loaded or the broker is contacted.
+func maintenanceGuard(request events.APIGatewayProxyRequest) *apiError {
+	if maintenanceAllowed(request) || !maintenanceMode() {
+		return nil
+	}
+	apiErr := newAPIError(503, "MAINTENANCE", "publishing temporarily disabled")
+	apiErr.RetryAfter = envDuration("MAINTENANCE_RETRY_AFTER", time.Minute)
+	return apiErr
+}
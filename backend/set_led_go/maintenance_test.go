@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestMaintenanceGuard(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY_SSM", "/replay/admin-key")
+	admin := map[string]string{"X-Api-Key": "k"}
+	tests := []struct {
+		method, path string
+		body         string
+		paused       bool // answered 503 while maintenance is on
+	}{
+		{"POST", "/set-led", `{"topic":"devices/lamp/led","message":"on"}`, true},
+		{"GET", "/devices", "", false},
+		{"GET", "/devices/lamp", "", false},
+		{"POST", "/devices", `{"deviceId":"lamp-2","topics":["devices/lamp-2/#"]}`, true},
+		{"DELETE", "/devices/lamp", "", true},
+		{"GET", "/health", "", false},
+	}
+	for _, mode := range []string{"true", "false"} {
+		for _, tt := range tests {
+			t.Run(mode+" "+tt.method+" "+tt.path, func(t *testing.T) {
+				t.Cleanup(seedConfig(map[string]string{"maintenance_mode": mode, "admin-key": "k"}))
+				newTestBroker(t)
+				newMemRegistry(t, deviceRecord{DeviceID: "lamp", Topics: []string{"devices/lamp/#"}})
+
+				resp := call(t, events.APIGatewayProxyRequest{HTTPMethod: tt.method, Path: tt.path, Body: tt.body, Headers: admin})
+				paused := resp.StatusCode == 503 && decodeBody(t, resp)["code"] == "MAINTENANCE"
+				if want := tt.paused && mode == "true"; paused != want {
+					t.Errorf("paused = %v, want %v (status %d: %s)", paused, want, resp.StatusCode, resp.Body)
+				}
+				if !paused && resp.StatusCode >= 500 {
+					t.Errorf("status %d: %s", resp.StatusCode, resp.Body)
+				}
+			})
+		}
+	}
+}
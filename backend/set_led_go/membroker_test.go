@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// memBroker is an in-process MQTT broker for the handler tests and the event
+// fixtures. It keeps retained messages, honours + and # subscriptions and
+// delivers QoS 0 and 1 synchronously, so a publish token completes only after
+// every matching subscriber has seen the message. QoS 2 is treated as QoS 1.
+type memBroker struct {
+	mu       sync.Mutex
+	retained map[string]*memMessage
+	subs     map[*memClient]map[string]memSub
+}
+
+type memSub struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+func newMemBroker() *memBroker {
+	return &memBroker{
+		retained: map[string]*memMessage{},
+		subs:     map[*memClient]map[string]memSub{},
+	}
+}
+
+// client returns a new, already connected client of b.
+func (b *memBroker) client() *memClient {
+	c := &memClient{broker: b, connected: true}
+	b.mu.Lock()
+	b.subs[c] = map[string]memSub{}
+	b.mu.Unlock()
+	return c
+}
+
+// retainedPayloads snapshots the retained messages as topic → payload.
+func (b *memBroker) retainedPayloads() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]string, len(b.retained))
+	for topic, m := range b.retained {
+		out[topic] = string(m.payload)
+	}
+	return out
+}
+
+// publish stores msg when retained (an empty payload clears the topic) and
+// hands it to every matching subscription.
+func (b *memBroker) publish(msg *memMessage) {
+	type delivery struct {
+		client  *memClient
+		handler mqtt.MessageHandler
+		qos     byte
+	}
+	b.mu.Lock()
+	if msg.retained {
+		if len(msg.payload) == 0 {
+			delete(b.retained, msg.topic)
+		} else {
+			b.retained[msg.topic] = msg
+		}
+	}
+	var deliveries []delivery
+	for c, filters := range b.subs {
+		for filter, sub := range filters {
+			if mqttclient.TopicMatches(filter, msg.topic) {
+				deliveries = append(deliveries, delivery{c, sub.handler, sub.qos})
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	// Live deliveries never carry the retain flag
+	for _, d := range deliveries {
+		d.handler(d.client, msg.forSubscriber(d.qos, false))
+	}
+}
+
+// memClient is an mqtt.Client attached to a memBroker.
+type memClient struct {
+	broker *memBroker
+
+	mu        sync.Mutex
+	connected bool
+}
+
+var errMemNotConnected = errors.New("not connected")
+
+func (c *memClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *memClient) IsConnectionOpen() bool { return c.IsConnected() }
+
+func (c *memClient) Connect() mqtt.Token {
+	c.mu.Lock()
+	c.connected = true
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+// Disconnect drops the connection and every subscription, like a clean
+// session.
+func (c *memClient) Disconnect(uint) {
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+	c.broker.mu.Lock()
+	c.broker.subs[c] = map[string]memSub{}
+	c.broker.mu.Unlock()
+}
+
+func (c *memClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if !c.IsConnected() {
+		return failedToken(errMemNotConnected)
+	}
+	var body []byte
+	switch p := payload.(type) {
+	case string:
+		body = []byte(p)
+	case []byte:
+		body = p
+	default:
+		return failedToken(fmt.Errorf("unsupported payload type %T", payload))
+	}
+	c.broker.publish(&memMessage{topic: topic, payload: body, qos: qos, retained: retained})
+	return doneToken{}
+}
+
+func (c *memClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple registers the filters and then replays matching retained
+// messages to callback, as a broker does on SUBACK.
+func (c *memClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	if !c.IsConnected() {
+		return failedToken(errMemNotConnected)
+	}
+	b := c.broker
+	b.mu.Lock()
+	var retained []*memMessage
+	for filter, qos := range filters {
+		b.subs[c][filter] = memSub{qos: qos, handler: callback}
+		for topic, m := range b.retained {
+			if mqttclient.TopicMatches(filter, topic) {
+				retained = append(retained, m.forSubscriber(qos, true))
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	if callback != nil {
+		for _, m := range retained {
+			callback(c, m)
+		}
+	}
+	return doneToken{}
+}
+
+func (c *memClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	for _, t := range topics {
+		delete(c.broker.subs[c], t)
+	}
+	return doneToken{}
+}
+
+func (c *memClient) AddRoute(string, mqtt.MessageHandler)    {}
+func (c *memClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// memMessage is a message as stored by memBroker and seen by subscribers.
+type memMessage struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+// forSubscriber copies m with the QoS downgraded to the subscription's and
+// the retain flag set as delivered.
+func (m *memMessage) forSubscriber(subQoS byte, retained bool) *memMessage {
+	out := *m
+	if subQoS < out.qos {
+		out.qos = subQoS
+	}
+	if out.qos > 1 {
+		out.qos = 1
+	}
+	out.retained = retained
+	return &out
+}
+
+func (m *memMessage) Duplicate() bool   { return false }
+func (m *memMessage) Qos() byte         { return m.qos }
+func (m *memMessage) Retained() bool    { return m.retained }
+func (m *memMessage) Topic() string     { return m.topic }
+func (m *memMessage) MessageID() uint16 { return 0 }
+func (m *memMessage) Payload() []byte   { return m.payload }
+func (m *memMessage) Ack()              {}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+)
+
+// errStructuredMessage is returned when 'message' holds an object or array;
+// structured JSON belongs in 'payload'.
+var errStructuredMessage = errors.New("'message' must be a string, number or boolean; use 'payload' for objects and arrays")
+
+// errInvalidUTF8 rejects a text 'message' that is not valid UTF-8. The JSON
+// decoder would otherwise replace the bad bytes with U+FFFD and publish a
+// subtly different command. ENFORCE_UTF8=false turns the check off.
+var errInvalidUTF8 = errors.New("'message' is not valid UTF-8; send binary data base64-encoded with \"message_encoding\": \"base64\"")
+
+// messageValue is the 'message' field. Besides strings it accepts JSON numbers
+// and booleans, publishing their literal text (42, true).
+type messageValue string
+
+func (m *messageValue) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0 || bytes.Equal(data, []byte("null")):
+		*m = ""
+	case data[0] == '"':
+		if !utf8.Valid(data) && envBool("ENFORCE_UTF8", true) {
+			return errInvalidUTF8
+		}
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*m = messageValue(s)
+	case data[0] == '{' || data[0] == '[':
+		return errStructuredMessage
+	default:
+		// number or boolean: keep the literal text
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*m = messageValue(data)
+	}
+	return nil
+}
+
+// payloadMessage compacts a structured 'payload' into the published text.
+func payloadMessage(payload json.RawMessage) (string, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, payload); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// decodeMessage applies 'message_encoding' to a message: "base64" carries
+// binary payloads, which are exempt from the UTF-8 check; empty means text.
+func decodeMessage(m messageValue, encoding string) (string, *apiError) {
+	switch encoding {
+	case "":
+		return string(m), nil
+	case "base64":
+		b, err := base64.StdEncoding.DecodeString(string(m))
+		if err != nil {
+			return "", newAPIError(400, "INVALID_BASE64", "'message' is not valid base64")
+		}
+		return string(b), nil
+	}
+	return "", newAPIError(400, "UNKNOWN_ENCODING", "unknown 'message_encoding' "+encoding+"; use base64")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Publish metrics are written as CloudWatch Embedded Metric Format log lines,
+// so they need no API calls; CloudWatch extracts them from the log stream.
+// Emission is off unless METRICS_NAMESPACE is set.
+
+// sizeBuckets are the SizeBucket dimension's upper bounds, in bytes.
+var sizeBuckets = []struct {
+	max  int
+	name string
+}{
+	{256, "<256B"},
+	{1024, "256B-1KB"},
+	{16 * 1024, "1KB-16KB"},
+	{128 * 1024, "16KB-128KB"},
+}
+
+// sizeBucket names the size range payloadBytes falls into.
+func sizeBucket(payloadBytes int) string {
+	for _, b := range sizeBuckets {
+		if payloadBytes < b.max {
+			return b.name
+		}
+	}
+	return ">=128KB"
+}
+
+// emitPublishMetrics records one publish's payload size and latency.
+func emitPublishMetrics(msg outboundMessage, latency time.Duration, apiErr *apiError) {
+	outcome := "ok"
+	if apiErr != nil {
+		outcome = "error"
+	}
+	recordPublishTelemetry(msg, latency, outcome)
+
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		return
+	}
+	emf := map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{{"SizeBucket"}, {}},
+			"Metrics": []map[string]string{
+				{"Name": "PayloadBytes", "Unit": "Bytes"},
+				{"Name": "PublishLatency", "Unit": "Milliseconds"},
+			},
+		}},
+	}
+	logger.Info("publish metrics",
+		"_aws", emf,
+		"SizeBucket", sizeBucket(len(msg.Payload)),
+		"PayloadBytes", len(msg.Payload),
+		"PublishLatency", latency.Milliseconds(),
+		"topic", msg.Topic,
+		"qos", msg.QoS,
+		"outcome", outcome,
+	)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// messageIDNamespace is the RFC 4122 URL namespace, used to derive stable
+// name-based (version 5) message IDs from idempotency keys.
+var messageIDNamespace = [16]byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// messageID returns the ID for the index'th of n messages in request, or ""
+// unless INJECT_MESSAGE_ID is set. The ID lets devices drop a broker
+// redelivery they have already handled. With an Idempotency-Key header it is
+// derived from the key, the topic and the position in the request, so a
+// retried request carries the same IDs as the original; otherwise it is
+// random.
+func messageID(request events.APIGatewayProxyRequest, topic string, index, n int) string {
+	if !envBool("INJECT_MESSAGE_ID", false) {
+		return ""
+	}
+	key := headerValue(request, "Idempotency-Key")
+	if key == "" {
+		return randomUUID()
+	}
+	name := key + "\n" + topic
+	if n > 1 {
+		name += "\n" + strconv.Itoa(index)
+	}
+	return nameUUID(name)
+}
+
+// assignMessageIDs sets messageID on every entry of a multi-message request.
+func assignMessageIDs(request events.APIGatewayProxyRequest, msgs []outboundMessage) {
+	for i := range msgs {
+		msgs[i].MessageID = messageID(request, msgs[i].Topic, i, len(msgs))
+	}
+}
+
+// applyMessageID carries msg.MessageID to the device: JSON object payloads
+// get a MESSAGE_ID_KEY field (default "_msgId"), keeping one the caller set;
+// other payloads get MQTT 5 correlation data, or go without on MQTT 3.1.1.
+func applyMessageID(msg outboundMessage, v5 bool) outboundMessage {
+	if msg.MessageID == "" {
+		return msg
+	}
+	if payload, ok := injectJSONField(msg.Payload, messageIDKey(), msg.MessageID, false); ok {
+		msg.Payload = payload
+		return msg
+	}
+	if v5 {
+		msg.Props.CorrelationData = []byte(msg.MessageID)
+	}
+	return msg
+}
+
+// messageIDKey is the JSON field carrying a message ID, MESSAGE_ID_KEY
+// (default "_msgId").
+func messageIDKey() string {
+	if key := os.Getenv("MESSAGE_ID_KEY"); key != "" {
+		return key
+	}
+	return "_msgId"
+}
+
+// nameUUID returns the version 5 UUID for name in messageIDNamespace.
+func nameUUID(name string) string {
+	h := sha1.New()
+	h.Write(messageIDNamespace[:])
+	h.Write([]byte(name))
+	return formatUUID(h.Sum(nil)[:16], 0x50)
+}
+
+// randomUUID returns a version 4 UUID.
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return formatUUID(b, 0x40)
+}
+
+func formatUUID(b []byte, version byte) string {
+	b[6] = b[6]&0x0f | version
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
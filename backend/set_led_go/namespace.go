@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/apigw"
+	"shared/topics"
+)
+
+// Topics are placed in the caller's USER_NAMESPACE as shared/topics
+// describes, with the subject taken from the caller's JWT.
+
+// requestSubject returns the "sub" claim of the caller's JWT. A request no
+// authorizer vouched for may act for a delegated subject instead.
+func requestSubject(request events.APIGatewayProxyRequest) string {
+	if sub := apigw.Subject(request); sub != "" {
+		return sub
+	}
+	sub, _ := request.RequestContext.Authorizer[delegatedSubjectKey].(string)
+	return sub
+}
+
+// delegatedSubjectKey is the authorizer context key holding the subject a
+// request acts for without a JWT: the user a verified publish token was
+// signed for (withTokenSubject) or a scheduled command's owner
+// (scheduledRequest).
+const delegatedSubjectKey = "delegatedSubject"
+
+// userTopic places a caller-supplied topic (or filter) in the caller's
+// namespace. It returns topic unchanged when USER_NAMESPACE is not set.
+func userTopic(request events.APIGatewayProxyRequest, topic string) (string, *apiError) {
+	placed, err := topics.Place(requestSubject(request), topic)
+	if errors.Is(err, topics.ErrNoSubject) {
+		return "", newAPIError(401, "NO_SUBJECT", err.Error())
+	}
+	if err != nil {
+		return "", newAPIError(403, "USER_NAMESPACE", err.Error())
+	}
+	return placed, nil
+}
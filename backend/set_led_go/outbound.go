@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"shared/mqttclient"
+)
+
+// outboundMessage is one message as it will be handed to the broker.
+type outboundMessage struct {
+	Topic    string
+	QoS      int
+	Retained bool
+	Payload  string
+	Props    mqttclient.Props
+	// Source identifies who issued the command; see applySource
+	Source string
+	// UseTopicAlias lets a v5 client replace a repeated topic with an alias
+	UseTopicAlias bool
+	// Format names the codec that encoded Payload, if any; see codecs
+	Format string
+	// ExpiresAt, when set, drops the message instead of publishing it late
+	ExpiresAt time.Time
+	// MessageID lets devices deduplicate redeliveries; see assignMessageIDs
+	MessageID string
+}
+
+// wire is msg as handed to the broker client.
+func (msg outboundMessage) wire() mqttclient.Message {
+	return mqttclient.Message{
+		Topic:         msg.Topic,
+		QoS:           msg.QoS,
+		Retained:      msg.Retained,
+		Payload:       msg.Payload,
+		Props:         msg.Props,
+		UseTopicAlias: msg.UseTopicAlias,
+	}
+}
+
+// filterCovers reports whether every topic matched by filter is also matched
+// by scope, e.g. "home/#" covers "home/+/status" but "home/+" does not cover
+// "home/#".
+func filterCovers(scope, filter string) bool {
+	s := strings.Split(scope, "/")
+	f := strings.Split(filter, "/")
+	for i, part := range s {
+		if part == "#" {
+			return true
+		}
+		if i >= len(f) || f[i] == "#" {
+			return false
+		}
+		if part != "+" && part != f[i] {
+			return false
+		}
+	}
+	return len(f) == len(s)
+}
+
+// validFilter reports whether filter is a well-formed MQTT topic filter:
+// "+" and "#" only as whole levels, and "#" only as the last one.
+func validFilter(filter string) bool {
+	parts := strings.Split(filter, "/")
+	for i, part := range parts {
+		if part == "+" || (part == "#" && i == len(parts)-1) {
+			continue
+		}
+		if strings.ContainsAny(part, "+#") {
+			return false
+		}
+	}
+	return filter != ""
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Presence states reported by GET /presence.
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+	presenceUnknown = "unknown"
+)
+
+// presenceTemplate is the topic devices publish their retained online/offline
+// status to (typically as birth message and LWT), with {device} standing for
+// one topic level: PRESENCE_TOPIC, default "devices/{device}/status".
+func presenceTemplate() string {
+	if t := os.Getenv("PRESENCE_TOPIC"); t != "" {
+		return t
+	}
+	return "devices/{device}/status"
+}
+
+// presenceHandler serves GET /presence?device=<id> from the retained status
+// messages, answering {device: "online"|"offline"|"unknown"}. device=* (or no
+// device) reports every device that has published a status.
+func presenceHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "GET" {
+		return errorRespStatus(405, "Use GET")
+	}
+	template, apiErr := userTopic(request, presenceTemplate())
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	template = prefixTopic(template)
+	if strings.Count(template, "{device}") != 1 {
+		return errorRespCode(500, "CONFIG_ERROR", "PRESENCE_TOPIC must contain {device} once")
+	}
+	device := request.QueryStringParameters["device"]
+	if device == "*" {
+		device = ""
+	}
+	if strings.ContainsAny(device, "/+#") {
+		return errorRespStatus(400, "'device' must be a single topic level")
+	}
+
+	filter := strings.Replace(template, "{device}", "+", 1)
+	if device != "" {
+		filter = strings.Replace(template, "{device}", device, 1)
+	}
+	apiErr = validateSubscription(filter)
+	if apiErr == nil {
+		apiErr = authorizeSubscriptionToken(request, filter)
+	}
+	if apiErr == nil {
+		apiErr = authorizeSubscription(request, filter)
+	}
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	route := template[:strings.Index(template, "{device}")]
+	client, release, apiErr := acquireClient(mqttCreds{}, route, nil)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	defer release()
+
+	items, err := retainedSnapshot(client, filter)
+	if errors.Is(err, errSubscriptionLimit) {
+		return errorRespCode(429, "SUBSCRIPTION_LIMIT", "Too many concurrent subscriptions; retry shortly")
+	}
+	if err != nil {
+		return errorRespCode(502, "SUBSCRIBE_FAILED", "Presence subscribe failed: "+err.Error())
+	}
+
+	presence := dataMap{}
+	if device != "" {
+		presence[device] = presenceUnknown
+	}
+	level := strings.Count(route, "/")
+	for _, m := range items {
+		if levels := strings.Split(m.Topic, "/"); level < len(levels) {
+			presence[levels[level]] = presenceState(m.Message)
+		}
+	}
+	return jsonResp(200, presence)
+}
+
+// presenceState reads a status payload: a bare "online"/"offline" (or
+// "true"/"false", "1"/"0"), or a JSON object with a "status" string or an
+// "online" boolean. Anything else is unknown.
+func presenceState(payload string) string {
+	switch strings.ToLower(strings.Trim(strings.TrimSpace(payload), `"`)) {
+	case "online", "true", "1", "connected":
+		return presenceOnline
+	case "offline", "false", "0", "disconnected":
+		return presenceOffline
+	}
+	var obj struct {
+		Status string `json:"status"`
+		Online *bool  `json:"online"`
+	}
+	if json.Unmarshal([]byte(payload), &obj) != nil {
+		return presenceUnknown
+	}
+	if obj.Online != nil {
+		if *obj.Online {
+			return presenceOnline
+		}
+		return presenceOffline
+	}
+	if obj.Status != "" {
+		return presenceState(obj.Status)
+	}
+	return presenceUnknown
+}
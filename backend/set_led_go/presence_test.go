@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestPresenceIsNamespaced(t *testing.T) {
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	t.Setenv("STATE_QUIET_PERIOD", "10ms")
+	broker := newTestBroker(t)
+	seed := broker.client()
+	seed.Publish("users/u1/devices/lamp/status", 1, true, "online")
+	seed.Publish("users/u2/devices/fan/status", 1, true, "online")
+	seed.Publish("devices/kettle/status", 1, true, "offline")
+
+	resp := call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/presence"}, map[string]interface{}{"sub": "u1"}))
+	body := decodeBody(t, resp)
+	if resp.StatusCode != 200 || len(body) != 1 || body["lamp"] != presenceOnline {
+		t.Errorf("status %d body %v, want only u1's lamp", resp.StatusCode, body)
+	}
+
+	if resp := call(t, events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/presence"}); resp.StatusCode != 401 {
+		t.Errorf("no subject: status %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// progressMessage is one message received on a progress topic.
+type progressMessage struct {
+	Topic   string `json:"topic"`
+	Message string `json:"message"`
+}
+
+// progressCollector buffers messages from a progress subscription that is
+// opened before the command is published, so early progress is not missed.
+type progressCollector struct {
+	client mqtt.Client
+	topic  string
+	ch     chan progressMessage
+}
+
+// errSubscriptionLimit is returned when MAX_ACTIVE_SUBSCRIPTIONS
+// subscriptions are already open in this container.
+var errSubscriptionLimit = errors.New("too many active subscriptions")
+
+// Subscription slots are shared by every concurrent request in the
+// container and sized once from MAX_ACTIVE_SUBSCRIPTIONS.
+var (
+	subSlotsOnce sync.Once
+	subSlots     chan struct{}
+)
+
+// acquireSubscription takes a subscription slot without waiting; the caller
+// must call releaseSubscription once it has unsubscribed.
+func acquireSubscription() bool {
+	subSlotsOnce.Do(func() { subSlots = make(chan struct{}, envInt("MAX_ACTIVE_SUBSCRIPTIONS", 10)) })
+	select {
+	case subSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSubscription() { <-subSlots }
+
+// startProgress subscribes to topic, keeping at most max messages.
+func startProgress(client mqtt.Client, topic string, qos byte, max int) (*progressCollector, error) {
+	if !acquireSubscription() {
+		return nil, errSubscriptionLimit
+	}
+	p := &progressCollector{client: client, topic: topic, ch: make(chan progressMessage, max)}
+	token := client.Subscribe(topic, qos, func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case p.ch <- progressMessage{Topic: m.Topic(), Message: string(m.Payload())}:
+		default: // buffer full: the caller has all it asked for
+		}
+	})
+	if err := mqttclient.WaitToken(token, connectTimeout()); err != nil {
+		releaseSubscription()
+		return nil, err
+	}
+	return p, nil
+}
+
+// collect waits up to window for max messages or a terminal message and
+// reports whether a terminal message was seen.
+func (p *progressCollector) collect(max int, window time.Duration) ([]progressMessage, bool) {
+	msgs := []progressMessage{}
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+
+	for len(msgs) < max {
+		select {
+		case m := <-p.ch:
+			msgs = append(msgs, m)
+			if isTerminalProgress(m.Message) {
+				return msgs, true
+			}
+		case <-timer.C:
+			return msgs, false
+		}
+	}
+	return msgs, false
+}
+
+// close unsubscribes from the progress topic and frees its slot, even when
+// the unsubscribe times out.
+func (p *progressCollector) close() {
+	defer releaseSubscription()
+	mqttclient.WaitToken(p.client.Unsubscribe(p.topic), connectTimeout())
+}
+
+// isTerminalProgress reports whether a progress payload is JSON carrying
+// "done": true.
+func isTerminalProgress(payload string) bool {
+	var v struct {
+		Done bool `json:"done"`
+	}
+	return json.Unmarshal([]byte(payload), &v) == nil && v.Done
+}
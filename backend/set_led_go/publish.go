@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+	"shared/topics"
+)
+
+// apiError is a failure that maps directly onto an HTTP error response.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	// RetryAfter, when set, is sent as a Retry-After header
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func (e *apiError) response() events.APIGatewayProxyResponse {
+	resp := errorRespCode(e.Status, e.Code, e.Message)
+	if e.RetryAfter > 0 {
+		// Whole seconds, rounded up so a client never retries early
+		resp.Headers["Retry-After"] = strconv.Itoa(int((e.RetryAfter + time.Second - 1) / time.Second))
+	}
+	return resp
+}
+
+func newAPIError(status int, code, msg string) *apiError {
+	return &apiError{Status: status, Code: code, Message: msg}
+}
+
+// unknownFieldError names a request body field STRICT_JSON does not accept.
+type unknownFieldError struct{ field string }
+
+func (e *unknownFieldError) Error() string { return "unknown field " + e.field + " in request body" }
+
+// decodeRequestBody parses a publish request. With STRICT_JSON=true a field
+// RequestBody does not define (say a misspelt "messsage") is an
+// unknownFieldError instead of being silently ignored.
+func decodeRequestBody(data string, body *RequestBody) error {
+	if !envBool("STRICT_JSON", false) {
+		return json.Unmarshal([]byte(data), body)
+	}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(body); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return &unknownFieldError{field: field}
+		}
+		return err
+	}
+	// Like json.Unmarshal, refuse anything after the object
+	if dec.More() {
+		return errors.New("trailing data after request body")
+	}
+	return nil
+}
+
+func publishHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Parse JSON request body
+	var body RequestBody
+	if request.Body != "" {
+		if err := decodeRequestBody(request.Body, &body); err != nil {
+			var unknown *unknownFieldError
+			if errors.As(err, &unknown) {
+				return errorRespCode(400, "UNKNOWN_FIELD", unknown.Error()), nil
+			}
+			if errors.Is(err, errStructuredMessage) {
+				return errorRespStatus(400, err.Error()), nil
+			}
+			if errors.Is(err, errInvalidUTF8) {
+				return errorRespCode(400, "INVALID_UTF8", err.Error()), nil
+			}
+			return errorResp("Invalid JSON body"), nil
+		}
+	}
+
+	if body.Group != "" {
+		return publishGroup(request, body), nil
+	}
+	if len(body.Topics) > 0 {
+		return publishBroadcast(request, body), nil
+	}
+	if len(body.Messages) > 0 {
+		return publishBatch(request, body), nil
+	}
+
+	topic, apiErr := placeTopic(request, body.Topic)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+	message, apiErr := decodeMessage(body.Message, body.MessageEncoding)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+
+	if body.Shadow {
+		if topic != "" || message != "" || len(body.Payload) > 0 {
+			return errorRespStatus(400, "Shadow updates take 'thing' and 'desired' instead of 'topic' and 'message'"), nil
+		}
+		// Shadow topics belong to AWS IoT, never to a user's namespace
+		if os.Getenv("USER_NAMESPACE") != "" {
+			return errorRespCode(403, "USER_NAMESPACE", "Shadow updates are not available with USER_NAMESPACE"), nil
+		}
+		var apiErr *apiError
+		if topic, message, apiErr = shadowUpdate(body.Thing, body.Desired); apiErr != nil {
+			return apiErr.response(), nil
+		}
+	}
+
+	// A structured payload is published as compact JSON, or encoded with the
+	// codec for 'format'
+	if len(body.Payload) > 0 {
+		if message != "" {
+			return errorRespStatus(400, "Use either 'payload' or 'message', not both"), nil
+		}
+		if body.Format != "" {
+			var apiErr *apiError
+			if message, apiErr = encodePayload(body.Format, body.Payload); apiErr != nil {
+				return apiErr.response(), nil
+			}
+		} else {
+			var err error
+			if message, err = payloadMessage(body.Payload); err != nil {
+				return errorRespStatus(400, "Invalid 'payload': "+err.Error()), nil
+			}
+		}
+	} else if body.Format != "" {
+		return errorRespStatus(400, "'format' requires a structured 'payload'"), nil
+	}
+
+	// A color replaces the message with the rendered COLOR_TEMPLATE
+	if body.Color != "" {
+		if message != "" {
+			return errorRespStatus(400, "Use either 'color' or 'message', not both"), nil
+		}
+		color, err := normalizeColor(body.Color)
+		if err != nil {
+			return errorRespCode(400, "INVALID_COLOR", err.Error()), nil
+		}
+		message = renderColorMessage(color)
+	}
+
+	// An S3 key publishes a presigned reference instead of the object itself
+	if body.S3Key != "" {
+		if message != "" {
+			return errorRespStatus(400, "Use either 's3_key' or 'message', 'payload' or 'color', not several"), nil
+		}
+		var apiErr *apiError
+		if message, apiErr = s3ReferenceMessage(body.S3Key, time.Now()); apiErr != nil {
+			return apiErr.response(), nil
+		}
+	}
+
+	if len(body.Variables) > 0 && topic != "" {
+		var apiErr *apiError
+		if message, apiErr = templateMessage(topic, message, body.Variables); apiErr != nil {
+			return apiErr.response(), nil
+		}
+	}
+
+	if topic == "" || message == "" {
+		return errorResp("Missing 'topic' or 'message' in request body"), nil
+	}
+
+	qos, apiErr := parseQoS(body.QoS)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+	if apiErr := validateTopic(topic); apiErr != nil {
+		return apiErr.response(), nil
+	}
+	expiresAt, apiErr := parseExpiry(body.ExpiresAt)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+	if commandExpired(expiresAt, time.Now()) {
+		// A queued command that sat too long is dropped but acknowledged, so
+		// the queue does not redeliver it; a direct caller is told outright
+		if messageTriggered(request) {
+			logger.Info("expired command dropped", "topic", topic, "expiresAt", body.ExpiresAt)
+			return jsonResp(200, map[string]interface{}{"topic": topic, "status": jobExpired}), nil
+		}
+		return expiredError(expiresAt).response(), nil
+	}
+	if apiErr := guardRepublish(request, topic); apiErr != nil {
+		return apiErr.response(), nil
+	}
+	if apiErr := authorizePublishToken(request, topic); apiErr != nil {
+		return apiErr.response(), nil
+	}
+
+	creds, apiErr := delegatedCreds(request)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+
+	msg := outboundMessage{
+		Topic:     topic,
+		QoS:       topicQoS(topic, qos),
+		Retained:  body.Retain,
+		Payload:   message,
+		Props:     mqttclient.Props{ContentType: body.ContentType, ResponseTopic: body.ResponseTopic},
+		Source:    requestSource(request, body.Source),
+		Format:    strings.ToLower(body.Format),
+		ExpiresAt: expiresAt,
+		MessageID: messageID(request, topic, 0, 1),
+	}
+	if apiErr := authorizeDevices(request, msg); apiErr != nil {
+		return apiErr.response(), nil
+	}
+	if body.ProgressTopic != "" {
+		if body.ProgressTopic, apiErr = replyTopic(request, body.ProgressTopic, validateSubscription); apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, "progress_topic: "+apiErr.Message), nil
+		}
+	}
+	if msg.Props.ResponseTopic != "" {
+		// Replies are read back from the response topic, so a token must
+		// cover it as it covers progress and ack topics
+		if msg.Props.ResponseTopic, apiErr = replyTopic(request, msg.Props.ResponseTopic, validateTopic); apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, "response_topic: "+apiErr.Message), nil
+		}
+	}
+
+	if body.Chunked {
+		if body.Retain || body.Async {
+			return errorRespStatus(400, "'chunked' cannot be combined with 'retain' or 'async'"), nil
+		}
+		if msg.MessageID == "" {
+			msg.MessageID = randomUUID()
+		}
+	}
+	if body.WaitForAck {
+		if body.Async || body.Chunked {
+			return errorRespStatus(400, "'wait_for_ack' cannot be combined with 'async' or 'chunked'"), nil
+		}
+		ackTo := ackTopic(msg)
+		apiErr := validateSubscription(ackTo)
+		if apiErr == nil {
+			apiErr = authorizeSubscriptionToken(request, ackTo)
+		}
+		if apiErr == nil {
+			apiErr = authorizeSubscription(request, ackTo)
+		}
+		if apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, "ack topic: "+apiErr.Message), nil
+		}
+		// The device must echo the ID the command actually carries
+		if id, _ := payloadMessageID(msg.Payload); id != "" {
+			msg.MessageID = id
+		} else if msg.MessageID == "" {
+			msg.MessageID = randomUUID()
+		}
+	}
+
+	if body.IfCurrentEquals != nil && (!body.Retain || body.Async || body.Chunked) {
+		return errorRespStatus(400, "'if_current_equals' requires 'retain' and cannot be combined with 'async' or 'chunked'"), nil
+	}
+
+	if body.Async {
+		return acceptAsync(ctx, request, body, creds, msg), nil
+	}
+
+	// Identical repeats within the dedup window are answered from memory,
+	// unless conditional: the state may have moved on since
+	dedupWindow := envDuration("DEDUP_WINDOW", 0)
+	if body.IfCurrentEquals != nil {
+		dedupWindow = 0
+	}
+	key := dedupRequest{
+		Callers:       callerIdentities(request),
+		Creds:         creds,
+		Topic:         topic,
+		Message:       message,
+		QoS:           msg.QoS,
+		Retain:        msg.Retained,
+		WaitForAck:    body.WaitForAck,
+		ProgressTopic: body.ProgressTopic,
+		ResponseTopic: msg.Props.ResponseTopic,
+	}.key()
+	if dedupWindow > 0 {
+		if prior, ok := recentPublishes.lookup(key, dedupWindow, time.Now()); ok {
+			prior["deduplicated"] = true
+			return jsonResp(200, prior), nil
+		}
+	}
+
+	var timings *requestTimings
+	if debugRequested(request) || otelEnabled() {
+		timings = &requestTimings{ctx: ctx}
+	}
+	client, release, apiErr := acquireClient(creds, msg.Topic, timings)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+	defer release()
+
+	if body.IfCurrentEquals != nil {
+		defer lockTopic(msg.Topic)()
+		matched, current, apiErr := compareRetained(client, msg.Topic, *body.IfCurrentEquals)
+		if apiErr != nil {
+			return apiErr.response(), nil
+		}
+		if !matched {
+			return conflictResp(msg.Topic, current), nil
+		}
+	}
+
+	// Subscribe before publishing so neither the ack nor any progress
+	// message is missed
+	var ack *ackWaiter
+	if body.WaitForAck {
+		_, v5 := client.(mqttclient.PropsPublisher)
+		if _, isObject := payloadMessageID(msg.Payload); !isObject && !v5 {
+			return errorRespCode(400, "ACK_NEEDS_CORRELATION", "'wait_for_ack' needs a JSON object message on MQTT 3.1.1, to carry the message ID"), nil
+		}
+		var err error
+		ack, err = startAck(client, ackTopic(msg), msg.MessageID, byte(msg.QoS))
+		if errors.Is(err, errSubscriptionLimit) {
+			return errorRespCode(429, "SUBSCRIPTION_LIMIT", "Too many concurrent subscriptions; retry shortly"), nil
+		}
+		if err != nil {
+			return errorRespCode(502, "SUBSCRIBE_FAILED", "Ack subscribe failed: "+err.Error()), nil
+		}
+		defer ack.close()
+	}
+
+	var progress *progressCollector
+	var progressMax int
+	var progressWindow time.Duration
+	if body.ProgressTopic != "" {
+		progressMax = body.ProgressMax
+		if limit := envInt("PROGRESS_MAX_MESSAGES", 50); progressMax <= 0 || progressMax > limit {
+			progressMax = limit
+		}
+		progressWindow = time.Duration(body.ProgressTimeoutMs) * time.Millisecond
+		if limit := envDuration("PROGRESS_MAX_WAIT", 10*time.Second); progressWindow <= 0 || progressWindow > limit {
+			progressWindow = limit
+		}
+		var err error
+		progress, err = startProgress(client, body.ProgressTopic, byte(qos), progressMax)
+		if errors.Is(err, errSubscriptionLimit) {
+			return errorRespCode(429, "SUBSCRIPTION_LIMIT", "Too many concurrent progress subscriptions; retry shortly"), nil
+		}
+		if err != nil {
+			return errorRespCode(502, "SUBSCRIBE_FAILED", "Progress subscribe failed: "+err.Error()), nil
+		}
+		defer progress.close()
+	}
+
+	publishStart := time.Now()
+	var accepted bool
+	var chunks int
+	if body.Chunked {
+		chunks, apiErr = publishChunks(client, msg, chunkSize(body.ChunkSize))
+	} else {
+		accepted, apiErr = publishMessage(client, msg)
+	}
+	timings.since(phasePublish, publishStart)
+	if apiErr != nil {
+		return apiErr.response(), nil
+	}
+
+	// Success response echoes the effective publish parameters
+	resp := map[string]interface{}{
+		"published": publishedEcho(msg),
+	}
+	if accepted {
+		resp["accepted"] = true
+	}
+	if chunks > 0 {
+		resp["chunks"] = chunks
+	}
+	if ack != nil {
+		timeout := time.Duration(body.AckTimeoutMs) * time.Millisecond
+		if limit := envDuration("ACK_MAX_WAIT", 10*time.Second); timeout <= 0 || timeout > limit {
+			timeout = limit
+		}
+		result, ok := ack.wait(publishStart, timeout)
+		if !ok {
+			return errorRespCode(504, "ACK_TIMEOUT", fmt.Sprintf("device did not acknowledge %s within %s", msg.MessageID, timeout)), nil
+		}
+		resp["ack"] = result
+	}
+	if progress != nil {
+		msgs, complete := progress.collect(progressMax, progressWindow)
+		resp["progress"] = msgs
+		resp["progressComplete"] = complete
+	}
+	if dedupWindow > 0 {
+		recentPublishes.store(key, resp, dedupWindow, time.Now())
+	}
+	if debugRequested(request) {
+		// A copy, so the dedup cache never replays this request's timings
+		out := map[string]interface{}{"debug": timings.debugBlock()}
+		for k, v := range resp {
+			out[k] = v
+		}
+		return jsonResp(200, out), nil
+	}
+	return jsonResp(200, resp), nil
+}
+
+// acceptAsync validates the async options, schedules the publish and returns
+// 202 Accepted with the job ID.
+func acceptAsync(ctx context.Context, request events.APIGatewayProxyRequest, body RequestBody, creds mqttCreds, msg outboundMessage) events.APIGatewayProxyResponse {
+	if body.ProgressTopic != "" {
+		return errorRespStatus(400, "'progress_topic' cannot be combined with 'async'")
+	}
+	if body.CallbackURL != "" {
+		if apiErr := validateCallbackURL(body.CallbackURL); apiErr != nil {
+			return apiErr.response()
+		}
+	}
+
+	job := asyncJob{JobID: newJobID(), CallbackURL: body.CallbackURL, Message: msg, Creds: creds, Request: request.Body}
+	if apiErr := publishAsync(ctx, job); apiErr != nil {
+		return apiErr.response()
+	}
+
+	return jsonResp(202, map[string]interface{}{
+		"jobId":  job.JobID,
+		"status": "accepted",
+		"topic":  msg.Topic,
+	})
+}
+
+// publishedEcho describes how a message was actually published, after
+// defaults have been applied.
+func publishedEcho(msg outboundMessage) map[string]interface{} {
+	echo := map[string]interface{}{
+		"topic":        msg.Topic,
+		"message":      msg.Payload,
+		"qos":          msg.QoS,
+		"retained":     msg.Retained,
+		"payloadBytes": len(msg.Payload),
+	}
+	if msg.Props.ContentType != "" {
+		echo["contentType"] = msg.Props.ContentType
+	}
+	if msg.Props.ResponseTopic != "" {
+		echo["responseTopic"] = msg.Props.ResponseTopic
+	}
+	if msg.Source != "" {
+		echo["source"] = msg.Source
+	}
+	if msg.Format != "" {
+		echo["format"] = msg.Format
+	}
+	if msg.MessageID != "" {
+		echo["messageId"] = msg.MessageID
+	}
+	// Binary payloads (e.g. CBOR) cannot be echoed as a JSON string
+	if !utf8.ValidString(msg.Payload) {
+		echo["message"] = base64.StdEncoding.EncodeToString([]byte(msg.Payload))
+		echo["messageEncoding"] = "base64"
+	}
+	// Large or sensitive messages need not be reflected back
+	if !envBool("RESPONSE_ECHO_MESSAGE", true) {
+		delete(echo, "message")
+		delete(echo, "messageEncoding")
+	}
+	return echo
+}
+
+// parseQoS applies the default QoS (MQTT_DEFAULT_QOS, else 1) and rejects
+// out-of-range values and those outside ALLOWED_QOS.
+func parseQoS(v *int) (int, *apiError) {
+	qos := envInt("MQTT_DEFAULT_QOS", 1)
+	if v != nil {
+		qos = *v
+	}
+	if qos < 0 || qos > 2 {
+		return 0, newAPIError(400, "", "'qos' must be 0, 1 or 2")
+	}
+	if allowed := os.Getenv("ALLOWED_QOS"); allowed != "" && !qosAllowed(allowed, qos) {
+		return 0, newAPIError(400, "QOS_NOT_ALLOWED", fmt.Sprintf("QoS %d is not allowed; allowed: %s", qos, allowed))
+	}
+	return qos, nil
+}
+
+// qosAllowed reports whether qos appears in allowed, a comma-separated list
+// such as "0,1".
+func qosAllowed(allowed string, qos int) bool {
+	for _, v := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(v) == strconv.Itoa(qos) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicQoS applies QOS_POLICY, a comma-separated list of prefix=qos entries
+// such as "alerts/=2,telemetry/=0", to a validated QoS. The longest matching
+// prefix wins; topics matching no entry keep qos.
+func topicQoS(topic string, qos int) int {
+	best := -1
+	for _, entry := range strings.Split(os.Getenv("QOS_POLICY"), ",") {
+		prefix, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !strings.HasPrefix(topic, prefix) || len(prefix) <= best {
+			continue
+		}
+		if q, err := strconv.Atoi(value); err == nil && q >= 0 && q <= 2 {
+			best, qos = len(prefix), q
+		}
+	}
+	return qos
+}
+
+func validateTopic(topic string) *apiError {
+	// Subscription patterns pasted as publish topics
+	if strings.ContainsAny(topic, "+#") {
+		return newAPIError(400, "WILDCARD_TOPIC", "publish topics cannot contain + or #")
+	}
+	if !topicAllowed(topic) {
+		return newAPIError(403, "TOPIC_NOT_ALLOWED", "topic "+topic+" is not in the allowlist")
+	}
+	if topicAllowRegex != nil && !topicAllowRegex.MatchString(topic) {
+		return newAPIError(403, "TOPIC_NOT_ALLOWED", "topic "+topic+" does not match TOPIC_ALLOW_REGEX")
+	}
+	return nil
+}
+
+// validateSubscription applies the publish topic rules to a filter the hub
+// subscribes to on the caller's behalf (progress_topic, GET /state, GET
+// /presence), so a request cannot read topics it could not publish to.
+// TOPIC_ALLOW_REGEX cannot be checked against wildcards, so with it set only
+// literal filters are accepted.
+func validateSubscription(filter string) *apiError {
+	if !validFilter(filter) {
+		return newAPIError(400, "INVALID_FILTER", "subscription "+filter+" is not a valid topic filter")
+	}
+	if !topicAllowed(filter) {
+		return newAPIError(403, "TOPIC_NOT_ALLOWED", "subscription "+filter+" is not in the allowlist")
+	}
+	if topicAllowRegex != nil {
+		if strings.ContainsAny(filter, "+#") {
+			return newAPIError(403, "TOPIC_NOT_ALLOWED", "wildcard subscriptions are not allowed with TOPIC_ALLOW_REGEX")
+		}
+		if !topicAllowRegex.MatchString(filter) {
+			return newAPIError(403, "TOPIC_NOT_ALLOWED", "subscription "+filter+" does not match TOPIC_ALLOW_REGEX")
+		}
+	}
+	return nil
+}
+
+// topicAllowRegex is TOPIC_ALLOW_REGEX anchored to match whole topics; nil
+// when unset. It is compiled once by compileTopicRegex at startup.
+var topicAllowRegex *regexp.Regexp
+
+func compileTopicRegex() error {
+	pattern := os.Getenv("TOPIC_ALLOW_REGEX")
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return fmt.Errorf("TOPIC_ALLOW_REGEX: %w", err)
+	}
+	topicAllowRegex = re
+	return nil
+}
+
+// prefixTopic prepends TOPIC_PREFIX to topic unless it already starts with
+// it, so callers can address "livingroom/led" for "home/livingroom/led".
+// Validation and the allowlist always see the prefixed topic.
+func prefixTopic(topic string) string {
+	return topics.Prefix(topic)
+}
+
+// replyTopic places a progress or response topic the way the publish topic
+// is placed (see placeTopic) and checks it with validate, against the caller's publish token and against
+// the devices the caller owns.
+func replyTopic(request events.APIGatewayProxyRequest, topic string, validate func(string) *apiError) (string, *apiError) {
+	topic, apiErr := placeTopic(request, topic)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	if apiErr := validate(topic); apiErr != nil {
+		return "", apiErr
+	}
+	if apiErr := authorizeSubscriptionToken(request, topic); apiErr != nil {
+		return "", apiErr
+	}
+	if apiErr := authorizeSubscription(request, topic); apiErr != nil {
+		return "", apiErr
+	}
+	return topic, nil
+}
+
+// placeTopic puts a caller-supplied topic where it is published: in the
+// caller's namespace, under TOPIC_PREFIX and normalized. Every publish path
+// places its topics first, so validation, authorization and deduplication
+// all see the topic as the broker will.
+func placeTopic(request events.APIGatewayProxyRequest, topic string) (string, *apiError) {
+	topic, apiErr := userTopic(request, topic)
+	if apiErr != nil {
+		return "", apiErr
+	}
+	return normalizeTopic(prefixTopic(topic)), nil
+}
+
+// normalizeTopic applies the opt-in TOPIC_STRIP_TRAILING_SLASH and
+// TOPIC_LOWERCASE rules, since MQTT treats "devices/X/led/" and
+// "devices/x/led" as distinct topics. The published echo shows the result.
+func normalizeTopic(topic string) string {
+	if envBool("TOPIC_STRIP_TRAILING_SLASH", false) {
+		if trimmed := strings.TrimRight(topic, "/"); trimmed != "" {
+			topic = trimmed
+		}
+	}
+	if envBool("TOPIC_LOWERCASE", false) {
+		topic = strings.ToLower(topic)
+	}
+	return topic
+}
+
+// topicAllowed checks topic against TOPIC_ALLOWLIST, a comma-separated list
+// of allowed topic prefixes. An empty list allows every topic.
+func topicAllowed(topic string) bool {
+	list := os.Getenv("TOPIC_ALLOWLIST")
+	if list == "" {
+		return true
+	}
+	for _, prefix := range strings.Split(list, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mqttCreds are caller-supplied connection overrides; the zero value means the
+// SSM-stored credentials over a verified connection.
+type mqttCreds struct {
+	Username string
+	Password string
+	// InsecureTLS skips broker certificate verification (dev only)
+	InsecureTLS bool
+}
+
+func (c mqttCreds) delegated() bool { return c.Username != "" }
+
+// singleUse reports whether the connection must not be pooled.
+func (c mqttCreds) singleUse() bool { return c.delegated() || c.InsecureTLS }
+
+// delegatedCreds reads the X-Mqtt-Username/X-Mqtt-Password pair, which is only
+// honoured when ALLOW_DELEGATED_CREDS is set, and X-Insecure-Skip-Verify.
+func delegatedCreds(request events.APIGatewayProxyRequest) (mqttCreds, *apiError) {
+	creds := mqttCreds{
+		Username:    headerValue(request, "X-Mqtt-Username"),
+		Password:    headerValue(request, "X-Mqtt-Password"),
+		InsecureTLS: insecureTLSRequested(request),
+	}
+	if creds.Username == "" && creds.Password == "" {
+		return creds, nil
+	}
+	if !envBool("ALLOW_DELEGATED_CREDS", false) {
+		return mqttCreds{}, newAPIError(400, "", "Delegated MQTT credentials are not enabled")
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return mqttCreds{}, newAPIError(400, "", "Both 'X-Mqtt-Username' and 'X-Mqtt-Password' are required")
+	}
+	return creds, nil
+}
+
+// insecureTLSRequested honours X-Insecure-Skip-Verify: true only when
+// ALLOW_INSECURE_TLS is set, which must never be the case in production.
+// Otherwise the header is ignored and the broker is always verified.
+func insecureTLSRequested(request events.APIGatewayProxyRequest) bool {
+	if headerValue(request, "X-Insecure-Skip-Verify") != "true" || !envBool("ALLOW_INSECURE_TLS", false) {
+		return false
+	}
+	logger.Warn("INSECURE TLS: broker certificate verification is disabled for this request",
+		"path", request.Path, "sourceIp", request.RequestContext.Identity.SourceIP)
+	return true
+}
+
+// acquireClient is how handlers obtain a client; tests swap in an in-memory
+// broker.
+var acquireClient = brokerClient
+
+// brokerClient returns a connected client for the broker topic routes to,
+// and a release func. Delegated credentials get a single-use client that
+// release disconnects; otherwise the route's pooled client is returned and
+// release is a no-op. SSM and connect durations are added to t.
+func brokerClient(creds mqttCreds, topic string, t *requestTimings) (mqtt.Client, func(), *apiError) {
+	if dataPlaneMode() {
+		return dataPlaneBrokerClient(creds, t)
+	}
+	route, err := routeFor(topic)
+	if err != nil {
+		return nil, nil, newAPIError(500, "CONFIG_ERROR", err.Error())
+	}
+
+	// Fetch credentials and broker
+	ssmStart := time.Now()
+	var cfg mqttclient.Config
+	if creds.delegated() {
+		cfg, err = routeEndpoint(mqttclient.NewSSMClient(), route)
+		cfg.Username, cfg.Password = creds.Username, creds.Password
+	} else {
+		cfg, err = routeConfig(mqttclient.NewSSMClient(), route)
+	}
+	cfg.InsecureSkipVerify = creds.InsecureTLS
+	t.since(phaseSSM, ssmStart)
+	if errors.Is(err, mqttclient.ErrClientCertExpired) {
+		return nil, nil, newAPIError(500, "CLIENT_CERT_EXPIRED", err.Error())
+	}
+	if errors.Is(err, mqttclient.ErrClientCertInvalid) {
+		return nil, nil, newAPIError(500, "CLIENT_CERT_INVALID", err.Error())
+	}
+	if err != nil {
+		return nil, nil, newAPIError(500, "", "SSM lookup failed: "+err.Error())
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, newAPIError(500, "CONFIG_ERROR", err.Error())
+	}
+
+	connectStart := time.Now()
+	defer t.since(phaseConnect, connectStart)
+
+	var client mqtt.Client
+	release := func() {}
+	if creds.singleUse() {
+		// Single-use client: never pool a connection made with caller
+		// credentials or without certificate verification
+		cfg = ephemeralSession(cfg)
+		client, err = mqttclient.ConnectWithRetry(func() (mqtt.Client, error) { return mqttclient.Connect(cfg) })
+		if err == nil {
+			quiesce := uint(envDuration("EPHEMERAL_DISCONNECT_QUIESCE", 100*time.Millisecond).Milliseconds())
+			release = func() { client.Disconnect(quiesce) }
+		}
+	} else {
+		client, release, err = mqttclient.Shared(route.key(), cfg)
+	}
+	if errors.Is(err, mqttclient.ErrTLSHandshakeTimeout) {
+		return nil, nil, newAPIError(504, "TLS_HANDSHAKE_TIMEOUT", "TLS handshake with the MQTT broker timed out")
+	}
+	if errors.Is(err, mqttclient.ErrTokenTimeout) {
+		return nil, nil, newAPIError(504, "CONNECT_TIMEOUT", "MQTT connect timed out")
+	}
+	// An unresolvable host is a configuration or DNS problem, not a broker one
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return nil, nil, newAPIError(502, "BROKER_DNS_FAILURE", "MQTT broker host "+dnsErr.Name+" could not be resolved: "+dnsErr.Err)
+	}
+	if err != nil {
+		return nil, nil, newAPIError(503, "BROKER_UNAVAILABLE", "MQTT connect failed: "+err.Error())
+	}
+	return client, release, nil
+}
+
+// prewarmBrokerPool fills the default route's MQTT_POOL_SIZE pool during the
+// cold start. A pool of one still connects lazily.
+func prewarmBrokerPool() {
+	if mqttclient.PoolSize() < 2 || dataPlaneMode() {
+		return
+	}
+	route, err := routeFor("")
+	var cfg mqttclient.Config
+	if err == nil {
+		cfg, err = routeConfig(mqttclient.NewSSMClient(), route)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logger.Warn("MQTT pool warm-up skipped", "error", err.Error())
+		return
+	}
+	mqttclient.WarmPool(route.key(), cfg)
+}
+
+// ephemeralSession applies the session settings for single-use clients.
+// They start a clean session by default; EPHEMERAL_CLEAN_SESSION=false
+// instead resumes a per-username session (client ID "iot-hub-<username>") so
+// brokers that queue messages per session keep them between requests.
+// Anonymous clients have no stable identity and always start clean.
+// EPHEMERAL_DISCONNECT_QUIESCE (default 100ms) is how long a v3 disconnect
+// waits for in-flight work; 0 disconnects abruptly.
+func ephemeralSession(cfg mqttclient.Config) mqttclient.Config {
+	if envBool("EPHEMERAL_CLEAN_SESSION", true) || cfg.Username == "" {
+		return cfg
+	}
+	cfg.PersistentSession = true
+	cfg.ClientID = "iot-hub-" + cfg.Username
+	return cfg
+}
+
+// publishMessage publishes one message and waits for the broker, except on
+// the QoS 0 fast path where it reports accepted without waiting.
+func publishMessage(client mqtt.Client, msg outboundMessage) (accepted bool, apiErr *apiError) {
+	// Every attempt is audited, including those rejected before sending
+	attemptStart := time.Now()
+	defer func() { recordAudit(client, msg, apiErr, time.Since(attemptStart)) }()
+
+	if apiErr := publishGate(msg); apiErr != nil {
+		return false, apiErr
+	}
+	msg = decorateMessage(client, msg)
+	return sendMessage(client, msg)
+}
+
+// publishGate refuses a publish while the broker is under backpressure or
+// once its command has gone stale.
+func publishGate(msg outboundMessage) *apiError {
+	if wait, ok := publishBackpressure.active(time.Now()); ok {
+		apiErr := newAPIError(503, "BROKER_BACKPRESSURE", "Broker is not keeping up; publishes are briefly paused")
+		apiErr.RetryAfter = wait
+		return apiErr
+	}
+	if commandExpired(msg.ExpiresAt, time.Now()) {
+		return expiredError(msg.ExpiresAt)
+	}
+	return nil
+}
+
+// decorateMessage tags msg with its source, timestamp and message ID, in the
+// payload or, on MQTT 5, as properties.
+func decorateMessage(client mqtt.Client, msg outboundMessage) outboundMessage {
+	_, v5 := client.(mqttclient.PropsPublisher)
+	msg = applySource(msg, v5)
+	msg = applyTimestamp(msg, v5, time.Now())
+	return applyMessageID(msg, v5)
+}
+
+// sendMessage puts msg on the wire as it is and waits for the broker.
+func sendMessage(client mqtt.Client, msg outboundMessage) (accepted bool, apiErr *apiError) {
+	pp, v5 := client.(mqttclient.PropsPublisher)
+	start := time.Now()
+	defer func() {
+		emitPublishMetrics(msg, time.Since(start), apiErr)
+		notifyWebhook(msg.Topic, apiErr, time.Now())
+	}()
+
+	var token mqtt.Token
+	if v5 {
+		token = pp.PublishWithProps(msg.wire())
+	} else if msg.Props.Empty() {
+		// UseTopicAlias is only an optimisation, so v3 simply ignores it
+		token = client.Publish(msg.Topic, byte(msg.QoS), msg.Retained, msg.Payload)
+	} else {
+		return false, newAPIError(400, "MQTT5_REQUIRED", "MQTT 5 publish properties require MQTT_VERSION=5")
+	}
+
+	// QoS 0 fast path: hand the message to paho without waiting on the token
+	if msg.QoS == 0 && envBool("FAST_QOS0", false) {
+		return true, nil
+	}
+
+	err := mqttclient.WaitToken(token, publishTimeoutFor(msg.QoS))
+	if err == nil || errors.Is(err, mqttclient.ErrTokenTimeout) {
+		publishBackpressure.record(err != nil, time.Now())
+	}
+	if errors.Is(err, mqttclient.ErrTokenTimeout) {
+		return false, newAPIError(504, "PUBLISH_TIMEOUT", "Publish timed out waiting for broker acknowledgement")
+	}
+	if err != nil {
+		return false, newAPIError(500, "PUBLISH_FAILED", "Publish failed: "+err.Error())
+	}
+	return false, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// tokenClient is a broker client whose publishes complete as token says.
+type tokenClient struct {
+	*memClient
+	token mqtt.Token
+}
+
+func (c *tokenClient) Publish(string, byte, bool, interface{}) mqtt.Token { return c.token }
+
+// stuckToken never completes.
+type stuckToken struct{}
+
+func (stuckToken) Wait() bool                     { return false }
+func (stuckToken) WaitTimeout(time.Duration) bool { return false }
+func (stuckToken) Done() <-chan struct{}          { return make(chan struct{}) }
+func (stuckToken) Error() error                   { return nil }
+
+func TestPublishTokenOutcomes(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  mqtt.Token
+		status int
+		code   string
+	}{
+		{"completed", doneToken{}, 0, ""},
+		{"completed with error", failedToken(errors.New("not authorized")), 500, "PUBLISH_FAILED"},
+		{"timed out", stuckToken{}, 504, "PUBLISH_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBroker(t)
+			client := &tokenClient{memClient: newMemBroker().client(), token: tt.token}
+			_, apiErr := publishMessage(client, outboundMessage{Topic: "esp8266/commands/led", Payload: "on", QoS: 1})
+			if tt.status == 0 {
+				if apiErr != nil {
+					t.Fatalf("publish failed: %+v", apiErr)
+				}
+				return
+			}
+			if apiErr == nil || apiErr.Status != tt.status || apiErr.Code != tt.code {
+				t.Fatalf("apiErr = %+v, want %d %s", apiErr, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+// propsClient is a recordingClient that takes MQTT 5 properties, logging
+// each message as sent.
+type propsClient struct {
+	*recordingClient
+	log *propsLog
+}
+
+type propsLog struct {
+	mu   sync.Mutex
+	msgs []mqttclient.Message
+}
+
+func (c *propsClient) PublishWithProps(m mqttclient.Message) mqtt.Token {
+	c.log.mu.Lock()
+	c.log.msgs = append(c.log.msgs, m)
+	c.log.mu.Unlock()
+	return c.Publish(m.Topic, byte(m.QoS), m.Retained, m.Payload)
+}
+
+// sent returns the MQTT 5 messages sent so far.
+func (l *propsLog) sent() []mqttclient.Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]mqttclient.Message{}, l.msgs...)
+}
+
+// speakV5 makes b's clients accept MQTT 5 properties for the rest of t.
+func speakV5(t *testing.T, b *testBroker) *propsLog {
+	t.Helper()
+	log := &propsLog{}
+	prev := acquireClient
+	acquireClient = func(mqttCreds, string, *requestTimings) (mqtt.Client, func(), *apiError) {
+		return &propsClient{&recordingClient{memClient: b.client(), broker: b}, log}, func() {}, nil
+	}
+	t.Cleanup(func() { acquireClient = prev })
+	return log
+}
+
+func TestResponseTopicNeedsTokenScope(t *testing.T) {
+	seedSigningKey(t, "secret")
+	broker := newTestBroker(t)
+	speakV5(t, broker)
+	_, token := sign(t, "u1", `{"topic":"devices/lamp-1/#"}`)
+
+	resp := publishWithToken(t, token, `{"topic":"devices/lamp-1/led","message":"on","response_topic":"devices/lamp-1/reply"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("in scope: status %d: %s", resp.StatusCode, resp.Body)
+	}
+
+	// Another tenant's topic would have the device's reply delivered there
+	resp = publishWithToken(t, token, `{"topic":"devices/lamp-1/led","message":"on","response_topic":"devices/lamp-2/reply"}`)
+	body := decodeBody(t, resp)
+	if msg, _ := body["error"].(string); resp.StatusCode != 403 || body["code"] != "TOKEN_SCOPE" || !strings.HasPrefix(msg, "response_topic: ") {
+		t.Errorf("cross-tenant: status %d body %v, want 403 TOKEN_SCOPE on response_topic", resp.StatusCode, body)
+	}
+	if n := len(broker.published()); n != 1 {
+		t.Errorf("%d messages published, want only the in-scope one", n)
+	}
+}
+
+func TestReplyTopicsArePlacedLikeTheTopic(t *testing.T) {
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	t.Setenv("TOPIC_PREFIX", "hub/")
+	broker := newTestBroker(t)
+	log := speakV5(t, broker)
+
+	resp := call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Body: `{"topic":"devices/lamp/led","message":"on","response_topic":"devices/lamp/reply"}`},
+		map[string]interface{}{"sub": "u1"}))
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	sent := log.sent()
+	if len(sent) != 1 || sent[0].Topic != "hub/users/u1/devices/lamp/led" || sent[0].Props.ResponseTopic != "hub/users/u1/devices/lamp/reply" {
+		t.Errorf("sent %+v, want topic and response topic in hub/users/u1/", sent)
+	}
+
+	// Another user's namespace is refused for a reply topic as for the topic
+	resp = call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Body: `{"topic":"devices/lamp/led","message":"on","progress_topic":"users/u2/devices/lamp/progress"}`},
+		map[string]interface{}{"sub": "u1"}))
+	body := decodeBody(t, resp)
+	if msg, _ := body["error"].(string); resp.StatusCode != 403 || body["code"] != "USER_NAMESPACE" || !strings.HasPrefix(msg, "progress_topic: ") {
+		t.Errorf("foreign progress_topic: status %d body %v, want 403 USER_NAMESPACE", resp.StatusCode, body)
+	}
+}
+
+func TestEveryPathPlacesTopicsBeforeCheckingThem(t *testing.T) {
+	t.Setenv("TOPIC_LOWERCASE", "true")
+	t.Setenv("TOPIC_STRIP_TRAILING_SLASH", "true")
+	t.Setenv("DEVICE_GROUPS", `{"lamps":["Devices/Lamp-1/Led/"]}`)
+	t.Setenv("TOPIC_ALLOWLIST", "devices/")
+	broker := newTestBroker(t)
+	newMemRegistry(t, deviceRecord{DeviceID: "lamp-1", Topics: []string{"devices/lamp-1/led"}, Owners: []string{"u1"}})
+
+	// The allowlist and the registry only know the normalized topic, so each
+	// path must have normalized before validating and authorizing
+	bodies := map[string]string{
+		"single":    `{"topic":"Devices/Lamp-1/Led/","message":"on"}`,
+		"batch":     `{"messages":[{"topic":"Devices/Lamp-1/Led/","message":"on"}]}`,
+		"broadcast": `{"topics":["Devices/Lamp-1/Led/","devices/lamp-1/led"],"message":"on"}`,
+		"group":     `{"group":"lamps","message":"on"}`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			before := len(broker.sentTo("devices/lamp-1/led"))
+			resp := call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Body: body}, map[string]interface{}{"sub": "u1"}))
+			if resp.StatusCode != 200 {
+				t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+			}
+			if n := len(broker.sentTo("devices/lamp-1/led")) - before; n != 1 {
+				t.Errorf("%d messages to devices/lamp-1/led, want 1", n)
+			}
+		})
+	}
+
+	// Deduplication sees the placed topic as well
+	t.Setenv("DEDUP_WINDOW", "1m")
+	for i, topic := range []string{"devices/lamp-1/led", "DEVICES/LAMP-1/LED/"} {
+		resp := call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Body: `{"topic":"` + topic + `","message":"off"}`}, map[string]interface{}{"sub": "u1"}))
+		if got := decodeBody(t, resp)["deduplicated"] == true; got != (i == 1) {
+			t.Errorf("%s: deduplicated = %v", topic, got)
+		}
+	}
+}
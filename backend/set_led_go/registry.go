@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"shared/mqttclient"
+)
+
+// The device registry (DEVICE_REGISTRY_TABLE) lists every device the hub may
+// command: the topic filters that reach it, who owns it and, optionally, the
+// schema its JSON commands must satisfy. With a registry configured, every
+// publish topic must belong to a registered device owned by the caller, and
+// every filter the caller reads from (progress, response and ack topics,
+// /state and /presence) must lie within one.
+
+// deviceRecord is one registry entry. Owners are caller identities: Cognito
+// or JWT subjects, IAM user ARNs or API Gateway API key IDs. Schema is kept as
+// JSON text so RESPONSE_CASE never rewrites its keys.
+type deviceRecord struct {
+	DeviceID  string   `json:"deviceId" dynamodbav:"deviceId"`
+	Topics    []string `json:"topics" dynamodbav:"topics"`
+	Owners    []string `json:"owners" dynamodbav:"owners"`
+	Schema    string   `json:"schema,omitempty" dynamodbav:"schema,omitempty"`
+	UpdatedAt string   `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// registryStore persists the device registry.
+type registryStore interface {
+	listDevices() ([]deviceRecord, error)
+	// getDevice returns nil, nil for an unknown device
+	getDevice(id string) (*deviceRecord, error)
+	// putDevice stores d, failing with errDeviceExists when create is set
+	// and the device is already registered
+	putDevice(d deviceRecord, create bool) error
+	// deleteDevice reports whether the device existed
+	deleteDevice(id string) (bool, error)
+}
+
+var errDeviceExists = errors.New("device already registered")
+
+// openRegistry returns the configured registry, or nil when
+// DEVICE_REGISTRY_TABLE is unset and topics are not checked against one.
+var openRegistry = func() registryStore {
+	table := os.Getenv("DEVICE_REGISTRY_TABLE")
+	if table == "" {
+		return nil
+	}
+	return dynamoRegistry{db: dynamodb.New(session.Must(session.NewSession())), table: table}
+}
+
+type dynamoRegistry struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (r dynamoRegistry) listDevices() ([]deviceRecord, error) {
+	var devices []deviceRecord
+	var pageErr error
+	err := r.db.ScanPages(&dynamodb.ScanInput{TableName: aws.String(r.table)}, func(out *dynamodb.ScanOutput, _ bool) bool {
+		var page []deviceRecord
+		if pageErr = dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); pageErr != nil {
+			return false
+		}
+		devices = append(devices, page...)
+		return true
+	})
+	if err == nil {
+		err = pageErr
+	}
+	return devices, err
+}
+
+func (r dynamoRegistry) getDevice(id string) (*deviceRecord, error) {
+	out, err := r.db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(r.table),
+		Key:            map[string]*dynamodb.AttributeValue{"deviceId": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(out.Item) == 0 {
+		return nil, err
+	}
+	var d deviceRecord
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (r dynamoRegistry) putDevice(d deviceRecord, create bool) error {
+	item, err := dynamodbattribute.MarshalMap(d)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{TableName: aws.String(r.table), Item: item}
+	if create {
+		input.ConditionExpression = aws.String("attribute_not_exists(deviceId)")
+	}
+	_, err = r.db.PutItem(input)
+	if isConditionFailed(err) {
+		return errDeviceExists
+	}
+	return err
+}
+
+func (r dynamoRegistry) deleteDevice(id string) (bool, error) {
+	out, err := r.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(r.table),
+		Key:          map[string]*dynamodb.AttributeValue{"deviceId": {S: aws.String(id)}},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(out.Attributes) > 0, nil
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// registryCache keeps the device list for REGISTRY_CACHE_TTL (default 30s),
+// so authorizing a publish does not scan the table. Registry writes through
+// this container drop it at once; other containers catch up within the TTL.
+var registryCache struct {
+	mu       sync.Mutex
+	devices  []deviceRecord
+	schemas  map[string]*payloadSchema // by device ID
+	loadedAt time.Time
+}
+
+func cachedDevices(store registryStore, now time.Time) ([]deviceRecord, map[string]*payloadSchema, error) {
+	registryCache.mu.Lock()
+	defer registryCache.mu.Unlock()
+	if !registryCache.loadedAt.IsZero() && now.Sub(registryCache.loadedAt) < envDuration("REGISTRY_CACHE_TTL", 30*time.Second) {
+		return registryCache.devices, registryCache.schemas, nil
+	}
+	devices, err := store.listDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+	schemas := map[string]*payloadSchema{}
+	for _, d := range devices {
+		if d.Schema == "" {
+			continue
+		}
+		s, err := parseSchema([]byte(d.Schema))
+		if err != nil {
+			// Entries are checked on write, so this one was edited by hand
+			logger.Warn("ignoring invalid device schema", "deviceId", d.DeviceID, "error", err.Error())
+			continue
+		}
+		schemas[d.DeviceID] = s
+	}
+	registryCache.devices, registryCache.schemas, registryCache.loadedAt = devices, schemas, now
+	return devices, schemas, nil
+}
+
+// invalidateRegistry drops the cached device list.
+func invalidateRegistry() {
+	registryCache.mu.Lock()
+	defer registryCache.mu.Unlock()
+	registryCache.loadedAt = time.Time{}
+}
+
+// callerIdentities are the identities request was authenticated as: the JWT
+// subject, the IAM user ARN and the API key ID, whichever API Gateway set.
+func callerIdentities(request events.APIGatewayProxyRequest) []string {
+	var ids []string
+	for _, id := range []string{requestSubject(request), request.RequestContext.Identity.UserArn, request.RequestContext.Identity.APIKeyID} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// authorizeDevices checks msgs against the registry: each topic must belong
+// to a registered device owned by the caller, and its payload must satisfy
+// the device's schema. Queued publishes carry no caller and skip the
+// ownership check only, except a scheduled command, which acts for its owner.
+func authorizeDevices(request events.APIGatewayProxyRequest, msgs ...outboundMessage) *apiError {
+	store := openRegistry()
+	if store == nil {
+		return nil
+	}
+	devices, schemas, err := cachedDevices(store, time.Now())
+	if err != nil {
+		return newAPIError(502, "REGISTRY_UNAVAILABLE", "Device registry lookup failed: "+err.Error())
+	}
+	callers := callerIdentities(request)
+	checkOwner := !messageTriggered(request) || len(callers) > 0
+	if checkOwner && len(callers) == 0 {
+		return newAPIError(401, "NO_CALLER", "Publishing to registered devices requires an authenticated caller")
+	}
+
+	for _, msg := range msgs {
+		var registered, owned *deviceRecord
+		for i := range devices {
+			d := &devices[i]
+			if !deviceHasTopic(d, msg.Topic) {
+				continue
+			}
+			registered = d
+			if !checkOwner || ownsDevice(d, callers) {
+				owned = d
+				break
+			}
+		}
+		if registered == nil {
+			return newAPIError(403, "DEVICE_NOT_REGISTERED", "topic "+msg.Topic+" does not belong to a registered device")
+		}
+		if owned == nil {
+			return newAPIError(403, "DEVICE_NOT_OWNED", "topic "+msg.Topic+" belongs to device "+registered.DeviceID+", which you do not own")
+		}
+		if schema := schemas[owned.DeviceID]; schema != nil {
+			var payload interface{}
+			if err := json.Unmarshal([]byte(msg.Payload), &payload); err != nil {
+				return newAPIError(400, "SCHEMA_MISMATCH", "device "+owned.DeviceID+" takes JSON commands")
+			}
+			if err := schema.check("payload", payload); err != nil {
+				return newAPIError(400, "SCHEMA_MISMATCH", "device "+owned.DeviceID+": "+err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeSubscription checks a filter the caller reads from against the
+// registry: it must lie within a topic filter of a device the caller owns, so
+// a wildcard spanning several devices is refused. Callers are treated as in
+// authorizeDevices.
+func authorizeSubscription(request events.APIGatewayProxyRequest, filter string) *apiError {
+	store := openRegistry()
+	if store == nil {
+		return nil
+	}
+	devices, _, err := cachedDevices(store, time.Now())
+	if err != nil {
+		return newAPIError(502, "REGISTRY_UNAVAILABLE", "Device registry lookup failed: "+err.Error())
+	}
+	callers := callerIdentities(request)
+	if len(callers) == 0 {
+		if messageTriggered(request) {
+			return nil
+		}
+		return newAPIError(401, "NO_CALLER", "Reading from registered devices requires an authenticated caller")
+	}
+
+	var registered *deviceRecord
+	for i := range devices {
+		d := &devices[i]
+		if !deviceCoversFilter(d, filter) {
+			continue
+		}
+		if ownsDevice(d, callers) {
+			return nil
+		}
+		registered = d
+	}
+	if registered == nil {
+		return newAPIError(403, "DEVICE_NOT_REGISTERED", "subscription "+filter+" is not within a registered device")
+	}
+	return newAPIError(403, "DEVICE_NOT_OWNED", "subscription "+filter+" belongs to device "+registered.DeviceID+", which you do not own")
+}
+
+func deviceCoversFilter(d *deviceRecord, filter string) bool {
+	for _, scope := range d.Topics {
+		if filterCovers(scope, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func deviceHasTopic(d *deviceRecord, topic string) bool {
+	for _, filter := range d.Topics {
+		if mqttclient.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func ownsDevice(d *deviceRecord, callers []string) bool {
+	for _, owner := range d.Owners {
+		for _, id := range callers {
+			if owner == id {
+				return true
+			}
+		}
+	}
+	return false
+}
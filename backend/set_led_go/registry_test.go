@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// seedAdminKey enables the admin endpoints with key for the rest of t.
+func seedAdminKey(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv("ADMIN_API_KEY_SSM", "/replay/admin-key")
+	t.Cleanup(seedConfig(map[string]string{"admin-key": key}))
+}
+
+// admin runs an admin request against the device registry.
+func admin(t *testing.T, method, path, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	return call(t, events.APIGatewayProxyRequest{HTTPMethod: method, Path: path, Body: body, Headers: map[string]string{"X-Api-Key": "k"}})
+}
+
+func TestDevicesCRUD(t *testing.T) {
+	seedAdminKey(t, "k")
+	newTestBroker(t)
+	registry := newMemRegistry(t)
+
+	resp := admin(t, "POST", "/devices", `{"device_id":"lamp-1","topics":["devices/lamp-1/#"],"owners":["u1"],"schema":{ "type": "object" }}`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("POST: status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if d := registry.devices["lamp-1"]; d.Schema != `{"type":"object"}` || d.UpdatedAt == "" {
+		t.Errorf("stored %+v, want a compacted schema", d)
+	}
+	if resp := admin(t, "POST", "/devices", `{"device_id":"lamp-1","topics":["devices/lamp-1/#"],"owners":["u1"]}`); resp.StatusCode != 409 {
+		t.Errorf("POST again: status %d, want 409", resp.StatusCode)
+	}
+
+	resp = admin(t, "PUT", "/devices/lamp-1", `{"topics":["devices/lamp-1/#"],"owners":["u1","u2"]}`)
+	if resp.StatusCode != 200 || len(registry.devices["lamp-1"].Owners) != 2 || registry.devices["lamp-1"].Schema != "" {
+		t.Errorf("PUT: status %d, stored %+v", resp.StatusCode, registry.devices["lamp-1"])
+	}
+	if resp := admin(t, "GET", "/devices/lamp-1", ""); resp.StatusCode != 200 || decodeBody(t, resp)["device_id"] != "lamp-1" {
+		t.Errorf("GET: status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if devices, _ := decodeBody(t, admin(t, "GET", "/devices", ""))["devices"].([]interface{}); len(devices) != 1 {
+		t.Errorf("list: %v", devices)
+	}
+
+	if resp := admin(t, "DELETE", "/devices/lamp-1/", ""); resp.StatusCode != 200 || len(registry.devices) != 0 {
+		t.Errorf("DELETE: status %d, %d devices left", resp.StatusCode, len(registry.devices))
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if resp := admin(t, method, "/devices/lamp-1", ""); resp.StatusCode != 404 {
+			t.Errorf("%s after DELETE: status %d, want 404", method, resp.StatusCode)
+		}
+	}
+	if devices, ok := decodeBody(t, admin(t, "GET", "/devices", ""))["devices"].([]interface{}); !ok || len(devices) != 0 {
+		t.Errorf("empty list: %v, want []", devices)
+	}
+}
+
+func TestDevicesRejects(t *testing.T) {
+	seedAdminKey(t, "k")
+	newTestBroker(t)
+	newMemRegistry(t)
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+		code                     string
+	}{
+		{"bad id in path", "GET", "/devices/a b", "", 400, "INVALID_DEVICE"},
+		{"bad id in body", "POST", "/devices", `{"device_id":"a/b","topics":["a"],"owners":["u1"]}`, 400, "INVALID_DEVICE"},
+		{"id mismatch", "PUT", "/devices/lamp-1", `{"device_id":"lamp-2","topics":["a"],"owners":["u1"]}`, 400, ""},
+		{"no topics", "POST", "/devices", `{"device_id":"lamp-1","owners":["u1"]}`, 400, ""},
+		{"no owners", "POST", "/devices", `{"device_id":"lamp-1","topics":["a"]}`, 400, ""},
+		{"empty owner", "POST", "/devices", `{"device_id":"lamp-1","topics":["a"],"owners":[" "]}`, 400, ""},
+		{"bad filter", "POST", "/devices", `{"device_id":"lamp-1","topics":["a/#/b"],"owners":["u1"]}`, 400, "INVALID_FILTER"},
+		{"bad schema", "POST", "/devices", `{"device_id":"lamp-1","topics":["a"],"owners":["u1"],"schema":{"type":"dict"}}`, 400, "INVALID_SCHEMA"},
+		{"bad JSON", "POST", "/devices", `{`, 400, ""},
+		{"method", "PATCH", "/devices/lamp-1", `{}`, 405, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := admin(t, tt.method, tt.path, tt.body)
+			if code, _ := decodeBody(t, resp)["code"].(string); resp.StatusCode != tt.status || (tt.code != "" && code != tt.code) {
+				t.Errorf("status %d code %q, want %d %q", resp.StatusCode, code, tt.status, tt.code)
+			}
+		})
+	}
+
+	resp := call(t, events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/devices", Headers: map[string]string{"X-Api-Key": "wrong"}})
+	if resp.StatusCode != 401 {
+		t.Errorf("wrong key: status %d, want 401", resp.StatusCode)
+	}
+	openRegistry = func() registryStore { return nil }
+	if resp := admin(t, "GET", "/devices", ""); decodeBody(t, resp)["code"] != "REGISTRY_DISABLED" {
+		t.Errorf("without a registry: %s", resp.Body)
+	}
+}
+
+func TestRegistryAuthorizesPublishes(t *testing.T) {
+	broker := newTestBroker(t)
+	newMemRegistry(t,
+		deviceRecord{DeviceID: "lamp-1", Topics: []string{"devices/lamp-1/#"}, Owners: []string{"u1", "arn:aws:iam::123456789012:user/ops", "key-1"}},
+		deviceRecord{DeviceID: "lamp-2", Topics: []string{"devices/lamp-2/+"}, Owners: []string{"u2"}, Schema: `{"type":"object","required":["state"]}`},
+	)
+	publish := func(request events.APIGatewayProxyRequest) (int, string) {
+		request.HTTPMethod, request.Path = "POST", "/"
+		resp := call(t, request)
+		code, _ := decodeBody(t, resp)["code"].(string)
+		return resp.StatusCode, code
+	}
+	as := func(sub, body string) events.APIGatewayProxyRequest {
+		return withClaims(events.APIGatewayProxyRequest{Body: body}, map[string]interface{}{"sub": sub})
+	}
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		status  int
+		code    string
+	}{
+		{"owner", as("u1", `{"topic":"devices/lamp-1/led","message":"on"}`), 200, ""},
+		{"not the owner", as("u2", `{"topic":"devices/lamp-1/led","message":"on"}`), 403, "DEVICE_NOT_OWNED"},
+		{"unregistered", as("u1", `{"topic":"devices/kettle/on","message":"on"}`), 403, "DEVICE_NOT_REGISTERED"},
+		{"no caller", events.APIGatewayProxyRequest{Body: `{"topic":"devices/lamp-1/led","message":"on"}`}, 401, "NO_CALLER"},
+		{"schema satisfied", as("u2", `{"topic":"devices/lamp-2/cmd","payload":{"state":"on"}}`), 200, ""},
+		{"schema violated", as("u2", `{"topic":"devices/lamp-2/cmd","payload":{"color":"red"}}`), 400, "SCHEMA_MISMATCH"},
+		{"not JSON for a schema", as("u2", `{"topic":"devices/lamp-2/cmd","message":"on"}`), 400, "SCHEMA_MISMATCH"},
+		{"one topic of a broadcast", as("u1", `{"topics":["devices/lamp-1/led","devices/lamp-2/cmd"],"message":"on"}`), 403, "DEVICE_NOT_OWNED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(broker.published())
+			status, code := publish(tt.request)
+			if status != tt.status || code != tt.code {
+				t.Errorf("status %d code %q, want %d %q", status, code, tt.status, tt.code)
+			}
+			if sent := len(broker.published()) > before; sent != (tt.status == 200) {
+				t.Errorf("published = %v", sent)
+			}
+		})
+	}
+
+	// IAM users and API keys are caller identities too
+	iam := events.APIGatewayProxyRequest{Body: `{"topic":"devices/lamp-1/led","message":"on"}`}
+	iam.RequestContext.Identity.UserArn = "arn:aws:iam::123456789012:user/ops"
+	key := events.APIGatewayProxyRequest{Body: `{"topic":"devices/lamp-1/led","message":"on"}`}
+	key.RequestContext.Identity.APIKeyID = "key-1"
+	for name, request := range map[string]events.APIGatewayProxyRequest{"IAM user": iam, "API key": key} {
+		if status, code := publish(request); status != 200 {
+			t.Errorf("%s: status %d code %q", name, status, code)
+		}
+	}
+}
+
+func TestRegistryAuthorizesReads(t *testing.T) {
+	t.Setenv("STATE_QUIET_PERIOD", "10ms")
+	broker := newTestBroker(t)
+	newMemRegistry(t,
+		deviceRecord{DeviceID: "lamp-1", Topics: []string{"devices/lamp-1/#"}, Owners: []string{"u1"}},
+		deviceRecord{DeviceID: "lamp-2", Topics: []string{"devices/lamp-2/+"}, Owners: []string{"u2"}},
+		// A relay whose acks are reported by another owner's monitor
+		deviceRecord{DeviceID: "relay", Topics: []string{"relay/cmd"}, Owners: []string{"u2"}},
+		deviceRecord{DeviceID: "relay-monitor", Topics: []string{"relay/cmd/ack"}, Owners: []string{"u1"}},
+	)
+	as := func(sub, method, path, body string) events.APIGatewayProxyRequest {
+		r := events.APIGatewayProxyRequest{HTTPMethod: method, Path: path, Body: body}
+		if p, query, ok := strings.Cut(path, "?"); ok {
+			r.Path = p
+			key, value, _ := strings.Cut(query, "=")
+			r.QueryStringParameters = map[string]string{key: value}
+		}
+		return withClaims(r, map[string]interface{}{"sub": sub})
+	}
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		status  int
+		code    string
+	}{
+		{"state of an owned device", as("u1", "GET", "/state?filter=devices/lamp-1/#", ""), 200, ""},
+		{"state of another's device", as("u1", "GET", "/state?filter=devices/lamp-2/status", ""), 403, "DEVICE_NOT_OWNED"},
+		{"state across devices", as("u1", "GET", "/state?filter=devices/+/status", ""), 403, "DEVICE_NOT_REGISTERED"},
+		{"presence of an owned device", as("u2", "GET", "/presence?device=lamp-2", ""), 200, ""},
+		{"presence of another's device", as("u2", "GET", "/presence?device=lamp-1", ""), 403, "DEVICE_NOT_OWNED"},
+		{"progress on another's device", as("u1", "POST", "/", `{"topic":"devices/lamp-1/led","message":"on","progress_topic":"devices/lamp-2/progress"}`), 403, "DEVICE_NOT_OWNED"},
+		{"response on another's device", as("u1", "POST", "/", `{"topic":"devices/lamp-1/led","message":"on","response_topic":"devices/lamp-2/reply"}`), 403, "DEVICE_NOT_OWNED"},
+		{"ack on another's device", as("u2", "POST", "/", `{"topic":"relay/cmd","message":"{}","wait_for_ack":true}`), 403, "DEVICE_NOT_OWNED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(broker.published())
+			resp := call(t, tt.request)
+			code, _ := decodeBody(t, resp)["code"].(string)
+			if resp.StatusCode != tt.status || code != tt.code {
+				t.Errorf("status %d code %q, want %d %q: %s", resp.StatusCode, code, tt.status, tt.code, resp.Body)
+			}
+			if n := len(broker.published()); n != before {
+				t.Errorf("%d messages published", n-before)
+			}
+		})
+	}
+}
+
+// countingRegistry counts the scans of a memRegistry.
+type countingRegistry struct {
+	*memRegistry
+	scans int
+	err   error
+}
+
+func (r *countingRegistry) listDevices() ([]deviceRecord, error) {
+	r.scans++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.memRegistry.listDevices()
+}
+
+func TestRegistryCache(t *testing.T) {
+	seedAdminKey(t, "k")
+	newTestBroker(t)
+	registry := &countingRegistry{memRegistry: newMemRegistry(t,
+		deviceRecord{DeviceID: "lamp-1", Topics: []string{"devices/lamp-1/#"}, Owners: []string{"u1"}},
+	)}
+	openRegistry = func() registryStore { return registry }
+	publish := func() int {
+		return call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Body: `{"topic":"devices/lamp-1/led","message":"on"}`},
+			map[string]interface{}{"sub": "u2"})).StatusCode
+	}
+
+	publish()
+	publish()
+	if registry.scans != 1 {
+		t.Errorf("%d scans for two publishes, want 1", registry.scans)
+	}
+	// A registry write through this container takes effect at once
+	if resp := admin(t, "PUT", "/devices/lamp-1", `{"topics":["devices/lamp-1/#"],"owners":["u1","u2"]}`); resp.StatusCode != 200 {
+		t.Fatalf("PUT: %s", resp.Body)
+	}
+	if status := publish(); status != 200 || registry.scans != 2 {
+		t.Errorf("after the write: status %d, %d scans", status, registry.scans)
+	}
+
+	t.Setenv("REGISTRY_CACHE_TTL", "0")
+	registry.err = errors.New("throttled")
+	resp := call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Body: `{"topic":"devices/lamp-1/led","message":"on"}`},
+		map[string]interface{}{"sub": "u2"}))
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 502 || code != "REGISTRY_UNAVAILABLE" {
+		t.Errorf("scan failure: status %d code %v", resp.StatusCode, code)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// TestReplayFixtures runs the recorded events in testdata/events through
+// handler and compares the responses with the recorded expectations, so a
+// production event that misbehaved can be captured as a regression fixture.
+//
+// Publishing goes to a fresh in-memory broker per fixture (see memBroker);
+// SSM is never called. A fixture may set environment variables and SSM config,
+// pre-seed the broker's retained messages and assert their state afterwards.
+// Fixtures run in name order and share the dedup cache, so one may replay an
+// earlier one's request.
+
+// replayFixture is one recorded event and the response it must produce.
+type replayFixture struct {
+	Event events.APIGatewayProxyRequest `json:"event"`
+	// Invoke, when set instead of Event, is a raw non-HTTP Lambda event (SNS,
+	// SQS, an IoT Rule) run through dispatch; only Expected.Retained applies
+	Invoke json.RawMessage `json:"invoke,omitempty"`
+	// Alias, when set, is the function alias Invoke arrives through
+	Alias string `json:"alias,omitempty"`
+	// Env is set for the duration of the fixture
+	Env map[string]string `json:"env,omitempty"`
+	// Config seeds the SSM_CONFIG_PATH settings as key → value
+	Config map[string]string `json:"config,omitempty"`
+	// Retained seeds the broker's retained messages as topic → payload
+	Retained map[string]string `json:"retained,omitempty"`
+	// Registry, when present, is the device registry for the fixture
+	Registry []deviceRecord `json:"registry,omitempty"`
+	Expected struct {
+		StatusCode int             `json:"statusCode"`
+		Body       json.RawMessage `json:"body,omitempty"`
+		// Headers must be present with these values, or absent when null
+		Headers map[string]*string `json:"headers,omitempty"`
+		// Retained, when present, must equal the retained messages afterwards
+		Retained map[string]string `json:"retained,omitempty"`
+		// DeadLetters, when present, must equal the dead letters written,
+		// without their failedAt
+		DeadLetters *[]deadLetter `json:"deadLetters,omitempty"`
+	} `json:"expected"`
+}
+
+func TestReplayFixtures(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "events", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no fixtures found in testdata/events: %v", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			if err := replayFile(t, file); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// replayFile runs the fixture in file, with its environment, config, broker,
+// dead-letter queue and registry installed for the duration of t.
+func replayFile(t *testing.T, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var fx replayFixture
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return fmt.Errorf("decode fixture: %w", err)
+	}
+
+	for k, v := range fx.Env {
+		t.Setenv(k, v)
+	}
+	if len(fx.Config) > 0 {
+		t.Cleanup(seedConfig(fx.Config))
+	}
+
+	broker := newMemBroker()
+	seed := broker.client()
+	for topic, payload := range fx.Retained {
+		seed.Publish(topic, 1, true, payload)
+	}
+	prevAcquire, prevDeadLetters, prevRegistry := acquireClient, openDeadLetterQueue, openRegistry
+	t.Cleanup(func() {
+		backgroundWork.Wait()
+		acquireClient, openDeadLetterQueue, openRegistry = prevAcquire, prevDeadLetters, prevRegistry
+		invalidateRegistry()
+	})
+	acquireClient = func(mqttCreds, string, *requestTimings) (mqtt.Client, func(), *apiError) {
+		return broker.client(), func() {}, nil
+	}
+	dlq := &replayDeadLetters{}
+	openDeadLetterQueue = func() deadLetterQueue { return dlq }
+	openRegistry = func() registryStore { return nil }
+	if fx.Registry != nil {
+		registry := replayRegistry(fx.Registry)
+		openRegistry = func() registryStore { return registry }
+	}
+	invalidateRegistry()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if len(fx.Invoke) > 0 {
+		if fx.Alias != "" {
+			ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:eu-central-1:123456789012:function:set-led:" + fx.Alias})
+		}
+		if _, err := dispatch(ctx, fx.Invoke); err != nil {
+			return fmt.Errorf("dispatch error: %w", err)
+		}
+		if err := dlq.check(fx.Expected.DeadLetters); err != nil {
+			return err
+		}
+		return checkRetained(broker, fx.Expected.Retained)
+	}
+	resp, err := handler(ctx, fx.Event)
+	if err != nil {
+		return fmt.Errorf("handler error: %w", err)
+	}
+
+	if resp.StatusCode != fx.Expected.StatusCode {
+		return fmt.Errorf("status %d, want %d (body %s)", resp.StatusCode, fx.Expected.StatusCode, resp.Body)
+	}
+	for name, want := range fx.Expected.Headers {
+		got, ok := resp.Headers[name]
+		if want == nil && ok {
+			return fmt.Errorf("header %s is %q, want it absent", name, got)
+		}
+		if want != nil && got != *want {
+			return fmt.Errorf("header %s is %q, want %q", name, got, *want)
+		}
+	}
+	if err := checkRetained(broker, fx.Expected.Retained); err != nil {
+		return err
+	}
+	if err := dlq.check(fx.Expected.DeadLetters); err != nil {
+		return err
+	}
+	if len(fx.Expected.Body) == 0 {
+		return nil
+	}
+	var got, want interface{}
+	if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+		return fmt.Errorf("response body is not JSON: %s", resp.Body)
+	}
+	if err := json.Unmarshal(fx.Expected.Body, &want); err != nil {
+		return fmt.Errorf("expected body is not JSON: %w", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("body %s, want %s", resp.Body, fx.Expected.Body)
+	}
+	return nil
+}
+
+// seedConfig stands in for SSM_CONFIG_PATH with config, as if just loaded,
+// and returns a func restoring the previous path and emptying the cache.
+func seedConfig(config map[string]string) func() {
+	prevPath, hadPath := os.LookupEnv("SSM_CONFIG_PATH")
+	os.Setenv("SSM_CONFIG_PATH", "/replay")
+	mqttclient.ClearCache()
+	mqttclient.SeedConfig(config, time.Hour)
+	return func() {
+		mqttclient.ClearCache()
+		if hadPath {
+			os.Setenv("SSM_CONFIG_PATH", prevPath)
+		} else {
+			os.Unsetenv("SSM_CONFIG_PATH")
+		}
+	}
+}
+
+// checkRetained compares the broker's retained messages with want, when the
+// fixture asserts them.
+func checkRetained(broker *memBroker, want map[string]string) error {
+	if want == nil {
+		return nil
+	}
+	if got := broker.retainedPayloads(); !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("retained %v, want %v", got, want)
+	}
+	return nil
+}
+
+// replayDeadLetters collects a fixture's dead letters in place of SQS.
+type replayDeadLetters struct {
+	mu      sync.Mutex
+	letters []deadLetter
+}
+
+func (q *replayDeadLetters) sendDeadLetter(dl deadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dl.FailedAt = ""
+	q.letters = append(q.letters, dl)
+	return nil
+}
+
+// check compares the dead letters with want, when the fixture asserts them,
+// once background (async) publishes have finished.
+func (q *replayDeadLetters) check(want *[]deadLetter) error {
+	if want == nil {
+		return nil
+	}
+	backgroundWork.Wait()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	got := append([]deadLetter{}, q.letters...)
+	if !reflect.DeepEqual(got, append([]deadLetter{}, *want...)) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(*want)
+		return fmt.Errorf("dead letters %s, want %s", gotJSON, wantJSON)
+	}
+	return nil
+}
+
+// replayRegistry is a fixture's device registry in place of DynamoDB.
+type replayRegistry []deviceRecord
+
+func (r replayRegistry) listDevices() ([]deviceRecord, error) { return r, nil }
+
+func (r replayRegistry) getDevice(id string) (*deviceRecord, error) {
+	for i := range r {
+		if r[i].DeviceID == id {
+			return &r[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r replayRegistry) putDevice(deviceRecord, bool) error {
+	return errors.New("the replay registry is read-only")
+}
+
+func (r replayRegistry) deleteDevice(string) (bool, error) {
+	return false, errors.New("the replay registry is read-only")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+
+	"shared/mqttclient"
+)
+
+// brokerRoute sends topics under Prefix to a broker other than the default.
+// Every field except Prefix and BrokerSSM is optional and falls back to the
+// MQTT_* environment settings, so a route only lists what differs.
+type brokerRoute struct {
+	Prefix      string `json:"prefix"`
+	BrokerSSM   string `json:"broker_ssm"`
+	Version     int    `json:"version,omitempty"`
+	Scheme      string `json:"scheme,omitempty"`
+	Port        string `json:"port,omitempty"`
+	UsernameSSM string `json:"username_ssm,omitempty"`
+	PasswordSSM string `json:"password_ssm,omitempty"`
+}
+
+// defaultRouteKey identifies the MQTT_BROKER_SSM broker in the client pool.
+const defaultRouteKey = "default"
+
+// key identifies the route's pooled client.
+func (r *brokerRoute) key() string {
+	if r == nil {
+		return defaultRouteKey
+	}
+	return "route:" + r.Prefix
+}
+
+// loadRoutes parses BROKER_ROUTES, a JSON array of brokerRoute.
+func loadRoutes() ([]brokerRoute, error) {
+	raw := os.Getenv("BROKER_ROUTES")
+	if raw == "" {
+		return nil, nil
+	}
+	var routes []brokerRoute
+	if err := json.Unmarshal([]byte(raw), &routes); err != nil {
+		return nil, fmt.Errorf("BROKER_ROUTES: %w", err)
+	}
+	for i, r := range routes {
+		if r.Prefix == "" || r.BrokerSSM == "" {
+			return nil, fmt.Errorf("BROKER_ROUTES[%d]: prefix and broker_ssm are required", i)
+		}
+		if r.Version != 0 && r.Version != 3 && r.Version != 5 {
+			return nil, fmt.Errorf("BROKER_ROUTES[%d]: unsupported version %d", i, r.Version)
+		}
+		if _, ok := mqttclient.DefaultPorts[strings.ToLower(r.Scheme)]; r.Scheme != "" && !ok {
+			return nil, fmt.Errorf("BROKER_ROUTES[%d]: unsupported scheme %q", i, r.Scheme)
+		}
+	}
+	return routes, nil
+}
+
+// routeFor picks the route with the longest prefix matching topic, or nil
+// for the default broker.
+func routeFor(topic string) (*brokerRoute, error) {
+	routes, err := loadRoutes()
+	if err != nil {
+		return nil, err
+	}
+	var best *brokerRoute
+	for i := range routes {
+		r := &routes[i]
+		if strings.HasPrefix(topic, r.Prefix) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	return best, nil
+}
+
+// routeSettings applies route's transport overrides to the environment
+// settings.
+func routeSettings(route *brokerRoute) (mqttclient.Config, error) {
+	cfg, err := mqttclient.Settings()
+	if err != nil {
+		return cfg, err
+	}
+	if route.Version != 0 {
+		cfg.Version = route.Version
+	}
+	if route.Scheme != "" {
+		cfg.Scheme = strings.ToLower(route.Scheme)
+		cfg.Port = mqttclient.DefaultPorts[cfg.Scheme]
+	}
+	if route.Port != "" {
+		cfg.Port = route.Port
+	}
+	return cfg, nil
+}
+
+// routeEndpoint resolves the broker host and transport for route, leaving
+// credentials empty. A nil route is the default broker.
+func routeEndpoint(client ssmiface.SSMAPI, route *brokerRoute) (mqttclient.Config, error) {
+	if route == nil {
+		return mqttclient.LoadEndpoint(client)
+	}
+	cfg, err := routeSettings(route)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Host, err = mqttclient.GetParam(client, route.BrokerSSM); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// routeConfig resolves route's endpoint plus its credentials in one SSM batch.
+// Routes without credential references connect anonymously, or with the
+// client certificate under MQTT_AUTH_MODE=mtls.
+func routeConfig(client ssmiface.SSMAPI, route *brokerRoute) (mqttclient.Config, error) {
+	if route == nil {
+		return mqttclient.LoadConfig(client)
+	}
+	cfg, err := routeSettings(route)
+	if err != nil {
+		return cfg, err
+	}
+	names := []string{route.BrokerSSM}
+	for _, ref := range []string{route.UsernameSSM, route.PasswordSSM} {
+		if ref != "" {
+			names = append(names, ref)
+		}
+	}
+	values, err := mqttclient.GetParams(client, names...)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Host, values = values[0], values[1:]
+	if route.UsernameSSM != "" {
+		cfg.Username, values = values[0], values[1:]
+	}
+	if route.PasswordSSM != "" {
+		cfg.Password = values[0]
+	}
+	return cfg, mqttclient.ApplyClientCert(client, &cfg)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Reference is published in place of a payload too large for MQTT; the
+// device downloads the object from URL before it expires.
+type s3Reference struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// presignGet returns a presigned GET URL for the object, valid for ttl.
+func presignGet(bucket, key string, ttl time.Duration) (string, error) {
+	req, _ := s3.New(session.Must(session.NewSession())).GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+// s3ReferenceMessage builds the JSON reference message for key in
+// S3_PAYLOAD_BUCKET. Keys must sit under S3_PAYLOAD_PREFIX when it is set.
+func s3ReferenceMessage(key string, now time.Time) (string, *apiError) {
+	bucket := os.Getenv("S3_PAYLOAD_BUCKET")
+	if bucket == "" {
+		return "", newAPIError(400, "S3_REFS_DISABLED", "S3 object references are not enabled")
+	}
+	// Reject traversal and anything path.Clean would rewrite
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.Contains(key, "..") {
+		return "", newAPIError(400, "INVALID_S3_KEY", "'s3_key' must be a plain relative object key")
+	}
+	if prefix := os.Getenv("S3_PAYLOAD_PREFIX"); !strings.HasPrefix(key, prefix) {
+		return "", newAPIError(403, "S3_KEY_NOT_ALLOWED", "'s3_key' must start with "+prefix)
+	}
+
+	ttl := envDuration("S3_URL_TTL", 15*time.Minute)
+	url, err := presignGet(bucket, key, ttl)
+	if err != nil {
+		return "", newAPIError(500, "PRESIGN_FAILED", "Presigning the S3 object failed: "+err.Error())
+	}
+	out, _ := json.Marshal(s3Reference{
+		Bucket:    bucket,
+		Key:       key,
+		URL:       url,
+		ExpiresAt: now.Add(ttl).UTC().Format(time.RFC3339),
+	})
+	return string(out), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Commands scheduled through the scheduler Lambda (backend/scheduler_go)
+// arrive from EventBridge Scheduler as bare publish requests carrying
+// "scheduled_by": {"owner": <Cognito subject>, "id": <command ID>}. The
+// scheduler checked the command against its owner when it was scheduled; it
+// runs as that owner too, so USER_NAMESPACE places its topics in the owner's
+// namespace and the registry checks the owner still owns the devices. Only
+// the scheduler invokes the function with a bare request outside
+// IOT_RULE_ALIAS (see detectSource), so scheduled_by is trusted there alone
+// and removed unread from every other queued publish.
+
+type scheduledBy struct {
+	Owner string `json:"owner"`
+	ID    string `json:"id"`
+}
+
+// queuedRequest is the queued publish request for body, with any
+// scheduled_by removed.
+func queuedRequest(body string) events.APIGatewayProxyRequest {
+	request, _ := splitScheduledBy(body)
+	return request
+}
+
+// scheduledRequest is the queued publish request for a scheduled command,
+// acting for its owner.
+func scheduledRequest(body string) events.APIGatewayProxyRequest {
+	request, by := splitScheduledBy(body)
+	if by.Owner != "" {
+		logger.Info("scheduled command", "scheduleId", by.ID, "owner", by.Owner)
+		request.RequestContext.Authorizer = map[string]interface{}{delegatedSubjectKey: by.Owner}
+	}
+	return request
+}
+
+// splitScheduledBy returns the queued publish request for body without its
+// scheduled_by, and what that said.
+func splitScheduledBy(body string) (events.APIGatewayProxyRequest, scheduledBy) {
+	request := events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: queuedPublishPath, Body: body}
+	var by scheduledBy
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &fields); err != nil || fields["scheduled_by"] == nil {
+		return request, by
+	}
+	_ = json.Unmarshal(fields["scheduled_by"], &by)
+	delete(fields, "scheduled_by")
+	if stripped, err := json.Marshal(fields); err == nil {
+		request.Body = string(stripped)
+	}
+	return request, by
+}
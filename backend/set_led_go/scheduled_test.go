@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestScheduledCommandUsesOwnerNamespace(t *testing.T) {
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	broker := newTestBroker(t)
+
+	err := handleScheduledPublish(context.Background(), `{"topic":"devices/lamp","message":"on","scheduled_by":{"owner":"u1","id":"c1"}}`)
+	if err != nil {
+		t.Fatalf("scheduled publish failed: %v", err)
+	}
+	sent := broker.sentTo("users/u1/devices/lamp")
+	if len(sent) != 1 || string(sent[0].payload) != "on" {
+		t.Errorf("sent %v, want one message to users/u1/devices/lamp", broker.published())
+	}
+
+	// A queued publish without an owner still has no namespace
+	var failure *queuedFailure
+	err = handleQueuedPublish(context.Background(), `{"topic":"devices/lamp","message":"on"}`)
+	if !errors.As(err, &failure) || failure.code != "NO_SUBJECT" {
+		t.Errorf("unscheduled publish: err = %v, want NO_SUBJECT", err)
+	}
+}
+
+func TestScheduledCommandChecksOwnership(t *testing.T) {
+	broker := newTestBroker(t)
+	newMemRegistry(t,
+		deviceRecord{DeviceID: "lamp-1", Topics: []string{"devices/lamp-1/#"}, Owners: []string{"u1"}},
+		deviceRecord{DeviceID: "lamp-2", Topics: []string{"devices/lamp-2/#"}, Owners: []string{"u2"}},
+	)
+
+	tests := []struct {
+		name, body string
+		code       string
+	}{
+		{"owned", `{"topic":"devices/lamp-1/led","message":"on","scheduled_by":{"owner":"u1","id":"c1"}}`, ""},
+		{"not owned", `{"topic":"devices/lamp-2/led","message":"on","scheduled_by":{"owner":"u1","id":"c2"}}`, "DEVICE_NOT_OWNED"},
+		{"unscheduled queued publish", `{"topic":"devices/lamp-2/led","message":"on"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handleScheduledPublish(context.Background(), tt.body)
+			var failure *queuedFailure
+			switch {
+			case tt.code == "" && err != nil:
+				t.Errorf("err = %v, want success", err)
+			case tt.code != "" && (!errors.As(err, &failure) || failure.code != tt.code):
+				t.Errorf("err = %v, want %s", err, tt.code)
+			}
+		})
+	}
+	if n := len(broker.sentTo("devices/lamp-2/led")); n != 1 {
+		t.Errorf("%d publishes to lamp-2, want only the unscheduled one", n)
+	}
+}
+
+func TestQueuedRequestStripsScheduledBy(t *testing.T) {
+	body := `{"topic":"a","message":"on","scheduled_by":{"owner":"u1","id":"c1"}}`
+	request := scheduledRequest(body)
+	if request.Body != `{"message":"on","topic":"a"}` {
+		t.Errorf("body %s still carries scheduled_by", request.Body)
+	}
+	if requestSubject(request) != "u1" || !messageTriggered(request) {
+		t.Errorf("request does not act for the owner as a queued publish: %+v", request)
+	}
+	// Any other queued publish has it removed unread
+	request = queuedRequest(body)
+	if request.Body != `{"message":"on","topic":"a"}` || requestSubject(request) != "" {
+		t.Errorf("queued request %+v acts on scheduled_by", request)
+	}
+	if body := `not json`; scheduledRequest(body).Body != body {
+		t.Error("a body that is not a JSON object was changed")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// payloadSchema is the subset of JSON Schema a registered device's commands
+// are checked against: type, enum, required, properties,
+// additionalProperties, items, pattern, minimum and maximum.
+type payloadSchema struct {
+	Type                 string                    `json:"type,omitempty"`
+	Enum                 []interface{}             `json:"enum,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Properties           map[string]*payloadSchema `json:"properties,omitempty"`
+	AdditionalProperties *bool                     `json:"additionalProperties,omitempty"`
+	Items                *payloadSchema            `json:"items,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty"`
+	Maximum              *float64                  `json:"maximum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+var schemaTypes = map[string]bool{"": true, "object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true}
+
+// parseSchema decodes and checks a device schema, compiling its patterns.
+func parseSchema(raw []byte) (*payloadSchema, error) {
+	var s payloadSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile("schema"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *payloadSchema) compile(path string) error {
+	if !schemaTypes[s.Type] {
+		return fmt.Errorf("%s: unsupported type %q", path, s.Type)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: pattern: %w", path, err)
+		}
+		s.pattern = re
+	}
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("%s.%s: empty schema", path, name)
+		}
+		if err := p.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// check validates the decoded JSON value v, naming the offending field by
+// path in the error.
+func (s *payloadSchema) check(path string, v interface{}) error {
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(v, allowed) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %v is not one of the allowed values", path, v)
+	}
+	if s.Type != "" && !hasType(v, s.Type) {
+		return fmt.Errorf("%s: must be %s", path, s.Type)
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := t[name]; !ok {
+				return fmt.Errorf("%s.%s: is required", path, name)
+			}
+		}
+		names := make([]string, 0, len(t))
+		for name := range t {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s: is not allowed", path, name)
+				}
+				continue
+			}
+			if err := p.check(path+"."+name, t[name]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range t {
+				if err := s.Items.check(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			return fmt.Errorf("%s: %q does not match %s", path, t, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && t < *s.Minimum {
+			return fmt.Errorf("%s: %v is below the minimum %v", path, t, *s.Minimum)
+		}
+		if s.Maximum != nil && t > *s.Maximum {
+			return fmt.Errorf("%s: %v is above the maximum %v", path, t, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case float64:
+		return typ == "number" || (typ == "integer" && t == math.Trunc(t))
+	case bool:
+		return typ == "boolean"
+	case nil:
+		return typ == "null"
+	}
+	return false
+}
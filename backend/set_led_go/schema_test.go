@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const ledSchema = `{
+	"type": "object",
+	"required": ["state"],
+	"additionalProperties": false,
+	"properties": {
+		"state": {"enum": ["on", "off"]},
+		"color": {"type": "string", "pattern": "^#[0-9A-F]{6}$"},
+		"brightness": {"type": "integer", "minimum": 0, "maximum": 100},
+		"steps": {"type": "array", "items": {"type": "number"}},
+		"fade": {"type": "boolean"},
+		"scene": {"type": "null"}
+	}
+}`
+
+func TestSchemaCheck(t *testing.T) {
+	s, err := parseSchema([]byte(ledSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		payload string
+		want    string // error prefix; "" when valid
+	}{
+		{`{"state":"on"}`, ""},
+		{`{"state":"off","color":"#00FF7F","brightness":40,"steps":[1,2.5],"fade":true,"scene":null}`, ""},
+		{`{"state":"dim"}`, "payload.state: dim is not one of the allowed values"},
+		{`{"color":"#00FF7F"}`, "payload.state: is required"},
+		{`{"state":"on","blink":true}`, "payload.blink: is not allowed"},
+		{`{"state":"on","color":"red"}`, `payload.color: "red" does not match`},
+		{`{"state":"on","brightness":40.5}`, "payload.brightness: must be integer"},
+		{`{"state":"on","brightness":101}`, "payload.brightness: 101 is above the maximum 100"},
+		{`{"state":"on","brightness":-1}`, "payload.brightness: -1 is below the minimum 0"},
+		{`{"state":"on","steps":[1,"2"]}`, "payload.steps[1]: must be number"},
+		{`{"state":"on","fade":"yes"}`, "payload.fade: must be boolean"},
+		{`{"state":"on","scene":"night"}`, "payload.scene: must be null"},
+		{`["on"]`, "payload: must be object"},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.payload), &v); err != nil {
+			t.Fatal(err)
+		}
+		err := s.check("payload", v)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.payload, err)
+		case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+			t.Errorf("%s: error %v, want %q", tt.payload, err, tt.want)
+		}
+	}
+}
+
+func TestSchemaReportsFirstFieldInOrder(t *testing.T) {
+	s, _ := parseSchema([]byte(`{"properties":{"a":{"type":"string"},"b":{"type":"string"}}}`))
+	// Maps iterate randomly; the error must not
+	for i := 0; i < 20; i++ {
+		if err := s.check("payload", map[string]interface{}{"b": 1.0, "a": 1.0}); err == nil || err.Error() != "payload.a: must be string" {
+			t.Fatalf("error %v, want payload.a reported first", err)
+		}
+	}
+}
+
+func TestParseSchemaRejects(t *testing.T) {
+	for raw, want := range map[string]string{
+		`{"type":"float"}`:                                 `schema: unsupported type "float"`,
+		`{"properties":{"a":{"type":"dict"}}}`:             `schema.a: unsupported type "dict"`,
+		`{"properties":{"a":null}}`:                        "schema.a: empty schema",
+		`{"items":{"properties":{"c":{"pattern":"[a-"}}}}`: "schema[].c: pattern: ",
+		`{"type":"object"`:                                 "unexpected end of JSON input",
+		`{"minimum":"0"}`:                                  "json: cannot unmarshal string",
+	} {
+		if _, err := parseSchema([]byte(raw)); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", raw, err, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// adminRetainedHandler seeds retained state for many topics at once from a
+// {topic: message} map, e.g. during device onboarding. Every entry is
+// published with retained=true.
+func adminRetainedHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "POST" {
+		return errorRespStatus(405, "Use POST")
+	}
+	if apiErr := requireAdmin(request); apiErr != nil {
+		return apiErr.response()
+	}
+
+	var seed map[string]messageValue
+	if err := json.Unmarshal([]byte(request.Body), &seed); err != nil || len(seed) == 0 {
+		return errorRespStatus(400, "Request body must be a non-empty {topic: message} JSON object")
+	}
+	if max := envInt("MAX_BATCH_SIZE", 100); len(seed) > max {
+		return errorRespCode(400, "BATCH_TOO_LARGE", fmt.Sprintf("at most %d topics per request", max))
+	}
+
+	topics := make([]string, 0, len(seed))
+	payloads := make(map[string]string, len(seed))
+	for topic, message := range seed {
+		// Admin topics have no namespace but are otherwise placed as any
+		// publish topic is (see placeTopic)
+		topic = normalizeTopic(prefixTopic(topic))
+		if _, dup := payloads[topic]; !dup {
+			topics = append(topics, topic)
+		}
+		payloads[topic] = string(message)
+	}
+	sort.Strings(topics)
+
+	qos, apiErr := parseQoS(nil)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	msgs := make([]outboundMessage, len(topics))
+	for i, topic := range topics {
+		if apiErr := validateTopic(topic); apiErr != nil {
+			return errorRespCode(apiErr.Status, apiErr.Code, topic+": "+apiErr.Message)
+		}
+		msgs[i] = outboundMessage{Topic: topic, QoS: qos, Retained: true, Payload: payloads[topic]}
+	}
+
+	results, apiErr := publishAll(mqttCreds{}, msgs)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	return batchResponse(results, map[string]interface{}{"total": len(results)})
+}
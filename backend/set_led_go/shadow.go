@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// thingNamePattern is the AWS IoT thing name charset.
+var thingNamePattern = regexp.MustCompile(`^[a-zA-Z0-9:_-]{1,128}$`)
+
+// shadowUpdate builds the AWS IoT shadow update topic and the
+// {"state":{"desired":...}} envelope for thing.
+func shadowUpdate(thing string, desired json.RawMessage) (topic, message string, apiErr *apiError) {
+	if !thingNamePattern.MatchString(thing) {
+		return "", "", newAPIError(400, "INVALID_THING", fmt.Sprintf("invalid thing name %q", thing))
+	}
+
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(desired, &state); err != nil || state == nil {
+		return "", "", newAPIError(400, "INVALID_DESIRED", "'desired' must be a JSON object")
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"state": map[string]interface{}{"desired": state},
+	})
+	if err != nil {
+		return "", "", newAPIError(400, "INVALID_DESIRED", err.Error())
+	}
+	return "$aws/things/" + thing + "/shadow/update", string(payload), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// backgroundWork tracks work still running after its invocation returned:
+// async publishes run off Lambda (publishAsync) and webhook deliveries
+// (notifyWebhook).
+var backgroundWork sync.WaitGroup
+
+// drainBackground waits up to timeout for background work to finish and
+// reports whether it did.
+func drainBackground(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// onShutdown runs on the SIGTERM Lambda sends before recycling the container.
+// The runtime gets about 500ms in total, so SHUTDOWN_DRAIN_TIMEOUT defaults
+// a little below that.
+func onShutdown() {
+	timeout := envDuration("SHUTDOWN_DRAIN_TIMEOUT", 400*time.Millisecond)
+	if drainBackground(timeout) {
+		logger.Info("shutdown: background publishes drained")
+		return
+	}
+	logger.Warn("shutdown: background publishes still running; abandoning", "waited", timeout.String())
+}
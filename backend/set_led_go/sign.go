@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/mqttclient"
+)
+
+// Publish tokens let a browser publish to one topic scope without holding
+// broker or API credentials. A token is
+//
+//	base64url(claims JSON) "." base64url(HMAC-SHA256(claims JSON))
+//
+// keyed with the secret in the SSM parameter named by SIGNING_KEY_SSM. The
+// scope is a topic or topic filter (e.g. devices/lamp-1/#). A token signed for
+// a signed-in user also carries their JWT subject, which stands in for the
+// authorizer on /publish (see withTokenSubject).
+
+type tokenClaims struct {
+	Topic   string `json:"topic"`
+	Subject string `json:"sub,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+type signRequest struct {
+	Topic      string `json:"topic"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+func signingKey() ([]byte, *apiError) {
+	name := os.Getenv("SIGNING_KEY_SSM")
+	if name == "" {
+		return nil, newAPIError(403, "SIGNING_DISABLED", "token signing is not configured")
+	}
+	key, err := mqttclient.GetParam(mqttclient.NewSSMClient(), name)
+	if err != nil {
+		return nil, newAPIError(500, "", "SSM lookup failed: "+err.Error())
+	}
+	return []byte(key), nil
+}
+
+func signToken(key []byte, claims tokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks the signature and expiry and returns the claims.
+func verifyToken(key []byte, token string, now time.Time) (tokenClaims, *apiError) {
+	var claims tokenClaims
+	enc := base64.RawURLEncoding
+
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	payload, err1 := enc.DecodeString(payloadPart)
+	sig, err2 := enc.DecodeString(sigPart)
+	if !ok || err1 != nil || err2 != nil {
+		return claims, newAPIError(401, "INVALID_TOKEN", "malformed publish token")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, newAPIError(401, "INVALID_TOKEN", "publish token signature mismatch")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, newAPIError(401, "INVALID_TOKEN", "malformed publish token")
+	}
+	if now.Unix() >= claims.Expires {
+		return claims, newAPIError(401, "TOKEN_EXPIRED", "publish token has expired")
+	}
+	return claims, nil
+}
+
+// signHandler issues a short-lived publish token for the requested topic.
+func signHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "POST" {
+		return errorRespStatus(405, "Use POST")
+	}
+	var body signRequest
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || body.Topic == "" {
+		return errorRespStatus(400, "Request body must be JSON with a 'topic'")
+	}
+
+	// Scope the token to the topic as it will actually be published, and
+	// only to topics the caller could publish to or subscribe to directly
+	topic, apiErr := placeTopic(request, body.Topic)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	if strings.ContainsAny(topic, "+#") {
+		apiErr = validateSubscription(topic)
+	} else {
+		apiErr = validateTopic(topic)
+	}
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	key, apiErr := signingKey()
+	if apiErr != nil {
+		return apiErr.response()
+	}
+
+	ttl := envDuration("SIGN_TOKEN_TTL", 5*time.Minute)
+	if requested := time.Duration(body.TTLSeconds) * time.Second; requested > 0 && requested < ttl {
+		ttl = requested
+	}
+	expires := time.Now().Add(ttl)
+	token := signToken(key, tokenClaims{Topic: topic, Subject: requestSubject(request), Expires: expires.Unix()})
+
+	return jsonResp(200, map[string]interface{}{
+		"token":     token,
+		"topic":     topic,
+		"expiresAt": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// authorizePublishToken validates the X-Publish-Token header against every
+// topic about to be published. The token is mandatory on /publish (which has
+// no other authorizer) and checked whenever present elsewhere.
+func authorizePublishToken(request events.APIGatewayProxyRequest, topics ...string) *apiError {
+	return checkPublishToken(request, func(scope string) *apiError {
+		for _, topic := range topics {
+			if !mqttclient.TopicMatches(scope, topic) {
+				return newAPIError(403, "TOKEN_SCOPE", "publish token does not cover topic "+topic)
+			}
+		}
+		return nil
+	})
+}
+
+// authorizeSubscriptionToken checks that a presented publish token's scope
+// covers every topic filter could match, so a token for one device cannot
+// read another's traffic.
+func authorizeSubscriptionToken(request events.APIGatewayProxyRequest, filter string) *apiError {
+	return checkPublishToken(request, func(scope string) *apiError {
+		if !filterCovers(scope, filter) {
+			return newAPIError(403, "TOKEN_SCOPE", "publish token does not cover subscription "+filter)
+		}
+		return nil
+	})
+}
+
+// checkPublishToken verifies the X-Publish-Token header, if any, and passes
+// its topic scope to check. The token is mandatory on /publish only.
+func checkPublishToken(request events.APIGatewayProxyRequest, check func(scope string) *apiError) *apiError {
+	claims, apiErr := publishTokenClaims(request)
+	if claims == nil || apiErr != nil {
+		return apiErr
+	}
+	return check(claims.Topic)
+}
+
+// publishTokenClaims returns the verified claims of the X-Publish-Token
+// header, or nil when there is none and none is required.
+func publishTokenClaims(request events.APIGatewayProxyRequest) (*tokenClaims, *apiError) {
+	token := headerValue(request, "X-Publish-Token")
+	if token == "" {
+		if isPublishPath(request) {
+			return nil, newAPIError(401, "TOKEN_REQUIRED", "X-Publish-Token header is required")
+		}
+		return nil, nil
+	}
+
+	key, apiErr := signingKey()
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	claims, apiErr := verifyToken(key, token, time.Now())
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return &claims, nil
+}
+
+// withTokenSubject verifies the publish token on /publish, which has no
+// authorizer, and records the subject it was signed for in the authorizer
+// context, so USER_NAMESPACE and device ownership resolve to that user.
+func withTokenSubject(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRequest, *apiError) {
+	if !isPublishPath(request) {
+		return request, nil
+	}
+	claims, apiErr := publishTokenClaims(request)
+	if apiErr != nil || claims.Subject == "" {
+		return request, apiErr
+	}
+	auth := map[string]interface{}{delegatedSubjectKey: claims.Subject}
+	for k, v := range request.RequestContext.Authorizer {
+		auth[k] = v
+	}
+	request.RequestContext.Authorizer = auth
+	return request, nil
+}
+
+func isPublishPath(request events.APIGatewayProxyRequest) bool {
+	return strings.TrimSuffix(request.Path, "/") == "/publish"
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// seedSigningKey makes SIGNING_KEY_SSM resolve to key without calling SSM.
+func seedSigningKey(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv("SIGNING_KEY_SSM", "/replay/signing-key")
+	t.Cleanup(seedConfig(map[string]string{"signing-key": key}))
+}
+
+// sign calls POST /sign as a Cognito user and returns the token.
+func sign(t *testing.T, sub, body string) (events.APIGatewayProxyResponse, string) {
+	t.Helper()
+	resp := call(t, withClaims(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/sign", Body: body}, map[string]interface{}{"sub": sub}))
+	token, _ := decodeBody(t, resp)["token"].(string)
+	return resp, token
+}
+
+func publishWithToken(t *testing.T, token, body string) events.APIGatewayProxyResponse {
+	t.Helper()
+	return post(t, "/publish", body, map[string]string{"X-Publish-Token": token})
+}
+
+func TestSignedTokenPublishes(t *testing.T) {
+	seedSigningKey(t, "secret")
+	broker := newTestBroker(t)
+
+	resp, token := sign(t, "u1", `{"topic":"devices/lamp-1/#"}`)
+	if resp.StatusCode != 200 || token == "" {
+		t.Fatalf("sign status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if resp := publishWithToken(t, token, `{"topic":"devices/lamp-1/led","message":"on"}`); resp.StatusCode != 200 {
+		t.Fatalf("publish status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if n := len(broker.sentTo("devices/lamp-1/led")); n != 1 {
+		t.Errorf("published %d times, want 1", n)
+	}
+}
+
+func TestSignedTokenRejected(t *testing.T) {
+	seedSigningKey(t, "secret")
+	newTestBroker(t)
+	_, token := sign(t, "u1", `{"topic":"devices/lamp-1/#"}`)
+	expired := signToken([]byte("secret"), tokenClaims{Topic: "devices/lamp-1/#", Expires: time.Now().Add(-time.Second).Unix()})
+	forged := signToken([]byte("other"), tokenClaims{Topic: "#", Expires: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name, token, topic string
+		status             int
+		code               string
+	}{
+		{"missing", "", "devices/lamp-1/led", 401, "TOKEN_REQUIRED"},
+		{"expired", expired, "devices/lamp-1/led", 401, "TOKEN_EXPIRED"},
+		{"forged", forged, "devices/lamp-1/led", 401, "INVALID_TOKEN"},
+		{"out of scope", token, "devices/lamp-2/led", 403, "TOKEN_SCOPE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := publishWithToken(t, tt.token, `{"topic":"`+tt.topic+`","message":"on"}`)
+			if code := decodeBody(t, resp)["code"]; resp.StatusCode != tt.status || code != tt.code {
+				t.Errorf("status %d code %v, want %d %s (body %s)", resp.StatusCode, code, tt.status, tt.code, resp.Body)
+			}
+		})
+	}
+}
+
+func TestSignChecksScope(t *testing.T) {
+	seedSigningKey(t, "secret")
+	tests := []struct {
+		name   string
+		env    map[string]string
+		topic  string
+		status int
+		code   string
+	}{
+		{"malformed filter", nil, "devices/lamp#", 400, "INVALID_FILTER"},
+		{"outside the allowlist", map[string]string{"TOPIC_ALLOWLIST": "devices/"}, "#", 403, "TOPIC_NOT_ALLOWED"},
+		{"literal outside the allowlist", map[string]string{"TOPIC_ALLOWLIST": "devices/"}, "admin/led", 403, "TOPIC_NOT_ALLOWED"},
+		{"another user's namespace", map[string]string{"USER_NAMESPACE": "users/{sub}/"}, "users/u2/#", 403, "USER_NAMESPACE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			resp, token := sign(t, "u1", `{"topic":"`+tt.topic+`"}`)
+			if code := decodeBody(t, resp)["code"]; resp.StatusCode != tt.status || code != tt.code || token != "" {
+				t.Errorf("status %d code %v, want %d %s (body %s)", resp.StatusCode, code, tt.status, tt.code, resp.Body)
+			}
+		})
+	}
+}
+
+func TestSignScopesToNamespace(t *testing.T) {
+	seedSigningKey(t, "secret")
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	resp, _ := sign(t, "u1", `{"topic":"devices/#"}`)
+	if got := decodeBody(t, resp)["topic"]; got != "users/u1/devices/#" {
+		t.Errorf("token topic %v, want users/u1/devices/#", got)
+	}
+}
+
+func TestPublishTokenCarriesNamespace(t *testing.T) {
+	seedSigningKey(t, "secret")
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	broker := newTestBroker(t)
+
+	_, token := sign(t, "u1", `{"topic":"devices/#"}`)
+	if resp := publishWithToken(t, token, `{"topic":"devices/lamp","message":"on"}`); resp.StatusCode != 200 {
+		t.Fatalf("publish status %d: %s", resp.StatusCode, resp.Body)
+	}
+	if n := len(broker.sentTo("users/u1/devices/lamp")); n != 1 {
+		t.Errorf("published %d times to users/u1/devices/lamp, want 1", n)
+	}
+
+	// The token's own subject decides the namespace, not the body
+	resp := publishWithToken(t, token, `{"topic":"users/u2/devices/lamp","message":"on"}`)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 403 || code != "USER_NAMESPACE" {
+		t.Errorf("status %d code %v, want 403 USER_NAMESPACE", resp.StatusCode, code)
+	}
+
+	// A token signed without a user has no namespace to publish into
+	anonymous := signToken([]byte("secret"), tokenClaims{Topic: "#", Expires: time.Now().Add(time.Hour).Unix()})
+	resp = publishWithToken(t, anonymous, `{"topic":"devices/lamp","message":"on"}`)
+	if code := decodeBody(t, resp)["code"]; resp.StatusCode != 401 || code != "NO_SUBJECT" {
+		t.Errorf("status %d code %v, want 401 NO_SUBJECT", resp.StatusCode, code)
+	}
+}
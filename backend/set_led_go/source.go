@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// eventSource identifies which AWS service invoked the function.
+type eventSource int
+
+const (
+	sourceUnknown eventSource = iota
+	sourceAPIGateway
+	sourceSQS
+	sourceEventBridge
+	sourceSNS
+	// sourceIoTRule is an AWS IoT Rule Lambda action, which invokes the
+	// function with the rule's SELECT output: the publish request itself
+	sourceIoTRule
+	// sourceAsyncJob is an async publish handed over by publishAsync
+	sourceAsyncJob
+	// sourceScheduler is EventBridge Scheduler, which invokes the function
+	// with a scheduled command as is (see scheduledRequest)
+	sourceScheduler
+)
+
+// An event's shape alone proves nothing about who sent it: a rule's SELECT
+// output is whatever a device published, and a device can publish something
+// shaped like an API Gateway request with authorizer claims. IoT Rule actions
+// therefore invoke the function through the IOT_RULE_ALIAS alias, and every
+// event arriving through it is read as a rule payload and nothing else. Any
+// other invocation comes from an invoker granted permission on the function
+// itself, and is told apart by the fields AWS sets, exactly one shape of
+// which must match; anything ambiguous is sourceUnknown and refused.
+
+// eventProbe holds just enough fields to tell the supported events apart.
+type eventProbe struct {
+	HTTPMethod     string          `json:"httpMethod"`
+	RequestContext json.RawMessage `json:"requestContext"`
+	Source         string          `json:"source"`
+	DetailType     string          `json:"detail-type"`
+	Detail         json.RawMessage `json:"detail"`
+	Topic          json.RawMessage `json:"topic"`
+	Topics         json.RawMessage `json:"topics"`
+	Group          json.RawMessage `json:"group"`
+	AsyncJob       json.RawMessage `json:"asyncJob"`
+	Records        []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+}
+
+// recordsFrom reports whether the event is a batch of records all delivered
+// by source, e.g. "aws:sqs".
+func (p eventProbe) recordsFrom(source string) bool {
+	for _, r := range p.Records {
+		if r.EventSource != source {
+			return false
+		}
+	}
+	return len(p.Records) > 0
+}
+
+// apiGateway reports whether the event is an API Gateway proxy request.
+func (p eventProbe) apiGateway() bool {
+	var rc struct {
+		APIID string `json:"apiId"`
+	}
+	return p.HTTPMethod != "" && json.Unmarshal(p.RequestContext, &rc) == nil && rc.APIID != ""
+}
+
+// publishRequest reports whether the event is a bare publish request.
+func (p eventProbe) publishRequest() bool {
+	return len(p.Topic) > 0 || len(p.Topics) > 0 || len(p.Group) > 0
+}
+
+// envelope reports whether the event carries any field of another event's
+// envelope, which a rule payload never legitimately does.
+func (p eventProbe) envelope() bool {
+	return p.HTTPMethod != "" || len(p.RequestContext) > 0 || len(p.Records) > 0 ||
+		p.DetailType != "" || len(p.Detail) > 0 || len(p.AsyncJob) > 0
+}
+
+func detectSource(ctx context.Context, raw json.RawMessage) eventSource {
+	var probe eventProbe
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return sourceUnknown
+	}
+	if ruleInvocation(ctx) {
+		if probe.publishRequest() && !probe.envelope() {
+			return sourceIoTRule
+		}
+		return sourceUnknown
+	}
+
+	var matched []eventSource
+	if probe.recordsFrom("aws:sqs") {
+		matched = append(matched, sourceSQS)
+	}
+	if probe.recordsFrom("aws:sns") {
+		matched = append(matched, sourceSNS)
+	}
+	if probe.Source != "" && probe.DetailType != "" && len(probe.Detail) > 0 {
+		matched = append(matched, sourceEventBridge)
+	}
+	if probe.apiGateway() {
+		matched = append(matched, sourceAPIGateway)
+	}
+	if len(probe.AsyncJob) > 0 {
+		matched = append(matched, sourceAsyncJob)
+	}
+	if probe.publishRequest() {
+		matched = append(matched, sourceScheduler)
+	}
+	if len(matched) != 1 {
+		return sourceUnknown
+	}
+	return matched[0]
+}
+
+// ruleInvocation reports whether the function was invoked through the
+// IOT_RULE_ALIAS alias.
+func ruleInvocation(ctx context.Context) bool {
+	alias := os.Getenv("IOT_RULE_ALIAS")
+	lc, ok := lambdacontext.FromContext(ctx)
+	if alias == "" || !ok {
+		return false
+	}
+	// arn:aws:lambda:<region>:<account>:function:<name>:<qualifier>
+	parts := strings.Split(lc.InvokedFunctionArn, ":")
+	return len(parts) == 8 && parts[7] == alias
+}
+
+// dispatch is the Lambda entry point. It detects the event source and routes
+// HTTP requests to handler and queued publish requests to their processors.
+func dispatch(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	switch detectSource(ctx, raw) {
+	case sourceAPIGateway:
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, err
+		}
+		return handler(ctx, request)
+	case sourceSQS:
+		var event events.SQSEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return handleSQS(ctx, event), nil
+	case sourceEventBridge:
+		var event events.CloudWatchEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return nil, handleQueuedPublish(ctx, string(event.Detail))
+	case sourceSNS:
+		var event events.SNSEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return nil, handleSNS(ctx, event)
+	case sourceIoTRule:
+		// Returning the error lets the rule's error action see the failure
+		return nil, handleQueuedPublish(ctx, string(raw))
+	case sourceScheduler:
+		return nil, handleScheduledPublish(ctx, string(raw))
+	case sourceAsyncJob:
+		var event struct {
+			AsyncJob asyncJob `json:"asyncJob"`
+		}
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		// A failed publish is dead-lettered, so Lambda must not retry it
+		runAsyncJob(ctx, event.AsyncJob)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported event source")
+}
+
+// handleSQS publishes each record body as a publish request and reports the
+// failed ones so SQS redelivers only those (ReportBatchItemFailures).
+func handleSQS(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+	var resp events.SQSEventResponse
+	for _, record := range event.Records {
+		if err := handleQueuedPublish(ctx, record.Body); err != nil {
+			logger.Warn("queued publish failed", "messageId", record.MessageId, "error", err.Error())
+			attempts, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+			if deadLetterQueued("sqs", record.MessageId, record.Body, attempts, err) {
+				continue
+			}
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return resp
+}
+
+// handleSNS publishes each record's message as a publish request. SNS
+// retries the whole (asynchronous) invocation, so any failure fails it.
+func handleSNS(ctx context.Context, event events.SNSEvent) error {
+	var failed []string
+	for _, record := range event.Records {
+		if err := handleQueuedPublish(ctx, record.SNS.Message); err != nil {
+			logger.Warn("sns publish failed", "messageId", record.SNS.MessageID, "error", err.Error())
+			if deadLetterQueued("sns", record.SNS.MessageID, record.SNS.Message, 1, err) {
+				continue
+			}
+			failed = append(failed, record.SNS.MessageID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d SNS messages failed: %v", len(failed), len(event.Records), failed)
+	}
+	return nil
+}
+
+// handleQueuedPublish runs a queued publish request body through the same
+// validation and publish path as an HTTP POST.
+func handleQueuedPublish(ctx context.Context, body string) error {
+	return runQueued(ctx, queuedRequest(body))
+}
+
+// handleScheduledPublish runs a scheduled command like a queued publish, on
+// behalf of its owner.
+func handleScheduledPublish(ctx context.Context, body string) error {
+	return runQueued(ctx, scheduledRequest(body))
+}
+
+func runQueued(ctx context.Context, request events.APIGatewayProxyRequest) error {
+	resp, err := handler(ctx, request)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		failure := &queuedFailure{status: resp.StatusCode, message: resp.Body}
+		var body struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+		}
+		if json.Unmarshal([]byte(resp.Body), &body) == nil && body.Error != "" {
+			failure.code, failure.message = body.Code, body.Error
+		}
+		return failure
+	}
+	return nil
+}
+
+// queuedFailure is a queued publish request answered with an error status.
+type queuedFailure struct {
+	status  int
+	code    string
+	message string
+}
+
+func (f *queuedFailure) Error() string {
+	return fmt.Sprintf("status %d: %s", f.status, f.message)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"shared/apigw"
+	"shared/mqttclient"
+)
+
+// sourceKey is the JSON field that carries the issuer of a command.
+func sourceKey() string {
+	if k := os.Getenv("SOURCE_KEY"); k != "" {
+		return k
+	}
+	return "_source"
+}
+
+// requestSource returns the explicit 'source' field or, when TAG_SOURCE is
+// set, the caller identity from the Cognito authorizer claims.
+func requestSource(request events.APIGatewayProxyRequest, explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if !envBool("TAG_SOURCE", false) {
+		return ""
+	}
+	claims := apigw.Claims(request)
+	for _, key := range []string{"email", "cognito:username", "sub"} {
+		if v, ok := claims[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// injectJSONField adds key=value to a JSON object payload. ok is false when
+// the payload is not a JSON object, in which case it is returned unchanged.
+func injectJSONField(payload, key string, value interface{}, overwrite bool) (string, bool) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &obj); err != nil || obj == nil {
+		return payload, false
+	}
+	if _, exists := obj[key]; exists && !overwrite {
+		return payload, true
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return payload, false
+	}
+	obj[key] = encoded
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return payload, false
+	}
+	return string(out), true
+}
+
+// applySource embeds msg.Source into a JSON object payload, or attaches it as
+// an MQTT 5 user property when the client supports properties. Non-JSON
+// payloads on MQTT 3.1.1 are published untagged.
+func applySource(msg outboundMessage, v5 bool) outboundMessage {
+	if msg.Source == "" {
+		return msg
+	}
+	if payload, ok := injectJSONField(msg.Payload, sourceKey(), msg.Source, false); ok {
+		msg.Payload = payload
+		return msg
+	}
+	if v5 {
+		msg.Props.UserProperties = append(msg.Props.UserProperties, mqttclient.UserProperty{Key: sourceKey(), Value: msg.Source})
+	}
+	return msg
+}
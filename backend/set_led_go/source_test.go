@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// throughAlias is ctx as seen by an invocation through alias.
+func throughAlias(ctx context.Context, alias string) context.Context {
+	return lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{InvokedFunctionArn: "arn:aws:lambda:eu-central-1:123456789012:function:set-led:" + alias})
+}
+
+func TestDetectSource(t *testing.T) {
+	t.Setenv("IOT_RULE_ALIAS", "iot-rule")
+	rule := throughAlias(context.Background(), "iot-rule")
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		event string
+		want  eventSource
+	}{
+		{"API Gateway", context.Background(), `{"httpMethod":"POST","path":"/","requestContext":{"apiId":"abc123"}}`, sourceAPIGateway},
+		{"SQS", context.Background(), `{"Records":[{"eventSource":"aws:sqs","body":"{}"}]}`, sourceSQS},
+		{"SNS", context.Background(), `{"Records":[{"EventSource":"aws:sns","Sns":{"Message":"{}"}}]}`, sourceSNS},
+		{"EventBridge", context.Background(), `{"source":"iothub","detail-type":"Publish","detail":{"topic":"a"}}`, sourceEventBridge},
+		{"async job", context.Background(), `{"asyncJob":{"jobId":"j1"}}`, sourceAsyncJob},
+		{"scheduled command", context.Background(), `{"topic":"a","message":"on","source":"schedule"}`, sourceScheduler},
+		{"IoT Rule", rule, `{"topic":"a","message":"on"}`, sourceIoTRule},
+
+		{"request without an API ID", context.Background(), `{"httpMethod":"POST","requestContext":{"authorizer":{}}}`, sourceUnknown},
+		{"mixed records", context.Background(), `{"Records":[{"eventSource":"aws:sqs"},{"eventSource":"aws:sns"}]}`, sourceUnknown},
+		{"EventBridge without a source", context.Background(), `{"detail-type":"Publish","detail":{}}`, sourceUnknown},
+		{"request with a topic", context.Background(), `{"httpMethod":"POST","requestContext":{"apiId":"abc123"},"topic":"a"}`, sourceUnknown},
+		{"records with a topic", context.Background(), `{"Records":[{"eventSource":"aws:sqs"}],"topic":"a"}`, sourceUnknown},
+		{"not an object", context.Background(), `[1]`, sourceUnknown},
+		{"empty", context.Background(), `{}`, sourceUnknown},
+
+		{"rule payload shaped as a request", rule, `{"httpMethod":"POST","requestContext":{"apiId":"abc123"},"body":"{}"}`, sourceUnknown},
+		{"rule payload carrying a request context", rule, `{"topic":"a","message":"on","requestContext":{"authorizer":{"claims":{"sub":"u1"}}}}`, sourceUnknown},
+		{"rule payload shaped as records", rule, `{"Records":[{"eventSource":"aws:sqs","body":"{}"}]}`, sourceUnknown},
+		{"rule payload carrying an async job", rule, `{"topic":"a","asyncJob":{"jobId":"j1"}}`, sourceUnknown},
+		{"another alias", throughAlias(context.Background(), "live"), `{"topic":"a","message":"on"}`, sourceScheduler},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectSource(tt.ctx, json.RawMessage(tt.event)); got != tt.want {
+				t.Errorf("detectSource = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulePayloadCannotClaimACaller(t *testing.T) {
+	t.Setenv("IOT_RULE_ALIAS", "iot-rule")
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	broker := newTestBroker(t)
+	rule := throughAlias(context.Background(), "iot-rule")
+
+	// A device publishing API Gateway's shape is not an authenticated request
+	spoofed := `{"topic":"devices/lamp","message":"on","httpMethod":"POST","path":"/",` +
+		`"requestContext":{"apiId":"abc123","authorizer":{"claims":{"sub":"u1"}}},"body":"{\"topic\":\"devices/lamp\",\"message\":\"on\"}"}`
+	if _, err := dispatch(rule, json.RawMessage(spoofed)); err == nil {
+		t.Error("a rule payload carrying a request context was accepted")
+	}
+
+	// Nor does it act for a scheduled command's owner
+	_, err := dispatch(rule, json.RawMessage(`{"topic":"devices/lamp","message":"on","scheduled_by":{"owner":"u1","id":"c1"}}`))
+	var failure *queuedFailure
+	if !errors.As(err, &failure) || failure.code != "NO_SUBJECT" {
+		t.Errorf("rule payload with scheduled_by: err = %v, want NO_SUBJECT", err)
+	}
+	if n := len(broker.published()); n != 0 {
+		t.Errorf("%d messages published", n)
+	}
+}
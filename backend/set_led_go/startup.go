@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"shared/mqttclient"
+)
+
+// startupFlags are the boolean feature toggles reported at cold start, with
+// the defaults their call sites use.
+var startupFlags = []struct {
+	name string
+	def  bool
+}{
+	{"ALLOW_DELEGATED_CREDS", false},
+	{"ALLOW_INSECURE_TLS", false},
+	{"ENFORCE_UTF8", true},
+	{"EPHEMERAL_CLEAN_SESSION", true},
+	{"FAST_QOS0", false},
+	{"INJECT_MESSAGE_ID", false},
+	{"INJECT_TIMESTAMP", false},
+	{"MAINTENANCE_MODE", false},
+	{"REFUSE_CLEARTEXT_CREDS", true},
+	{"RESPONSE_ECHO_MESSAGE", true},
+	{"TAG_SOURCE", false},
+	{"TOPIC_LOWERCASE", false},
+	{"TOPIC_STRIP_TRAILING_SLASH", false},
+}
+
+// startupSettings are plain, non-secret settings reported when set. SSM
+// parameter names are safe to show; their values never are.
+var startupSettings = []string{
+	"MQTT_BROKER_SSM", "MQTT_USERNAME_SSM", "MQTT_PASSWORD_SSM", "SSM_REGION", "SSM_CONFIG_PATH",
+	"MQTT_AUTH_MODE", "MQTT_CERT_SSM", "MQTT_KEY_SSM", "MQTT_CA_SSM", "IOT_DATA_ENDPOINT", "MQTT_POOL_SIZE",
+	"MQTT_AUTO_RECONNECT", "MQTT_MAX_RECONNECT_INTERVAL", "MQTT_CONNECT_RETRY",
+	"TOPIC_PREFIX", "USER_NAMESPACE", "TOPIC_ALLOWLIST", "TOPIC_ALLOW_REGEX", "ALLOWED_QOS", "QOS_POLICY", "NO_REPUBLISH_TOPICS",
+	"AUDIT_TOPIC", "AUDIT_TABLE", "JOBS_TABLE", "METRICS_NAMESPACE", "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"DEAD_LETTER_QUEUE_URL", "S3_PAYLOAD_BUCKET", "RESPONSE_CASE", "STRICT_JSON",
+}
+
+// logStartupSummary writes one structured line describing the effective
+// configuration, so operators can confirm what a deployment will do. The
+// broker host is resolved from SSM; credentials are never fetched here.
+func logStartupSummary() {
+	cfg, err := mqttclient.LoadEndpoint(mqttclient.NewSSMClient())
+
+	broker := []interface{}{
+		slog.String("host", cfg.Host),
+		slog.String("port", cfg.Port),
+		slog.String("scheme", cfg.Scheme),
+		slog.Int("version", cfg.Version),
+		slog.Bool("tls", cfg.UsesTLS()),
+		slog.String("tlsServerName", cfg.TLSServerName),
+		slog.Int("certPins", mqttclient.CertPinCount()),
+	}
+	if err != nil {
+		broker = append(broker, slog.String("error", err.Error()))
+	}
+	_, routesErr := loadRoutes()
+	broker = append(broker, slog.Bool("routed", os.Getenv("BROKER_ROUTES") != ""))
+	if routesErr != nil {
+		broker = append(broker, slog.String("routesError", routesErr.Error()))
+	}
+
+	flags := make([]interface{}, 0, len(startupFlags))
+	for _, f := range startupFlags {
+		flags = append(flags, slog.Bool(f.name, envBool(f.name, f.def)))
+	}
+	settings := make([]interface{}, 0, len(startupSettings))
+	for _, name := range startupSettings {
+		if v := os.Getenv(name); v != "" {
+			settings = append(settings, slog.String(name, v))
+		}
+	}
+
+	logger.Info("startup configuration",
+		slog.Group("broker", broker...),
+		slog.Group("flags", flags...),
+		slog.Group("settings", settings...),
+		slog.Bool("adminEnabled", os.Getenv("ADMIN_API_KEY_SSM") != ""),
+		slog.Bool("signingEnabled", os.Getenv("SIGNING_KEY_SSM") != ""),
+		slog.Bool("registryEnabled", os.Getenv("DEVICE_REGISTRY_TABLE") != ""),
+	)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"shared/mqttclient"
+)
+
+// stateEnvelopeBytes is reserved for the snapshot's fields around its items
+// when sizing a page against MAX_RESPONSE_BYTES.
+const stateEnvelopeBytes = 512
+
+// stateHandler serves GET /state?filter=<topic filter>: a snapshot of the
+// retained messages matching filter, e.g. every device's last reported state
+// under "home/+/status". Responses are capped at MAX_RESPONSE_BYTES (default
+// 5 MB, under API Gateway's 6 MB limit); a capped page sets truncated and a
+// cursor to pass back for the rest.
+func stateHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "GET" {
+		return errorRespStatus(405, "Use GET")
+	}
+	filter, apiErr := userTopic(request, request.QueryStringParameters["filter"])
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	filter = prefixTopic(filter)
+	if filter == "" {
+		return errorRespStatus(400, "Missing 'filter' query parameter")
+	}
+	apiErr = validateSubscription(filter)
+	if apiErr == nil {
+		apiErr = authorizeSubscriptionToken(request, filter)
+	}
+	if apiErr == nil {
+		apiErr = authorizeSubscription(request, filter)
+	}
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	after, err := decodeStateCursor(request.QueryStringParameters["cursor"])
+	if err != nil {
+		return errorRespCode(400, "INVALID_CURSOR", "'cursor' is not a cursor from a previous response")
+	}
+
+	// Route on the filter's literal prefix, the part a topic must start with
+	route := filter
+	if i := strings.IndexAny(route, "+#"); i >= 0 {
+		route = route[:i]
+	}
+	client, release, apiErr := acquireClient(mqttCreds{}, route, nil)
+	if apiErr != nil {
+		return apiErr.response()
+	}
+	defer release()
+
+	items, err := retainedSnapshot(client, filter)
+	if errors.Is(err, errSubscriptionLimit) {
+		return errorRespCode(429, "SUBSCRIPTION_LIMIT", "Too many concurrent subscriptions; retry shortly")
+	}
+	if err != nil {
+		return errorRespCode(502, "SUBSCRIBE_FAILED", "State subscribe failed: "+err.Error())
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Topic < items[j].Topic })
+	start := sort.Search(len(items), func(i int) bool { return items[i].Topic > after })
+	page, truncated := fitResponse(items[start:], envInt("MAX_RESPONSE_BYTES", 5<<20)-stateEnvelopeBytes)
+
+	resp := map[string]interface{}{
+		"filter":    filter,
+		"items":     page,
+		"count":     len(page),
+		"truncated": truncated,
+	}
+	if truncated && len(page) > 0 {
+		resp["cursor"] = base64.RawURLEncoding.EncodeToString([]byte(page[len(page)-1].Topic))
+	}
+	return jsonResp(200, resp)
+}
+
+// decodeStateCursor returns the last topic of the previous page, or "" to
+// start from the beginning.
+func decodeStateCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	topic, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(topic) == 0 {
+		return "", errors.New("invalid cursor")
+	}
+	return string(topic), nil
+}
+
+// fitResponse returns the longest prefix of items whose JSON encoding fits in
+// limit bytes, and whether any items were left out. At least one item is
+// always returned so a cursor can make progress.
+func fitResponse[T any](items []T, limit int) ([]T, bool) {
+	size := 2 // brackets
+	for i, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		size += len(b) + 1 // comma
+		if size > limit && i > 0 {
+			return items[:i], true
+		}
+	}
+	return items, false
+}
+
+// retainedSnapshot subscribes to filter and gathers the retained messages the
+// broker replays, until none has arrived for STATE_QUIET_PERIOD (default
+// 300ms) or STATE_MAX_WAIT (default 3s) has passed.
+func retainedSnapshot(client mqtt.Client, filter string) ([]progressMessage, error) {
+	if !acquireSubscription() {
+		return nil, errSubscriptionLimit
+	}
+	defer releaseSubscription()
+
+	var (
+		mu    sync.Mutex
+		items []progressMessage
+	)
+	arrived := make(chan struct{}, 1)
+	token := client.Subscribe(filter, 0, func(_ mqtt.Client, m mqtt.Message) {
+		// Live messages are not part of the snapshot
+		if !m.Retained() {
+			return
+		}
+		mu.Lock()
+		items = append(items, progressMessage{Topic: m.Topic(), Message: string(m.Payload())})
+		mu.Unlock()
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+	})
+	if err := mqttclient.WaitToken(token, connectTimeout()); err != nil {
+		return nil, err
+	}
+	defer mqttclient.WaitToken(client.Unsubscribe(filter), connectTimeout())
+
+	period := envDuration("STATE_QUIET_PERIOD", 300*time.Millisecond)
+	quiet := time.NewTimer(period)
+	defer quiet.Stop()
+	deadline := time.NewTimer(envDuration("STATE_MAX_WAIT", 3*time.Second))
+	defer deadline.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-arrived:
+			if !quiet.Stop() {
+				<-quiet.C
+			}
+			quiet.Reset(period)
+		case <-quiet.C:
+			waiting = false
+		case <-deadline.C:
+			waiting = false
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]progressMessage(nil), items...), nil
+}
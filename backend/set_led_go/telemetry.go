@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry export is an alternative to X-Ray and CloudWatch metrics for
+// other observability backends. It is off unless OTEL_EXPORTER_OTLP_ENDPOINT
+// names an OTLP/HTTP collector; the exporters read the other standard OTEL_*
+// variables (headers, service name, resource attributes) themselves. When
+// off, the global providers stay no-ops and none of this costs anything.
+
+const instrumentationName = "setled"
+
+var tracer = otel.Tracer(instrumentationName)
+
+var (
+	publishCount   metric.Int64Counter
+	publishLatency metric.Float64Histogram
+	// flushTelemetry exports what the invocation recorded before Lambda
+	// freezes the container
+	flushTelemetry = func(context.Context) {}
+)
+
+// otelEnabled reports whether OTLP export is configured.
+func otelEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""
+}
+
+// initTelemetry installs the OTLP trace and metric providers when enabled.
+func initTelemetry(ctx context.Context) error {
+	if !otelEnabled() {
+		return nil
+	}
+	res, err := resource.Merge(resource.Default(), resource.Environment())
+	if err != nil {
+		return err
+	}
+	spanExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+
+	meter := mp.Meter(instrumentationName)
+	if publishCount, err = meter.Int64Counter("iothub.publish.count",
+		metric.WithDescription("MQTT publish attempts")); err != nil {
+		return err
+	}
+	if publishLatency, err = meter.Float64Histogram("iothub.publish.latency",
+		metric.WithDescription("Time for the broker to acknowledge a publish"), metric.WithUnit("ms")); err != nil {
+		return err
+	}
+
+	flushTelemetry = func(ctx context.Context) {
+		if err := tp.ForceFlush(ctx); err != nil {
+			logger.Warn("span export failed", "error", err.Error())
+		}
+		if err := mp.ForceFlush(ctx); err != nil {
+			logger.Warn("metric export failed", "error", err.Error())
+		}
+	}
+	return nil
+}
+
+// phaseSpanNames name the spans recorded for each timing phase.
+var phaseSpanNames = map[timingPhase]string{
+	phaseSSM:     "ssm.lookup",
+	phaseConnect: "mqtt.connect",
+	phasePublish: "mqtt.publish",
+}
+
+// recordPhaseSpan records a finished phase as a child span of ctx.
+func recordPhaseSpan(ctx context.Context, phase timingPhase, start, end time.Time) {
+	_, span := tracer.Start(ctx, phaseSpanNames[phase], trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
+
+// recordPublishTelemetry adds one publish to the OTLP count and latency
+// metrics.
+func recordPublishTelemetry(msg outboundMessage, latency time.Duration, outcome string) {
+	if publishCount == nil {
+		return
+	}
+	attrs := metric.WithAttributes(
+		attribute.String("outcome", outcome),
+		attribute.Int("qos", msg.QoS),
+		attribute.String("size_bucket", sizeBucket(len(msg.Payload))),
+	)
+	ctx := context.Background()
+	publishCount.Add(ctx, 1, attrs)
+	publishLatency.Record(ctx, float64(latency.Microseconds())/1000, attrs)
+}
+
+// endRequestSpan finishes the span for one API request with its outcome.
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
+	span.End()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/iotdataplane/iotdataplaneiface"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans enables OTLP export for the rest of t, with spans going to the
+// returned in-memory exporter instead of a collector.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector.invalid:4318")
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := tracer
+	tracer = tp.Tracer(instrumentationName)
+	t.Cleanup(func() { tracer = prev })
+	return exporter
+}
+
+// recordMetrics installs the publish instruments on a manual reader for the
+// rest of t.
+func recordMetrics(t *testing.T) *sdkmetric.ManualReader {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter(instrumentationName)
+	prevCount, prevLatency := publishCount, publishLatency
+	var err error
+	if publishCount, err = meter.Int64Counter("iothub.publish.count"); err != nil {
+		t.Fatal(err)
+	}
+	if publishLatency, err = meter.Float64Histogram("iothub.publish.latency", metric.WithUnit("ms")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publishCount, publishLatency = prevCount, prevLatency })
+	return reader
+}
+
+func TestRequestSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	useDataPlane(t)
+
+	resp := call(t, events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Resource: "/", Body: `{"topic":"devices/lamp-1/led","message":"on"}`})
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, resp.Body)
+	}
+	spans := exporter.GetSpans()
+	byName := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	server, ok := byName["POST /"]
+	if !ok {
+		t.Fatalf("no request span among %d spans", len(spans))
+	}
+	if server.SpanKind.String() != "server" || server.Status.Code != codes.Unset {
+		t.Errorf("request span kind %v status %v", server.SpanKind, server.Status)
+	}
+	if !hasAttr(server.Attributes, attribute.Int("http.response.status_code", 200)) {
+		t.Errorf("request span attributes %v", server.Attributes)
+	}
+	for _, phase := range []string{"mqtt.connect", "mqtt.publish"} {
+		s, ok := byName[phase]
+		if !ok {
+			t.Errorf("no %s span", phase)
+			continue
+		}
+		if s.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("%s is not a child of the request span", phase)
+		}
+		if s.EndTime.Before(s.StartTime) {
+			t.Errorf("%s ends before it starts", phase)
+		}
+	}
+}
+
+func TestRequestSpanMarksServerErrors(t *testing.T) {
+	exporter := recordSpans(t)
+	useDataPlane(t)
+	newIoTDataClient = func() (iotdataplaneiface.IoTDataPlaneAPI, error) { return nil, errors.New("no endpoint") }
+
+	call(t, events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/", Resource: "/", Body: `{"topic":"devices/lamp-1/led","message":"on"}`})
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "POST /" {
+			if s.Status.Code != codes.Error || !hasAttr(s.Attributes, attribute.Int("http.response.status_code", 503)) {
+				t.Errorf("status %v attributes %v, want an error with 503", s.Status, s.Attributes)
+			}
+			return
+		}
+	}
+	t.Error("no request span")
+}
+
+func TestNoSpansWhenDisabled(t *testing.T) {
+	exporter := recordSpans(t)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	useDataPlane(t)
+
+	post(t, "/", `{"topic":"devices/lamp-1/led","message":"on"}`, nil)
+	for _, s := range exporter.GetSpans() {
+		for _, phase := range phaseSpanNames {
+			if s.Name == phase {
+				t.Errorf("phase span %s recorded with OTLP export off", s.Name)
+			}
+		}
+	}
+}
+
+func TestPublishMetrics(t *testing.T) {
+	reader := recordMetrics(t)
+	msg := outboundMessage{Topic: "a", Payload: "on", QoS: 1}
+	recordPublishTelemetry(msg, 1500*time.Microsecond, "ok")
+	recordPublishTelemetry(msg, 3*time.Millisecond, "ok")
+	recordPublishTelemetry(msg, time.Millisecond, "error")
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{}
+	var latency metricdata.HistogramDataPoint[float64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					outcome, _ := dp.Attributes.Value("outcome")
+					if qos, _ := dp.Attributes.Value("qos"); qos.AsInt64() != 1 {
+						t.Errorf("qos attribute %v", qos)
+					}
+					counts[outcome.AsString()] = dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					if outcome, _ := dp.Attributes.Value("outcome"); outcome.AsString() == "ok" {
+						latency = dp
+					}
+				}
+			}
+		}
+	}
+	if counts["ok"] != 2 || counts["error"] != 1 {
+		t.Errorf("publish counts %v, want 2 ok and 1 error", counts)
+	}
+	if latency.Count != 2 || latency.Sum != 4.5 {
+		t.Errorf("ok latency count %d sum %v, want 2 and 4.5ms", latency.Count, latency.Sum)
+	}
+}
+
+func hasAttr(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
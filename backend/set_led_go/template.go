@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"shared/mqttclient"
+)
+
+// templatePlaceholder matches a {{name}} variable reference in a template.
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// topicTemplate returns the payload template configured for topic's longest
+// matching prefix, stored at SSM_CONFIG_PATH/templates/<prefix>; e.g. the
+// parameter templates/home/lamps serves home/lamps/kitchen. Templates come
+// from the config cache, so they are reloaded with the rest of the path.
+func topicTemplate(topic string) (string, bool) {
+	levels := strings.Split(strings.Trim(topic, "/"), "/")
+	for n := len(levels); n > 0; n-- {
+		if tmpl, ok := mqttclient.ConfigValue("templates/" + strings.Join(levels[:n], "/")); ok {
+			return tmpl, true
+		}
+	}
+	return "", false
+}
+
+// renderTemplate replaces each {{name}} in tmpl with variables[name]. Strings
+// are inserted as-is, other values as JSON; a placeholder without a variable
+// is an error rather than being published unrendered.
+func renderTemplate(tmpl string, variables map[string]json.RawMessage) (string, *apiError) {
+	var missing []string
+	out := templatePlaceholder.ReplaceAllStringFunc(tmpl, func(ref string) string {
+		name := templatePlaceholder.FindStringSubmatch(ref)[1]
+		raw, ok := variables[name]
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s
+		}
+		return string(raw)
+	})
+	if len(missing) > 0 {
+		return "", newAPIError(400, "MISSING_VARIABLE", fmt.Sprintf("template needs variables: %s", strings.Join(missing, ", ")))
+	}
+	return out, nil
+}
+
+// templateMessage renders the template configured for topic with variables.
+// When no template is configured, message is published literally.
+func templateMessage(topic, message string, variables map[string]json.RawMessage) (string, *apiError) {
+	tmpl, ok := topicTemplate(topic)
+	if !ok {
+		if message == "" {
+			return "", newAPIError(400, "NO_TEMPLATE", "no template is configured for topic "+topic+"; send 'message' instead")
+		}
+		return message, nil
+	}
+	if message != "" {
+		return "", newAPIError(400, "", "Use either 'variables' or 'message' for a templated topic, not both")
+	}
+	return renderTemplate(tmpl, variables)
+}
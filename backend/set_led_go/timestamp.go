@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"shared/mqttclient"
+)
+
+// applyTimestamp stamps msg with the server time when INJECT_TIMESTAMP is set,
+// so devices need not trust the caller's clock. JSON object payloads get a
+// TIMESTAMP_KEY field (default "_ts"), which an existing one is kept over
+// unless TIMESTAMP_FORCE is set; other payloads get an MQTT 5 user property,
+// or are left untouched on MQTT 3.1.1.
+func applyTimestamp(msg outboundMessage, v5 bool, now time.Time) outboundMessage {
+	if !envBool("INJECT_TIMESTAMP", false) {
+		return msg
+	}
+	key := os.Getenv("TIMESTAMP_KEY")
+	if key == "" {
+		key = "_ts"
+	}
+
+	// TIMESTAMP_FORMAT is rfc3339 (default) or epoch_ms
+	var value interface{} = now.UTC().Format(time.RFC3339Nano)
+	if os.Getenv("TIMESTAMP_FORMAT") == "epoch_ms" {
+		value = now.UnixMilli()
+	}
+
+	if payload, ok := injectJSONField(msg.Payload, key, value, envBool("TIMESTAMP_FORCE", false)); ok {
+		msg.Payload = payload
+		return msg
+	}
+	if v5 {
+		msg.Props.UserProperties = append(msg.Props.UserProperties, mqttclient.UserProperty{Key: key, Value: fmt.Sprint(value)})
+	}
+	return msg
+}
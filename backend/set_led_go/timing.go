@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// requestTimings records how long each phase of a publish took. A nil
+// *requestTimings is valid and records nothing.
+type requestTimings struct {
+	SSM     time.Duration
+	Connect time.Duration
+	Publish time.Duration
+	// ctx, when set, is the request's trace context; each phase is then
+	// also recorded as a span
+	ctx context.Context
+}
+
+type timingPhase int
+
+const (
+	phaseSSM timingPhase = iota
+	phaseConnect
+	phasePublish
+)
+
+// since adds the time elapsed from start to phase.
+func (t *requestTimings) since(phase timingPhase, start time.Time) {
+	if t == nil {
+		return
+	}
+	end := time.Now()
+	d := end.Sub(start)
+	if t.ctx != nil {
+		recordPhaseSpan(t.ctx, phase, start, end)
+	}
+	switch phase {
+	case phaseSSM:
+		t.SSM += d
+	case phaseConnect:
+		t.Connect += d
+	case phasePublish:
+		t.Publish += d
+	}
+}
+
+// debugBlock is the "debug" object added to responses under ?debug=true.
+func (t *requestTimings) debugBlock() map[string]int64 {
+	return map[string]int64{
+		"ssmMs":     t.SSM.Milliseconds(),
+		"connectMs": t.Connect.Milliseconds(),
+		"publishMs": t.Publish.Milliseconds(),
+	}
+}
+
+// debugRequested reports whether the caller asked for ?debug=true.
+func debugRequested(request events.APIGatewayProxyRequest) bool {
+	return request.QueryStringParameters["debug"] == "true"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"shared/mqttclient"
+)
+
+// webhookEvent is POSTed to PUBLISH_WEBHOOK_URL after every publish.
+type webhookEvent struct {
+	Topic     string `json:"topic"`
+	Status    string `json:"status"` // published or failed
+	Code      string `json:"code,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// notifyWebhook reports a publish outcome to PUBLISH_WEBHOOK_URL in the
+// background; delivery is best effort and never delays the response. The body
+// is signed with the PUBLISH_WEBHOOK_SECRET_SSM key as
+// X-Hub-Signature-256: sha256=<hex HMAC> when a secret is configured.
+func notifyWebhook(topic string, apiErr *apiError, now time.Time) {
+	url := os.Getenv("PUBLISH_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+	event := webhookEvent{Topic: topic, Status: "published", Timestamp: now.UTC().Format(time.RFC3339Nano)}
+	if apiErr != nil {
+		event.Status, event.Code = "failed", apiErr.Code
+	}
+
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		if err := postWebhook(url, event); err != nil {
+			logger.Warn("publish webhook failed", "topic", topic, "error", err.Error())
+		}
+	}()
+}
+
+func postWebhook(url string, event webhookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("WEBHOOK_TIMEOUT", 2*time.Second))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if name := os.Getenv("PUBLISH_WEBHOOK_SECRET_SSM"); name != "" {
+		secret, err := mqttclient.GetParam(mqttclient.NewSSMClient(), name)
+		if err != nil {
+			return fmt.Errorf("webhook secret: %w", err)
+		}
+		req.Header.Set("X-Hub-Signature-256", "sha256="+webhookSignature([]byte(secret), payload))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of body under secret.
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+// Package apigw is what the backend Lambdas share about API Gateway proxy
+// requests: who the caller is, and JSON responses a browser app may read.
+package apigw
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Logger reports responses that could not be encoded.
+var Logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Claims returns the caller's JWT claims from the authorizer context: Cognito
+// user pool authorizers on REST APIs put them at the top level, JWT
+// authorizers on HTTP APIs under "jwt". It is nil when no authorizer vouched
+// for the caller.
+func Claims(request events.APIGatewayProxyRequest) map[string]interface{} {
+	auth := request.RequestContext.Authorizer
+	claims, _ := auth["claims"].(map[string]interface{})
+	if claims == nil {
+		jwt, _ := auth["jwt"].(map[string]interface{})
+		claims, _ = jwt["claims"].(map[string]interface{})
+	}
+	return claims
+}
+
+// Subject returns the "sub" claim of the caller's JWT, or "".
+func Subject(request events.APIGatewayProxyRequest) string {
+	sub, _ := Claims(request)["sub"].(string)
+	return sub
+}
+
+// Responder answers an API's requests, allowing CORS_ALLOW_ORIGIN (default
+// "*") to read them.
+type Responder struct {
+	// Methods is what a preflight allows, e.g. "GET,OPTIONS"
+	Methods string
+}
+
+// JSON encodes v as the response body. A nil v answers a CORS preflight.
+func (r Responder) JSON(status int, v interface{}) events.APIGatewayProxyResponse {
+	origin := os.Getenv("CORS_ALLOW_ORIGIN")
+	if origin == "" {
+		origin = "*"
+	}
+	headers := map[string]string{"Access-Control-Allow-Origin": origin}
+	if v == nil {
+		headers["Access-Control-Allow-Methods"] = r.Methods
+		headers["Access-Control-Allow-Headers"] = "Content-Type,Authorization"
+		return events.APIGatewayProxyResponse{StatusCode: status, Headers: headers}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		// Never answer a success status with an empty body
+		Logger.Error("marshal response", "status", status, "error", err.Error())
+		status = 500
+		body = []byte(`{"error":"Failed to encode response","code":"ENCODE_FAILED"}`)
+	}
+	headers["Content-Type"] = "application/json"
+	return events.APIGatewayProxyResponse{StatusCode: status, Headers: headers, Body: string(body)}
+}
+
+// Error answers {"error": msg, "code": code}, leaving out an empty code.
+func (r Responder) Error(status int, code, msg string) events.APIGatewayProxyResponse {
+	body := map[string]string{"error": msg}
+	if code != "" {
+		body["code"] = code
+	}
+	return r.JSON(status, body)
+}
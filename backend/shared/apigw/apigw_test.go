@@ -0,0 +1,58 @@
+package apigw
+
+import (
+	"math"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestSubject(t *testing.T) {
+	tests := []struct {
+		name string
+		auth map[string]interface{}
+		want string
+	}{
+		{"REST user pool authorizer", map[string]interface{}{"claims": map[string]interface{}{"sub": "u1"}}, "u1"},
+		{"HTTP API JWT authorizer", map[string]interface{}{"jwt": map[string]interface{}{"claims": map[string]interface{}{"sub": "u2"}}}, "u2"},
+		{"no authorizer", nil, ""},
+		{"claims of the wrong type", map[string]interface{}{"claims": "sub=u1"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var request events.APIGatewayProxyRequest
+			request.RequestContext.Authorizer = tt.auth
+			if got := Subject(request); got != tt.want {
+				t.Errorf("Subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponder(t *testing.T) {
+	r := Responder{Methods: "GET,OPTIONS"}
+
+	t.Setenv("CORS_ALLOW_ORIGIN", "")
+	resp := r.Error(404, "NOT_FOUND", "Unknown path /x")
+	if resp.StatusCode != 404 || resp.Body != `{"code":"NOT_FOUND","error":"Unknown path /x"}` {
+		t.Errorf("error response %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp.Headers["Access-Control-Allow-Origin"] != "*" || resp.Headers["Content-Type"] != "application/json" {
+		t.Errorf("error response headers %v", resp.Headers)
+	}
+	if resp := r.Error(405, "", "Use GET"); resp.Body != `{"error":"Use GET"}` {
+		t.Errorf("error without a code: %s", resp.Body)
+	}
+
+	t.Setenv("CORS_ALLOW_ORIGIN", "https://app.example.com")
+	preflight := r.JSON(204, nil)
+	if preflight.Body != "" || preflight.Headers["Access-Control-Allow-Methods"] != "GET,OPTIONS" ||
+		preflight.Headers["Access-Control-Allow-Origin"] != "https://app.example.com" {
+		t.Errorf("preflight %+v", preflight)
+	}
+
+	// An unencodable body must not leave a success status without one
+	if resp := r.JSON(200, math.Inf(1)); resp.StatusCode != 500 || resp.Body == "" {
+		t.Errorf("unencodable body: %d %q", resp.StatusCode, resp.Body)
+	}
+}
@@ -0,0 +1,73 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// brokerCertPins are the SHA-256 fingerprints from TLS_PIN_SHA256; nil when
+// pinning is off. They are parsed once by LoadCertPins at startup.
+var brokerCertPins [][]byte
+
+// CertPinCount is the number of certificate pins in force.
+func CertPinCount() int { return len(brokerCertPins) }
+
+// LoadCertPins parses TLS_PIN_SHA256, a comma-separated list of hex SHA-256
+// fingerprints (colons optional). Listing the current and next pin lets a
+// certificate rotate without a redeploy in between.
+func LoadCertPins() error {
+	brokerCertPins = nil
+	for _, pin := range strings.Split(os.Getenv("TLS_PIN_SHA256"), ",") {
+		pin = strings.ReplaceAll(strings.TrimSpace(pin), ":", "")
+		if pin == "" {
+			continue
+		}
+		sum, err := hex.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("TLS_PIN_SHA256: %q is not a hex SHA-256 fingerprint", pin)
+		}
+		brokerCertPins = append(brokerCertPins, sum)
+	}
+	return nil
+}
+
+// errCertPinMismatch rejects a broker whose leaf certificate matches no pin.
+var errCertPinMismatch = errors.New("broker certificate does not match TLS_PIN_SHA256")
+
+// verifyCertPin returns a tls.Config.VerifyPeerCertificate callback accepting
+// only a leaf whose certificate or public key (SubjectPublicKeyInfo) hashes to
+// one of pins. It runs after normal chain verification, never instead of it.
+func verifyCertPin(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errCertPinMismatch
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		certSum := sha256.Sum256(leaf.Raw)
+		keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, certSum[:]) || bytes.Equal(pin, keySum[:]) {
+				return nil
+			}
+		}
+		return errCertPinMismatch
+	}
+}
+
+// applyCertPins installs the pin check on tc when pinning is configured.
+func applyCertPins(tc *tls.Config) *tls.Config {
+	if len(brokerCertPins) > 0 {
+		tc.VerifyPeerCertificate = verifyCertPin(brokerCertPins)
+	}
+	return tc
+}
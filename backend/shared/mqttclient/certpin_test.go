@@ -0,0 +1,189 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a self-signed certificate for 127.0.0.1, usable as a broker or
+// client certificate and as its own CA.
+type testCert struct {
+	certPEM, keyPEM string
+	tls             tls.Certificate
+	leaf            *x509.Certificate
+}
+
+func newTestCert(t *testing.T, cn string, notBefore, notAfter time.Time) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testCert{
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+	if c.tls, err = tls.X509KeyPair([]byte(c.certPEM), []byte(c.keyPEM)); err != nil {
+		t.Fatal(err)
+	}
+	c.leaf, _ = x509.ParseCertificate(der)
+	return c
+}
+
+func validTestCert(t *testing.T, cn string) testCert {
+	return newTestCert(t, cn, time.Now().Add(-time.Hour), time.Now().Add(365*24*time.Hour))
+}
+
+// certSum and keySum are the certificate and public key pins of c.
+func (c testCert) certSum() string {
+	sum := sha256.Sum256(c.leaf.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c testCert) keySum() string {
+	sum := sha256.Sum256(c.leaf.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// colons writes a hex fingerprint the way openssl prints it.
+func colons(sum string) string {
+	var parts []string
+	for i := 0; i < len(sum); i += 2 {
+		parts = append(parts, strings.ToUpper(sum[i:i+2]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// loadPins sets TLS_PIN_SHA256 and loads it for the duration of t.
+func loadPins(t *testing.T, pins string) error {
+	t.Helper()
+	t.Setenv("TLS_PIN_SHA256", pins)
+	t.Cleanup(func() { brokerCertPins = nil })
+	return LoadCertPins()
+}
+
+func TestLoadCertPins(t *testing.T) {
+	c := validTestCert(t, "broker")
+	if err := loadPins(t, " "+colons(c.certSum())+" , "+c.keySum()+",,"); err != nil || CertPinCount() != 2 {
+		t.Fatalf("LoadCertPins = %v with %d pins, want 2", err, CertPinCount())
+	}
+	for _, bad := range []string{"zz", c.certSum()[:40], c.certSum() + "00"} {
+		if err := loadPins(t, bad); err == nil {
+			t.Errorf("TLS_PIN_SHA256=%s: no error", bad)
+		}
+	}
+	if err := loadPins(t, ""); err != nil || CertPinCount() != 0 {
+		t.Errorf("unset: %v with %d pins", err, CertPinCount())
+	}
+}
+
+func TestVerifyCertPin(t *testing.T) {
+	broker, other := validTestCert(t, "broker"), validTestCert(t, "other")
+	pin := func(sum string) [][]byte {
+		b, _ := hex.DecodeString(sum)
+		return [][]byte{b}
+	}
+	chain := [][]byte{broker.leaf.Raw}
+	tests := []struct {
+		name string
+		pins [][]byte
+		raw  [][]byte
+		want error
+	}{
+		{"certificate pin", pin(broker.certSum()), chain, nil},
+		{"public key pin", pin(broker.keySum()), chain, nil},
+		{"next pin listed", append(pin(other.certSum()), pin(broker.keySum())...), chain, nil},
+		{"another certificate", pin(other.certSum()), chain, errCertPinMismatch},
+		{"no certificate", pin(broker.certSum()), nil, errCertPinMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyCertPin(tt.pins)(tt.raw, nil); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("verifyCertPin = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// serveTLS accepts TLS connections with cert on a local port until t ends.
+func serveTLS(t *testing.T, cert testCert) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert.tls}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestPinnedHandshake(t *testing.T) {
+	broker, other := validTestCert(t, "broker"), validTestCert(t, "other")
+	addr := serveTLS(t, broker)
+	cfg := Config{Host: "127.0.0.1", RootCAs: x509.NewCertPool()}
+	cfg.RootCAs.AddCert(broker.leaf)
+
+	dial := func() error {
+		conn, err := dialTLS(context.Background(), addr, buildTLSConfig(cfg), time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := loadPins(t, broker.keySum()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	if err := loadPins(t, other.certSum()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(); !errors.Is(err, errCertPinMismatch) {
+		t.Errorf("mismatching pin: %v, want errCertPinMismatch", err)
+	}
+}
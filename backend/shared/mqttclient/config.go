@@ -0,0 +1,169 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// Config holds everything needed to open an MQTT connection.
+type Config struct {
+	Version int // MQTT protocol version: 3 (3.1.1) or 5
+	Scheme  string
+	Host    string
+	Port    string
+	WSPath  string
+	// TLSServerName is the SNI/verification hostname; empty means Host
+	TLSServerName string
+	// InsecureSkipVerify disables certificate verification
+	InsecureSkipVerify bool
+	Username           string
+	Password           string
+	// ClientCert authenticates the client during the TLS handshake
+	// (MQTT_AUTH_MODE=mtls); RootCAs, when set, replaces the system roots
+	ClientCert *tls.Certificate
+	RootCAs    *x509.CertPool
+	// PersistentSession resumes the broker session for ClientID, with any
+	// messages it queued, instead of starting clean
+	PersistentSession bool
+	ClientID          string
+	// Pooled connections outlive the request and reconnect by themselves;
+	// see applyReconnect
+	Pooled bool
+}
+
+// DefaultPorts maps each supported MQTT_SCHEME to the port used when MQTT_PORT
+// is unset.
+var DefaultPorts = map[string]string{
+	"tls": "8883",
+	"ssl": "8883",
+	"tcp": "1883",
+	"ws":  "80",
+	"wss": "443",
+}
+
+// Settings reads the transport settings from the environment.
+func Settings() (Config, error) {
+	cfg := Config{
+		Scheme: strings.ToLower(os.Getenv("MQTT_SCHEME")),
+		Port:   os.Getenv("MQTT_PORT"),
+		WSPath: os.Getenv("MQTT_WS_PATH"),
+
+		TLSServerName: os.Getenv("MQTT_TLS_SERVER_NAME"),
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "tls"
+	}
+	switch mode := AuthMode(); mode {
+	case AuthPassword, AuthMTLS, AuthIoTDataPlane:
+	default:
+		return cfg, fmt.Errorf("unsupported MQTT_AUTH_MODE %q; use password, mtls or iot-dataplane", mode)
+	}
+	switch cfg.Version = envInt("MQTT_VERSION", 3); cfg.Version {
+	case 3, 5:
+	default:
+		return cfg, fmt.Errorf("unsupported MQTT_VERSION %d", cfg.Version)
+	}
+	port, ok := DefaultPorts[cfg.Scheme]
+	if !ok {
+		return cfg, fmt.Errorf("unsupported MQTT_SCHEME %q", cfg.Scheme)
+	}
+	if cfg.Port == "" {
+		cfg.Port = port
+	}
+	if cfg.WSPath == "" {
+		cfg.WSPath = "/mqtt"
+	}
+	return cfg, nil
+}
+
+// brokerURL composes the paho broker URL, e.g. tls://host:8883 or
+// wss://host:443/mqtt.
+func (cfg Config) brokerURL() string {
+	url := fmt.Sprintf("%s://%s:%s", cfg.Scheme, cfg.Host, cfg.Port)
+	if cfg.Scheme == "ws" || cfg.Scheme == "wss" {
+		url += "/" + strings.TrimPrefix(cfg.WSPath, "/")
+	}
+	return url
+}
+
+// ErrCleartextCreds guards against sending a username/password over a non-TLS
+// transport; set REFUSE_CLEARTEXT_CREDS=false to opt out deliberately.
+var ErrCleartextCreds = errors.New("refusing to send MQTT credentials over non-TLS scheme; set REFUSE_CLEARTEXT_CREDS=false to allow")
+
+// Validate rejects unsafe combinations of settings before connecting.
+func (cfg Config) Validate() error {
+	hasCreds := cfg.Username != "" || cfg.Password != ""
+	if hasCreds && !cfg.UsesTLS() && envBool("REFUSE_CLEARTEXT_CREDS", true) {
+		return fmt.Errorf("%w (MQTT_SCHEME=%s)", ErrCleartextCreds, cfg.Scheme)
+	}
+	if cfg.ClientCert != nil && !cfg.UsesTLS() {
+		return fmt.Errorf("%w: a client certificate needs a TLS scheme (MQTT_SCHEME=%s)", ErrClientCertInvalid, cfg.Scheme)
+	}
+	return nil
+}
+
+// UsesTLS reports whether the scheme runs over TLS.
+func (cfg Config) UsesTLS() bool {
+	return cfg.Scheme == "tls" || cfg.Scheme == "ssl" || cfg.Scheme == "wss"
+}
+
+// The SSM parameters naming the default broker and its credentials.
+func UsernameParamName() string { return os.Getenv("MQTT_USERNAME_SSM") + ":1" }
+func PasswordParamName() string { return os.Getenv("MQTT_PASSWORD_SSM") + ":1" }
+func BrokerParamName() string   { return os.Getenv("MQTT_BROKER_SSM") }
+
+// LoadConfig fetches the broker host and credentials from SSM in one batch,
+// reporting every missing parameter at once. With MQTT_AUTH_MODE=mtls the
+// credentials are the client certificate (see ApplyClientCert) instead of a
+// username and password.
+func LoadConfig(client ssmiface.SSMAPI) (Config, error) {
+	cfg, err := Settings()
+	if err != nil {
+		return cfg, err
+	}
+	if AuthMode() == AuthMTLS {
+		if cfg.Host, err = GetParam(client, BrokerParamName()); err != nil {
+			return cfg, err
+		}
+		return cfg, ApplyClientCert(client, &cfg)
+	}
+	values, err := GetParams(client, BrokerParamName(), UsernameParamName(), PasswordParamName())
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Host, cfg.Username, cfg.Password = values[0], values[1], values[2]
+	return cfg, nil
+}
+
+// LoadEndpoint fetches only the broker host, leaving credentials empty.
+func LoadEndpoint(client ssmiface.SSMAPI) (Config, error) {
+	cfg, err := Settings()
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Host, err = GetParam(client, BrokerParamName()); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// buildTLSConfig verifies the broker certificate against TLSServerName,
+// falling back to the dial host, unless cfg.InsecureSkipVerify is set, and
+// presents cfg.ClientCert when the broker asks for one.
+func buildTLSConfig(cfg Config) *tls.Config {
+	serverName := cfg.TLSServerName
+	if serverName == "" {
+		serverName = cfg.Host
+	}
+	tc := &tls.Config{ServerName: serverName, InsecureSkipVerify: cfg.InsecureSkipVerify, RootCAs: cfg.RootCAs}
+	if cfg.ClientCert != nil {
+		tc.Certificates = []tls.Certificate{*cfg.ClientCert}
+	}
+	return applyCertPins(tc)
+}
@@ -0,0 +1,118 @@
+package mqttclient
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string // broker URL for host h
+		tls  bool
+	}{
+		{"defaults", nil, "tls://h:8883", true},
+		{"tcp", map[string]string{"MQTT_SCHEME": "TCP"}, "tcp://h:1883", false},
+		{"explicit port", map[string]string{"MQTT_SCHEME": "ssl", "MQTT_PORT": "443"}, "ssl://h:443", true},
+		{"websocket", map[string]string{"MQTT_SCHEME": "wss"}, "wss://h:443/mqtt", true},
+		{"websocket path", map[string]string{"MQTT_SCHEME": "ws", "MQTT_WS_PATH": "/ws"}, "ws://h:80/ws", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Settings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.Host = "h"
+			if got := cfg.brokerURL(); got != tt.want || cfg.UsesTLS() != tt.tls || cfg.Version != 3 {
+				t.Errorf("broker %s tls %v version %d, want %s %v 3", got, cfg.UsesTLS(), cfg.Version, tt.want, tt.tls)
+			}
+		})
+	}
+}
+
+func TestSettingsRejects(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"MQTT_SCHEME": "http"},
+		{"MQTT_VERSION": "4"},
+		{"MQTT_AUTH_MODE": "kerberos"},
+	} {
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		if _, err := Settings(); err == nil {
+			t.Errorf("%v: no error", env)
+		}
+		for k := range env {
+			t.Setenv(k, "")
+		}
+	}
+	t.Setenv("MQTT_VERSION", "5")
+	if cfg, err := Settings(); err != nil || cfg.Version != 5 {
+		t.Errorf("MQTT_VERSION=5: %d, %v", cfg.Version, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (Config{Scheme: "tcp", Username: "u", Password: "p"}).Validate(); !errors.Is(err, ErrCleartextCreds) {
+		t.Errorf("credentials over tcp: %v, want ErrCleartextCreds", err)
+	}
+	if err := (Config{Scheme: "tcp"}).Validate(); err != nil {
+		t.Errorf("anonymous tcp: %v", err)
+	}
+	if err := (Config{Scheme: "tls", Username: "u", Password: "p"}).Validate(); err != nil {
+		t.Errorf("credentials over tls: %v", err)
+	}
+	t.Setenv("REFUSE_CLEARTEXT_CREDS", "false")
+	if err := (Config{Scheme: "ws", Username: "u"}).Validate(); err != nil {
+		t.Errorf("opted out: %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	t.Setenv("MQTT_BROKER_SSM", "/iot/mqtt/broker")
+	t.Setenv("MQTT_USERNAME_SSM", "/iot/mqtt/username")
+	t.Setenv("MQTT_PASSWORD_SSM", "/iot/mqtt/password")
+	f := &fakeSSM{values: map[string]string{
+		"/iot/mqtt/broker":     "broker.example",
+		"/iot/mqtt/username:1": "hub",
+		"/iot/mqtt/password:1": "secret",
+	}}
+	cfg, err := LoadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "broker.example" || cfg.Username != "hub" || cfg.Password != "secret" || f.calls.Load() != 1 {
+		t.Errorf("config %+v after %d calls, want one batch", cfg, f.calls.Load())
+	}
+
+	cfg, err = LoadEndpoint(f)
+	if err != nil || cfg.Host != "broker.example" || cfg.Username != "" || f.calls.Load() != 1 {
+		t.Errorf("LoadEndpoint = %+v, %v after %d calls", cfg, err, f.calls.Load())
+	}
+
+	ClearCache()
+	delete(f.values, "/iot/mqtt/password:1")
+	var missing *MissingParamsError
+	if _, err := LoadConfig(f); !errors.As(err, &missing) || len(missing.Names) != 1 {
+		t.Errorf("err = %v, want the password reported missing", err)
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	if tc := buildTLSConfig(Config{Host: "broker.example"}); tc.ServerName != "broker.example" || tc.InsecureSkipVerify || len(tc.Certificates) != 0 {
+		t.Errorf("defaults: %+v", tc)
+	}
+	if tc := buildTLSConfig(Config{Host: "10.0.0.5", TLSServerName: "broker.example"}); tc.ServerName != "broker.example" {
+		t.Errorf("server name %q, want MQTT_TLS_SERVER_NAME", tc.ServerName)
+	}
+	if tc := buildTLSConfig(Config{Host: "h"}); tc.VerifyPeerCertificate != nil {
+		t.Error("a pin check is installed without TLS_PIN_SHA256")
+	}
+}
@@ -0,0 +1,119 @@
+package mqttclient
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ConnectTimeout bounds each connection attempt, MQTT_CONNECT_TIMEOUT (default
+// 5s). A Lambda may replace it to clamp connects to its invocation deadline.
+var ConnectTimeout = func() time.Duration {
+	return envDuration("MQTT_CONNECT_TIMEOUT", 5*time.Second)
+}
+
+// ErrBrokerUnavailable is returned when the broker cannot be (re)connected
+// after all retries.
+var ErrBrokerUnavailable = errors.New("MQTT broker unavailable")
+
+// ErrTokenTimeout marks a paho token that did not complete in time, as
+// opposed to one that completed with an error.
+var ErrTokenTimeout = errors.New("timed out")
+
+// WaitToken waits for token and separates its three outcomes: timed out
+// (ErrTokenTimeout), completed with an error, or completed successfully (nil).
+func WaitToken(token mqtt.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return ErrTokenTimeout
+	}
+	return token.Error()
+}
+
+// Connect opens an MQTT connection using cfg.
+func Connect(cfg Config) (mqtt.Client, error) {
+	if cfg.Version == 5 {
+		client := newV5Client(cfg)
+		if err := WaitToken(client.Connect(), ConnectTimeout()); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.brokerURL()).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetConnectTimeout(ConnectTimeout())
+	if cfg.PersistentSession {
+		opts.SetCleanSession(false).SetClientID(cfg.ClientID)
+	}
+	applyReconnect(opts, cfg)
+	if cfg.UsesTLS() {
+		opts.SetTLSConfig(buildTLSConfig(cfg))
+		if cfg.Scheme == "tls" || cfg.Scheme == "ssl" {
+			opts.SetCustomOpenConnectionFn(tlsOpenConnection(cfg))
+		}
+	}
+
+	client := mqtt.NewClient(opts)
+
+	if err := WaitToken(client.Connect(), ConnectTimeout()); err != nil {
+		// A retrying connect carries on in the background until stopped
+		if opts.ConnectRetry {
+			client.Disconnect(0)
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// applyReconnect configures paho's own reconnection for MQTT 3.1.1 clients.
+// A pooled client reconnects automatically (MQTT_AUTO_RECONNECT, default
+// true) with backoff capped at MQTT_MAX_RECONNECT_INTERVAL (default 1m), and
+// with MQTT_CONNECT_RETRY=true also retries its first connect every
+// MQTT_CONNECT_RETRY_INTERVAL (default 1s) until the connect timeout.
+// Single-use clients never reconnect; they are gone within the request.
+//
+// While reconnecting, paho reports the client connected, so requests keep
+// using it rather than opening their own connection: their publishes are
+// stored and sent once the connection is back, QoS 0 ones reporting success
+// at once and QoS 1+ ones waiting, bounded by the publish timeout. In-flight
+// publishes are resent after a reconnect even though pooled clients start a
+// clean session, as paho keeps them in memory; subscriptions are not
+// restored, which only affects the short-lived progress and snapshot
+// subscriptions. A frozen container makes no reconnect progress until its
+// next invocation. MQTT 5 clients do not reconnect by themselves; Shared
+// replaces one found disconnected.
+func applyReconnect(opts *mqtt.ClientOptions, cfg Config) {
+	if !cfg.Pooled {
+		opts.SetAutoReconnect(false)
+		return
+	}
+	opts.SetAutoReconnect(envBool("MQTT_AUTO_RECONNECT", true)).
+		SetMaxReconnectInterval(envDuration("MQTT_MAX_RECONNECT_INTERVAL", time.Minute)).
+		SetConnectRetry(envBool("MQTT_CONNECT_RETRY", false)).
+		SetConnectRetryInterval(envDuration("MQTT_CONNECT_RETRY_INTERVAL", time.Second))
+}
+
+// ConnectWithRetry calls connect up to MQTT_CONNECT_RETRIES extra times,
+// doubling the MQTT_RETRY_BACKOFF delay between attempts.
+func ConnectWithRetry(connect func() (mqtt.Client, error)) (mqtt.Client, error) {
+	retries := envInt("MQTT_CONNECT_RETRIES", 2)
+	backoff := envDuration("MQTT_RETRY_BACKOFF", 200*time.Millisecond)
+
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		client, err := connect()
+		if err == nil {
+			return client, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w: %w", ErrBrokerUnavailable, lastErr)
+}
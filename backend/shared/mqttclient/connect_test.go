@@ -0,0 +1,111 @@
+package mqttclient
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is a token that completes, or never does, as the test says.
+type fakeToken struct {
+	completes bool
+	err       error
+}
+
+func (t fakeToken) Wait() bool                     { return t.completes }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return t.completes }
+func (t fakeToken) Done() <-chan struct{}          { return make(chan struct{}) }
+func (t fakeToken) Error() error                   { return t.err }
+
+func TestWaitTokenOutcomes(t *testing.T) {
+	broken := errors.New("not authorized")
+	tests := []struct {
+		name  string
+		token mqtt.Token
+		want  error
+	}{
+		{"completed", fakeToken{completes: true}, nil},
+		{"completed with error", fakeToken{completes: true, err: broken}, broken},
+		{"timed out", fakeToken{}, ErrTokenTimeout},
+		// A timed-out token may still report no error; it must not pass
+		{"timed out without error", fakeToken{completes: false, err: nil}, ErrTokenTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := WaitToken(tt.token, time.Millisecond); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("WaitToken = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectWithRetryGivesUp(t *testing.T) {
+	t.Setenv("MQTT_CONNECT_RETRIES", "2")
+	t.Setenv("MQTT_RETRY_BACKOFF", "1ms")
+	attempts := 0
+	_, err := ConnectWithRetry(func() (mqtt.Client, error) {
+		attempts++
+		return nil, ErrTokenTimeout
+	})
+	if !errors.Is(err, ErrBrokerUnavailable) || !errors.Is(err, ErrTokenTimeout) {
+		t.Errorf("err = %v, want ErrBrokerUnavailable wrapping ErrTokenTimeout", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestApplyReconnect(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		pooled        bool
+		autoReconnect bool
+		maxInterval   time.Duration
+		connectRetry  bool
+		retryInterval time.Duration
+	}{
+		{"pooled defaults", nil, true, true, time.Minute, false, time.Second},
+		{"pooled configured", map[string]string{
+			"MQTT_AUTO_RECONNECT":         "false",
+			"MQTT_MAX_RECONNECT_INTERVAL": "10s",
+			"MQTT_CONNECT_RETRY":          "true",
+			"MQTT_CONNECT_RETRY_INTERVAL": "250ms",
+		}, true, false, 10 * time.Second, true, 250 * time.Millisecond},
+		// Single-use clients never reconnect, whatever is configured
+		{"single use", map[string]string{"MQTT_AUTO_RECONNECT": "true", "MQTT_CONNECT_RETRY": "true"}, false, false, 0, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			opts := mqtt.NewClientOptions()
+			applyReconnect(opts, Config{Pooled: tt.pooled})
+			if opts.AutoReconnect != tt.autoReconnect || opts.ConnectRetry != tt.connectRetry {
+				t.Errorf("autoReconnect %v connectRetry %v, want %v %v", opts.AutoReconnect, opts.ConnectRetry, tt.autoReconnect, tt.connectRetry)
+			}
+			if tt.pooled && (opts.MaxReconnectInterval != tt.maxInterval || opts.ConnectRetryInterval != tt.retryInterval) {
+				t.Errorf("maxReconnectInterval %v connectRetryInterval %v, want %v %v",
+					opts.MaxReconnectInterval, opts.ConnectRetryInterval, tt.maxInterval, tt.retryInterval)
+			}
+		})
+	}
+}
+
+func TestSharedClientsReconnect(t *testing.T) {
+	b := newFakeBroker(t)
+	var pooled atomic.Bool
+	b.connect = func(cfg Config) error {
+		pooled.Store(cfg.Pooled)
+		return nil
+	}
+	_, release := shared(t, "broker")
+	release()
+	if !pooled.Load() {
+		t.Error("Shared connected without Pooled, so the client would not reconnect")
+	}
+}
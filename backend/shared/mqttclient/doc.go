@@ -0,0 +1,16 @@
+// Package mqttclient is the broker transport shared by the backend Lambdas:
+// decrypted SSM parameters cached across warm invocations, the MQTT_*
+// environment settings, TLS with optional certificate pinning and client
+// certificates (MQTT_AUTH_MODE=mtls), and a container-wide pool of MQTT 3.1.1
+// or 5 connections that reconnect by themselves after a broker drop.
+//
+// A Lambda resolves its broker once and takes a pooled client per request:
+//
+//	cfg, err := mqttclient.LoadConfig(mqttclient.NewSSMClient())
+//	client, release, err := mqttclient.Shared("default", cfg)
+//	defer release()
+//
+// Nothing connects at import time; the first Shared call for a route (or a
+// WarmPool at cold start) opens its connections and later invocations of the
+// same container reuse them.
+package mqttclient
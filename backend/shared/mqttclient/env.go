@@ -0,0 +1,33 @@
+package mqttclient
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Logger receives the package's connection events; replace it to route them
+// through the Lambda's own logger.
+var Logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
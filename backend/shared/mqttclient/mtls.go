@@ -0,0 +1,146 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// MQTT_AUTH_MODE=mtls authenticates to the broker with an X.509 client
+// certificate, as AWS IoT Core expects, instead of a username and password.
+// MQTT_CERT_SSM, MQTT_KEY_SSM and the optional MQTT_CA_SSM name the PEM
+// certificate (chain), private key and broker CA bundle. Each is an SSM
+// SecureString or, through Parameter Store's reference path, a Secrets
+// Manager secret: /aws/reference/secretsmanager/<secret-id>. Without a CA
+// bundle the broker is verified against the system roots.
+
+// The MQTT_AUTH_MODE values. AuthIoTDataPlane publishes through the AWS IoT
+// Data Plane API rather than an MQTT connection and is handled by the caller.
+const (
+	AuthPassword     = "password"
+	AuthMTLS         = "mtls"
+	AuthIoTDataPlane = "iot-dataplane"
+)
+
+// AuthMode returns the configured MQTT_AUTH_MODE, lowercased, defaulting to
+// password.
+func AuthMode() string {
+	if m := strings.ToLower(os.Getenv("MQTT_AUTH_MODE")); m != "" {
+		return m
+	}
+	return AuthPassword
+}
+
+// The SSM parameters holding the client certificate material.
+func CertParamName() string { return os.Getenv("MQTT_CERT_SSM") }
+func KeyParamName() string  { return os.Getenv("MQTT_KEY_SSM") }
+func CAParamName() string   { return os.Getenv("MQTT_CA_SSM") }
+
+var (
+	// ErrClientCertInvalid marks certificate material that cannot be used:
+	// unset, not PEM, or a key that does not match the certificate.
+	ErrClientCertInvalid = errors.New("invalid MQTT client certificate")
+	// ErrClientCertExpired marks a client certificate outside its validity
+	// period, which the broker would reject during the handshake.
+	ErrClientCertExpired = errors.New("MQTT client certificate expired or not yet valid")
+)
+
+// clientCert is parsed certificate material. Parsing happens once per
+// distinct set of PEM values, so pooled connections keep comparing equal
+// until the parameters rotate, and a certificate that expires within
+// MQTT_CERT_EXPIRY_WARNING (default 14 days) is logged once when parsed.
+type clientCert struct {
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	roots  *x509.CertPool // nil for the system roots
+	source string         // the PEM values it was parsed from
+}
+
+var certCache struct {
+	mu   sync.Mutex
+	last *clientCert
+}
+
+// ApplyClientCert loads the client certificate into cfg when MQTT_AUTH_MODE
+// is mtls, reporting missing parameters as a MissingParamsError and unusable
+// or expired material as ErrClientCertInvalid or ErrClientCertExpired.
+func ApplyClientCert(client ssmiface.SSMAPI, cfg *Config) error {
+	if AuthMode() != AuthMTLS {
+		return nil
+	}
+	if CertParamName() == "" || KeyParamName() == "" {
+		return fmt.Errorf("%w: MQTT_AUTH_MODE=mtls needs MQTT_CERT_SSM and MQTT_KEY_SSM", ErrClientCertInvalid)
+	}
+	names := []string{CertParamName(), KeyParamName()}
+	if CAParamName() != "" {
+		names = append(names, CAParamName())
+	}
+	values, err := GetParams(client, names...)
+	if err != nil {
+		return err
+	}
+	var caPEM string
+	if len(values) > 2 {
+		caPEM = values[2]
+	}
+	cc, err := parseClientCert(values[0], values[1], caPEM)
+	if err != nil {
+		return err
+	}
+	if err := checkValidity(cc.leaf, time.Now()); err != nil {
+		return err
+	}
+	cfg.ClientCert, cfg.RootCAs = cc.cert, cc.roots
+	return nil
+}
+
+func parseClientCert(certPEM, keyPEM, caPEM string) (*clientCert, error) {
+	source := certPEM + "\x00" + keyPEM + "\x00" + caPEM
+	certCache.mu.Lock()
+	defer certCache.mu.Unlock()
+	if certCache.last != nil && certCache.last.source == source {
+		return certCache.last, nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s, %s): %v", ErrClientCertInvalid, CertParamName(), KeyParamName(), err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w (%s): %v", ErrClientCertInvalid, CertParamName(), err)
+	}
+	cert.Leaf = leaf
+	cc := &clientCert{cert: &cert, leaf: leaf, source: source}
+	if caPEM != "" {
+		cc.roots = x509.NewCertPool()
+		if !cc.roots.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, fmt.Errorf("%w (%s): no PEM certificates in the CA bundle", ErrClientCertInvalid, CAParamName())
+		}
+	}
+	if left := time.Until(leaf.NotAfter); left > 0 && left < envDuration("MQTT_CERT_EXPIRY_WARNING", 14*24*time.Hour) {
+		Logger.Warn("MQTT client certificate expires soon",
+			"subject", leaf.Subject.CommonName, "notAfter", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	certCache.last = cc
+	return cc, nil
+}
+
+// checkValidity fails for a certificate outside its validity period. It runs
+// on every load, as cached material can expire while a container is warm.
+func checkValidity(leaf *x509.Certificate, now time.Time) error {
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("%w: %q expired at %s", ErrClientCertExpired, leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("%w: %q is not valid before %s", ErrClientCertExpired, leaf.Subject.CommonName, leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+)
+
+// useMTLS selects MQTT_AUTH_MODE=mtls for the rest of t, with the
+// certificate parameters served by the returned fake SSM.
+func useMTLS(t *testing.T, cert testCert, caPEM string) *fakeSSM {
+	t.Helper()
+	ClearCache()
+	certCache.last = nil
+	t.Cleanup(func() {
+		ClearCache()
+		certCache.last = nil
+	})
+	t.Setenv("MQTT_AUTH_MODE", "MTLS")
+	t.Setenv("MQTT_BROKER_SSM", "/iot/mqtt/broker")
+	t.Setenv("MQTT_CERT_SSM", "/iot/mqtt/cert")
+	t.Setenv("MQTT_KEY_SSM", "/iot/mqtt/key")
+	f := &fakeSSM{values: map[string]string{
+		"/iot/mqtt/broker": "broker.example",
+		"/iot/mqtt/cert":   cert.certPEM,
+		"/iot/mqtt/key":    cert.keyPEM,
+	}}
+	if caPEM != "" {
+		t.Setenv("MQTT_CA_SSM", "/iot/mqtt/ca")
+		f.values["/iot/mqtt/ca"] = caPEM
+	}
+	return f
+}
+
+func TestApplyClientCert(t *testing.T) {
+	client, ca := validTestCert(t, "hub"), validTestCert(t, "broker-ca")
+	f := useMTLS(t, client, ca.certPEM)
+
+	cfg, err := LoadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "broker.example" || cfg.Username != "" || cfg.Password != "" {
+		t.Errorf("config %+v, want the host without a username and password", cfg)
+	}
+	if cfg.ClientCert == nil || cfg.ClientCert.Leaf.Subject.CommonName != "hub" || cfg.RootCAs == nil {
+		t.Fatalf("client certificate %v roots %v", cfg.ClientCert, cfg.RootCAs)
+	}
+	if _, err := ca.leaf.Verify(x509.VerifyOptions{Roots: cfg.RootCAs}); err != nil {
+		t.Errorf("the CA bundle does not hold the broker CA: %v", err)
+	}
+	if tc := buildTLSConfig(cfg); len(tc.Certificates) != 1 {
+		t.Errorf("TLS config presents %d certificates, want 1", len(tc.Certificates))
+	}
+
+	// Unchanged parameters reuse the parsed certificate, so pooled
+	// connections keep comparing equal
+	again, err := LoadConfig(f)
+	if err != nil || again.ClientCert != cfg.ClientCert || again != cfg {
+		t.Errorf("reloaded config differs: %v", err)
+	}
+}
+
+func TestApplyClientCertSystemRoots(t *testing.T) {
+	f := useMTLS(t, validTestCert(t, "hub"), "")
+	var cfg Config
+	if err := ApplyClientCert(f, &cfg); err != nil || cfg.ClientCert == nil || cfg.RootCAs != nil {
+		t.Errorf("ApplyClientCert = %v, roots %v, want the system roots", err, cfg.RootCAs)
+	}
+}
+
+func TestApplyClientCertOtherModes(t *testing.T) {
+	t.Setenv("MQTT_AUTH_MODE", "")
+	f := &fakeSSM{}
+	var cfg Config
+	if err := ApplyClientCert(f, &cfg); err != nil || cfg.ClientCert != nil || f.calls.Load() != 0 {
+		t.Errorf("password mode: %v, %d SSM calls", err, f.calls.Load())
+	}
+}
+
+func TestApplyClientCertRejects(t *testing.T) {
+	hub, other := validTestCert(t, "hub"), validTestCert(t, "other")
+	expired := newTestCert(t, "hub", time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour))
+	early := newTestCert(t, "hub", time.Now().Add(time.Hour), time.Now().Add(48*time.Hour))
+
+	tests := []struct {
+		name  string
+		setup func(f *fakeSSM)
+		want  error
+	}{
+		{"not PEM", func(f *fakeSSM) { f.values["/iot/mqtt/cert"] = "not a certificate" }, ErrClientCertInvalid},
+		{"key of another certificate", func(f *fakeSSM) { f.values["/iot/mqtt/key"] = other.keyPEM }, ErrClientCertInvalid},
+		{"CA bundle without certificates", func(f *fakeSSM) { f.values["/iot/mqtt/ca"] = "empty" }, ErrClientCertInvalid},
+		{"expired", func(f *fakeSSM) {
+			f.values["/iot/mqtt/cert"], f.values["/iot/mqtt/key"] = expired.certPEM, expired.keyPEM
+		}, ErrClientCertExpired},
+		{"not yet valid", func(f *fakeSSM) { f.values["/iot/mqtt/cert"], f.values["/iot/mqtt/key"] = early.certPEM, early.keyPEM }, ErrClientCertExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useMTLS(t, hub, hub.certPEM)
+			tt.setup(f)
+			var cfg Config
+			if err := ApplyClientCert(f, &cfg); !errors.Is(err, tt.want) || cfg.ClientCert != nil {
+				t.Errorf("err = %v, want %v and no certificate", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("unset parameters", func(t *testing.T) {
+		useMTLS(t, hub, "")
+		t.Setenv("MQTT_KEY_SSM", "")
+		if err := ApplyClientCert(&fakeSSM{}, &Config{}); !errors.Is(err, ErrClientCertInvalid) {
+			t.Errorf("err = %v, want ErrClientCertInvalid", err)
+		}
+	})
+	t.Run("missing parameters", func(t *testing.T) {
+		f := useMTLS(t, hub, "")
+		delete(f.values, "/iot/mqtt/key")
+		var missing *MissingParamsError
+		if err := ApplyClientCert(f, &Config{}); !errors.As(err, &missing) || missing.Names[0] != "/iot/mqtt/key" {
+			t.Errorf("err = %v, want /iot/mqtt/key missing", err)
+		}
+	})
+}
+
+func TestCheckValidity(t *testing.T) {
+	c := newTestCert(t, "hub", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC))
+	for at, want := range map[time.Time]error{
+		time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC): nil,
+		time.Date(2027, 1, 2, 0, 0, 0, 0, time.UTC):   ErrClientCertExpired,
+		time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC): ErrClientCertExpired,
+	} {
+		if err := checkValidity(c.leaf, at); !errors.Is(err, want) || (want == nil && err != nil) {
+			t.Errorf("at %s: %v, want %v", at.Format(time.DateOnly), err, want)
+		}
+	}
+}
+
+func TestValidateClientCertNeedsTLS(t *testing.T) {
+	cert := validTestCert(t, "hub").tls
+	if err := (Config{Scheme: "tcp", ClientCert: &cert}).Validate(); !errors.Is(err, ErrClientCertInvalid) {
+		t.Errorf("err = %v, want ErrClientCertInvalid", err)
+	}
+	if err := (Config{Scheme: "tls", ClientCert: &cert}).Validate(); err != nil {
+		t.Errorf("over tls: %v", err)
+	}
+}
+
+func TestMutualTLSHandshake(t *testing.T) {
+	broker, hub, stranger := validTestCert(t, "broker"), validTestCert(t, "hub"), validTestCert(t, "stranger")
+	clients := x509.NewCertPool()
+	clients.AddCert(hub.leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{broker.tls},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// TLS 1.3 reports a rejected client certificate on the
+				// client's first read, so answer a byte once verified
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte{0})
+				}
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(c testCert) error {
+		f := useMTLS(t, c, broker.certPEM)
+		cfg := Config{Host: "127.0.0.1", Scheme: "tls"}
+		if err := ApplyClientCert(f, &cfg); err != nil {
+			return err
+		}
+		conn, err := dialTLS(context.Background(), ln.Addr().String(), buildTLSConfig(cfg), time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+	if err := dial(hub); err != nil {
+		t.Errorf("trusted client certificate: %v", err)
+	}
+	if err := dial(stranger); err == nil {
+		t.Error("the broker accepted an untrusted client certificate")
+	}
+}
@@ -0,0 +1,241 @@
+package mqttclient
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"golang.org/x/sync/singleflight"
+)
+
+// paramCache keeps decrypted SSM values for SSM_CACHE_TTL so warm invocations
+// skip the SSM round trips.
+type paramCache struct {
+	mu       sync.Mutex
+	entries  map[string]cachedParam
+	pathLoad time.Time // when SSM_CONFIG_PATH was last loaded
+}
+
+type cachedParam struct {
+	value   string
+	expires time.Time
+}
+
+var ssmCache = &paramCache{entries: map[string]cachedParam{}}
+
+func cacheTTL() time.Duration {
+	return envDuration("SSM_CACHE_TTL", 5*time.Minute)
+}
+
+func (c *paramCache) get(name string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok || now.After(e.expires) {
+		return "", false
+	}
+	return e.value, true
+}
+
+func (c *paramCache) set(name, value string, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = cachedParam{value: value, expires: now.Add(ttl)}
+}
+
+// ClearCache drops every cached value, forcing the next lookups back to SSM.
+func ClearCache() {
+	ssmCache.mu.Lock()
+	defer ssmCache.mu.Unlock()
+	ssmCache.entries = map[string]cachedParam{}
+	ssmCache.pathLoad = time.Time{}
+}
+
+// ssmFlight coalesces concurrent cache misses for the same parameters into a
+// single SSM call, so a burst on a cold cache does not stampede SSM.
+var ssmFlight singleflight.Group
+
+// GetParam reads a single (decrypted) SSM parameter, served from the cache
+// while it is fresh.
+func GetParam(client ssmiface.SSMAPI, name string) (string, error) {
+	if v, ok := ssmCache.get(name, time.Now()); ok {
+		return v, nil
+	}
+
+	value, err, _ := ssmFlight.Do(name, func() (interface{}, error) {
+		value, err := FetchParam(client, name)
+		if err != nil {
+			return "", err
+		}
+		ssmCache.set(name, value, cacheTTL(), time.Now())
+		return value, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// FetchParam always goes to SSM, bypassing the cache.
+func FetchParam(client ssmiface.SSMAPI, name string) (string, error) {
+	param, err := client.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if param.Parameter == nil {
+		return "", fmt.Errorf("%s: empty GetParameter response", name)
+	}
+	return aws.StringValue(param.Parameter.Value), nil
+}
+
+// MissingParamsError lists every parameter a GetParameters call could not
+// return, so a fresh environment can be fixed in one pass.
+type MissingParamsError struct {
+	Names []string
+}
+
+func (e *MissingParamsError) Error() string {
+	return "missing or undecryptable SSM parameters: " + strings.Join(e.Names, ", ")
+}
+
+// GetParams reads several (decrypted) parameters, serving fresh ones from the
+// cache and fetching the rest with batched GetParameters calls. Values are
+// returned in the order of names.
+func GetParams(client ssmiface.SSMAPI, names ...string) ([]string, error) {
+	values := make([]string, len(names))
+	var fetch []string
+	for i, name := range names {
+		if v, ok := ssmCache.get(name, time.Now()); ok {
+			values[i] = v
+		} else {
+			fetch = append(fetch, name)
+		}
+	}
+
+	if len(fetch) == 0 {
+		return values, nil
+	}
+	res, err, _ := ssmFlight.Do("batch:"+strings.Join(fetch, "\x00"), func() (interface{}, error) {
+		return fetchParams(client, fetch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	fetched := res.(map[string]string)
+	for i, name := range names {
+		if v, ok := fetched[name]; ok {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+// fetchParams reads names with batched GetParameters calls and caches the
+// results, failing with a MissingParamsError naming every absent parameter.
+func fetchParams(client ssmiface.SSMAPI, fetch []string) (map[string]string, error) {
+	fetched := map[string]string{}
+	missing := &MissingParamsError{}
+	// GetParameters accepts at most 10 names per call
+	for start := 0; start < len(fetch); start += 10 {
+		chunk := fetch[start:min(start+10, len(fetch))]
+		out, err := client.GetParameters(&ssm.GetParametersInput{
+			Names:          aws.StringSlice(chunk),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(chunk, ", "), err)
+		}
+		for _, p := range out.Parameters {
+			// Selector (e.g. ":1") comes back separately from the name
+			fetched[aws.StringValue(p.Name)+aws.StringValue(p.Selector)] = aws.StringValue(p.Value)
+		}
+		missing.Names = append(missing.Names, aws.StringValueSlice(out.InvalidParameters)...)
+	}
+	if len(missing.Names) > 0 {
+		return nil, missing
+	}
+	for name, v := range fetched {
+		ssmCache.set(name, v, cacheTTL(), time.Now())
+	}
+	return fetched, nil
+}
+
+// ConfigPath is the SSM path holding dynamic configuration, e.g. /iot/config.
+func ConfigPath() string {
+	return strings.TrimSuffix(os.Getenv("SSM_CONFIG_PATH"), "/")
+}
+
+// LoadConfigPath reads every parameter under SSM_CONFIG_PATH (recursively,
+// following pagination) into the cache.
+func LoadConfigPath(client ssmiface.SSMAPI, now time.Time) error {
+	path := ConfigPath()
+	if path == "" {
+		return nil
+	}
+
+	ttl := cacheTTL()
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	}
+	err := client.GetParametersByPathPages(input, func(page *ssm.GetParametersByPathOutput, _ bool) bool {
+		for _, p := range page.Parameters {
+			ssmCache.set(aws.StringValue(p.Name), aws.StringValue(p.Value), ttl, now)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	ssmCache.mu.Lock()
+	ssmCache.pathLoad = now
+	ssmCache.mu.Unlock()
+	return nil
+}
+
+// SeedConfig caches values as the SSM_CONFIG_PATH settings, key → value, as
+// if the path had just been loaded.
+func SeedConfig(values map[string]string, ttl time.Duration) {
+	now := time.Now()
+	path := ConfigPath()
+	for k, v := range values {
+		ssmCache.set(path+"/"+strings.TrimPrefix(k, "/"), v, ttl, now)
+	}
+	ssmCache.mu.Lock()
+	ssmCache.pathLoad = now
+	ssmCache.mu.Unlock()
+}
+
+// ConfigValue returns the dynamic setting stored at SSM_CONFIG_PATH/key,
+// reloading the whole path once the cached copy has expired.
+func ConfigValue(key string) (string, bool) {
+	path := ConfigPath()
+	if path == "" {
+		return "", false
+	}
+
+	now := time.Now()
+	ssmCache.mu.Lock()
+	stale := now.Sub(ssmCache.pathLoad) > cacheTTL()
+	ssmCache.mu.Unlock()
+	if stale {
+		if err := LoadConfigPath(NewSSMClient(), now); err != nil {
+			Logger.Warn("config reload failed", "path", path, "error", err.Error())
+		}
+	}
+	return ssmCache.get(path+"/"+strings.TrimPrefix(key, "/"), now)
+}
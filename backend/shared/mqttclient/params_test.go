@@ -0,0 +1,240 @@
+package mqttclient
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// fakeSSM serves values, counting calls. With release set, each call waits
+// for it to close, so concurrent lookups pile up behind the first.
+type fakeSSM struct {
+	ssmiface.SSMAPI
+
+	values  map[string]string
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (f *fakeSSM) wait() {
+	f.calls.Add(1)
+	if f.release != nil {
+		<-f.release
+	}
+}
+
+func (f *fakeSSM) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	f.wait()
+	v, ok := f.values[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Value: aws.String(v)}}, nil
+}
+
+func (f *fakeSSM) GetParameters(in *ssm.GetParametersInput) (*ssm.GetParametersOutput, error) {
+	f.wait()
+	out := &ssm.GetParametersOutput{}
+	for _, name := range in.Names {
+		if v, ok := f.values[aws.StringValue(name)]; ok {
+			out.Parameters = append(out.Parameters, &ssm.Parameter{Name: name, Value: aws.String(v)})
+		} else {
+			out.InvalidParameters = append(out.InvalidParameters, name)
+		}
+	}
+	return out, nil
+}
+
+// concurrently runs n calls of fn once they have all started, releasing f
+// after they had time to reach it.
+func concurrently(t *testing.T, f *fakeSSM, n int, fn func() error) {
+	t.Helper()
+	f.release = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(f.release)
+	wg.Wait()
+}
+
+func TestGetParamCoalescesConcurrentMisses(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	f := &fakeSSM{values: map[string]string{"/iot/mqtt/broker": "broker.example:8883"}}
+
+	concurrently(t, f, 10, func() error {
+		v, err := GetParam(f, "/iot/mqtt/broker")
+		if err == nil && v != "broker.example:8883" {
+			err = errors.New("GetParam = " + v)
+		}
+		return err
+	})
+	if n := f.calls.Load(); n != 1 {
+		t.Errorf("%d GetParameter calls for 10 concurrent misses, want 1", n)
+	}
+
+	// Now cached
+	if _, err := GetParam(f, "/iot/mqtt/broker"); err != nil || f.calls.Load() != 1 {
+		t.Errorf("cached lookup: %v, %d calls", err, f.calls.Load())
+	}
+}
+
+func TestGetParamsCoalescesConcurrentMisses(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	f := &fakeSSM{values: map[string]string{"/u": "user", "/p": "secret"}}
+
+	concurrently(t, f, 10, func() error {
+		v, err := GetParams(f, "/u", "/p")
+		if err == nil && (v[0] != "user" || v[1] != "secret") {
+			err = errors.New("GetParams in the wrong order")
+		}
+		return err
+	})
+	if n := f.calls.Load(); n != 1 {
+		t.Errorf("%d GetParameters calls for 10 concurrent misses, want 1", n)
+	}
+}
+
+func TestGetParamsReportsEveryMissing(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	f := &fakeSSM{values: map[string]string{"/u": "user"}}
+
+	_, err := GetParams(f, "/u", "/p", "/b")
+	var missing *MissingParamsError
+	if !errors.As(err, &missing) || len(missing.Names) != 2 || missing.Names[0] != "/p" || missing.Names[1] != "/b" {
+		t.Fatalf("err = %v, want /p and /b missing", err)
+	}
+	// A failed batch caches nothing, so the found value is fetched again
+	if _, err := GetParams(f, "/u"); err != nil || f.calls.Load() != 2 {
+		t.Errorf("after a failed batch: %v, %d calls", err, f.calls.Load())
+	}
+}
+
+func TestGetParamsBatchesOfTen(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	f := &fakeSSM{values: map[string]string{}}
+	var names []string
+	for i := 0; i < 25; i++ {
+		name := "/p" + string(rune('a'+i))
+		f.values[name] = name
+		names = append(names, name)
+	}
+	values, err := GetParams(f, names...)
+	if err != nil || values[24] != names[24] {
+		t.Fatalf("GetParams = %v, %v", values, err)
+	}
+	if n := f.calls.Load(); n != 3 {
+		t.Errorf("%d GetParameters calls for 25 names, want 3", n)
+	}
+}
+
+func (f *fakeSSM) GetParametersByPathPages(in *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool) error {
+	f.wait()
+	prefix := aws.StringValue(in.Path) + "/"
+	// One parameter per page, to exercise pagination
+	for name, v := range f.values {
+		if strings.HasPrefix(name, prefix) {
+			page := &ssm.GetParametersByPathOutput{Parameters: []*ssm.Parameter{{Name: aws.String(name), Value: aws.String(v)}}}
+			if !fn(page, false) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func TestGetParamCacheTTL(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	f := &fakeSSM{values: map[string]string{"/b": "one"}}
+
+	t.Setenv("SSM_CACHE_TTL", "0")
+	GetParam(f, "/b")
+	GetParam(f, "/b")
+	if n := f.calls.Load(); n != 2 {
+		t.Errorf("SSM_CACHE_TTL=0: %d calls, want every lookup to reach SSM", n)
+	}
+
+	t.Setenv("SSM_CACHE_TTL", "1h")
+	GetParam(f, "/b")
+	f.values["/b"] = "two"
+	if v, _ := GetParam(f, "/b"); v != "one" || f.calls.Load() != 3 {
+		t.Errorf("cached: %q after %d calls", v, f.calls.Load())
+	}
+	if v, _ := FetchParam(f, "/b"); v != "two" {
+		t.Errorf("FetchParam = %q, want it to bypass the cache", v)
+	}
+	ClearCache()
+	if v, _ := GetParam(f, "/b"); v != "two" {
+		t.Errorf("after ClearCache: %q", v)
+	}
+}
+
+func TestGetParamErrors(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	f := &fakeSSM{values: map[string]string{}}
+	if _, err := GetParam(f, "/missing"); err == nil || !strings.HasPrefix(err.Error(), "/missing: ") {
+		t.Errorf("err = %v, want it to name the parameter", err)
+	}
+	// Failures are not cached
+	f.values["/missing"] = "found"
+	if v, err := GetParam(f, "/missing"); err != nil || v != "found" {
+		t.Errorf("after it was created: %q, %v", v, err)
+	}
+}
+
+func TestConfigValue(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	t.Setenv("SSM_CONFIG_PATH", "/iot/config/")
+	f := &fakeSSM{values: map[string]string{
+		"/iot/config/MAX_BATCH":      "20",
+		"/iot/config/topics/default": "devices/all",
+		"/iot/other":                 "ignored",
+	}}
+	if err := LoadConfigPath(f, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"MAX_BATCH": "20", "/topics/default": "devices/all"} {
+		if v, ok := ConfigValue(key); !ok || v != want {
+			t.Errorf("ConfigValue(%q) = %q, %v, want %q", key, v, ok, want)
+		}
+	}
+	if _, ok := ConfigValue("other"); ok {
+		t.Error("a parameter outside SSM_CONFIG_PATH was loaded")
+	}
+}
+
+func TestSeedConfig(t *testing.T) {
+	ClearCache()
+	t.Cleanup(ClearCache)
+	t.Setenv("SSM_CONFIG_PATH", "/replay")
+	SeedConfig(map[string]string{"MAX_BATCH": "5"}, time.Hour)
+	if v, ok := ConfigValue("MAX_BATCH"); !ok || v != "5" {
+		t.Errorf("ConfigValue = %q, %v, want the seeded value without a reload", v, ok)
+	}
+
+	t.Setenv("SSM_CONFIG_PATH", "")
+	if _, ok := ConfigValue("MAX_BATCH"); ok {
+		t.Error("ConfigValue answered without SSM_CONFIG_PATH")
+	}
+}
@@ -0,0 +1,245 @@
+package mqttclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// pooledClient is one broker's connection in the container-wide pool.
+type pooledClient struct {
+	client   mqtt.Client
+	cfg      Config
+	lastUsed time.Time
+	// inUse counts requests holding the client; a client retired from the
+	// pool while in use is disconnected by the last of them to release it
+	inUse   int
+	retired bool
+	// dial is set while the Shared call that reserved the member connects it
+	dial *dialState
+}
+
+// dialState is a member's connect in progress. err is written before done is
+// closed.
+type dialState struct {
+	done chan struct{}
+	err  error
+}
+
+// Shared clients survive across warm invocations of the same container:
+// MQTT_POOL_SIZE per route key, keyed by poolMember.
+var (
+	sharedMu      sync.Mutex
+	sharedClients = map[string]*pooledClient{}
+	poolNext      = map[string]int{} // route key → next member to hand out
+	evictorOnce   sync.Once
+)
+
+// connectMember opens one pool member's connection. It is a variable so a
+// test can stand in for the broker.
+var connectMember = Connect
+
+// maxPoolSize bounds MQTT_POOL_SIZE, each member being a broker connection.
+const maxPoolSize = 16
+
+// PoolSize is the number of clients kept per route, MQTT_POOL_SIZE (default
+// 1). Several spread concurrent publishes in a provisioned container across
+// connections instead of queueing them behind one client's locks.
+func PoolSize() int {
+	n := envInt("MQTT_POOL_SIZE", 1)
+	if n < 1 {
+		return 1
+	}
+	return min(n, maxPoolSize)
+}
+
+// poolMember is the sharedClients key of the route key's i-th member; a pool
+// of one keeps the plain route key.
+func poolMember(key string, i int) string {
+	if i == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s#%d", key, i)
+}
+
+// Shared returns a container-wide client for the route key, taking the
+// route's pool members in turn. A member is connected on first use and
+// replaced by a fresh connection when cfg has changed or it has dropped since
+// it was last used. The connect (with retry/backoff) runs outside sharedMu:
+// the member is reserved first, so other routes and members are served
+// meanwhile and concurrent requests for the same member wait for the one
+// connect. The caller must call release once it is done publishing.
+func Shared(key string, cfg Config) (client mqtt.Client, release func(), err error) {
+	cfg.Pooled = true
+	sharedMu.Lock()
+
+	idle := envDuration("MQTT_IDLE_EVICT", 0)
+	if idle > 0 {
+		evictorOnce.Do(func() { go evictIdle(idle) })
+	}
+
+	n := PoolSize()
+	i := poolNext[key] % n
+	poolNext[key] = i + 1
+	member := poolMember(key, i)
+
+	// A frozen container never ran the evictor, so check idleness here too
+	pc := sharedClients[member]
+	if pc != nil && (pc.cfg != cfg || idleExpired(pc, idle, time.Now())) {
+		retireClient(member, pc)
+		pc = nil
+	} else if pc != nil && pc.dial == nil && !pc.client.IsConnected() {
+		Logger.Warn("replacing dead MQTT connection", "broker", member)
+		retireClient(member, pc)
+		pc = nil
+	}
+	reserved := pc == nil
+	if reserved {
+		evictLRU(max(envInt("MAX_BROKER_CLIENTS", 8), n) - 1)
+		pc = &pooledClient{cfg: cfg, dial: &dialState{done: make(chan struct{})}}
+		sharedClients[member] = pc
+	}
+	pc.lastUsed = time.Now()
+	pc.inUse++
+	dial := pc.dial
+	sharedMu.Unlock()
+
+	if reserved {
+		client, err := ConnectWithRetry(func() (mqtt.Client, error) { return connectMember(cfg) })
+		sharedMu.Lock()
+		pc.client, pc.dial, dial.err = client, nil, err
+		close(dial.done)
+		sharedMu.Unlock()
+	} else if dial != nil {
+		<-dial.done
+	}
+	if dial != nil && dial.err != nil {
+		abandonClient(member, pc)
+		return nil, nil, dial.err
+	}
+	return pc.client, func() { releaseClient(pc) }, nil
+}
+
+// abandonClient gives up a hold on a member whose connect failed, dropping
+// it from the pool so the next request connects afresh.
+func abandonClient(member string, pc *pooledClient) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	pc.inUse--
+	pc.retired = true
+	if sharedClients[member] == pc {
+		delete(sharedClients, member)
+	}
+}
+
+// WarmPool connects the route key's pool members in parallel, for a cold
+// start to pay the connects before the first request does. Members already
+// connected are kept; failures are left to Shared to retry.
+func WarmPool(key string, cfg Config) {
+	cfg.Pooled = true
+	n := PoolSize()
+	clients := make([]mqtt.Client, n)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := ConnectWithRetry(func() (mqtt.Client, error) { return connectMember(cfg) })
+			if err != nil {
+				Logger.Warn("MQTT pool warm-up failed", "broker", poolMember(key, i), "error", err.Error())
+				return
+			}
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	now := time.Now()
+	for i, client := range clients {
+		if client == nil {
+			continue
+		}
+		if _, ok := sharedClients[poolMember(key, i)]; ok {
+			client.Disconnect(100)
+			continue
+		}
+		sharedClients[poolMember(key, i)] = &pooledClient{client: client, cfg: cfg, lastUsed: now}
+	}
+}
+
+// releaseClient returns a client taken from the pool, disconnecting it if it
+// was retired meanwhile and this was its last user.
+func releaseClient(pc *pooledClient) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	pc.inUse--
+	if pc.retired && pc.inUse == 0 {
+		pc.client.Disconnect(100)
+	}
+}
+
+// retireClient removes key's client from the pool and disconnects it, or
+// leaves that to releaseClient while requests still hold it (as they do a
+// member still connecting). The caller holds sharedMu.
+func retireClient(key string, pc *pooledClient) {
+	delete(sharedClients, key)
+	pc.retired = true
+	if pc.inUse == 0 {
+		pc.client.Disconnect(100)
+	}
+}
+
+// evictLRU retires the least recently used clients until at most max remain,
+// bounding the connections (and file descriptors) held for many distinct
+// brokers to MAX_BROKER_CLIENTS. The caller holds sharedMu.
+func evictLRU(max int) {
+	for len(sharedClients) > 0 && len(sharedClients) > max {
+		var lruKey string
+		var lru *pooledClient
+		for key, pc := range sharedClients {
+			if lru == nil || pc.lastUsed.Before(lru.lastUsed) {
+				lruKey, lru = key, pc
+			}
+		}
+		Logger.Info("evicting least recently used MQTT connection", "broker", lruKey, "clients", len(sharedClients))
+		retireClient(lruKey, lru)
+	}
+}
+
+// idleExpired reports whether pc has been unused for longer than idle. The
+// caller holds sharedMu.
+func idleExpired(pc *pooledClient, idle time.Duration, now time.Time) bool {
+	return idle > 0 && now.Sub(pc.lastUsed) > idle
+}
+
+// evictIdle disconnects pooled clients once they have been idle for longer
+// than idle (MQTT_IDLE_EVICT); the next request reconnects lazily.
+func evictIdle(idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		sharedMu.Lock()
+		for key, pc := range sharedClients {
+			if idleExpired(pc, idle, now) {
+				Logger.Info("evicting idle MQTT connection", "broker", key, "idle", now.Sub(pc.lastUsed).String())
+				retireClient(key, pc)
+			}
+		}
+		sharedMu.Unlock()
+	}
+}
+
+// ResetPool disconnects and forgets every pooled client so the next request
+// connects with freshly loaded settings.
+func ResetPool() {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	for key, pc := range sharedClients {
+		retireClient(key, pc)
+	}
+}
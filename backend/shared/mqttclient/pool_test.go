@@ -0,0 +1,288 @@
+package mqttclient
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeClient is a pooled connection that only tracks its state.
+type fakeClient struct {
+	id           int
+	connected    atomic.Bool
+	disconnected atomic.Bool
+}
+
+func (c *fakeClient) IsConnected() bool                    { return c.connected.Load() }
+func (c *fakeClient) IsConnectionOpen() bool               { return c.connected.Load() }
+func (c *fakeClient) Connect() mqtt.Token                  { return fakeToken{completes: true} }
+func (c *fakeClient) Disconnect(uint)                      { c.connected.Store(false); c.disconnected.Store(true) }
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+func (c *fakeClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return fakeToken{completes: true}
+}
+func (c *fakeClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return fakeToken{completes: true}
+}
+func (c *fakeClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return fakeToken{completes: true}
+}
+func (c *fakeClient) Unsubscribe(...string) mqtt.Token { return fakeToken{completes: true} }
+
+// fakeBroker stands in for connectMember for the duration of t, handing out
+// numbered fakeClients. connect, when set, runs first and may fail the
+// connect.
+type fakeBroker struct {
+	connects atomic.Int32
+	connect  func(cfg Config) error
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	b := &fakeBroker{}
+	prev := connectMember
+	connectMember = func(cfg Config) (mqtt.Client, error) {
+		if b.connect != nil {
+			if err := b.connect(cfg); err != nil {
+				return nil, err
+			}
+		}
+		c := &fakeClient{id: int(b.connects.Add(1))}
+		c.connected.Store(true)
+		return c, nil
+	}
+	resetPool := func() {
+		ResetPool()
+		sharedMu.Lock()
+		poolNext = map[string]int{}
+		sharedMu.Unlock()
+	}
+	resetPool()
+	t.Cleanup(func() {
+		connectMember = prev
+		resetPool()
+	})
+	return b
+}
+
+func shared(t *testing.T, key string) (*fakeClient, func()) {
+	t.Helper()
+	client, release, err := Shared(key, Config{Host: key})
+	if err != nil {
+		t.Fatalf("Shared(%q): %v", key, err)
+	}
+	return client.(*fakeClient), release
+}
+
+func TestSharedRoundRobin(t *testing.T) {
+	t.Setenv("MQTT_POOL_SIZE", "3")
+	b := newFakeBroker(t)
+
+	var ids []int
+	for i := 0; i < 7; i++ {
+		c, release := shared(t, "broker")
+		ids = append(ids, c.id)
+		release()
+	}
+	want := []int{1, 2, 3, 1, 2, 3, 1}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("members handed out %v, want %v", ids, want)
+		}
+	}
+	if n := b.connects.Load(); n != 3 {
+		t.Errorf("%d connects, want one per member", n)
+	}
+}
+
+func TestSharedReplacesDeadMember(t *testing.T) {
+	b := newFakeBroker(t)
+
+	first, release := shared(t, "broker")
+	release()
+	first.connected.Store(false)
+
+	second, release := shared(t, "broker")
+	defer release()
+	if second == first {
+		t.Fatal("a dropped member was handed out again")
+	}
+	if !first.disconnected.Load() {
+		t.Error("the dropped member was not disconnected")
+	}
+	if n := b.connects.Load(); n != 2 {
+		t.Errorf("%d connects, want 2", n)
+	}
+}
+
+func TestSharedKeepsRetiredMemberForItsHolder(t *testing.T) {
+	newFakeBroker(t)
+
+	held, release := shared(t, "broker")
+	held.connected.Store(false)
+	replacement, releaseReplacement := shared(t, "broker")
+	defer releaseReplacement()
+	if replacement == held || held.disconnected.Load() {
+		t.Fatal("a member still in use was disconnected")
+	}
+	release()
+	if !held.disconnected.Load() {
+		t.Error("the retired member was not disconnected by its last holder")
+	}
+}
+
+func TestSharedConnectsWithoutHoldingThePool(t *testing.T) {
+	b := newFakeBroker(t)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	b.connect = func(cfg Config) error {
+		if cfg.Host == "slow" {
+			once.Do(func() { close(started) })
+			<-unblock
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	slow := make([]mqtt.Client, 3)
+	for i := range slow {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, release, err := Shared("slow", Config{Host: "slow"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			slow[i] = client
+		}(i)
+	}
+	<-started
+
+	// Another broker is served while the slow one is still connecting
+	done := make(chan error)
+	go func() {
+		_, release, err := Shared("fast", Config{Host: "fast"})
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shared for another broker waited on a connect in progress")
+	}
+
+	close(unblock)
+	wg.Wait()
+	if slow[0] == nil || slow[0] != slow[1] || slow[1] != slow[2] {
+		t.Error("concurrent requests for one member got different connections")
+	}
+	if n := b.connects.Load(); n != 2 {
+		t.Errorf("%d connects, want one per broker", n)
+	}
+}
+
+func TestSharedConnectFailure(t *testing.T) {
+	t.Setenv("MQTT_CONNECT_RETRIES", "0")
+	b := newFakeBroker(t)
+	refused := errors.New("connection refused")
+	b.connect = func(Config) error { return refused }
+
+	if _, _, err := Shared("broker", Config{Host: "broker"}); !errors.Is(err, refused) {
+		t.Fatalf("err = %v, want %v", err, refused)
+	}
+	// The failed member is not kept: the next request connects afresh
+	b.connect = nil
+	if c, release := shared(t, "broker"); c == nil {
+		t.Fatal("no client after the broker recovered")
+	} else {
+		release()
+	}
+}
+
+// use takes and releases key's client, returning it.
+func use(t *testing.T, key string) *fakeClient {
+	t.Helper()
+	c, release := shared(t, key)
+	release()
+	// Keep lastUsed strictly ordered between uses
+	time.Sleep(time.Millisecond)
+	return c
+}
+
+func TestSharedEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Setenv("MAX_BROKER_CLIENTS", "2")
+	b := newFakeBroker(t)
+
+	a1 := use(t, "a")
+	bc := use(t, "b")
+	if again := use(t, "a"); again != a1 {
+		t.Fatal("a was reconnected while the pool had room")
+	}
+	use(t, "c")
+	if !bc.disconnected.Load() {
+		t.Error("b, the least recently used, was not disconnected")
+	}
+	if a1.disconnected.Load() {
+		t.Error("a, used after b, was disconnected")
+	}
+	if b.connects.Load() != 3 {
+		t.Errorf("%d connects, want 3", b.connects.Load())
+	}
+
+	// b connects afresh, evicting a
+	if again := use(t, "b"); again == bc {
+		t.Error("the evicted client was handed out again")
+	}
+	if !a1.disconnected.Load() {
+		t.Error("a was not evicted for b")
+	}
+}
+
+func TestSharedEvictedClientDisconnectsOnRelease(t *testing.T) {
+	t.Setenv("MAX_BROKER_CLIENTS", "1")
+	newFakeBroker(t)
+
+	held, release := shared(t, "a")
+	use(t, "b")
+	if held.disconnected.Load() {
+		t.Fatal("an evicted client was disconnected while a request held it")
+	}
+	release()
+	if !held.disconnected.Load() {
+		t.Error("the evicted client was not disconnected by its last holder")
+	}
+}
+
+func TestSharedEvictionKeepsThePool(t *testing.T) {
+	// MAX_BROKER_CLIENTS never goes below one route's pool
+	t.Setenv("MAX_BROKER_CLIENTS", "1")
+	t.Setenv("MQTT_POOL_SIZE", "3")
+	b := newFakeBroker(t)
+
+	var first []*fakeClient
+	for i := 0; i < 3; i++ {
+		first = append(first, use(t, "a"))
+	}
+	for i := 0; i < 3; i++ {
+		if c := use(t, "a"); c != first[i] || c.disconnected.Load() {
+			t.Errorf("member %d was evicted by its own pool", i)
+		}
+	}
+	if b.connects.Load() != 3 {
+		t.Errorf("%d connects, want 3", b.connects.Load())
+	}
+}
@@ -0,0 +1,91 @@
+package mqttclient
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// NewSSMClient returns the SSM client for SSM_REGION, failing over to its
+// fallback regions for parameters the primary region does not have.
+func NewSSMClient() ssmiface.SSMAPI {
+	sess := session.Must(session.NewSession())
+	return newRegionalSSM(sess, ssmRegions(os.Getenv("SSM_REGION")))
+}
+
+// fallbackSSM reads parameters from the primary region and, when a parameter
+// is not found there, retries each fallback region in order.
+type fallbackSSM struct {
+	ssmiface.SSMAPI
+	fallbacks []ssmiface.SSMAPI
+}
+
+func (f fallbackSSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	out, err := f.SSMAPI.GetParameter(input)
+	for _, fb := range f.fallbacks {
+		if !isParameterNotFound(err) {
+			break
+		}
+		out, err = fb.GetParameter(input)
+	}
+	return out, err
+}
+
+// GetParameters retries the names the primary region reported invalid in
+// each fallback region, merging what they find.
+func (f fallbackSSM) GetParameters(input *ssm.GetParametersInput) (*ssm.GetParametersOutput, error) {
+	out, err := f.SSMAPI.GetParameters(input)
+	for _, fb := range f.fallbacks {
+		if err != nil || len(out.InvalidParameters) == 0 {
+			break
+		}
+		retry := *input
+		retry.Names = out.InvalidParameters
+		more, fbErr := fb.GetParameters(&retry)
+		if fbErr != nil {
+			break
+		}
+		out.Parameters = append(out.Parameters, more.Parameters...)
+		out.InvalidParameters = more.InvalidParameters
+	}
+	return out, err
+}
+
+func isParameterNotFound(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.Code() == ssm.ErrCodeParameterNotFound || aerr.Code() == ssm.ErrCodeParameterVersionNotFound
+}
+
+// ssmRegions parses SSM_REGION, a comma-separated list whose first entry is
+// the primary region and the rest are fallbacks. An empty list means the
+// session's default region.
+func ssmRegions(value string) []string {
+	var regions []string
+	for _, r := range strings.Split(value, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			regions = append(regions, r)
+		}
+	}
+	return regions
+}
+
+// newRegionalSSM builds the SSM client chain for regions.
+func newRegionalSSM(sess *session.Session, regions []string) ssmiface.SSMAPI {
+	if len(regions) == 0 {
+		return ssm.New(sess)
+	}
+	client := fallbackSSM{SSMAPI: ssm.New(sess, aws.NewConfig().WithRegion(regions[0]))}
+	for _, r := range regions[1:] {
+		client.fallbacks = append(client.fallbacks, ssm.New(sess, aws.NewConfig().WithRegion(r)))
+	}
+	return client
+}
@@ -0,0 +1,59 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrTLSHandshakeTimeout marks a broker that accepted the TCP connection but
+// did not complete the TLS handshake in time: a network or certificate
+// problem on its side rather than bad credentials.
+var ErrTLSHandshakeTimeout = errors.New("TLS handshake timed out")
+
+// dialTCP opens the raw connection under the TLS handshake. It is a variable
+// so a slow endpoint can be simulated.
+var dialTCP = (&net.Dialer{}).DialContext
+
+// tlsHandshakeTimeout bounds the handshake separately from the overall
+// MQTT_CONNECT_TIMEOUT, so a stalled handshake is reported as such.
+func tlsHandshakeTimeout() time.Duration {
+	return envDuration("TLS_HANDSHAKE_TIMEOUT", 3*time.Second)
+}
+
+// dialTLS connects to addr and completes the TLS handshake before timeout,
+// failing with ErrTLSHandshakeTimeout when the handshake stalls.
+func dialTLS(ctx context.Context, addr string, tc *tls.Config, timeout time.Duration) (net.Conn, error) {
+	raw, err := dialTCP(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hsCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn := tls.Client(raw, tc)
+	if err := conn.HandshakeContext(hsCtx); err != nil {
+		raw.Close()
+		if errors.Is(hsCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, fmt.Errorf("%s: %w", addr, ErrTLSHandshakeTimeout)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tlsOpenConnection is the v3 client's connection opener for tls/ssl
+// brokers, routing the handshake through dialTLS. WebSocket schemes keep
+// paho's own dialer.
+func tlsOpenConnection(cfg Config) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout())
+		defer cancel()
+		return dialTLS(ctx, uri.Host, buildTLSConfig(cfg), tlsHandshakeTimeout())
+	}
+}
@@ -0,0 +1,90 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stallDial swaps dialTCP for the duration of t with one whose endpoint
+// accepts the connection but never answers the handshake.
+func stallDial(t *testing.T) {
+	t.Helper()
+	prev := dialTCP
+	dialTCP = func(context.Context, string, string) (net.Conn, error) {
+		client, broker := net.Pipe()
+		go io.Copy(io.Discard, broker)
+		t.Cleanup(func() { broker.Close() })
+		return client, nil
+	}
+	t.Cleanup(func() { dialTCP = prev })
+}
+
+func TestStalledHandshakeTimesOut(t *testing.T) {
+	stallDial(t)
+	start := time.Now()
+	_, err := dialTLS(context.Background(), "broker.example:8883", &tls.Config{ServerName: "broker.example"}, 50*time.Millisecond)
+	if !errors.Is(err, ErrTLSHandshakeTimeout) {
+		t.Fatalf("err = %v, want ErrTLSHandshakeTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about the 50ms timeout", elapsed)
+	}
+}
+
+func TestCancelledHandshakeIsNotATimeout(t *testing.T) {
+	stallDial(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// The overall connect deadline passes first: that is the caller's timeout
+	_, err := dialTLS(ctx, "broker.example:8883", &tls.Config{ServerName: "broker.example"}, time.Second)
+	if err == nil || errors.Is(err, ErrTLSHandshakeTimeout) {
+		t.Errorf("err = %v, want a failure other than ErrTLSHandshakeTimeout", err)
+	}
+}
+
+func TestDialFailureIsNotATimeout(t *testing.T) {
+	refused := errors.New("connection refused")
+	prev := dialTCP
+	dialTCP = func(context.Context, string, string) (net.Conn, error) { return nil, refused }
+	t.Cleanup(func() { dialTCP = prev })
+
+	if _, err := dialTLS(context.Background(), "broker.example:8883", &tls.Config{}, time.Second); !errors.Is(err, refused) {
+		t.Errorf("err = %v, want the dial error", err)
+	}
+}
+
+func TestOpenConnectionUsesHandshakeTimeout(t *testing.T) {
+	t.Setenv("TLS_HANDSHAKE_TIMEOUT", "50ms")
+	t.Setenv("MQTT_CONNECT_TIMEOUT", "5s")
+	stallDial(t)
+	open := tlsOpenConnection(Config{Host: "broker.example"})
+	if _, err := open(&url.URL{Scheme: "ssl", Host: "broker.example:8883"}, mqtt.ClientOptions{}); !errors.Is(err, ErrTLSHandshakeTimeout) {
+		t.Errorf("err = %v, want ErrTLSHandshakeTimeout", err)
+	}
+}
+
+func TestHandshakeCompletes(t *testing.T) {
+	broker := validTestCert(t, "broker")
+	addr := serveTLS(t, broker)
+	roots := x509.NewCertPool()
+	roots.AddCert(broker.leaf)
+
+	conn, err := dialTLS(context.Background(), addr, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// An untrusted broker fails verification, not the timeout
+	if _, err := dialTLS(context.Background(), addr, &tls.Config{ServerName: "127.0.0.1"}, time.Second); err == nil || errors.Is(err, ErrTLSHandshakeTimeout) {
+		t.Errorf("untrusted broker: err = %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Props are MQTT 5 publish properties. The v3 client cannot carry them, so
+// publishing with any set requires MQTT_VERSION=5.
+type Props struct {
+	ContentType     string
+	ResponseTopic   string
+	UserProperties  []UserProperty
+	CorrelationData []byte
+}
+
+type UserProperty struct {
+	Key, Value string
+}
+
+func (p Props) Empty() bool {
+	return p.ContentType == "" && p.ResponseTopic == "" && len(p.UserProperties) == 0 && len(p.CorrelationData) == 0
+}
+
+// Message is one publish with its MQTT 5 properties.
+type Message struct {
+	Topic    string
+	QoS      int
+	Retained bool
+	Payload  string
+	Props    Props
+	// UseTopicAlias lets a v5 client replace a repeated topic with an alias
+	UseTopicAlias bool
+}
+
+// PropsPublisher is implemented by clients that can send MQTT 5 properties.
+type PropsPublisher interface {
+	PublishWithProps(msg Message) mqtt.Token
+}
+
+// v5Client adapts a paho.golang MQTT 5 connection to the mqtt.Client
+// interface, adding PublishWithProps.
+type v5Client struct {
+	cfg       Config
+	connected atomic.Bool
+
+	mu     sync.Mutex
+	conn   *paho.Client
+	routes map[string]mqtt.MessageHandler
+
+	// Topic aliases are per connection and reset on every Connect
+	aliasMax uint16
+	aliases  map[string]*topicAlias
+}
+
+// topicAlias is an alias assigned to a topic. Until the publish that
+// registers it has completed, concurrent publishes keep sending the full
+// topic so the broker never sees the alias before its mapping.
+type topicAlias struct {
+	id          uint16
+	registering bool
+	established bool
+}
+
+func newV5Client(cfg Config) *v5Client {
+	return &v5Client{cfg: cfg, routes: map[string]mqtt.MessageHandler{}, aliases: map[string]*topicAlias{}}
+}
+
+// opTimeout bounds the underlying paho.golang calls; callers wait on the
+// returned tokens with their own (usually shorter) timeouts.
+const opTimeout = 30 * time.Second
+
+func (c *v5Client) Connect() mqtt.Token {
+	return NewAsyncToken(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout())
+		defer cancel()
+
+		netConn, err := dialBroker(ctx, c.cfg)
+		if err != nil {
+			return err
+		}
+		clientID := c.cfg.ClientID
+		if clientID == "" {
+			clientID = randomClientID()
+		}
+		conn := paho.NewClient(paho.ClientConfig{
+			ClientID:          clientID,
+			Conn:              netConn,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.deliver},
+			OnServerDisconnect: func(*paho.Disconnect) {
+				c.connected.Store(false)
+			},
+			OnClientError: func(error) {
+				c.connected.Store(false)
+			},
+		})
+
+		cp := &paho.Connect{
+			ClientID:   conn.ClientID(),
+			KeepAlive:  30,
+			CleanStart: !c.cfg.PersistentSession,
+		}
+		if c.cfg.PersistentSession {
+			// Without an expiry interval a v5 session ends with the connection
+			expiry := uint32(envDuration("MQTT_SESSION_EXPIRY", time.Hour).Seconds())
+			cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &expiry}
+		}
+		if c.cfg.Username != "" {
+			cp.Username, cp.UsernameFlag = c.cfg.Username, true
+		}
+		if c.cfg.Password != "" {
+			cp.Password, cp.PasswordFlag = []byte(c.cfg.Password), true
+		}
+
+		ack, err := conn.Connect(ctx, cp)
+		if err != nil {
+			netConn.Close()
+			return err
+		}
+		if ack.ReasonCode != 0 {
+			netConn.Close()
+			return fmt.Errorf("connect refused: reason code %d", ack.ReasonCode)
+		}
+
+		c.mu.Lock()
+		c.conn = conn
+		c.aliasMax = 0
+		if ack.Properties != nil && ack.Properties.TopicAliasMaximum != nil {
+			c.aliasMax = *ack.Properties.TopicAliasMaximum
+		}
+		c.aliases = map[string]*topicAlias{}
+		c.mu.Unlock()
+		c.connected.Store(true)
+		return nil
+	})
+}
+
+// randomClientID names a connection that has no ClientID of its own.
+func randomClientID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// dialBroker opens the raw transport for the v5 client. WebSocket schemes are
+// only supported on the v3 client.
+func dialBroker(ctx context.Context, cfg Config) (net.Conn, error) {
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	dialer := &net.Dialer{}
+	switch cfg.Scheme {
+	case "tcp":
+		return dialer.DialContext(ctx, "tcp", addr)
+	case "tls", "ssl":
+		return dialTLS(ctx, addr, buildTLSConfig(cfg), tlsHandshakeTimeout())
+	}
+	return nil, fmt.Errorf("MQTT_VERSION=5 does not support MQTT_SCHEME %q", cfg.Scheme)
+}
+
+func (c *v5Client) current() (*paho.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || !c.connected.Load() {
+		return nil, errors.New("not connected")
+	}
+	return c.conn, nil
+}
+
+// deliver routes an incoming publish to every matching subscription handler.
+func (c *v5Client) deliver(pr paho.PublishReceived) (bool, error) {
+	c.mu.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, h := range c.routes {
+		if TopicMatches(filter, pr.Packet.Topic) {
+			handlers = append(handlers, h)
+		}
+	}
+	c.mu.Unlock()
+
+	msg := &v5Message{p: pr.Packet}
+	for _, h := range handlers {
+		h(c, msg)
+	}
+	return len(handlers) > 0, nil
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var body string
+	switch p := payload.(type) {
+	case string:
+		body = p
+	case []byte:
+		body = string(p)
+	default:
+		return NewAsyncToken(func() error { return fmt.Errorf("unsupported payload type %T", payload) })
+	}
+	return c.PublishWithProps(Message{Topic: topic, QoS: int(qos), Retained: retained, Payload: body})
+}
+
+func (c *v5Client) PublishWithProps(msg Message) mqtt.Token {
+	return NewAsyncToken(func() error {
+		conn, err := c.current()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		defer cancel()
+
+		pb := &paho.Publish{
+			Topic:   msg.Topic,
+			QoS:     byte(msg.QoS),
+			Retain:  msg.Retained,
+			Payload: []byte(msg.Payload),
+		}
+		pb.Properties = &paho.PublishProperties{
+			ContentType:     msg.Props.ContentType,
+			ResponseTopic:   msg.Props.ResponseTopic,
+			CorrelationData: msg.Props.CorrelationData,
+		}
+		for _, up := range msg.Props.UserProperties {
+			pb.Properties.User.Add(up.Key, up.Value)
+		}
+
+		var registering *topicAlias
+		if msg.UseTopicAlias {
+			alias, established := c.aliasFor(msg.Topic)
+			if alias != nil {
+				pb.Properties.TopicAlias = &alias.id
+				if established {
+					pb.Topic = ""
+				} else {
+					registering = alias
+				}
+			}
+		}
+
+		resp, err := conn.Publish(ctx, pb)
+		if registering != nil {
+			c.mu.Lock()
+			registering.registering = false
+			registering.established = err == nil
+			c.mu.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		if resp != nil && resp.ReasonCode >= 0x80 {
+			return fmt.Errorf("publish rejected: reason code %d", resp.ReasonCode)
+		}
+		return nil
+	})
+}
+
+// aliasFor returns the alias to use for topic and whether the broker already
+// knows it; when it doesn't, the caller's publish registers it. It returns
+// nil when the topic should go unaliased: another publish is registering its
+// alias, or the broker's alias maximum (zero when it allows none) is used up.
+func (c *v5Client) aliasFor(topic string) (*topicAlias, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.aliases[topic]
+	if !ok {
+		if len(c.aliases) >= int(c.aliasMax) {
+			return nil, false
+		}
+		a = &topicAlias{id: uint16(len(c.aliases) + 1)}
+		c.aliases[topic] = a
+	}
+	switch {
+	case a.established:
+		return a, true
+	case a.registering:
+		return nil, false
+	}
+	a.registering = true
+	return a, false
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return NewAsyncToken(func() error {
+		conn, err := c.current()
+		if err != nil {
+			return err
+		}
+		sub := &paho.Subscribe{}
+		c.mu.Lock()
+		for topic, qos := range filters {
+			sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+			if callback != nil {
+				c.routes[topic] = callback
+			}
+		}
+		c.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		defer cancel()
+		ack, err := conn.Subscribe(ctx, sub)
+		if err != nil {
+			return err
+		}
+		for _, code := range ack.Reasons {
+			if code >= 0x80 {
+				return fmt.Errorf("subscribe rejected: reason code %d", code)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	return NewAsyncToken(func() error {
+		c.mu.Lock()
+		for _, t := range topics {
+			delete(c.routes, t)
+		}
+		c.mu.Unlock()
+
+		conn, err := c.current()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		defer cancel()
+		_, err = conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	c.connected.Store(false)
+	if conn != nil {
+		conn.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
+
+func (c *v5Client) IsConnected() bool      { return c.connected.Load() }
+func (c *v5Client) IsConnectionOpen() bool { return c.connected.Load() }
+
+func (c *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+func (c *v5Client) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+
+// v5Message adapts a received MQTT 5 publish to mqtt.Message.
+type v5Message struct {
+	p *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool   { return false }
+func (m *v5Message) Qos() byte         { return m.p.QoS }
+func (m *v5Message) Retained() bool    { return m.p.Retain }
+func (m *v5Message) Topic() string     { return m.p.Topic }
+func (m *v5Message) MessageID() uint16 { return m.p.PacketID }
+func (m *v5Message) Payload() []byte   { return m.p.Payload }
+func (m *v5Message) Ack()              {}
+
+// CorrelationData returns the publish's MQTT 5 correlation data, if any.
+func (m *v5Message) CorrelationData() []byte {
+	if m.p.Properties == nil {
+		return nil
+	}
+	return m.p.Properties.CorrelationData
+}
+
+// asyncToken is an mqtt.Token completed by a background function.
+type asyncToken struct {
+	done chan struct{}
+	err  error
+}
+
+// NewAsyncToken runs fn in the background, completing the token with its
+// error.
+func NewAsyncToken(fn func() error) mqtt.Token {
+	t := &asyncToken{done: make(chan struct{})}
+	go func() {
+		t.err = fn()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *asyncToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *asyncToken) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *asyncToken) Done() <-chan struct{} { return t.done }
+
+func (t *asyncToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// TopicMatches reports whether topic matches the subscription filter,
+// honouring the + and # wildcards.
+func TopicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
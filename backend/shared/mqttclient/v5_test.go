@@ -0,0 +1,30 @@
+package mqttclient
+
+import "testing"
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"devices/lamp/led", "devices/lamp/led", true},
+		{"devices/lamp/led", "devices/lamp", false},
+		{"devices/lamp", "devices/lamp/led", false},
+		{"devices/+/led", "devices/lamp/led", true},
+		{"devices/+/led", "devices/lamp/fan", false},
+		{"devices/+", "devices/lamp/led", false},
+		{"devices/#", "devices/lamp/led", true},
+		// # also matches its parent level
+		{"devices/#", "devices", true},
+		{"#", "anything/at/all", true},
+		{"+/+", "a/b", true},
+		{"+", "", true},
+		{"devices/+/led", "devices//led", true},
+		{"Devices/lamp", "devices/lamp", false},
+	}
+	for _, tt := range tests {
+		if got := TopicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package topics places the topics callers name the same way in every backend
+// Lambda, so a command is checked where it is scheduled against the topic it
+// will publish to.
+//
+// USER_NAMESPACE binds consumer apps to their own devices: a topic prefix in
+// which {sub} stands for the JWT subject of the authenticated user, e.g.
+// "users/{sub}/". Caller topics are then relative to that namespace, so
+// "devices/lamp" publishes to users/<sub>/devices/lamp; a topic already
+// inside the caller's namespace is kept, and one inside another user's is
+// refused outright. TOPIC_PREFIX is applied after the namespace.
+package topics
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrNoSubject is a namespaced topic without a subject to place it for.
+	ErrNoSubject = errors.New("USER_NAMESPACE requires an authenticated user")
+	// ErrSubjectLevel is a subject that spans or wildcards topic levels,
+	// which would widen the namespace.
+	ErrSubjectLevel = errors.New("JWT subject cannot be used as a topic level")
+)
+
+// OutsideError is a topic inside another user's namespace.
+type OutsideError struct {
+	Topic     string
+	Namespace string
+}
+
+func (e *OutsideError) Error() string {
+	return "topic " + e.Topic + " is outside your namespace " + e.Namespace
+}
+
+// Namespace returns sub's topic namespace, or "" when USER_NAMESPACE is not
+// set.
+func Namespace(sub string) (string, error) {
+	template := os.Getenv("USER_NAMESPACE")
+	if template == "" {
+		return "", nil
+	}
+	if sub == "" {
+		return "", ErrNoSubject
+	}
+	if strings.ContainsAny(sub, "/+#") {
+		return "", ErrSubjectLevel
+	}
+	return strings.ReplaceAll(template, "{sub}", sub), nil
+}
+
+// Place puts a caller-supplied topic (or filter) in sub's namespace. It
+// returns topic unchanged when USER_NAMESPACE is not set.
+func Place(sub, topic string) (string, error) {
+	ns, err := Namespace(sub)
+	if err != nil {
+		return "", err
+	}
+	if ns == "" || topic == "" {
+		return topic, nil
+	}
+	if strings.HasPrefix(topic, ns) {
+		return topic, nil
+	}
+	// The namespace root shared by every user, e.g. "users/"
+	root, _, _ := strings.Cut(os.Getenv("USER_NAMESPACE"), "{sub}")
+	if root != "" && strings.HasPrefix(topic, root) {
+		return "", &OutsideError{Topic: topic, Namespace: ns}
+	}
+	return ns + strings.TrimPrefix(topic, "/"), nil
+}
+
+// Prefix prepends TOPIC_PREFIX to topic unless it already starts with it, so
+// callers can address "livingroom/led" for "home/livingroom/led".
+func Prefix(topic string) string {
+	prefix := os.Getenv("TOPIC_PREFIX")
+	if topic == "" || strings.HasPrefix(topic, prefix) {
+		return topic
+	}
+	return prefix + topic
+}
@@ -0,0 +1,54 @@
+package topics
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPlace(t *testing.T) {
+	t.Setenv("USER_NAMESPACE", "users/{sub}/")
+	tests := []struct {
+		name, sub, topic string
+		want             string
+		err              error
+	}{
+		{"relative topic", "u1", "devices/lamp", "users/u1/devices/lamp", nil},
+		{"leading slash", "u1", "/devices/lamp", "users/u1/devices/lamp", nil},
+		{"already placed", "u1", "users/u1/devices/lamp", "users/u1/devices/lamp", nil},
+		{"empty topic", "u1", "", "", nil},
+		{"no subject", "", "devices/lamp", "", ErrNoSubject},
+		{"subject spanning levels", "u1/+", "devices/lamp", "", ErrSubjectLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Place(tt.sub, tt.topic)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("Place(%q, %q) = %q, %v, want %q, %v", tt.sub, tt.topic, got, err, tt.want, tt.err)
+			}
+		})
+	}
+
+	_, err := Place("u1", "users/u2/devices/lamp")
+	var outside *OutsideError
+	if !errors.As(err, &outside) || outside.Namespace != "users/u1/" {
+		t.Errorf("another user's topic: err = %v, want an OutsideError", err)
+	}
+
+	t.Setenv("USER_NAMESPACE", "")
+	if got, err := Place("", "devices/lamp"); got != "devices/lamp" || err != nil {
+		t.Errorf("without USER_NAMESPACE: %q, %v", got, err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	t.Setenv("TOPIC_PREFIX", "home/")
+	for topic, want := range map[string]string{
+		"livingroom/led":      "home/livingroom/led",
+		"home/livingroom/led": "home/livingroom/led",
+		"":                    "",
+	} {
+		if got := Prefix(topic); got != want {
+			t.Errorf("Prefix(%q) = %q, want %q", topic, got, want)
+		}
+	}
+}
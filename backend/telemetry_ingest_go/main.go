@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"shared/apigw"
+)
+
+// Telemetry ingestion: devices publish readings that an AWS IoT rule (SELECT
+// *, topic(2) AS device FROM 'devices/+/telemetry') or an MQTT-to-SQS bridge
+// hands to this function, which validates and stores them. The same function
+// serves GET /telemetry/latest.
+
+// eventProbe holds just enough fields to tell the supported events apart.
+type eventProbe struct {
+	HTTPMethod     string          `json:"httpMethod"`
+	RequestContext json.RawMessage `json:"requestContext"`
+	Records        []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+}
+
+// dispatch is the Lambda entry point. API Gateway requests go to the query
+// API, SQS batches are ingested record by record, and anything else is taken
+// as an IoT rule's SELECT output: one reading.
+func dispatch(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var probe eventProbe
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("unsupported event: %w", err)
+	}
+	switch {
+	case len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs":
+		var event events.SQSEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return handleSQS(event), nil
+	case probe.HTTPMethod != "" || len(probe.RequestContext) > 0:
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, err
+		}
+		return handler(request), nil
+	}
+	// Returning the error lets the rule's error action see the failure
+	return nil, ingest("iot-rule", raw)
+}
+
+// ingest validates and stores one telemetry payload. An invalid payload is
+// logged and dropped, as redelivering it cannot help; a storage failure is
+// returned so the caller retries.
+func ingest(source string, payload []byte) error {
+	r, err := parseReading(payload, time.Now())
+	if errors.Is(err, errInvalidReading) {
+		logger.Warn("telemetry rejected", "source", source, "error", err.Error(), "payload", truncate(string(payload), 256))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	store, err := openReadingStore()
+	if err != nil {
+		return err
+	}
+	if err := store.putReading(r); err != nil {
+		return fmt.Errorf("store reading for %s: %w", r.DeviceID, err)
+	}
+	return nil
+}
+
+// handleSQS ingests each record body and reports the ones that failed to
+// store so SQS redelivers only those (ReportBatchItemFailures).
+func handleSQS(event events.SQSEvent) events.SQSEventResponse {
+	var resp events.SQSEventResponse
+	for _, record := range event.Records {
+		if err := ingest("sqs", []byte(record.Body)); err != nil {
+			logger.Warn("telemetry not stored", "messageId", record.MessageId, "error", err.Error())
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return resp
+}
+
+// respond answers the query API, which a browser app may call.
+var respond = apigw.Responder{Methods: "GET,OPTIONS"}
+
+// handler serves the query API.
+func handler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod == "OPTIONS" {
+		return respond.JSON(204, nil)
+	}
+	if strings.TrimSuffix(request.Path, "/") == "/telemetry/latest" {
+		return latestHandler(request)
+	}
+	return respond.Error(404, "NOT_FOUND", "Unknown path "+request.Path)
+}
+
+// latestHandler serves GET /telemetry/latest?device=<id>[,<id>...], answering
+// {device: reading} with null for a requested device that has reported
+// nothing. Without device it lists the caller's devices, up to LATEST_LIMIT
+// (default 100). Another user's device is reported as having no reading.
+func latestHandler(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.HTTPMethod != "GET" {
+		return respond.Error(405, "", "Use GET")
+	}
+	var devices []string
+	for _, d := range strings.Split(request.QueryStringParameters["device"], ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		if !validDeviceID.MatchString(d) {
+			return respond.Error(400, "INVALID_DEVICE", fmt.Sprintf("device %q must be 1-128 letters, digits or _.:-", d))
+		}
+		devices = append(devices, d)
+	}
+	if len(devices) > 100 {
+		return respond.Error(400, "TOO_MANY_DEVICES", "At most 100 devices per request")
+	}
+
+	owner := apigw.Subject(request)
+	if owner == "" {
+		return respond.Error(401, "NO_CALLER", "Reading telemetry requires a signed-in user")
+	}
+	registry := openDeviceRegistry()
+	if registry == nil {
+		return respond.Error(500, "CONFIG_ERROR", "DEVICE_REGISTRY_TABLE must be set")
+	}
+	owned, err := ownedDevices(registry, owner)
+	if err != nil {
+		logger.Error("device registry lookup failed", "error", err.Error())
+		return respond.Error(502, "REGISTRY_UNAVAILABLE", "Device registry lookup failed")
+	}
+	latest := map[string]*reading{}
+	var lookup []string
+	for _, d := range devices {
+		latest[d] = nil
+		if owned[d] {
+			lookup = append(lookup, d)
+		}
+	}
+	if len(devices) == 0 {
+		for d := range owned {
+			lookup = append(lookup, d)
+		}
+		sort.Strings(lookup)
+		lookup = lookup[:min(len(lookup), max(envInt("LATEST_LIMIT", 100), 1))]
+	}
+	if len(lookup) == 0 {
+		return respond.JSON(200, latest)
+	}
+
+	store, err := openReadingStore()
+	if err != nil {
+		return respond.Error(500, "CONFIG_ERROR", err.Error())
+	}
+	readings, err := store.latest(lookup)
+	if err != nil {
+		logger.Error("latest readings lookup failed", "error", err.Error())
+		return respond.Error(502, "STORE_FAILED", "Reading telemetry failed")
+	}
+	for i := range readings {
+		latest[readings[i].DeviceID] = &readings[i]
+	}
+	return respond.JSON(200, latest)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
+
+func main() {
+	lambda.Start(dispatch)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// memStore is an in-memory readingStore.
+type memStore struct {
+	mu      sync.Mutex
+	latests map[string]reading
+	looked  [][]string // the devices of each latest call
+	putErr  error
+}
+
+func (s *memStore) putReading(r reading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.putErr != nil {
+		return s.putErr
+	}
+	if prev, ok := s.latests[r.DeviceID]; !ok || prev.Timestamp <= r.Timestamp {
+		s.latests[r.DeviceID] = r
+	}
+	return nil
+}
+
+func (s *memStore) latest(devices []string) ([]reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.looked = append(s.looked, devices)
+	var out []reading
+	for _, d := range devices {
+		if r, ok := s.latests[d]; ok {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// fakeRegistry is a fixed device registry.
+type fakeRegistry []deviceOwners
+
+func (r fakeRegistry) listDevices() ([]deviceOwners, error) { return r, nil }
+
+// newFakes installs an empty store and registry for the duration of t.
+func newFakes(t *testing.T, registry fakeRegistry) *memStore {
+	t.Helper()
+	store := &memStore{latests: map[string]reading{}}
+	prevStore, prevRegistry := openReadingStore, openDeviceRegistry
+	openReadingStore = func() (readingStore, error) { return store, nil }
+	openDeviceRegistry = func() deviceRegistry { return registry }
+	t.Cleanup(func() { openReadingStore, openDeviceRegistry = prevStore, prevRegistry })
+	return store
+}
+
+// getLatest runs GET /telemetry/latest as the Cognito user sub.
+func getLatest(t *testing.T, sub, device string) (int, map[string]*reading) {
+	t.Helper()
+	request := events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/telemetry/latest"}
+	if device != "" {
+		request.QueryStringParameters = map[string]string{"device": device}
+	}
+	if sub != "" {
+		request.RequestContext.Authorizer = map[string]interface{}{"claims": map[string]interface{}{"sub": sub}}
+	}
+	resp := handler(request)
+	var body map[string]*reading
+	if resp.StatusCode == 200 {
+		if err := json.Unmarshal([]byte(resp.Body), &body); err != nil {
+			t.Fatalf("response body: %s", resp.Body)
+		}
+	}
+	return resp.StatusCode, body
+}
+
+func keys(m map[string]*reading) string {
+	var out []string
+	for k, v := range m {
+		if v == nil {
+			k += "=null"
+		}
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+var registry = fakeRegistry{
+	{DeviceID: "lamp-1", Owners: []string{"u1"}},
+	{DeviceID: "lamp-2", Owners: []string{"u1", "u2"}},
+	{DeviceID: "kettle", Owners: []string{"u2"}},
+	{DeviceID: "quiet", Owners: []string{"u1"}},
+}
+
+func seedReadings(t *testing.T, store *memStore, devices ...string) {
+	t.Helper()
+	for _, d := range devices {
+		r, err := parseReading([]byte(`{"device":"`+d+`","temperature":20}`), testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.putReading(r)
+	}
+}
+
+func TestLatestListsOwnDevices(t *testing.T) {
+	store := newFakes(t, registry)
+	seedReadings(t, store, "lamp-1", "lamp-2", "kettle", "unregistered")
+
+	status, body := getLatest(t, "u1", "")
+	if got := keys(body); status != 200 || got != "lamp-1 lamp-2" {
+		t.Errorf("u1: status %d devices %q, want lamp-1 lamp-2", status, got)
+	}
+	if _, body := getLatest(t, "u2", ""); keys(body) != "kettle lamp-2" {
+		t.Errorf("u2: devices %q, want kettle lamp-2", keys(body))
+	}
+	if _, body := getLatest(t, "u3", ""); len(body) != 0 || len(store.looked) != 2 {
+		t.Errorf("a user without devices: %q, %d lookups", keys(body), len(store.looked))
+	}
+}
+
+func TestLatestLimit(t *testing.T) {
+	t.Setenv("LATEST_LIMIT", "2")
+	store := newFakes(t, registry)
+	seedReadings(t, store, "lamp-1", "lamp-2", "quiet")
+	if _, body := getLatest(t, "u1", ""); len(body) != 2 {
+		t.Errorf("devices %q, want 2", keys(body))
+	}
+}
+
+func TestLatestRequestedDevices(t *testing.T) {
+	store := newFakes(t, registry)
+	seedReadings(t, store, "lamp-1", "kettle")
+
+	status, body := getLatest(t, "u1", "lamp-1, quiet,kettle,unregistered")
+	if got := keys(body); status != 200 || got != "kettle=null lamp-1 quiet=null unregistered=null" {
+		t.Errorf("status %d devices %q", status, got)
+	}
+	if body["lamp-1"] == nil || *body["lamp-1"].Temperature != 20 {
+		t.Errorf("lamp-1 %+v", body["lamp-1"])
+	}
+	if looked := store.looked[0]; strings.Join(looked, ",") != "lamp-1,quiet" {
+		t.Errorf("looked up %v, want only the caller's devices", looked)
+	}
+}
+
+func TestLatestRejects(t *testing.T) {
+	newFakes(t, registry)
+	if status, _ := getLatest(t, "", ""); status != 401 {
+		t.Errorf("without a caller: status %d, want 401", status)
+	}
+	if status, _ := getLatest(t, "u1", "a/b"); status != 400 {
+		t.Errorf("invalid device: status %d, want 400", status)
+	}
+	if status, _ := getLatest(t, "u1", strings.Repeat("d,", 101)+"d"); status != 400 {
+		t.Errorf("too many devices: status %d, want 400", status)
+	}
+	resp := handler(events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/telemetry/latest"})
+	if resp.StatusCode != 405 {
+		t.Errorf("POST: status %d, want 405", resp.StatusCode)
+	}
+
+	openDeviceRegistry = func() deviceRegistry { return nil }
+	if status, _ := getLatest(t, "u1", ""); status != 500 {
+		t.Errorf("without a registry: status %d, want 500", status)
+	}
+}
+
+func TestHandleSQS(t *testing.T) {
+	store := newFakes(t, registry)
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "ok", Body: `{"device":"lamp-1","led":"on"}`},
+		{MessageId: "invalid", Body: `{"device":"lamp-1"}`},
+	}}
+	if resp := handleSQS(event); len(resp.BatchItemFailures) != 0 {
+		t.Errorf("failures %v: an invalid reading is dropped, not retried", resp.BatchItemFailures)
+	}
+	if store.latests["lamp-1"].LED != "on" {
+		t.Errorf("stored %+v", store.latests["lamp-1"])
+	}
+
+	store.putErr = errors.New("throttled")
+	resp := handleSQS(event)
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "ok" {
+		t.Errorf("failures %v, want the record that was not stored", resp.BatchItemFailures)
+	}
+}
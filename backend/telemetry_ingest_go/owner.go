@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Readings are served to the owners of the device that reported them, as
+// listed in the device registry the publish Lambda keeps
+// (DEVICE_REGISTRY_TABLE). A device that is not registered has no owner and
+// its readings are stored but never served.
+
+// deviceOwners is the part of a DEVICE_REGISTRY_TABLE item read here.
+type deviceOwners struct {
+	DeviceID string   `dynamodbav:"deviceId"`
+	Owners   []string `dynamodbav:"owners"`
+}
+
+// deviceRegistry lists the registered devices.
+type deviceRegistry interface {
+	listDevices() ([]deviceOwners, error)
+}
+
+// ownedDevices returns the IDs of the devices owner owns.
+func ownedDevices(registry deviceRegistry, owner string) (map[string]bool, error) {
+	devices, err := registry.listDevices()
+	if err != nil {
+		return nil, err
+	}
+	owned := map[string]bool{}
+	for _, d := range devices {
+		for _, o := range d.Owners {
+			if o == owner {
+				owned[d.DeviceID] = true
+				break
+			}
+		}
+	}
+	return owned, nil
+}
+
+// openDeviceRegistry returns the DEVICE_REGISTRY_TABLE registry, or nil when
+// it is unset. It is a variable so another registry can stand in.
+var openDeviceRegistry = func() deviceRegistry {
+	table := os.Getenv("DEVICE_REGISTRY_TABLE")
+	if table == "" {
+		return nil
+	}
+	return dynamoRegistry{db: dynamodb.New(session.Must(session.NewSession())), table: table}
+}
+
+type dynamoRegistry struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func (r dynamoRegistry) listDevices() ([]deviceOwners, error) {
+	var devices []deviceOwners
+	var pageErr error
+	input := &dynamodb.ScanInput{TableName: aws.String(r.table), ProjectionExpression: aws.String("deviceId, owners")}
+	err := r.db.ScanPages(input, func(out *dynamodb.ScanOutput, _ bool) bool {
+		var page []deviceOwners
+		if pageErr = dynamodbattribute.UnmarshalListOfMaps(out.Items, &page); pageErr != nil {
+			return false
+		}
+		devices = append(devices, page...)
+		return true
+	})
+	if err == nil {
+		err = pageErr
+	}
+	return devices, err
+}
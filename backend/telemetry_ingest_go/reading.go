@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// reading is one validated telemetry sample as stored and served. Timestamp
+// (epoch milliseconds) orders a device's readings; ExpiresAt is the history
+// table's TTL attribute.
+type reading struct {
+	DeviceID    string   `json:"deviceId" dynamodbav:"deviceId"`
+	Timestamp   int64    `json:"-" dynamodbav:"ts"`
+	Time        string   `json:"timestamp" dynamodbav:"time"`
+	Temperature *float64 `json:"temperature,omitempty" dynamodbav:"temperature,omitempty"`
+	LED         string   `json:"led,omitempty" dynamodbav:"led,omitempty"`
+	Battery     *float64 `json:"battery,omitempty" dynamodbav:"battery,omitempty"`
+	ReceivedAt  string   `json:"receivedAt" dynamodbav:"receivedAt"`
+	ExpiresAt   int64    `json:"-" dynamodbav:"expiresAt,omitempty"`
+}
+
+// telemetryPayload is the schema devices publish, e.g.
+//
+//	{"device": "esp8266-001", "timestamp": 1718000000, "temperature": 21.5, "led": "#FF0000", "battery": 87}
+//
+// device may be left out when the IoT rule adds it from the topic
+// (SELECT *, topic(2) AS device). Unknown fields are rejected so a firmware
+// typo is not silently dropped.
+type telemetryPayload struct {
+	Device      string          `json:"device"`
+	Timestamp   json.RawMessage `json:"timestamp"`
+	Temperature *float64        `json:"temperature"`
+	LED         json.RawMessage `json:"led"`
+	Battery     *float64        `json:"battery"`
+}
+
+// errInvalidReading marks a payload that will never become valid, so it is
+// dropped rather than retried.
+var errInvalidReading = errors.New("invalid telemetry")
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidReading, fmt.Sprintf(format, args...))
+}
+
+// validDeviceID is a single topic level safe to use as a key.
+var validDeviceID = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+
+// Sensor ranges; readings outside them are wiring or firmware faults.
+const (
+	minTemperature = -55.0
+	maxTemperature = 125.0
+)
+
+// parseReading validates raw against telemetryPayload and returns the reading
+// to store, received at now.
+func parseReading(raw []byte, now time.Time) (reading, error) {
+	var p telemetryPayload
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return reading{}, invalidf("%v", err)
+	}
+	if !validDeviceID.MatchString(p.Device) {
+		return reading{}, invalidf("'device' must be 1-128 letters, digits or _.:-, got %q", p.Device)
+	}
+
+	r := reading{DeviceID: p.Device, ReceivedAt: now.UTC().Format(time.RFC3339)}
+	at, err := readingTime(p.Timestamp, now)
+	if err != nil {
+		return reading{}, err
+	}
+	r.Timestamp, r.Time = at.UnixMilli(), at.UTC().Format(time.RFC3339Nano)
+
+	if t := p.Temperature; t != nil {
+		if math.IsNaN(*t) || *t < minTemperature || *t > maxTemperature {
+			return reading{}, invalidf("'temperature' %v is outside %v..%v °C", *t, minTemperature, maxTemperature)
+		}
+		r.Temperature = t
+	}
+	if b := p.Battery; b != nil {
+		if math.IsNaN(*b) || *b < 0 || *b > 100 {
+			return reading{}, invalidf("'battery' %v is not a percentage", *b)
+		}
+		r.Battery = b
+	}
+	if r.LED, err = ledState(p.LED); err != nil {
+		return reading{}, err
+	}
+	if r.Temperature == nil && r.Battery == nil && r.LED == "" {
+		return reading{}, invalidf("no 'temperature', 'led' or 'battery' value")
+	}
+	if ttl := envDuration("TELEMETRY_TTL", 0); ttl > 0 {
+		r.ExpiresAt = now.Add(ttl).Unix()
+	}
+	return r, nil
+}
+
+// readingTime reads the optional timestamp: RFC 3339, or epoch seconds or
+// milliseconds. A missing one is the receive time. Timestamps further ahead
+// than MAX_CLOCK_SKEW (default 5m) would shadow every later reading.
+func readingTime(raw json.RawMessage, now time.Time) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return now, nil
+	}
+	var at time.Time
+	var epoch float64
+	var text string
+	switch {
+	case json.Unmarshal(raw, &epoch) == nil:
+		// Seconds stay below 1e11 until the year 5138
+		if epoch >= 1e11 {
+			at = time.UnixMilli(int64(epoch))
+		} else {
+			at = time.Unix(0, int64(epoch*float64(time.Second)))
+		}
+	case json.Unmarshal(raw, &text) == nil:
+		var err error
+		if at, err = time.Parse(time.RFC3339Nano, text); err != nil {
+			return time.Time{}, invalidf("'timestamp' %q is not RFC 3339", text)
+		}
+	default:
+		return time.Time{}, invalidf("'timestamp' must be RFC 3339 or epoch seconds/milliseconds")
+	}
+	if at.Sub(now) > envDuration("MAX_CLOCK_SKEW", 5*time.Minute) {
+		return time.Time{}, invalidf("'timestamp' %s is in the future", at.UTC().Format(time.RFC3339))
+	}
+	return at, nil
+}
+
+// ledState normalizes the LED value: on/off (or true/false), or the #RRGGBB
+// color set-led last applied.
+func ledState(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var on bool
+	if json.Unmarshal(raw, &on) == nil {
+		if on {
+			return "on", nil
+		}
+		return "off", nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return "", invalidf("'led' must be a string or boolean")
+	}
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case "on", "off":
+		return s, nil
+	}
+	if hex, ok := strings.CutPrefix(s, "#"); ok && len(hex) == 6 && strings.Trim(hex, "0123456789abcdef") == "" {
+		return "#" + strings.ToUpper(hex), nil
+	}
+	return "", invalidf("'led' %q must be on, off or a #RRGGBB color", s)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, 10, 14, 20, 0, 0, 0, time.UTC)
+
+func TestParseReading(t *testing.T) {
+	r, err := parseReading([]byte(`{"device":"esp8266-001","timestamp":1791921600,"temperature":21.5,"led":"#ff0000","battery":87}`), testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DeviceID != "esp8266-001" || r.Timestamp != 1791921600000 || r.Time != "2026-10-13T20:00:00Z" ||
+		*r.Temperature != 21.5 || r.LED != "#FF0000" || *r.Battery != 87 || r.ReceivedAt != "2026-10-14T20:00:00Z" {
+		t.Errorf("reading %+v", r)
+	}
+	if r.ExpiresAt != 0 {
+		t.Errorf("expiresAt %d without TELEMETRY_TTL", r.ExpiresAt)
+	}
+}
+
+func TestParseReadingTTL(t *testing.T) {
+	t.Setenv("TELEMETRY_TTL", "24h")
+	r, err := parseReading([]byte(`{"device":"d1","led":true}`), testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExpiresAt != testNow.Add(24*time.Hour).Unix() {
+		t.Errorf("expiresAt %d", r.ExpiresAt)
+	}
+	if r.Timestamp != testNow.UnixMilli() {
+		t.Errorf("a reading without a timestamp is timed %d, want the receive time", r.Timestamp)
+	}
+}
+
+func TestParseReadingRejects(t *testing.T) {
+	for _, payload := range []string{
+		`not json`,
+		`{"temperature":20}`,
+		`{"device":"a/b","temperature":20}`,
+		`{"device":"d1","temperature":20,"humidity":40}`,
+		`{"device":"d1"}`,
+		`{"device":"d1","temperature":200}`,
+		`{"device":"d1","temperature":-60}`,
+		`{"device":"d1","battery":101}`,
+		`{"device":"d1","battery":-1}`,
+		`{"device":"d1","led":"blue"}`,
+		`{"device":"d1","led":20,"temperature":20}`,
+		`{"device":"d1","temperature":20,"timestamp":"yesterday"}`,
+	} {
+		if _, err := parseReading([]byte(payload), testNow); !errors.Is(err, errInvalidReading) {
+			t.Errorf("%s: error %v, want errInvalidReading", payload, err)
+		}
+	}
+}
+
+func TestReadingTime(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want time.Time
+	}{
+		{``, testNow},
+		{`null`, testNow},
+		{`1791921600`, time.Unix(1791921600, 0)},
+		{`1791921600.5`, time.Unix(1791921600, 500e6)},
+		{`1791921600123`, time.UnixMilli(1791921600123)},
+		{`"2026-10-14T21:30:00+02:00"`, time.Date(2026, 10, 14, 19, 30, 0, 0, time.UTC)},
+		{`"2026-10-14T20:04:00Z"`, testNow.Add(4 * time.Minute)},
+	}
+	for _, tt := range tests {
+		got, err := readingTime(json.RawMessage(tt.raw), testNow)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("readingTime(%s) = %v, %v, want %v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadingTimeRejects(t *testing.T) {
+	for _, raw := range []string{`"2026-10-14 20:00"`, `true`, `{}`, `"2026-10-14T20:06:00Z"`} {
+		if _, err := readingTime(json.RawMessage(raw), testNow); !errors.Is(err, errInvalidReading) {
+			t.Errorf("readingTime(%s): error %v, want errInvalidReading", raw, err)
+		}
+	}
+}
+
+func TestReadingTimeSkew(t *testing.T) {
+	t.Setenv("MAX_CLOCK_SKEW", "1h")
+	if _, err := readingTime(json.RawMessage(`"2026-10-14T20:30:00Z"`), testNow); err != nil {
+		t.Errorf("within MAX_CLOCK_SKEW: %v", err)
+	}
+}
+
+func TestLEDState(t *testing.T) {
+	tests := map[string]string{
+		``:          "",
+		`null`:      "",
+		`true`:      "on",
+		`false`:     "off",
+		`"ON"`:      "on",
+		`" off "`:   "off",
+		`"#00ff7F"`: "#00FF7F",
+	}
+	for raw, want := range tests {
+		if got, err := ledState(json.RawMessage(raw)); err != nil || got != want {
+			t.Errorf("ledState(%s) = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{`"#fff"`, `"#gggggg"`, `"red"`, `1`, `[]`} {
+		if _, err := ledState(json.RawMessage(raw)); !errors.Is(err, errInvalidReading) {
+			t.Errorf("ledState(%s): error %v, want errInvalidReading", raw, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// readingStore persists telemetry: every reading in a per-device history and
+// the newest one per device for the latest-readings API.
+type readingStore interface {
+	putReading(r reading) error
+	// latest returns the newest reading of each device found
+	latest(devices []string) ([]reading, error)
+}
+
+// openReadingStore returns the DynamoDB store for TELEMETRY_TABLE (history,
+// keyed by deviceId and ts) and TELEMETRY_LATEST_TABLE (keyed by deviceId).
+// It is a variable so another store can stand in.
+var openReadingStore = func() (readingStore, error) {
+	history, latest := os.Getenv("TELEMETRY_TABLE"), os.Getenv("TELEMETRY_LATEST_TABLE")
+	if history == "" || latest == "" {
+		return nil, errors.New("TELEMETRY_TABLE and TELEMETRY_LATEST_TABLE must be set")
+	}
+	db := dynamodb.New(session.Must(session.NewSession()))
+	return dynamoReadingStore{db: db, history: history, latestTable: latest}, nil
+}
+
+type dynamoReadingStore struct {
+	db          dynamodbiface.DynamoDBAPI
+	history     string
+	latestTable string
+}
+
+// putReading appends r to the history and makes it the device's latest
+// reading unless a newer one is already there: devices buffer offline and
+// an IoT rule retry or SQS redelivery may arrive out of order.
+func (s dynamoReadingStore) putReading(r reading) error {
+	item, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.PutItem(&dynamodb.PutItemInput{TableName: aws.String(s.history), Item: item}); err != nil {
+		return err
+	}
+
+	delete(item, "expiresAt")
+	_, err = s.db.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(s.latestTable),
+		Item:                      item,
+		ConditionExpression:       aws.String("attribute_not_exists(deviceId) OR ts <= :ts"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":ts": item["ts"]},
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+	return err
+}
+
+func (s dynamoReadingStore) latest(devices []string) ([]reading, error) {
+	var readings []reading
+	// BatchGetItem accepts at most 100 keys per call
+	for start := 0; start < len(devices); start += 100 {
+		var keys []map[string]*dynamodb.AttributeValue
+		for _, d := range devices[start:min(start+100, len(devices))] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{"deviceId": {S: aws.String(d)}})
+		}
+		request := map[string]*dynamodb.KeysAndAttributes{s.latestTable: {Keys: keys}}
+		for len(request) > 0 {
+			out, err := s.db.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return nil, err
+			}
+			var page []reading
+			if err := dynamodbattribute.UnmarshalListOfMaps(out.Responses[s.latestTable], &page); err != nil {
+				return nil, err
+			}
+			readings = append(readings, page...)
+			request = out.UnprocessedKeys
+		}
+	}
+	return readings, nil
+}
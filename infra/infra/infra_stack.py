@@ -12,6 +12,8 @@ from aws_cdk import (
     aws_iam as iam,
     aws_ssm as ssm,
     aws_iot as iot,
+    aws_dynamodb as dynamodb,
+    aws_sqs as sqs,
     aws_ssm as ssm,
     CfnOutput,
 )
@@ -108,9 +110,204 @@ class InfraStack(Stack):
                 "MQTT_USERNAME_SSM": "/iot/mqtt/username",
                 "MQTT_PASSWORD_SSM": "/iot/mqtt/password",
                 "MQTT_BROKER_SSM": "/iot/mqtt/broker",
+                "METRICS_NAMESPACE": "IoTHub",
             },
         )
 
+        # ───────────── Async publishes (an Event invocation of itself) ─────────────
+        # Naming the function's own ARN in its role policy would be a
+        # dependency cycle, so the statement matches its generated name
+        set_led_lambda.add_to_role_policy(
+            iam.PolicyStatement(
+                actions=["lambda:InvokeFunction"],
+                resources=[f"arn:aws:lambda:{self.region}:{self.account}:function:{self.stack_name}-SetLedLambdaGo*"],
+            )
+        )
+
+        # ───────────── IoT Rule actions (through their own alias) ─────────────
+        # Events arriving through this alias are always read as rule payloads,
+        # whatever a device made them look like; rules must target it
+        set_led_rule_alias = set_led_lambda.add_alias("iot-rule")
+        set_led_lambda.add_environment("IOT_RULE_ALIAS", set_led_rule_alias.alias_name)
+
+        # ───────────── Async job status (GET /jobs/{id}) ─────────────
+        jobs_table = dynamodb.Table(
+            self,
+            "PublishJobsTable",
+            partition_key=dynamodb.Attribute(name="jobId", type=dynamodb.AttributeType.STRING),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            time_to_live_attribute="expiresAt",
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        jobs_table.grant_read_write_data(set_led_lambda)
+        set_led_lambda.add_environment("JOBS_TABLE", jobs_table.table_name)
+
+        # ───────────── Publish audit trail (one item per attempt) ─────────────
+        audit_table = dynamodb.Table(
+            self,
+            "PublishAuditTable",
+            partition_key=dynamodb.Attribute(name="topic", type=dynamodb.AttributeType.STRING),
+            sort_key=dynamodb.Attribute(name="timestamp", type=dynamodb.AttributeType.STRING),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            time_to_live_attribute="expiresAt",
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        audit_table.grant_write_data(set_led_lambda)
+        set_led_lambda.add_environment("AUDIT_TABLE", audit_table.table_name)
+
+        # ───────────── Device groups ("group" → list of device topics) ─────────────
+        groups_table = dynamodb.Table(
+            self,
+            "DeviceGroupsTable",
+            partition_key=dynamodb.Attribute(name="group", type=dynamodb.AttributeType.STRING),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        groups_table.grant_read_data(set_led_lambda)
+        set_led_lambda.add_environment("DEVICE_GROUPS_TABLE", groups_table.table_name)
+
+        # ───────────── Device registry (topics, owners and command schema per device) ─────────────
+        registry_table = dynamodb.Table(
+            self,
+            "DeviceRegistryTable",
+            partition_key=dynamodb.Attribute(name="deviceId", type=dynamodb.AttributeType.STRING),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        registry_table.grant_read_write_data(set_led_lambda)
+        set_led_lambda.add_environment("DEVICE_REGISTRY_TABLE", registry_table.table_name)
+
+        # ───────────── Dead letters (publishes that failed for good) ─────────────
+        dead_letter_queue = sqs.Queue(
+            self,
+            "PublishDeadLetterQueue",
+            retention_period=Duration.days(14),
+        )
+        dead_letter_queue.grant_send_messages(set_led_lambda)
+        set_led_lambda.add_environment("DEAD_LETTER_QUEUE_URL", dead_letter_queue.queue_url)
+
+        # ───────────── Large payloads (published as presigned references) ─────────────
+        payload_bucket = s3.Bucket(
+            self,
+            "PayloadBucket",
+            removal_policy=RemovalPolicy.DESTROY,
+            auto_delete_objects=True,
+            block_public_access=s3.BlockPublicAccess.BLOCK_ALL,
+        )
+        payload_bucket.grant_read(set_led_lambda)
+        set_led_lambda.add_environment("S3_PAYLOAD_BUCKET", payload_bucket.bucket_name)
+
+        # ───────────── IoT Data Plane publishing (MQTT_AUTH_MODE=iot-dataplane) ─────────────
+        set_led_lambda.add_to_role_policy(
+            iam.PolicyStatement(
+                actions=["iot:Publish", "iot:RetainPublish"],
+                resources=[f"arn:aws:iot:{self.region}:{self.account}:topic/*"],
+            )
+        )
+        set_led_lambda.add_to_role_policy(
+            iam.PolicyStatement(actions=["iot:DescribeEndpoint"], resources=["*"])
+        )
+
+        # ───────────── Lambda: telemetry ingest (device readings → DynamoDB) ─────────────
+        telemetry_table = dynamodb.Table(
+            self,
+            "TelemetryTable",
+            partition_key=dynamodb.Attribute(name="deviceId", type=dynamodb.AttributeType.STRING),
+            sort_key=dynamodb.Attribute(name="ts", type=dynamodb.AttributeType.NUMBER),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            time_to_live_attribute="expiresAt",
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        telemetry_latest_table = dynamodb.Table(
+            self,
+            "TelemetryLatestTable",
+            partition_key=dynamodb.Attribute(name="deviceId", type=dynamodb.AttributeType.STRING),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        telemetry_lambda = _lambda.Function(
+            self,
+            "TelemetryIngestLambdaGo",
+            runtime=_lambda.Runtime.PROVIDED_AL2,
+            handler="bootstrap",
+            code=_lambda.Code.from_asset("../backend/telemetry_ingest_go"),
+            environment={
+                "TELEMETRY_TABLE": telemetry_table.table_name,
+                "TELEMETRY_LATEST_TABLE": telemetry_latest_table.table_name,
+                "TELEMETRY_TTL": "2160h",
+                "DEVICE_REGISTRY_TABLE": registry_table.table_name,
+            },
+        )
+        telemetry_table.grant_write_data(telemetry_lambda)
+        telemetry_latest_table.grant_read_write_data(telemetry_lambda)
+        registry_table.grant_read_data(telemetry_lambda)
+
+        telemetry_rule = iot.CfnTopicRule(
+            self,
+            "TelemetryRule",
+            topic_rule_payload=iot.CfnTopicRule.TopicRulePayloadProperty(
+                sql="SELECT *, topic(2) AS device FROM 'devices/+/telemetry'",
+                aws_iot_sql_version="2016-03-23",
+                actions=[
+                    iot.CfnTopicRule.ActionProperty(
+                        lambda_=iot.CfnTopicRule.LambdaActionProperty(function_arn=telemetry_lambda.function_arn)
+                    )
+                ],
+            ),
+        )
+        telemetry_lambda.add_permission(
+            "AllowIoTRule",
+            principal=iam.ServicePrincipal("iot.amazonaws.com"),
+            source_arn=telemetry_rule.attr_arn,
+        )
+
+        # ───────────── Lambda: scheduled commands (EventBridge Scheduler → set-led) ─────────────
+        schedules_table = dynamodb.Table(
+            self,
+            "SchedulesTable",
+            partition_key=dynamodb.Attribute(name="owner", type=dynamodb.AttributeType.STRING),
+            sort_key=dynamodb.Attribute(name="id", type=dynamodb.AttributeType.STRING),
+            billing_mode=dynamodb.BillingMode.PAY_PER_REQUEST,
+            time_to_live_attribute="expiresAt",
+            removal_policy=RemovalPolicy.DESTROY,
+        )
+        schedule_dead_letter_queue = sqs.Queue(
+            self,
+            "ScheduleDeadLetterQueue",
+            retention_period=Duration.days(14),
+        )
+        scheduler_role = iam.Role(
+            self,
+            "SchedulerInvokeRole",
+            assumed_by=iam.ServicePrincipal("scheduler.amazonaws.com"),
+        )
+        set_led_lambda.grant_invoke(scheduler_role)
+        schedule_dead_letter_queue.grant_send_messages(scheduler_role)
+
+        scheduler_lambda = _lambda.Function(
+            self,
+            "SchedulerLambdaGo",
+            runtime=_lambda.Runtime.PROVIDED_AL2,
+            handler="bootstrap",
+            code=_lambda.Code.from_asset("../backend/scheduler_go"),
+            environment={
+                "SCHEDULES_TABLE": schedules_table.table_name,
+                "PUBLISH_FUNCTION_ARN": set_led_lambda.function_arn,
+                "SCHEDULER_ROLE_ARN": scheduler_role.role_arn,
+                "DEAD_LETTER_QUEUE_ARN": schedule_dead_letter_queue.queue_arn,
+                "DEVICE_REGISTRY_TABLE": registry_table.table_name,
+            },
+        )
+        schedules_table.grant_read_write_data(scheduler_lambda)
+        registry_table.grant_read_data(scheduler_lambda)
+        scheduler_lambda.add_to_role_policy(
+            iam.PolicyStatement(
+                actions=["scheduler:CreateSchedule", "scheduler:DeleteSchedule"],
+                resources=[f"arn:aws:scheduler:{self.region}:{self.account}:schedule/default/cmd-*"],
+            )
+        )
+        scheduler_role.grant_pass_role(scheduler_lambda.role)
+
         # ───────────── SSM Params (readable by Lambda) ─────────────
         username_param = ssm.StringParameter.from_secure_string_parameter_attributes(
             self, "UsernameParam", parameter_name="/iot/mqtt/username", version=1
@@ -124,16 +321,27 @@ class InfraStack(Stack):
         for param in (username_param, password_param, broker_param):
             param.grant_read(set_led_lambda)
 
+        # Client certificate for MQTT_AUTH_MODE=mtls: set MQTT_AUTH_MODE and
+        # MQTT_CERT_SSM / MQTT_KEY_SSM / MQTT_CA_SSM to these SecureStrings
+        set_led_lambda.add_to_role_policy(
+            iam.PolicyStatement(
+                actions=["ssm:GetParameter", "ssm:GetParameters"],
+                resources=[f"arn:aws:ssm:{self.region}:{self.account}:parameter/iot/mqtt/tls/*"],
+            )
+        )
+
         # ───────────── REST API ─────────────
         api = apigateway.RestApi(
             self,
             "IoTHubAPI",
             rest_api_name="IoT Hub API",
             description="IoT Hub API",
+            # gzip-compressed Lambda responses are returned as base64 binary
+            binary_media_types=["*/*"],
             default_cors_preflight_options=apigateway.CorsOptions(
                 allow_origins=apigateway.Cors.ALL_ORIGINS,
                 allow_methods=apigateway.Cors.ALL_METHODS,
-                allow_headers=apigateway.Cors.DEFAULT_HEADERS + ["Accept", "Authorization"],
+                allow_headers=apigateway.Cors.DEFAULT_HEADERS + ["Accept", "Authorization", "X-Publish-Token"],
             ),
         )
 
@@ -182,6 +390,93 @@ class InfraStack(Stack):
             authorization_type=apigateway.AuthorizationType.COGNITO,
         )
 
+        # ───────────── /sign  (secured: issues scoped publish tokens) ─────────────
+        api.root.add_resource("sign").add_method(
+            "POST",
+            apigateway.LambdaIntegration(set_led_lambda),
+            authorizer=authorizer,
+            authorization_type=apigateway.AuthorizationType.COGNITO,
+        )
+
+        # ───────────── /jobs/{id}  (secured: async publish status) ─────────────
+        api.root.add_resource("jobs").add_resource("{id}").add_method(
+            "GET",
+            apigateway.LambdaIntegration(set_led_lambda),
+            authorizer=authorizer,
+            authorization_type=apigateway.AuthorizationType.COGNITO,
+        )
+
+        # ───────────── /state  (secured: retained state snapshot) ─────────────
+        api.root.add_resource("state").add_method(
+            "GET",
+            apigateway.LambdaIntegration(set_led_lambda),
+            authorizer=authorizer,
+            authorization_type=apigateway.AuthorizationType.COGNITO,
+        )
+
+        # ───────────── /presence  (secured: device online/offline state) ─────────────
+        api.root.add_resource("presence").add_method(
+            "GET",
+            apigateway.LambdaIntegration(set_led_lambda),
+            authorizer=authorizer,
+            authorization_type=apigateway.AuthorizationType.COGNITO,
+        )
+
+        # ───────────── /publish  (X-Publish-Token checked by the Lambda) ─────────────
+        api.root.add_resource("publish").add_method(
+            "POST", apigateway.LambdaIntegration(set_led_lambda)
+        )
+
+        # ───────────── /health, /health/deep  (public probes) ─────────────
+        health_resource = api.root.add_resource("health")
+        health_resource.add_method("GET", apigateway.LambdaIntegration(set_led_lambda))
+        health_resource.add_resource("deep").add_method(
+            "GET", apigateway.LambdaIntegration(set_led_lambda)
+        )
+
+        # ───────────── /admin/refresh, /admin/retained  (X-Api-Key checked by the Lambda) ─────────────
+        admin_resource = api.root.add_resource("admin")
+        admin_resource.add_resource("refresh").add_method(
+            "POST", apigateway.LambdaIntegration(set_led_lambda)
+        )
+        admin_resource.add_resource("retained").add_method(
+            "POST", apigateway.LambdaIntegration(set_led_lambda)
+        )
+
+        # ───────────── /devices, /devices/{id}  (registry CRUD, X-Api-Key checked by the Lambda) ─────────────
+        devices_resource = api.root.add_resource("devices")
+        for method in ("GET", "POST"):
+            devices_resource.add_method(method, apigateway.LambdaIntegration(set_led_lambda))
+        device_resource = devices_resource.add_resource("{id}")
+        for method in ("GET", "PUT", "DELETE"):
+            device_resource.add_method(method, apigateway.LambdaIntegration(set_led_lambda))
+
+        # ───────────── /telemetry/latest  (secured: newest reading per device) ─────────────
+        api.root.add_resource("telemetry").add_resource("latest").add_method(
+            "GET",
+            apigateway.LambdaIntegration(telemetry_lambda),
+            authorizer=authorizer,
+            authorization_type=apigateway.AuthorizationType.COGNITO,
+        )
+
+        # ───────────── /schedules, /schedules/{id}  (secured: scheduled commands per user) ─────────────
+        schedules_resource = api.root.add_resource("schedules")
+        for method in ("GET", "POST"):
+            schedules_resource.add_method(
+                method,
+                apigateway.LambdaIntegration(scheduler_lambda),
+                authorizer=authorizer,
+                authorization_type=apigateway.AuthorizationType.COGNITO,
+            )
+        schedule_resource = schedules_resource.add_resource("{id}")
+        for method in ("GET", "DELETE"):
+            schedule_resource.add_method(
+                method,
+                apigateway.LambdaIntegration(scheduler_lambda),
+                authorizer=authorizer,
+                authorization_type=apigateway.AuthorizationType.COGNITO,
+            )
+
         thing = iot.CfnThing(self, "EspThing", thing_name="esp8266-001")
 
         iot_policy = iot.CfnPolicy(
@@ -201,6 +496,12 @@ class InfraStack(Stack):
                     "Action": ["iot:Subscribe", "iot:Receive"],
                     "Resource":
                     f"arn:aws:iot:{self.region}:{self.account}:topicfilter/esp8266/commands/#"
+                    },
+                    {  # publish own telemetry
+                    "Effect": "Allow",
+                    "Action": "iot:Publish",
+                    "Resource":
+                    f"arn:aws:iot:{self.region}:{self.account}:topic/devices/${{iot:Connection.Thing.ThingName}}/telemetry"
                     }
                 ]
             }